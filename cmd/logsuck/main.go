@@ -16,15 +16,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"syscall"
 	"time"
 
+	"github.com/jackbister/logsuck/internal/alerts"
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
 	"github.com/jackbister/logsuck/internal/files"
@@ -46,6 +50,8 @@ var cfg = config.Config{
 		Enabled: false,
 	},
 
+	Publisher: config.DefaultPublisherConfig(),
+
 	Recipient: &config.RecipientConfig{
 		Enabled: false,
 	},
@@ -73,6 +79,8 @@ func (i *flagStringArray) Set(value string) error {
 	return nil
 }
 
+const shutdownTimeout = 10 * time.Second
+
 var versionString string // This must be set using -ldflags "-X main.versionString=<version>" when building for --version to work
 
 var cfgFileFlag string
@@ -80,6 +88,7 @@ var databaseFileFlag string
 var eventDelimiterFlag string
 var fieldExtractorFlags flagStringArray
 var printVersion bool
+var rebuildIndex bool
 var timeLayoutFlag string
 var webAddrFlag string
 
@@ -97,6 +106,7 @@ func main() {
 			"(defaults \"(\\w+)=(\\w+)\" and \"(?P<_time>\\d\\d\\d\\d/\\d\\d/\\d\\d \\d\\d:\\d\\d:\\d\\d.\\d\\d\\d\\d\\d\\d)\")")
 	flag.StringVar(&timeLayoutFlag, "timelayout", "2006/01/02 15:04:05", "The layout of the timestamp which will be extracted in the _time field. For more information on how to write a timelayout and examples, see https://golang.org/pkg/time/#Parse and https://golang.org/pkg/time/#pkg-constants.")
 	flag.BoolVar(&printVersion, "version", false, "Print version info and quit.")
+	flag.BoolVar(&rebuildIndex, "rebuildindex", false, "Rebuild the full text index of the events from the stored raws and quit. This can fix searches which return the wrong events because the index is corrupted.")
 	flag.StringVar(&webAddrFlag, "webaddr", ":8080", "The address on which the search GUI will be exposed.")
 	flag.Parse()
 
@@ -131,9 +141,9 @@ func main() {
 		if len(fieldExtractorFlags) > 0 {
 			cfg.FieldExtractors = make([]*regexp.Regexp, len(fieldExtractorFlags))
 			for i, fe := range fieldExtractorFlags {
-				re, err := regexp.Compile(fe)
+				re, err := config.CompileFieldExtractor(fe)
 				if err != nil {
-					log.Fatalf("failed to compile regex '%v': %v\n", fe, err)
+					log.Fatalf("failed to compile field extractor '%v': %v\n", fe, err)
 				}
 				cfg.FieldExtractors[i] = re
 			}
@@ -148,7 +158,7 @@ func main() {
 				Filename:       file,
 				EventDelimiter: regexp.MustCompile(eventDelimiterFlag),
 				ReadInterval:   1 * time.Second,
-				TimeLayout:     timeLayoutFlag,
+				TimeLayouts:    []string{timeLayoutFlag},
 			}
 		}
 	}
@@ -159,24 +169,58 @@ func main() {
 	var jobEngine *jobs.Engine
 	var publisher events.EventPublisher
 	var repo events.Repository
+	var liveTail *events.LiveTail
 	if cfg.Forwarder.Enabled {
-		publisher = events.ForwardingEventPublisher(&cfg)
+		publisher = events.ForwardingEventPublisher(cfg.Forwarder, nil)
 	} else {
-		db, err := sql.Open("sqlite3", cfg.SQLite.DatabaseFile+"?cache=shared&_journal_mode=WAL")
+		db, err := sql.Open("sqlite3", events.SqliteDataSourceName(cfg.SQLite))
 		if err != nil {
 			log.Fatalln(err.Error())
 		}
-		repo, err = events.SqliteRepository(db, cfg.SQLite)
+		if cfg.SQLite.ShardDirectory != "" {
+			repo, err = events.ShardedSqliteRepository(cfg.SQLite)
+		} else {
+			repo, err = events.SqliteRepository(db, cfg.SQLite)
+		}
 		if err != nil {
 			log.Fatalln(err.Error())
 		}
+		if rebuildIndex {
+			rebuilder, ok := repo.(events.IndexRebuilder)
+			if !ok {
+				log.Fatalln("the repository does not support rebuilding its index")
+			}
+			err = rebuilder.RebuildIndex(context.Background())
+			if err != nil {
+				log.Fatalf("error rebuilding index: %v\n", err)
+			}
+			return
+		}
 		jobRepo, err = jobs.SqliteRepository(db)
 		if err != nil {
 			log.Fatalln(err.Error())
 		}
 		jobEngine = jobs.NewEngine(&cfg, repo, jobRepo)
-		publisher = events.BatchedRepositoryPublisher(&cfg, repo)
+		liveTail = events.NewLiveTail(&cfg, events.BatchedRepositoryPublisher(&cfg, repo, nil))
+		publisher = liveTail
+		if cfg.RetentionPeriod > 0 {
+			log.Printf("Starting retention, events older than retentionPeriod=%v will be deleted\n", cfg.RetentionPeriod)
+			go events.RunRetention(context.Background(), repo, cfg.RetentionPeriod, events.RetentionCheckInterval)
+		}
+		if len(cfg.Alerts) > 0 {
+			scheduler, err := alerts.NewScheduler(&cfg, repo, func(trigger alerts.Trigger) {
+				log.Printf("alert name=%v triggered, found numEvents=%v matching searchString=%q between %v and %v, threshold=%v\n",
+					trigger.Alert.Name, trigger.Count, trigger.Alert.SearchString, trigger.Start, trigger.End, trigger.Alert.Threshold)
+			})
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			log.Printf("Starting alert scheduler with numAlerts=%v\n", len(cfg.Alerts))
+			go scheduler.Run(context.Background(), alerts.CheckInterval)
+		}
 	}
+	ingestMetrics := events.NewIngestMetricsPublisher(publisher, events.DefaultIngestMetricsWindow)
+	publisher = ingestMetrics
 
 	// files can only be watched once. If a file is matched by multiple globs, the first one wins.
 	seenFiles := map[string]struct{}{}
@@ -195,7 +239,7 @@ func main() {
 				continue
 			}
 			commandChannels[i] = make(chan files.FileWatcherCommand, 1)
-			fw, err := files.NewFileWatcher(fileCfg, file, cfg.HostName, commandChannels[i], publisher)
+			fw, err := files.NewFileWatcher(fileCfg, file, cfg.HostName, commandChannels[i], publisher, repo)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -207,15 +251,24 @@ func main() {
 
 	if cfg.Recipient.Enabled {
 		go func() {
-			log.Fatal(events.NewEventRecipient(&cfg, repo).Serve())
+			log.Fatal(events.NewEventRecipient(&cfg, publisher).Serve())
 		}()
 	}
 
 	if cfg.Web.Enabled {
 		go func() {
-			log.Fatal(web.NewWeb(&cfg, repo, jobRepo, jobEngine).Serve())
+			log.Fatal(web.NewWeb(&cfg, repo, jobRepo, jobEngine, liveTail, ingestMetrics).Serve())
 		}()
 	}
 
-	select {}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received signal=%v, will flush buffered events and shut down\n", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = publisher.Shutdown(ctx)
+	if err != nil {
+		log.Printf("error when shutting down publisher: %v\n", err)
+	}
 }
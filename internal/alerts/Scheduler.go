@@ -0,0 +1,123 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/pipeline"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// CheckInterval is how often the alerts are evaluated when running logsuck.
+const CheckInterval = 1 * time.Minute
+
+// Trigger describes an alert whose count exceeded its threshold.
+type Trigger struct {
+	Alert config.AlertConfig
+	// Count is the number of events which matched the search of the alert between Start and End.
+	Count      int64
+	Start, End time.Time
+}
+
+type scheduledAlert struct {
+	cfg       config.AlertConfig
+	srch      *search.Search
+	lastFired time.Time
+	fired     bool
+}
+
+// Scheduler evaluates the alerts in the configuration by counting the events matching their searches, and calls
+// onTrigger for every alert whose count exceeds its threshold unless the alert is in its cooldown.
+type Scheduler struct {
+	cfg       *config.Config
+	repo      events.Repository
+	onTrigger func(Trigger)
+	alerts    []*scheduledAlert
+	logger    logging.Logger
+
+	now func() time.Time
+}
+
+// NewScheduler creates a Scheduler for cfg.Alerts. An error is returned if the search of any alert is invalid, so
+// that a mistake in the configuration is found at startup instead of when the alert is first evaluated.
+func NewScheduler(cfg *config.Config, repo events.Repository, onTrigger func(Trigger)) (*Scheduler, error) {
+	alerts := make([]*scheduledAlert, len(cfg.Alerts))
+	for i, alert := range cfg.Alerts {
+		srch, err := search.Parse(alert.SearchString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse search of alert name=%v: %w", alert.Name, err)
+		}
+		alerts[i] = &scheduledAlert{cfg: alert, srch: srch}
+	}
+	return &Scheduler{
+		cfg:       cfg,
+		repo:      repo,
+		onTrigger: onTrigger,
+		alerts:    alerts,
+		logger:    logging.OrDefault(cfg.Logger),
+		now:       time.Now,
+	}, nil
+}
+
+// Run evaluates the alerts once immediately and then every interval, until ctx is cancelled. It is meant to be ran
+// in its own goroutine.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Evaluate(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Evaluate counts the events matching each alert within its window and calls onTrigger for the ones which exceed
+// their threshold and are not in their cooldown. An alert which can not be counted is logged and skipped.
+func (s *Scheduler) Evaluate(ctx context.Context) {
+	for _, alert := range s.alerts {
+		end := s.now()
+		start := end.Add(-alert.cfg.Window)
+		if alert.fired && end.Sub(alert.lastFired) < alert.cooldown() {
+			continue
+		}
+		count, err := pipeline.Count(ctx, s.repo, s.cfg, alert.srch, &start, &end)
+		if err != nil {
+			s.logger.Errorf("error when counting events for alert name=%v: %v", alert.cfg.Name, err)
+			continue
+		}
+		if count <= alert.cfg.Threshold {
+			continue
+		}
+		alert.fired = true
+		alert.lastFired = end
+		s.onTrigger(Trigger{Alert: alert.cfg, Count: count, Start: start, End: end})
+	}
+}
+
+func (alert *scheduledAlert) cooldown() time.Duration {
+	if alert.cfg.Cooldown > 0 {
+		return alert.cfg.Cooldown
+	}
+	return alert.cfg.Window
+}
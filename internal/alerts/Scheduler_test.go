@@ -0,0 +1,143 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// countingRepo returns the next of counts every time it is counted, and records the time range it was counted for.
+// The rest of events.Repository is not implemented since the scheduler only counts events.
+type countingRepo struct {
+	events.Repository
+	counts []int64
+	starts []time.Time
+	ends   []time.Time
+}
+
+func (repo *countingRepo) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	repo.starts = append(repo.starts, *searchStartTime)
+	repo.ends = append(repo.ends, *searchEndTime)
+	count := repo.counts[0]
+	repo.counts = repo.counts[1:]
+	return count, nil
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestScheduler(t *testing.T, alert config.AlertConfig, counts []int64) (*Scheduler, *countingRepo, *fakeClock, *[]Trigger) {
+	repo := &countingRepo{counts: counts}
+	triggers := []Trigger{}
+	s, err := NewScheduler(&config.Config{Alerts: []config.AlertConfig{alert}}, repo, func(trigger Trigger) {
+		triggers = append(triggers, trigger)
+	})
+	if err != nil {
+		t.Fatalf("got error when creating scheduler: %v", err)
+	}
+	clock := &fakeClock{t: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	s.now = clock.now
+	return s, repo, clock, &triggers
+}
+
+func TestScheduler_TriggersWhenThresholdIsExceeded(t *testing.T) {
+	alert := config.AlertConfig{Name: "errors", SearchString: "error", Window: 5 * time.Minute, Threshold: 10}
+	s, repo, clock, triggers := newTestScheduler(t, alert, []int64{5, 10, 11, 20})
+
+	start := clock.t
+	for i := 0; i < 3; i++ {
+		s.Evaluate(context.Background())
+		clock.t = clock.t.Add(1 * time.Minute)
+	}
+	if len(*triggers) != 1 {
+		t.Fatalf("got unexpected triggers, expected only one when the count exceeded the threshold but got %v", *triggers)
+	}
+	trigger := (*triggers)[0]
+	expectedEnd := start.Add(2 * time.Minute)
+	if trigger.Alert.Name != "errors" || trigger.Count != 11 || !trigger.End.Equal(expectedEnd) || !trigger.Start.Equal(expectedEnd.Add(-5*time.Minute)) {
+		t.Fatalf("got unexpected trigger, expected errors with count=11 ending at %v but got %+v", expectedEnd, trigger)
+	}
+	for i := range repo.starts {
+		if repo.ends[i].Sub(repo.starts[i]) != alert.Window {
+			t.Fatalf("got unexpected time range when counting, expected the window of the alert but got %v to %v", repo.starts[i], repo.ends[i])
+		}
+	}
+}
+
+func TestScheduler_Cooldown(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		cooldown         time.Duration
+		expectedTriggers []int64
+	}{
+		// Without a cooldown the window is used, so the alert triggers at 0 and 5 minutes
+		{"window", 0, []int64{11, 12}},
+		{"cooldown", 2 * time.Minute, []int64{11, 12, 13, 14}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			alert := config.AlertConfig{Name: "errors", SearchString: "error", Window: 5 * time.Minute, Threshold: 10, Cooldown: tt.cooldown}
+			counts := []int64{11, 12, 13, 14, 15, 16, 17}
+			s, repo, clock, triggers := newTestScheduler(t, alert, counts)
+			for i := 0; i < 7; i++ {
+				s.Evaluate(context.Background())
+				clock.t = clock.t.Add(1 * time.Minute)
+			}
+			if len(*triggers) != len(tt.expectedTriggers) {
+				t.Fatalf("got unexpected triggers, expected counts %v but got %v", tt.expectedTriggers, *triggers)
+			}
+			for i, trigger := range *triggers {
+				if trigger.Count != tt.expectedTriggers[i] {
+					t.Fatalf("got unexpected triggers, expected counts %v but got %v", tt.expectedTriggers, *triggers)
+				}
+			}
+			// The repository is not counted while the alert is in its cooldown
+			if len(repo.starts) != len(tt.expectedTriggers) {
+				t.Fatalf("got unexpected number of counts, expected %v but got %v", len(tt.expectedTriggers), len(repo.starts))
+			}
+		})
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	alert := config.AlertConfig{Name: "errors", SearchString: "error", Window: 5 * time.Minute, Threshold: 10}
+	s, _, _, triggers := newTestScheduler(t, alert, []int64{11})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The alerts are evaluated once before Run notices that ctx is cancelled
+	s.Run(ctx, 1*time.Hour)
+	if len(*triggers) != 1 {
+		t.Fatalf("got unexpected triggers, expected one from the first evaluation but got %v", *triggers)
+	}
+}
+
+func TestNewScheduler_InvalidSearch(t *testing.T) {
+	_, err := NewScheduler(&config.Config{
+		Alerts: []config.AlertConfig{{Name: "broken", SearchString: "(error", Window: 5 * time.Minute}},
+	}, &countingRepo{}, func(Trigger) {})
+	if err == nil {
+		t.Fatal("expected error when creating scheduler with an invalid search but got nil")
+	}
+}
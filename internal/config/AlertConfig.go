@@ -0,0 +1,33 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "time"
+
+// AlertConfig is a search which is ran periodically and triggers when too many events match it.
+type AlertConfig struct {
+	// Name identifies the alert when it triggers.
+	Name string
+	// SearchString is the search whose matching events are counted. It may only contain a search, not a pipeline.
+	SearchString string
+	// Window is how far back from the time the alert is evaluated events are counted, e.g. the last 5 minutes.
+	Window time.Duration
+	// Threshold is the number of events the count must exceed for the alert to trigger.
+	Threshold int64
+	// Cooldown is the minimum time between two triggers of the alert, so that it does not trigger every time it is
+	// evaluated while the count stays above the threshold. If it is zero, Window is used so that the same events
+	// do not make the alert trigger twice.
+	Cooldown time.Duration
+}
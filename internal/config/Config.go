@@ -14,7 +14,26 @@
 
 package config
 
-import "regexp"
+import (
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/logging"
+)
+
+const (
+	// DuplicateKeyOffset makes events duplicates of each other if they have the same host, source, timestamp and
+	// offset, which is right for files where the offset tells events apart.
+	DuplicateKeyOffset = "offset"
+	// DuplicateKeyContent makes events duplicates of each other if they have the same host, source and raw, which is
+	// useful for sources without a meaningful offset. Identical lines at different offsets are then only added once.
+	// If the SQLite database is sharded by day, only events in the same shard are compared.
+	DuplicateKeyContent = "content"
+)
+
+// DefaultTimeField is the field which is parsed as the timestamp of an event if no other TimeField is configured.
+const DefaultTimeField = "_time"
 
 type Config struct {
 	IndexedFiles []IndexedFileConfig
@@ -24,15 +43,135 @@ type Config struct {
 	//or it should match two groups where the first group will be considered the field name and the second group will be
 	//considered the field value.
 	// The defaults are [ "(\w+)=(\w+)", "^(?P<_time>\d\d\d\d\/\d\d\/\d\d \d\d:\d\d:\d\d.\d\d\d\d\d\d)"]
-	// If a field with the name _time is extracted, it will be matched against TimeLayout
+	// If a field with the name TimeField is extracted, it will be matched against TimeLayouts
 	FieldExtractors []*regexp.Regexp
+	// TimeField is the name of the field which is parsed as the timestamp of an event, such as ts for extractors
+	// which capture the timestamp as (?P<ts>...). It must be lowercase since field names are. An empty string means
+	// DefaultTimeField.
+	TimeField string
+	// JSONExtraction enables extracting the fields of events which are JSON objects, in addition to the fields
+	// extracted by FieldExtractors. Nested keys are flattened, as in user.id or tags[0].
+	JSONExtraction bool
+	// KeyValueExtraction enables extracting key=value and key="quoted value" pairs from events, in addition to the
+	// fields extracted by FieldExtractors.
+	KeyValueExtraction bool
+	// CaseSensitive makes searches match fragments and field values case sensitively. Field names are still case
+	// insensitive.
+	CaseSensitive bool
+	// PreserveFieldCase makes extracted field values keep the case they have in the raw of the event instead of being
+	// lowercased, while searches are still case insensitive unless CaseSensitive is set. Field extractors are then
+	// matched against the raw as it is, so they need to handle upper case letters.
+	PreserveFieldCase bool
+	// DuplicateKey decides which events are duplicates of each other and are only added once, either
+	// DuplicateKeyOffset or DuplicateKeyContent. An empty string means DuplicateKeyOffset.
+	DuplicateKey string
+	// StoreFields makes the fields of each event be extracted and stored when it is added, so that the repository can
+	// filter on field values instead of every event having its fields extracted when searching.
+	StoreFields bool
 
 	HostName string
 
 	Forwarder *ForwarderConfig
+	Publisher *PublisherConfig
 	Recipient *RecipientConfig
 
 	SQLite *SqliteConfig
 
+	// Search limits the size of the results of searches. If it is nil there are no limits.
+	Search *SearchConfig
+
+	// TimeZone is the location used for _time values which do not contain a time zone or offset.
+	// If it is nil, such times are assumed to be in UTC.
+	TimeZone *time.Location
+
+	// RetentionPeriod is how long events are kept before they are deleted. Zero means events are kept forever.
+	RetentionPeriod time.Duration
+
+	// Alerts are searches which are ran periodically and trigger when too many events match them.
+	Alerts []AlertConfig
+
 	Web *WebConfig
+
+	// Logger is where the publisher and searches log to. The JSON configuration only sets its level, using logLevel.
+	// If it is nil, logging.Default() is used.
+	Logger logging.Logger
+}
+
+// FieldExtractorsForSource returns the field extractors which should be used for events from source.
+// These are the FieldExtractors of the first indexed file whose Filename matches source, or the global
+// FieldExtractors if there is no such file or it does not have any FieldExtractors of its own.
+func (cfg *Config) FieldExtractorsForSource(source string) []*regexp.Regexp {
+	for _, file := range cfg.IndexedFiles {
+		if len(file.FieldExtractors) == 0 {
+			continue
+		}
+		if matched, err := filepath.Match(file.Filename, source); err == nil && matched {
+			return file.FieldExtractors
+		}
+	}
+	return cfg.FieldExtractors
+}
+
+// JSONExtractionForSource returns true if JSON extraction is enabled for events from source.
+// This is the JSONExtraction of the first indexed file whose Filename matches source and which sets JSONExtraction,
+// or the global JSONExtraction if there is no such file.
+func (cfg *Config) JSONExtractionForSource(source string) bool {
+	for _, file := range cfg.IndexedFiles {
+		if file.JSONExtraction == nil {
+			continue
+		}
+		if matched, err := filepath.Match(file.Filename, source); err == nil && matched {
+			return *file.JSONExtraction
+		}
+	}
+	return cfg.JSONExtraction
+}
+
+// DuplicateKeyForSource returns the duplicate key of events from source, which is the DuplicateKey of the first
+// indexed file whose Filename matches source and which sets DuplicateKey, or the global DuplicateKey if there is no
+// such file. It is never empty.
+func (cfg *Config) DuplicateKeyForSource(source string) string {
+	for _, file := range cfg.IndexedFiles {
+		if file.DuplicateKey == "" {
+			continue
+		}
+		if matched, err := filepath.Match(file.Filename, source); err == nil && matched {
+			return file.DuplicateKey
+		}
+	}
+	if cfg.DuplicateKey == "" {
+		return DuplicateKeyOffset
+	}
+	return cfg.DuplicateKey
+}
+
+// TimeFieldForSource returns the name of the field which is parsed as the timestamp of events from source.
+// It is looked up the same way as DuplicateKeyForSource and is never empty.
+func (cfg *Config) TimeFieldForSource(source string) string {
+	for _, file := range cfg.IndexedFiles {
+		if file.TimeField == "" {
+			continue
+		}
+		if matched, err := filepath.Match(file.Filename, source); err == nil && matched {
+			return file.TimeField
+		}
+	}
+	if cfg.TimeField == "" {
+		return DefaultTimeField
+	}
+	return cfg.TimeField
+}
+
+// KeyValueExtractionForSource returns true if key=value extraction is enabled for events from source.
+// It is looked up the same way as JSONExtractionForSource.
+func (cfg *Config) KeyValueExtractionForSource(source string) bool {
+	for _, file := range cfg.IndexedFiles {
+		if file.KeyValueExtraction == nil {
+			continue
+		}
+		if matched, err := filepath.Match(file.Filename, source); err == nil && matched {
+			return *file.KeyValueExtraction
+		}
+	}
+	return cfg.KeyValueExtraction
 }
@@ -0,0 +1,61 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// CompileFieldExtractor compiles a field extractor and checks that it has the capture groups field extraction
+// expects: either only named groups, whose names are the names of the fields, or exactly two unnamed groups, which
+// capture the name and the value of a field. An extractor with other groups would compile but never extract anything.
+func CompileFieldExtractor(expr string) (*regexp.Regexp, error) {
+	rex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regexp: %w", err)
+	}
+	named, unnamed := 0, 0
+	for _, name := range rex.SubexpNames()[1:] {
+		if name == "" {
+			unnamed++
+		} else {
+			named++
+		}
+	}
+	if unnamed > 0 && (named > 0 || unnamed != 2) {
+		return nil, fmt.Errorf("regexp '%v' has unnamed capture groups, so it must have exactly two capture groups but it has %v", expr, named+unnamed)
+	}
+	if named == 0 && unnamed == 0 {
+		return nil, fmt.Errorf("regexp '%v' has no capture groups, so it can not extract any fields", expr)
+	}
+	return rex, nil
+}
+
+// compileFieldExtractors compiles the field extractors at path. Rather than stopping at the first one which can not be
+// compiled, an error is returned for each of them so that they can all be fixed at once.
+func compileFieldExtractors(path string, exprs []string) ([]*regexp.Regexp, []error) {
+	ret := make([]*regexp.Regexp, len(exprs))
+	var errs []error
+	for i, expr := range exprs {
+		rex, err := CompileFieldExtractor(expr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error reading config at %v[%v]: %w", path, i, err))
+			continue
+		}
+		ret[i] = rex
+	}
+	return ret, errs
+}
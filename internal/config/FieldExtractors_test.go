@@ -0,0 +1,146 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileFieldExtractor(t *testing.T) {
+	for _, tt := range []struct {
+		expr  string
+		valid bool
+	}{
+		{"(\\w+)=(\\w+)", true},
+		{"^(?P<_time>\\d+)", true},
+		{"(?P<user>\\w+)@(?P<domain>\\w+)", true},
+		{"(?:user|client)=(?P<user>\\w+)", true},
+		{"(\\w+", false},
+		{"user=\\w+", false},
+		{"(\\w+)", false},
+		{"(\\w+)=(\\w+) (\\w+)", false},
+		{"(?P<user>\\w+)=(\\w+)", false},
+	} {
+		_, err := CompileFieldExtractor(tt.expr)
+		if (err == nil) != tt.valid {
+			t.Fatalf("got unexpected result for expr=%v, expected valid=%v but got err=%v", tt.expr, tt.valid, err)
+		}
+	}
+}
+
+func TestFromJSON_InvalidFieldExtractors(t *testing.T) {
+	_, err := FromJSON(strings.NewReader(`{"fieldExtractors": ["(\\w+)=(\\w+)", "(\\w+"]}`))
+	if err == nil || !strings.Contains(err.Error(), "fieldExtractors[1]") {
+		t.Fatalf("got unexpected error, expected an error for fieldExtractors[1] but got %v", err)
+	}
+
+	// Every invalid extractor is reported, not just the first
+	_, err = FromJSON(strings.NewReader(`{
+		"files": [{"fileName": "a.log", "fieldExtractors": ["(\\w+)"]}],
+		"fieldExtractors": ["(\\w+)=(\\w+)", "(\\w+", "user=\\w+"]
+	}`))
+	if err == nil {
+		t.Fatal("expected an error for the invalid field extractors but got nil")
+	}
+	for _, path := range []string{"files[0].fieldExtractors[0]", "fieldExtractors[1]", "fieldExtractors[2]"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Fatalf("got unexpected error, expected it to mention %v but got %v", path, err)
+		}
+	}
+}
+
+func TestFromJSON_FieldExtractorsAreCompiledOnce(t *testing.T) {
+	cfg, err := FromJSON(strings.NewReader(`{
+		"files": [{"fileName": "a.log", "fieldExtractors": ["(?P<user>\\w+)@"]}],
+		"fieldExtractors": ["(\\w+)=(\\w+)"]
+	}`))
+	if err != nil {
+		t.Fatalf("got unexpected error when reading config: %v", err)
+	}
+	// The extractors are compiled when the config is read, so every event gets the same compiled regexps
+	for _, source := range []string{"a.log", "b.log"} {
+		first := cfg.FieldExtractorsForSource(source)
+		second := cfg.FieldExtractorsForSource(source)
+		if len(first) != 1 || first[0] != second[0] {
+			t.Fatalf("got unexpected field extractors for source=%v, expected the same compiled regexp every time but got %v and %v", source, first, second)
+		}
+	}
+	if cfg.FieldExtractorsForSource("a.log")[0] != cfg.IndexedFiles[0].FieldExtractors[0] {
+		t.Fatal("got unexpected field extractor for a.log, expected the one compiled for the file")
+	}
+	if cfg.FieldExtractorsForSource("b.log")[0] != cfg.FieldExtractors[0] {
+		t.Fatal("got unexpected field extractor for b.log, expected the top level one")
+	}
+}
+
+func TestFromJSON_DuplicateKey(t *testing.T) {
+	cfg, err := FromJSON(strings.NewReader(`{
+		"files": [{"fileName": "net-*.log", "duplicateKey": "content"}, {"fileName": "*.log"}],
+		"duplicateKey": "offset"
+	}`))
+	if err != nil {
+		t.Fatalf("got unexpected error when reading config: %v", err)
+	}
+	for source, expected := range map[string]string{"net-1.log": DuplicateKeyContent, "app.log": DuplicateKeyOffset} {
+		if actual := cfg.DuplicateKeyForSource(source); actual != expected {
+			t.Fatalf("got unexpected duplicate key for source=%v, expected %v but got %v", source, expected, actual)
+		}
+	}
+
+	cfg, err = FromJSON(strings.NewReader(`{"duplicateKey": "content"}`))
+	if err != nil {
+		t.Fatalf("got unexpected error when reading config: %v", err)
+	}
+	if actual := cfg.DuplicateKeyForSource("app.log"); actual != DuplicateKeyContent {
+		t.Fatalf("got unexpected duplicate key, expected the top level %v but got %v", DuplicateKeyContent, actual)
+	}
+
+	for _, tt := range []struct {
+		json string
+		path string
+	}{
+		{`{"duplicateKey": "raw"}`, "duplicateKey"},
+		{`{"files": [{"fileName": "a.log", "duplicateKey": "hash"}]}`, "files[0].duplicateKey"},
+	} {
+		_, err = FromJSON(strings.NewReader(tt.json))
+		if err == nil || !strings.Contains(err.Error(), "config at "+tt.path+":") {
+			t.Fatalf("got unexpected error, expected an error for %v but got %v", tt.path, err)
+		}
+	}
+}
+
+func TestFromJSON_TimeField(t *testing.T) {
+	cfg, err := FromJSON(strings.NewReader(`{
+		"files": [{"fileName": "app-*.log", "timeField": "TS"}, {"fileName": "*.log"}],
+		"timeField": "timestamp"
+	}`))
+	if err != nil {
+		t.Fatalf("got unexpected error when reading config: %v", err)
+	}
+	for source, expected := range map[string]string{"app-1.log": "ts", "net.log": "timestamp"} {
+		if actual := cfg.TimeFieldForSource(source); actual != expected {
+			t.Fatalf("got unexpected time field for source=%v, expected %v but got %v", source, expected, actual)
+		}
+	}
+
+	cfg, err = FromJSON(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("got unexpected error when reading config: %v", err)
+	}
+	if actual := cfg.TimeFieldForSource("app.log"); actual != DefaultTimeField {
+		t.Fatalf("got unexpected time field, expected the default %v but got %v", DefaultTimeField, actual)
+	}
+}
@@ -14,8 +14,28 @@
 
 package config
 
+import "time"
+
+const (
+	DefaultForwarderMaxBufferedEvents = 1000000
+	DefaultForwarderFlushInterval     = 1 * time.Second
+	DefaultForwarderRetryBackoff      = 1 * time.Second
+)
+
+// ForwarderConfig configures how events are forwarded to a recipient instance.
+// Zero values are treated as "use the default".
 type ForwarderConfig struct {
 	Enabled           bool
 	MaxBufferedEvents int
 	RecipientAddress  string
+	// FlushInterval is the maximum time events will be accumulated before they are forwarded to the recipient.
+	// The default is DefaultForwarderFlushInterval.
+	FlushInterval time.Duration
+	// RetryBackoff is the time to wait before forwarding again after the recipient could not be reached. The wait is
+	// doubled for every following failure until forwarding succeeds again.
+	// The default is DefaultForwarderRetryBackoff.
+	RetryBackoff time.Duration
+	// Compress makes the forwarder gzip the events it sends, which uses less bandwidth at the cost of some CPU. The
+	// recipient must be a version of logsuck which accepts gzipped events.
+	Compress bool
 }
@@ -21,49 +21,110 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strings"
 	"time"
+
+	"github.com/jackbister/logsuck/internal/logging"
 )
 
 type jsonFileConfig struct {
-	Filename       string `json:fileName`
-	EventDelimiter string `json:eventDelimiter`
-	ReadInterval   string `json:readInterval`
-	TimeLayout     string `json:timeLayout`
+	Filename           string   `json:"fileName"`
+	EventDelimiter     string   `json:"eventDelimiter"`
+	EventStart         string   `json:"eventStart"`
+	ReadInterval       string   `json:"readInterval"`
+	TimeLayout         string   `json:"timeLayout"`
+	TimeLayouts        []string `json:"timeLayouts"`
+	FieldExtractors    []string `json:"fieldExtractors"`
+	JSONExtraction     *bool    `json:"jsonExtraction"`
+	KeyValueExtraction *bool    `json:"keyValueExtraction"`
+	DuplicateKey       string   `json:"duplicateKey"`
+	TimeField          string   `json:"timeField"`
 }
 
 type jsonForwarderConfig struct {
-	Enabled           *bool  `json:enabled`
-	MaxBufferedEvents *int   `json:maxBufferedEvents`
-	RecipientAddress  string `json:recipientAddress`
+	Enabled           *bool  `json:"enabled"`
+	MaxBufferedEvents *int   `json:"maxBufferedEvents"`
+	RecipientAddress  string `json:"recipientAddress"`
+	FlushInterval     string `json:"flushInterval"`
+	RetryBackoff      string `json:"retryBackoff"`
+	Compress          bool   `json:"compress"`
+}
+
+type jsonPublisherConfig struct {
+	BatchSize         *int   `json:"batchSize"`
+	FlushInterval     string `json:"flushInterval"`
+	MaxRetries        *int   `json:"maxRetries"`
+	RetryBackoff      string `json:"retryBackoff"`
+	MaxBufferedEvents *int   `json:"maxBufferedEvents"`
+	QueueSize         *int   `json:"queueSize"`
+	DropWhenFull      bool   `json:"dropWhenFull"`
+	ReplaceDuplicates bool   `json:"replaceDuplicates"`
+	MaxRawBytes       *int   `json:"maxRawBytes"`
+	RejectOversized   bool   `json:"rejectOversized"`
 }
 
 type jsonRecipientConfig struct {
-	Enabled     *bool             `json:enabled`
-	Address     string            `json:address`
-	TimeLayouts map[string]string `json:timeLayouts`
+	Enabled     *bool             `json:"enabled"`
+	Address     string            `json:"address"`
+	TimeLayouts map[string]string `json:"timeLayouts"`
 }
 
 type jsonSqliteConfig struct {
-	FileName  string `json:fileName`
-	TrueBatch *bool  `json:trueBatch`
+	FileName       string `json:"fileName"`
+	TrueBatch      *bool  `json:"trueBatch"`
+	FtsModule      string `json:"ftsModule"`
+	Tokenizer      string `json:"tokenizer"`
+	WAL            *bool  `json:"wal"`
+	BusyTimeout    string `json:"busyTimeout"`
+	ShardDirectory string `json:"shardDirectory"`
+	QueryLog       string `json:"queryLog"`
+	PageSize       *int   `json:"filterStreamPageSize"`
 }
 
-type jsonWebConfig struct {
-	Enabled          *bool  `json:enabled`
-	Address          string `json:address`
-	UsePackagedFiles *bool  `json:usePackagedFiles`
+type jsonSearchConfig struct {
+	MaxResultEvents *int `json:"maxResultEvents"`
+	MaxResultBytes  *int `json:"maxResultBytes"`
 }
 
-type jsonConfig struct {
-	Files           []jsonFileConfig `json:files`
-	FieldExtractors []string         `json:fieldExtractors`
+type jsonWebConfig struct {
+	Enabled          *bool  `json:"enabled"`
+	Address          string `json:"address"`
+	UsePackagedFiles *bool  `json:"usePackagedFiles"`
+}
 
-	HostName string `json:hostName`
+type jsonAlertConfig struct {
+	Name         string `json:"name"`
+	SearchString string `json:"searchString"`
+	Window       string `json:"window"`
+	Threshold    int64  `json:"threshold"`
+	Cooldown     string `json:"cooldown"`
+}
 
-	Forwarder *jsonForwarderConfig `json:forwarder`
-	Recipient *jsonRecipientConfig `json:recipient`
-	Sqlite    *jsonSqliteConfig    `json:sqlite`
-	Web       *jsonWebConfig       `json:web`
+type jsonConfig struct {
+	Files              []jsonFileConfig `json:"files"`
+	FieldExtractors    []string         `json:"fieldExtractors"`
+	JSONExtraction     bool             `json:"jsonExtraction"`
+	KeyValueExtraction bool             `json:"keyValueExtraction"`
+	CaseSensitive      bool             `json:"caseSensitive"`
+	PreserveFieldCase  bool             `json:"preserveFieldCase"`
+	DuplicateKey       string           `json:"duplicateKey"`
+	StoreFields        bool             `json:"storeFields"`
+	TimeField          string           `json:"timeField"`
+
+	HostName string `json:"hostName"`
+
+	Forwarder *jsonForwarderConfig `json:"forwarder"`
+	Publisher *jsonPublisherConfig `json:"publisher"`
+	Recipient *jsonRecipientConfig `json:"recipient"`
+	Sqlite    *jsonSqliteConfig    `json:"sqlite"`
+	Search    *jsonSearchConfig    `json:"search"`
+
+	RetentionPeriod string            `json:"retentionPeriod"`
+	TimeZone        string            `json:"timeZone"`
+	LogLevel        string            `json:"logLevel"`
+	Alerts          []jsonAlertConfig `json:"alerts"`
+
+	Web *jsonWebConfig `json:"web"`
 }
 
 var defaultConfig = Config{
@@ -76,10 +137,14 @@ var defaultConfig = Config{
 
 	Forwarder: &ForwarderConfig{
 		Enabled:           false,
-		MaxBufferedEvents: 1000000,
+		MaxBufferedEvents: DefaultForwarderMaxBufferedEvents,
 		RecipientAddress:  "http://localhost:8081",
+		FlushInterval:     DefaultForwarderFlushInterval,
+		RetryBackoff:      DefaultForwarderRetryBackoff,
 	},
 
+	Publisher: DefaultPublisherConfig(),
+
 	Recipient: &RecipientConfig{
 		Enabled: false,
 		Address: ":8081",
@@ -91,6 +156,11 @@ var defaultConfig = Config{
 	SQLite: &SqliteConfig{
 		DatabaseFile: "logsuck.db",
 		TrueBatch:    true,
+		FtsModule:    SqliteFtsModuleFts4,
+		WAL:          true,
+		BusyTimeout:  DefaultSqliteBusyTimeout,
+
+		FilterStreamPageSize: DefaultFilterStreamPageSize,
 	},
 
 	Web: &WebConfig{
@@ -104,6 +174,34 @@ var defaultEventDelimiter = regexp.MustCompile("\n")
 var defaultReadInterval = 1 * time.Second
 var defaultTimeLayout = "2006/01/02 15:04:05"
 
+// timeLayoutPresets are names which can be used instead of writing out common time layouts.
+var timeLayoutPresets = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"Apache":      "02/Jan/2006:15:04:05 -0700",
+	"Syslog":      time.Stamp,
+}
+
+func resolveTimeLayout(layout string) string {
+	if preset, ok := timeLayoutPresets[layout]; ok {
+		return preset
+	}
+	return layout
+}
+
+// warnAboutBuiltinFields logs a warning for field extractors with a named group for one of the built in fields, since
+// the built in fields take precedence and the extracted value will not be used.
+func warnAboutBuiltinFields(path string, fieldExtractors []*regexp.Regexp) {
+	for i, fe := range fieldExtractors {
+		for _, name := range fe.SubexpNames() {
+			if name == "host" || name == "source" {
+				log.Printf("Field extractor at %v[%v] extracts the field %v, which is a built in field. The extracted value will not be used.\n", path, i, name)
+			}
+		}
+	}
+}
+
 func FromJSON(r io.Reader) (*Config, error) {
 	var cfg jsonConfig
 	decoder := json.NewDecoder(r)
@@ -112,6 +210,8 @@ func FromJSON(r io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("error decoding config JSON: %w", err)
 	}
 
+	// Invalid field extractors are collected and reported together after all of them have been compiled
+	var fieldExtractorErrs []error
 	indexedFiles := make([]IndexedFileConfig, len(cfg.Files))
 	for i, file := range cfg.Files {
 		if file.Filename == "" {
@@ -130,6 +230,14 @@ func FromJSON(r io.Reader) (*Config, error) {
 			indexedFiles[i].EventDelimiter = ed
 		}
 
+		if file.EventStart != "" {
+			es, err := regexp.Compile(file.EventStart)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at files[%v]: error compiling eventStart regexp: %w", i, err)
+			}
+			indexedFiles[i].EventStart = es
+		}
+
 		if file.ReadInterval == "" {
 			log.Printf("Using default read interval for file=%v, defaultReadInterval=%v\n", file.Filename, defaultReadInterval)
 			indexedFiles[i].ReadInterval = defaultReadInterval
@@ -141,12 +249,43 @@ func FromJSON(r io.Reader) (*Config, error) {
 			indexedFiles[i].ReadInterval = ri
 		}
 
-		if file.TimeLayout == "" {
-			log.Printf("Using default time layout for file=%v, defaultTimeLayout=%v\n", file.Filename, defaultTimeLayout)
-			indexedFiles[i].TimeLayout = defaultTimeLayout
+		if file.TimeLayout != "" && len(file.TimeLayouts) > 0 {
+			return nil, fmt.Errorf("error reading config at files[%v]: only one of timeLayout and timeLayouts may be given", i)
+		} else if file.TimeLayout != "" {
+			indexedFiles[i].TimeLayouts = []string{resolveTimeLayout(file.TimeLayout)}
+		} else if len(file.TimeLayouts) > 0 {
+			indexedFiles[i].TimeLayouts = make([]string, len(file.TimeLayouts))
+			for j, tl := range file.TimeLayouts {
+				if tl == "" {
+					return nil, fmt.Errorf("error reading config at files[%v].timeLayouts[%v]: timeLayout is empty", i, j)
+				}
+				indexedFiles[i].TimeLayouts[j] = resolveTimeLayout(tl)
+			}
 		} else {
-			indexedFiles[i].TimeLayout = file.TimeLayout
+			log.Printf("Using default time layout for file=%v, defaultTimeLayout=%v\n", file.Filename, defaultTimeLayout)
+			indexedFiles[i].TimeLayouts = []string{defaultTimeLayout}
+		}
+
+		if len(file.FieldExtractors) > 0 {
+			path := fmt.Sprintf("files[%v].fieldExtractors", i)
+			fes, errs := compileFieldExtractors(path, file.FieldExtractors)
+			fieldExtractorErrs = append(fieldExtractorErrs, errs...)
+			indexedFiles[i].FieldExtractors = fes
+			if len(errs) == 0 {
+				warnAboutBuiltinFields(path, fes)
+			}
+		}
+		indexedFiles[i].JSONExtraction = file.JSONExtraction
+		indexedFiles[i].KeyValueExtraction = file.KeyValueExtraction
+		if file.DuplicateKey != "" && !isDuplicateKey(file.DuplicateKey) {
+			return nil, fmt.Errorf("error reading config at files[%v].duplicateKey: duplicateKey must be either %q or %q, got %q", i, DuplicateKeyOffset, DuplicateKeyContent, file.DuplicateKey)
 		}
+		indexedFiles[i].DuplicateKey = file.DuplicateKey
+		// Extracted field names are lowercased, so the time field has to be too for it to be found
+		indexedFiles[i].TimeField = strings.ToLower(file.TimeField)
+	}
+	if cfg.DuplicateKey != "" && !isDuplicateKey(cfg.DuplicateKey) {
+		return nil, fmt.Errorf("error reading config at duplicateKey: duplicateKey must be either %q or %q, got %q", DuplicateKeyOffset, DuplicateKeyContent, cfg.DuplicateKey)
 	}
 
 	var fieldExtractors []*regexp.Regexp
@@ -154,15 +293,20 @@ func FromJSON(r io.Reader) (*Config, error) {
 		log.Printf("Using default field extractors. defaultFieldExtractors=%v\n", defaultConfig.FieldExtractors)
 		fieldExtractors = defaultConfig.FieldExtractors
 	} else {
-		fieldExtractors = make([]*regexp.Regexp, len(cfg.FieldExtractors))
-		for i, fe := range cfg.FieldExtractors {
-			re, err := regexp.Compile(fe)
-			if err != nil {
-				return nil, fmt.Errorf("error reading config at fieldExtractors[%v]: error compiling regexp: %w", i, err)
-			}
-			fieldExtractors[i] = re
+		var errs []error
+		fieldExtractors, errs = compileFieldExtractors("fieldExtractors", cfg.FieldExtractors)
+		fieldExtractorErrs = append(fieldExtractorErrs, errs...)
+	}
+	if len(fieldExtractorErrs) == 1 {
+		return nil, fieldExtractorErrs[0]
+	} else if len(fieldExtractorErrs) > 1 {
+		msgs := make([]string, len(fieldExtractorErrs))
+		for i, err := range fieldExtractorErrs {
+			msgs[i] = err.Error()
 		}
+		return nil, fmt.Errorf("found numErrors=%v invalid field extractors: %v", len(fieldExtractorErrs), strings.Join(msgs, "; "))
 	}
+	warnAboutBuiltinFields("fieldExtractors", fieldExtractors)
 
 	var hostName string
 	if cfg.HostName != "" {
@@ -201,6 +345,123 @@ func FromJSON(r io.Reader) (*Config, error) {
 		} else {
 			forwarder.RecipientAddress = cfg.Forwarder.RecipientAddress
 		}
+		if cfg.Forwarder.FlushInterval == "" {
+			log.Printf("Using default flushInterval for forwarder. defaultFlushInterval=%v\n", defaultConfig.Forwarder.FlushInterval)
+			forwarder.FlushInterval = defaultConfig.Forwarder.FlushInterval
+		} else {
+			fi, err := time.ParseDuration(cfg.Forwarder.FlushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at forwarder.flushInterval: error parsing duration: %w", err)
+			}
+			if fi <= 0 {
+				return nil, fmt.Errorf("error reading config at forwarder.flushInterval: flushInterval must be greater than 0, got %v", fi)
+			}
+			forwarder.FlushInterval = fi
+		}
+		if cfg.Forwarder.RetryBackoff == "" {
+			log.Printf("Using default retryBackoff for forwarder. defaultRetryBackoff=%v\n", defaultConfig.Forwarder.RetryBackoff)
+			forwarder.RetryBackoff = defaultConfig.Forwarder.RetryBackoff
+		} else {
+			rb, err := time.ParseDuration(cfg.Forwarder.RetryBackoff)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at forwarder.retryBackoff: error parsing duration: %w", err)
+			}
+			if rb <= 0 {
+				return nil, fmt.Errorf("error reading config at forwarder.retryBackoff: retryBackoff must be greater than 0, got %v", rb)
+			}
+			forwarder.RetryBackoff = rb
+		}
+		forwarder.Compress = cfg.Forwarder.Compress
+	}
+
+	var publisher *PublisherConfig
+	if cfg.Publisher == nil {
+		log.Println("Using default publisher configuration.")
+		publisher = defaultConfig.Publisher
+	} else {
+		publisher = &PublisherConfig{}
+		if cfg.Publisher.BatchSize == nil {
+			log.Printf("Using default batchSize for publisher. defaultBatchSize=%v\n", defaultConfig.Publisher.BatchSize)
+			publisher.BatchSize = defaultConfig.Publisher.BatchSize
+		} else if *cfg.Publisher.BatchSize <= 0 {
+			return nil, fmt.Errorf("error reading config at publisher.batchSize: batchSize must be greater than 0, got %v", *cfg.Publisher.BatchSize)
+		} else {
+			publisher.BatchSize = *cfg.Publisher.BatchSize
+		}
+		if cfg.Publisher.FlushInterval == "" {
+			log.Printf("Using default flushInterval for publisher. defaultFlushInterval=%v\n", defaultConfig.Publisher.FlushInterval)
+			publisher.FlushInterval = defaultConfig.Publisher.FlushInterval
+		} else {
+			fi, err := time.ParseDuration(cfg.Publisher.FlushInterval)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at publisher.flushInterval: error parsing duration: %w", err)
+			}
+			if fi <= 0 {
+				return nil, fmt.Errorf("error reading config at publisher.flushInterval: flushInterval must be greater than 0, got %v", fi)
+			}
+			publisher.FlushInterval = fi
+		}
+		if cfg.Publisher.MaxRetries == nil {
+			log.Printf("Using default maxRetries for publisher. defaultMaxRetries=%v\n", *defaultConfig.Publisher.MaxRetries)
+			publisher.MaxRetries = defaultConfig.Publisher.MaxRetries
+		} else if *cfg.Publisher.MaxRetries < 0 {
+			return nil, fmt.Errorf("error reading config at publisher.maxRetries: maxRetries must not be negative, got %v", *cfg.Publisher.MaxRetries)
+		} else {
+			publisher.MaxRetries = cfg.Publisher.MaxRetries
+		}
+		if cfg.Publisher.RetryBackoff == "" {
+			log.Printf("Using default retryBackoff for publisher. defaultRetryBackoff=%v\n", defaultConfig.Publisher.RetryBackoff)
+			publisher.RetryBackoff = defaultConfig.Publisher.RetryBackoff
+		} else {
+			rb, err := time.ParseDuration(cfg.Publisher.RetryBackoff)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at publisher.retryBackoff: error parsing duration: %w", err)
+			}
+			if rb <= 0 {
+				return nil, fmt.Errorf("error reading config at publisher.retryBackoff: retryBackoff must be greater than 0, got %v", rb)
+			}
+			publisher.RetryBackoff = rb
+		}
+		if cfg.Publisher.MaxBufferedEvents == nil {
+			log.Printf("Using default maxBufferedEvents for publisher. defaultMaxBufferedEvents=%v\n", defaultConfig.Publisher.MaxBufferedEvents)
+			publisher.MaxBufferedEvents = defaultConfig.Publisher.MaxBufferedEvents
+		} else if *cfg.Publisher.MaxBufferedEvents <= 0 {
+			return nil, fmt.Errorf("error reading config at publisher.maxBufferedEvents: maxBufferedEvents must be greater than 0, got %v", *cfg.Publisher.MaxBufferedEvents)
+		} else {
+			publisher.MaxBufferedEvents = *cfg.Publisher.MaxBufferedEvents
+		}
+		if cfg.Publisher.QueueSize != nil {
+			if *cfg.Publisher.QueueSize <= 0 {
+				return nil, fmt.Errorf("error reading config at publisher.queueSize: queueSize must be greater than 0, got %v", *cfg.Publisher.QueueSize)
+			}
+			publisher.QueueSize = *cfg.Publisher.QueueSize
+		}
+		publisher.DropWhenFull = cfg.Publisher.DropWhenFull
+		publisher.ReplaceDuplicates = cfg.Publisher.ReplaceDuplicates
+		if cfg.Publisher.MaxRawBytes != nil {
+			if *cfg.Publisher.MaxRawBytes <= 0 {
+				return nil, fmt.Errorf("error reading config at publisher.maxRawBytes: maxRawBytes must be greater than 0, got %v", *cfg.Publisher.MaxRawBytes)
+			}
+			publisher.MaxRawBytes = *cfg.Publisher.MaxRawBytes
+		}
+		publisher.RejectOversized = cfg.Publisher.RejectOversized
+	}
+
+	var srch *SearchConfig
+	if cfg.Search != nil {
+		srch = &SearchConfig{}
+		if cfg.Search.MaxResultEvents != nil {
+			if *cfg.Search.MaxResultEvents <= 0 {
+				return nil, fmt.Errorf("error reading config at search.maxResultEvents: maxResultEvents must be greater than 0, got %v", *cfg.Search.MaxResultEvents)
+			}
+			srch.MaxResultEvents = *cfg.Search.MaxResultEvents
+		}
+		if cfg.Search.MaxResultBytes != nil {
+			if *cfg.Search.MaxResultBytes <= 0 {
+				return nil, fmt.Errorf("error reading config at search.maxResultBytes: maxResultBytes must be greater than 0, got %v", *cfg.Search.MaxResultBytes)
+			}
+			srch.MaxResultBytes = *cfg.Search.MaxResultBytes
+		}
 	}
 
 	var recipient *RecipientConfig
@@ -225,7 +486,10 @@ func FromJSON(r io.Reader) (*Config, error) {
 			log.Printf("Using default time layouts for recipient. defaultTimeLayouts=%v\n", defaultConfig.Recipient.TimeLayouts)
 			recipient.TimeLayouts = defaultConfig.Recipient.TimeLayouts
 		} else {
-			recipient.TimeLayouts = cfg.Recipient.TimeLayouts
+			recipient.TimeLayouts = make(map[string]string, len(cfg.Recipient.TimeLayouts))
+			for source, tl := range cfg.Recipient.TimeLayouts {
+				recipient.TimeLayouts[source] = resolveTimeLayout(tl)
+			}
 			if _, ok := recipient.TimeLayouts["DEFAULT"]; !ok {
 				log.Printf("No DEFAULT key found in recipient.timeLayouts, will add DEFAULT timeLayout '%v'\n", defaultConfig.Recipient.TimeLayouts["DEFAULT"])
 				recipient.TimeLayouts["DEFAULT"] = defaultConfig.Recipient.TimeLayouts["DEFAULT"]
@@ -245,12 +509,130 @@ func FromJSON(r io.Reader) (*Config, error) {
 		} else {
 			sqlite.DatabaseFile = cfg.Sqlite.FileName
 		}
+		sqlite.ShardDirectory = cfg.Sqlite.ShardDirectory
 		if cfg.Sqlite.TrueBatch == nil {
 			log.Println("Using default TrueBatch mode. defaultTrueBatch=true")
 			sqlite.TrueBatch = true
 		} else {
 			sqlite.TrueBatch = *cfg.Sqlite.TrueBatch
 		}
+		switch cfg.Sqlite.FtsModule {
+		case "":
+			log.Printf("Using default sqlite ftsModule. defaultFtsModule=%v\n", defaultConfig.SQLite.FtsModule)
+			sqlite.FtsModule = defaultConfig.SQLite.FtsModule
+		case SqliteFtsModuleFts4, SqliteFtsModuleFts5:
+			sqlite.FtsModule = cfg.Sqlite.FtsModule
+		default:
+			return nil, fmt.Errorf("error reading config at sqlite.ftsModule: ftsModule must be either %q or %q, got %q", SqliteFtsModuleFts4, SqliteFtsModuleFts5, cfg.Sqlite.FtsModule)
+		}
+		// The arguments are quoted by the repository when creating the table, so they can not contain quotes themselves
+		if strings.ContainsAny(cfg.Sqlite.Tokenizer, "'\"") {
+			return nil, fmt.Errorf("error reading config at sqlite.tokenizer: tokenizer must not contain quotes, got %q", cfg.Sqlite.Tokenizer)
+		}
+		sqlite.Tokenizer = strings.Join(strings.Fields(cfg.Sqlite.Tokenizer), " ")
+		switch cfg.Sqlite.QueryLog {
+		case "", SqliteQueryLogStatements, SqliteQueryLogExplain:
+			sqlite.QueryLog = cfg.Sqlite.QueryLog
+		default:
+			return nil, fmt.Errorf("error reading config at sqlite.queryLog: queryLog must be either %q or %q, got %q", SqliteQueryLogStatements, SqliteQueryLogExplain, cfg.Sqlite.QueryLog)
+		}
+		if cfg.Sqlite.WAL == nil {
+			log.Println("Using default sqlite WAL mode. defaultWal=true")
+			sqlite.WAL = defaultConfig.SQLite.WAL
+		} else {
+			sqlite.WAL = *cfg.Sqlite.WAL
+		}
+		if cfg.Sqlite.BusyTimeout == "" {
+			log.Printf("Using default sqlite busyTimeout. defaultBusyTimeout=%v\n", defaultConfig.SQLite.BusyTimeout)
+			sqlite.BusyTimeout = defaultConfig.SQLite.BusyTimeout
+		} else {
+			bt, err := time.ParseDuration(cfg.Sqlite.BusyTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at sqlite.busyTimeout: error parsing duration: %w", err)
+			}
+			if bt < 0 {
+				return nil, fmt.Errorf("error reading config at sqlite.busyTimeout: busyTimeout must not be negative, got %v", bt)
+			}
+			sqlite.BusyTimeout = bt
+		}
+		if cfg.Sqlite.PageSize == nil {
+			sqlite.FilterStreamPageSize = defaultConfig.SQLite.FilterStreamPageSize
+		} else if *cfg.Sqlite.PageSize <= 0 {
+			return nil, fmt.Errorf("error reading config at sqlite.filterStreamPageSize: filterStreamPageSize must be a positive integer, got %v", *cfg.Sqlite.PageSize)
+		} else {
+			sqlite.FilterStreamPageSize = *cfg.Sqlite.PageSize
+		}
+	}
+
+	var retentionPeriod time.Duration
+	if cfg.RetentionPeriod != "" {
+		rp, err := time.ParseDuration(cfg.RetentionPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config at retentionPeriod: error parsing duration: %w", err)
+		}
+		if rp < 0 {
+			return nil, fmt.Errorf("error reading config at retentionPeriod: retentionPeriod must not be negative, got %v", rp)
+		}
+		retentionPeriod = rp
+	}
+
+	alerts := make([]AlertConfig, len(cfg.Alerts))
+	for i, alert := range cfg.Alerts {
+		if alert.Name == "" {
+			return nil, fmt.Errorf("error reading config at alerts[%v].name: name must not be empty", i)
+		}
+		if alert.SearchString == "" {
+			return nil, fmt.Errorf("error reading config at alerts[%v].searchString: searchString must not be empty", i)
+		}
+		window, err := time.ParseDuration(alert.Window)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config at alerts[%v].window: error parsing duration: %w", i, err)
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("error reading config at alerts[%v].window: window must be positive, got %v", i, window)
+		}
+		if alert.Threshold < 0 {
+			return nil, fmt.Errorf("error reading config at alerts[%v].threshold: threshold must not be negative, got %v", i, alert.Threshold)
+		}
+		var cooldown time.Duration
+		if alert.Cooldown != "" {
+			cooldown, err = time.ParseDuration(alert.Cooldown)
+			if err != nil {
+				return nil, fmt.Errorf("error reading config at alerts[%v].cooldown: error parsing duration: %w", i, err)
+			}
+			if cooldown < 0 {
+				return nil, fmt.Errorf("error reading config at alerts[%v].cooldown: cooldown must not be negative, got %v", i, cooldown)
+			}
+		}
+		alerts[i] = AlertConfig{
+			Name:         alert.Name,
+			SearchString: alert.SearchString,
+			Window:       window,
+			Threshold:    alert.Threshold,
+			Cooldown:     cooldown,
+		}
+	}
+
+	var timeZone *time.Location
+	if cfg.TimeZone != "" {
+		tz, err := time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config at timeZone: error loading location: %w", err)
+		}
+		timeZone = tz
+	}
+
+	var logger logging.Logger
+	if cfg.LogLevel != "" {
+		level, err := logging.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config at logLevel: %w", err)
+		}
+		logger = logging.New(log.New(os.Stderr, "", log.LstdFlags), level)
+		// sqlite may be the default configuration, which must not be changed
+		withLogger := *sqlite
+		withLogger.Logger = logger
+		sqlite = &withLogger
 	}
 
 	var web *WebConfig
@@ -289,16 +671,36 @@ func FromJSON(r io.Reader) (*Config, error) {
 	}
 
 	return &Config{
-		IndexedFiles:    indexedFiles,
-		FieldExtractors: fieldExtractors,
+		IndexedFiles:       indexedFiles,
+		FieldExtractors:    fieldExtractors,
+		JSONExtraction:     cfg.JSONExtraction,
+		KeyValueExtraction: cfg.KeyValueExtraction,
+		CaseSensitive:      cfg.CaseSensitive,
+		PreserveFieldCase:  cfg.PreserveFieldCase,
+		DuplicateKey:       cfg.DuplicateKey,
+		StoreFields:        cfg.StoreFields,
+		TimeField:          strings.ToLower(cfg.TimeField),
 
 		HostName: hostName,
 
 		Forwarder: forwarder,
+		Publisher: publisher,
 		Recipient: recipient,
 
 		SQLite: sqlite,
+		Search: srch,
+
+		RetentionPeriod: retentionPeriod,
+		TimeZone:        timeZone,
+
+		Alerts: alerts,
 
 		Web: web,
+
+		Logger: logger,
 	}, nil
 }
+
+func isDuplicateKey(s string) bool {
+	return s == DuplicateKeyOffset || s == DuplicateKeyContent
+}
@@ -26,11 +26,27 @@ type IndexedFileConfig struct {
 	// EventDelimiter is a regex that is used to determine where one event ends and another begins.
 	// The default is "\n".
 	EventDelimiter *regexp.Regexp
+	// EventStart is a regex which matches the beginning of an event, for files where one event can span several of
+	// the pieces split by EventDelimiter, such as stack traces. A piece which does not match is appended to the event
+	// before it. If it is nil every piece is an event.
+	EventStart *regexp.Regexp
 	// ReadInterval is the time the file watcher will sleep between looking for new events in the file.
 	// A lower duration will make events arrive faster in the search engine, but will consume more CPU.
 	// The default is 10 * time.Second.
 	ReadInterval time.Duration
-	// TimeLayout is the layout of the _time field if it is extracted, following Go's time.Parse style https://golang.org/pkg/time/#Parse
-	// The default is "2006/01/02 15:04:05"
-	TimeLayout string
+	// TimeLayouts are the layouts of the time field if it is extracted, following Go's time.Parse style https://golang.org/pkg/time/#Parse
+	// They are tried in order and the first one which matches is used.
+	// The default is ["2006/01/02 15:04:05"]
+	TimeLayouts []string
+	// FieldExtractors are used instead of the global Config.FieldExtractors for events from this file.
+	// If it is empty, the global FieldExtractors are used.
+	FieldExtractors []*regexp.Regexp
+	// JSONExtraction overrides the global Config.JSONExtraction for events from this file if it is set.
+	JSONExtraction *bool
+	// KeyValueExtraction overrides the global Config.KeyValueExtraction for events from this file if it is set.
+	KeyValueExtraction *bool
+	// DuplicateKey overrides the global Config.DuplicateKey for events from this file if it is not empty.
+	DuplicateKey string
+	// TimeField overrides the global Config.TimeField for events from this file if it is not empty.
+	TimeField string
 }
@@ -0,0 +1,76 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "time"
+
+const (
+	DefaultPublisherBatchSize         = 5000
+	DefaultPublisherFlushInterval     = 1 * time.Second
+	DefaultPublisherMaxRetries        = 3
+	DefaultPublisherRetryBackoff      = 100 * time.Millisecond
+	DefaultPublisherMaxBufferedEvents = 1000000
+)
+
+// DefaultPublisherConfig returns a PublisherConfig where every option is set to its default.
+func DefaultPublisherConfig() *PublisherConfig {
+	maxRetries := DefaultPublisherMaxRetries
+	return &PublisherConfig{
+		BatchSize:         DefaultPublisherBatchSize,
+		FlushInterval:     DefaultPublisherFlushInterval,
+		MaxRetries:        &maxRetries,
+		RetryBackoff:      DefaultPublisherRetryBackoff,
+		MaxBufferedEvents: DefaultPublisherMaxBufferedEvents,
+	}
+}
+
+// PublisherConfig configures how events are written to the repository.
+// Zero values and nil are treated as "use the default".
+type PublisherConfig struct {
+	// BatchSize is the number of events which will be accumulated before they are written to the repository.
+	// The default is DefaultPublisherBatchSize.
+	BatchSize int
+	// FlushInterval is the maximum time events will be accumulated before they are written to the repository,
+	// even if BatchSize has not been reached.
+	// The default is DefaultPublisherFlushInterval.
+	FlushInterval time.Duration
+	// MaxRetries is the number of times adding a batch will be retried if the repository returns an error.
+	// It is a pointer since 0 is a meaningful value which disables retrying. The default is DefaultPublisherMaxRetries.
+	MaxRetries *int
+	// RetryBackoff is the time to wait before the first retry. The wait is doubled for every following retry.
+	// The default is DefaultPublisherRetryBackoff.
+	RetryBackoff time.Duration
+	// MaxBufferedEvents is the maximum number of events which will be kept in memory while the repository is failing.
+	// If it is exceeded, the oldest events will be dropped.
+	// The default is DefaultPublisherMaxBufferedEvents.
+	MaxBufferedEvents int
+	// QueueSize is the number of events which can be waiting to be added to a batch before publishing an event has
+	// to wait. Publishing will have to wait if the repository is slower than the rate events are published.
+	// The default is to use the same size as BatchSize.
+	QueueSize int
+	// DropWhenFull makes the publisher drop events instead of waiting when the queue is full, so that reading log
+	// files is not slowed down by a slow repository. The number of dropped events is logged.
+	DropWhenFull bool
+	// ReplaceDuplicates makes an event which has the same host, source, timestamp and offset as an existing event
+	// replace the raw of that event instead of being skipped, for example when a file is read again after the events
+	// in it have been corrected.
+	ReplaceDuplicates bool
+	// MaxRawBytes is the longest raw an event can have. Longer raws are truncated, unless RejectOversized is set in
+	// which case the event is dropped instead. This keeps a runaway log line from bloating the database and the full
+	// text index. The default is 0, which means there is no limit.
+	MaxRawBytes int
+	// RejectOversized makes events with a raw longer than MaxRawBytes be dropped instead of truncated.
+	RejectOversized bool
+}
@@ -0,0 +1,26 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// SearchConfig limits the size of the results the search passes on to the rest of the pipeline, so that a page of
+// matches with large raws does not reach the commands after the search, or the client, all at once.
+// Zero values mean that there is no limit, and a page of events from the repository is passed on as a single result.
+type SearchConfig struct {
+	// MaxResultEvents is the largest number of events in a result.
+	MaxResultEvents int
+	// MaxResultBytes is the largest total size of the raws and fields of the events in a result. An event which is
+	// larger than this on its own is passed on in a result by itself.
+	MaxResultBytes int
+}
@@ -14,7 +14,55 @@
 
 package config
 
+import (
+	"time"
+
+	"github.com/jackbister/logsuck/internal/logging"
+)
+
+const (
+	SqliteFtsModuleFts4 = "fts4"
+	SqliteFtsModuleFts5 = "fts5"
+
+	DefaultSqliteBusyTimeout = 5 * time.Second
+
+	// DefaultFilterStreamPageSize is the number of events a search fetches from the database at a time unless
+	// SqliteConfig.FilterStreamPageSize is set.
+	DefaultFilterStreamPageSize = 1000
+
+	// SqliteQueryLogStatements logs every statement executed when searching, along with its arguments.
+	SqliteQueryLogStatements = "statements"
+	// SqliteQueryLogExplain logs the same as SqliteQueryLogStatements, and also the query plan of each statement and
+	// the number of rows and time taken for each page of results.
+	SqliteQueryLogExplain = "explain"
+)
+
 type SqliteConfig struct {
 	DatabaseFile string
 	TrueBatch    bool
+	// FtsModule is the SQLite full text search module used to index the raw events, either "fts4" or "fts5".
+	// An empty string means "fts4".
+	FtsModule string
+	// Tokenizer is the tokenizer of the full text search index followed by its arguments, such as "porter" or
+	// "unicode61 remove_diacritics=2". An empty string means the default tokenizer of FtsModule.
+	Tokenizer string
+	// WAL enables SQLite's write-ahead log, which lets searches read the database while events are being written.
+	WAL bool
+	// BusyTimeout is how long a connection waits for another connection to release its lock before failing with
+	// SQLITE_BUSY. It is set per connection, so it is part of the data source name rather than set by the repository.
+	BusyTimeout time.Duration
+	// ShardDirectory makes events be stored in one SQLite database per day in this directory instead of in
+	// DatabaseFile, so that old events can be deleted by removing whole files. Jobs are still stored in DatabaseFile.
+	// An empty string means that sharding is disabled.
+	ShardDirectory string
+	// QueryLog is used to debug slow searches by logging the statements they execute. It is either
+	// SqliteQueryLogStatements or SqliteQueryLogExplain. An empty string means that nothing is logged.
+	QueryLog string
+	// FilterStreamPageSize is the number of events a search fetches from the database at a time. Larger pages need
+	// fewer queries but use more memory and take longer before the first events are sent on. 0 means
+	// DefaultFilterStreamPageSize.
+	FilterStreamPageSize int
+	// Logger is where the repository logs to, including the statements logged because of QueryLog. If it is nil,
+	// logging.Default() is used.
+	Logger logging.Logger
 }
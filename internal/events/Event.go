@@ -22,6 +22,10 @@ type RawEvent struct {
 	Host   string
 	Source string
 	Offset int64
+	// Timestamp is used as the timestamp of the event if it is set, instead of the time field extracted from Raw.
+	// This is for sources which already know when their events happened, so that no fields have to be extracted when
+	// the event is published unless Config.StoreFields is enabled. Other fields are still extracted when searching.
+	Timestamp time.Time
 }
 
 type Event struct {
@@ -30,6 +34,13 @@ type Event struct {
 	Host      string
 	Source    string
 	Offset    int64
+	// Fields are the fields extracted from the event when it was published. They are only set if
+	// Config.StoreFields is enabled, in which case the repository stores them to be able to filter on them.
+	Fields map[string]string
+	// DuplicateKey decides which events this event is a duplicate of, either config.DuplicateKeyOffset or
+	// config.DuplicateKeyContent. It is set from Config.DuplicateKeyForSource when the event is published, and an
+	// empty string means config.DuplicateKeyOffset.
+	DuplicateKey string
 }
 
 type EventWithId struct {
@@ -38,6 +49,10 @@ type EventWithId struct {
 	Timestamp time.Time
 	Host      string
 	Source    string
+	// Snippet is the excerpt of Raw around the fragments the event matched if search.Search.Snippet was set. It is only
+	// set by the SQLite repository, and is empty for events which were not found using full text search, such as when
+	// the search has no fragments.
+	Snippet string
 }
 
 type EventWithExtractedFields struct {
@@ -48,8 +63,3 @@ type EventWithExtractedFields struct {
 	Source    string
 	Fields    map[string]string
 }
-
-type EventIdAndTimestamp struct {
-	Id        int64
-	Timestamp time.Time
-}
@@ -15,106 +15,440 @@
 package events
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jackbister/logsuck/internal/config"
-	"github.com/jackbister/logsuck/internal/parser"
+	"github.com/jackbister/logsuck/internal/logging"
 )
 
+var (
+	// ErrPublisherShutdown is returned when publishing an event to a publisher which has been shut down.
+	ErrPublisherShutdown = errors.New("publisher has been shut down")
+	// ErrPublisherQueueFull is returned when an event was dropped because the publisher could not keep up.
+	ErrPublisherQueueFull = errors.New("publisher queue is full")
+	// ErrEventTooLarge is returned when an event was rejected because its raw is longer than the configured
+	// MaxRawBytes.
+	ErrEventTooLarge = errors.New("event is too large")
+)
+
+// TruncatedField is the field which is set to "true" on events whose raw was truncated because it was longer than the
+// configured MaxRawBytes. It is only stored if Config.StoreFields is enabled.
+const TruncatedField = "_truncated"
+
 type EventPublisher interface {
-	PublishEvent(evt RawEvent, timeLayout string)
+	// PublishEvent publishes evt, using timeLayouts to parse its timestamp. It returns an error if evt was dropped
+	// instead of being published, which wraps ErrPublisherShutdown, ErrPublisherQueueFull or ErrEventTooLarge when that
+	// is the reason.
+	// A nil error means the publisher has accepted evt, not that it has been stored.
+	PublishEvent(evt RawEvent, timeLayouts []string) error
+	// Shutdown flushes any events the publisher is holding on to and stops it.
+	// Events published after Shutdown has been called are dropped.
+	Shutdown(ctx context.Context) error
+}
+
+// NonBlockingEventPublisher is an EventPublisher which can publish events without waiting for the repository to
+// catch up.
+type NonBlockingEventPublisher interface {
+	EventPublisher
+	// TryPublishEvent publishes evt only if it can be done without waiting, and returns whether evt was published.
+	TryPublishEvent(evt RawEvent, timeLayouts []string) bool
+	// DroppedEvents returns the number of events PublishEvent has dropped because the queue was full.
+	// Events are only dropped if dropWhenFull is enabled in the configuration.
+	DroppedEvents() int64
 }
 
 type batchedRepositoryPublisher struct {
-	cfg  *config.Config
-	repo Repository
+	cfg          *config.Config
+	repo         Repository
+	onBatchAdded func(AddBatchResult)
+	logger       logging.Logger
+
+	batchSize         int
+	flushInterval     time.Duration
+	maxRetries        int
+	retryBackoff      time.Duration
+	maxBufferedEvents int
+	queueSize         int
+	dropWhenFull      bool
+	replaceDuplicates bool
+	maxRawBytes       int
+	rejectOversized   bool
 
-	adder chan<- Event
+	// dropped must only be accessed atomically
+	dropped         int64
+	reportedDropped int64
+	accumulated     []Event
+	adder           chan<- Event
+	// sending is held for reading while an event is being sent to adder, so that the event goroutine can wait for
+	// those sends to finish before its final flush when shutting down.
+	sending sync.RWMutex
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	done         chan struct{}
 }
 
-func BatchedRepositoryPublisher(cfg *config.Config, repo Repository) EventPublisher {
-	adder := make(chan Event, 5000)
+// BatchedRepositoryPublisher creates an EventPublisher which adds events to repo in batches.
+// If onBatchAdded is not nil it is called with the result of every batch that is successfully added,
+// which can be used to keep track of how many events are being skipped as duplicates.
+func BatchedRepositoryPublisher(cfg *config.Config, repo Repository, onBatchAdded func(AddBatchResult)) EventPublisher {
+	ep := batchedRepositoryPublisher{
+		cfg:          cfg,
+		repo:         repo,
+		onBatchAdded: onBatchAdded,
+		logger:       logging.OrDefault(cfg.Logger),
+
+		batchSize:         config.DefaultPublisherBatchSize,
+		flushInterval:     config.DefaultPublisherFlushInterval,
+		maxRetries:        config.DefaultPublisherMaxRetries,
+		retryBackoff:      config.DefaultPublisherRetryBackoff,
+		maxBufferedEvents: config.DefaultPublisherMaxBufferedEvents,
+	}
+	if cfg.Publisher != nil {
+		if cfg.Publisher.BatchSize > 0 {
+			ep.batchSize = cfg.Publisher.BatchSize
+		}
+		if cfg.Publisher.FlushInterval > 0 {
+			ep.flushInterval = cfg.Publisher.FlushInterval
+		}
+		if cfg.Publisher.MaxRetries != nil {
+			ep.maxRetries = *cfg.Publisher.MaxRetries
+		}
+		if cfg.Publisher.RetryBackoff > 0 {
+			ep.retryBackoff = cfg.Publisher.RetryBackoff
+		}
+		if cfg.Publisher.MaxBufferedEvents > 0 {
+			ep.maxBufferedEvents = cfg.Publisher.MaxBufferedEvents
+		}
+		ep.queueSize = cfg.Publisher.QueueSize
+		ep.dropWhenFull = cfg.Publisher.DropWhenFull
+		ep.replaceDuplicates = cfg.Publisher.ReplaceDuplicates
+		ep.maxRawBytes = cfg.Publisher.MaxRawBytes
+		ep.rejectOversized = cfg.Publisher.RejectOversized
+	}
+	if ep.queueSize <= 0 {
+		ep.queueSize = ep.batchSize
+	}
+	adder := make(chan Event, ep.queueSize)
+	ep.accumulated = make([]Event, 0, ep.batchSize)
+	ep.adder = adder
+	ep.shutdown = make(chan struct{})
+	ep.done = make(chan struct{})
 
 	go func() {
-		accumulated := make([]Event, 0, 5000)
-		timeout := time.After(1 * time.Second)
+		lastErrorTime := time.Now().Add(-ep.flushInterval)
+		timeout := time.After(ep.flushInterval)
 		for {
 			select {
 			case <-timeout:
-				if len(accumulated) > 0 {
-					repo.AddBatch(accumulated)
-					accumulated = accumulated[:0]
+				if len(ep.accumulated) > 0 {
+					err := ep.flush()
+					if err != nil {
+						ep.logger.Errorf("error when adding events: %v", err)
+						lastErrorTime = time.Now()
+					}
+					ep.dropExcessEvents()
 				}
-				timeout = time.After(1 * time.Second)
+				timeout = time.After(ep.flushInterval)
 			case evt := <-adder:
-				accumulated = append(accumulated, evt)
-				if len(accumulated) >= 5000 {
-					err := repo.AddBatch(accumulated)
+				ep.accumulated = append(ep.accumulated, evt)
+				// After a failure the accumulator will be above batchSize until the repository recovers,
+				// so wait for the timer instead of retrying on every new event.
+				if len(ep.accumulated) >= ep.batchSize && time.Now().Sub(lastErrorTime) > ep.flushInterval {
+					err := ep.flush()
 					if err != nil {
-						// TODO: Error handling
-						log.Println("error when adding events:", err)
+						ep.logger.Errorf("error when adding events: %v", err)
+						lastErrorTime = time.Now()
+					}
+					ep.dropExcessEvents()
+					timeout = time.After(ep.flushInterval)
+				}
+			case <-ep.shutdown:
+				// Once every send which started before the shutdown is done, no more events can be added to adder
+				ep.sending.Lock()
+				ep.sending.Unlock()
+			drain:
+				for {
+					select {
+					case evt := <-adder:
+						ep.accumulated = append(ep.accumulated, evt)
+					default:
+						break drain
 					}
-					accumulated = accumulated[:0]
-					timeout = time.After(1 * time.Second)
 				}
+				if len(ep.accumulated) > 0 {
+					err := ep.flush()
+					if err != nil {
+						ep.logger.Errorf("error when adding events during shutdown, numEvents=%v will be lost: %v", len(ep.accumulated), err)
+					}
+				}
+				close(ep.done)
+				return
 			}
 		}
 	}()
 
-	return &batchedRepositoryPublisher{
-		cfg:  cfg,
-		repo: repo,
+	return &ep
+}
+
+func (ep *batchedRepositoryPublisher) flush() error {
+	if dropped := atomic.LoadInt64(&ep.dropped); dropped > ep.reportedDropped {
+		ep.logger.Warnf("dropped numEvents=%v since the last flush because the publisher queue was full, queueSize=%v", dropped-ep.reportedDropped, ep.queueSize)
+		ep.reportedDropped = dropped
+	}
+	// The buffer can grow far beyond batchSize while the repository is failing, so it is added batchSize events at a
+	// time. Each batch is removed from the buffer as soon as it has been added, so a later failure only keeps the
+	// events which have not been added yet.
+	added := 0
+	for added < len(ep.accumulated) {
+		end := added + ep.batchSize
+		if end > len(ep.accumulated) {
+			end = len(ep.accumulated)
+		}
+		err := ep.addWithRetries(ep.accumulated[added:end])
+		if err != nil {
+			ep.accumulated = append(ep.accumulated[:0], ep.accumulated[added:]...)
+			return fmt.Errorf("failed to add numEvents=%v after %v retries. Events will be buffered: %w", len(ep.accumulated), ep.maxRetries, err)
+		}
+		added = end
+	}
+	ep.accumulated = ep.accumulated[:0]
+	return nil
+}
+
+// addWithRetries adds batch to the repository, retrying up to maxRetries times with a backoff which doubles after
+// every attempt.
+func (ep *batchedRepositoryPublisher) addWithRetries(batch []Event) error {
+	var err error
+	backoff := ep.retryBackoff
+	for attempt := 0; attempt <= ep.maxRetries; attempt++ {
+		if attempt > 0 {
+			ep.logger.Warnf("retrying adding numEvents=%v after error, attempt=%v/%v, backoff=%v: %v", len(batch), attempt, ep.maxRetries, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var res AddBatchResult
+		if ep.replaceDuplicates {
+			res, err = ep.repo.UpsertBatch(batch)
+		} else {
+			res, err = ep.repo.AddBatch(batch)
+		}
+		if err == nil {
+			if ep.onBatchAdded != nil {
+				ep.onBatchAdded(res)
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+func (ep *batchedRepositoryPublisher) dropExcessEvents() {
+	if len(ep.accumulated) > ep.maxBufferedEvents {
+		ep.logger.Warnf("number of buffered events exceeded maxBufferedEvents=%v, will drop events to keep buffer size down.", ep.maxBufferedEvents)
+		numOver := len(ep.accumulated) - ep.maxBufferedEvents
+		ep.accumulated = ep.accumulated[numOver:]
+	}
+}
+
+func (ep *batchedRepositoryPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	if ep.dropWhenFull {
+		err := ep.tryPublish(evt, timeLayouts)
+		if errors.Is(err, ErrPublisherQueueFull) {
+			atomic.AddInt64(&ep.dropped, 1)
+		}
+		return err
+	}
+	processed, err := ep.process(evt, timeLayouts)
+	if err != nil {
+		return err
+	}
+	ep.sending.RLock()
+	defer ep.sending.RUnlock()
+	select {
+	case <-ep.shutdown:
+		return ErrPublisherShutdown
+	default:
+	}
+	select {
+	case ep.adder <- processed:
+		return nil
+	case <-ep.shutdown:
+		return ErrPublisherShutdown
+	}
+}
+
+func (ep *batchedRepositoryPublisher) TryPublishEvent(evt RawEvent, timeLayouts []string) bool {
+	return ep.tryPublish(evt, timeLayouts) == nil
+}
+
+func (ep *batchedRepositoryPublisher) tryPublish(evt RawEvent, timeLayouts []string) error {
+	processed, err := ep.process(evt, timeLayouts)
+	if err != nil {
+		return err
+	}
+	ep.sending.RLock()
+	defer ep.sending.RUnlock()
+	select {
+	case <-ep.shutdown:
+		return ErrPublisherShutdown
+	default:
+	}
+	select {
+	case ep.adder <- processed:
+		return nil
+	default:
+		return ErrPublisherQueueFull
+	}
+}
+
+func (ep *batchedRepositoryPublisher) DroppedEvents() int64 {
+	return atomic.LoadInt64(&ep.dropped)
+}
 
-		adder: adder,
+// process turns evt into an Event the same way as processEvent.
+// A raw longer than maxRawBytes is truncated, or an error wrapping ErrEventTooLarge is returned if rejectOversized is
+// set. The fields are extracted from the truncated raw, the same way they will be when searching.
+func (ep *batchedRepositoryPublisher) process(evt RawEvent, timeLayouts []string) (Event, error) {
+	truncated := false
+	if ep.maxRawBytes > 0 && len(evt.Raw) > ep.maxRawBytes {
+		if ep.rejectOversized {
+			return Event{}, fmt.Errorf("event from source=%v at offset=%v has numBytes=%v, which is more than maxRawBytes=%v: %w",
+				evt.Source, evt.Offset, len(evt.Raw), ep.maxRawBytes, ErrEventTooLarge)
+		}
+		evt.Raw = truncateRaw(evt.Raw, ep.maxRawBytes)
+		truncated = true
+	}
+	processed, err := processEvent(ep.cfg, evt, timeLayouts)
+	if err != nil {
+		ep.logger.Warnf("failed to parse %v field, will use current time as timestamp: %v", ep.cfg.TimeFieldForSource(evt.Source), err)
 	}
+	if truncated && processed.Fields != nil {
+		processed.Fields[TruncatedField] = "true"
+	}
+	return processed, nil
 }
 
-func (ep *batchedRepositoryPublisher) PublishEvent(evt RawEvent, timeLayout string) {
+// truncateRaw returns the first maxBytes bytes of raw, or fewer if that would cut a UTF-8 encoded character in half.
+func truncateRaw(raw string, maxBytes int) string {
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(raw[end]) {
+		end--
+	}
+	return raw[:end]
+}
+
+// processEvent turns evt into an Event, using the field named by cfg.TimeFieldForSource as the timestamp if it has one.
+// If that field can not be parsed the current time is used as the timestamp, and the error is returned along with the
+// event.
+// If evt.Timestamp is set it is used as the timestamp as is, and the fields are only extracted if they are stored.
+func processEvent(cfg *config.Config, evt RawEvent, timeLayouts []string) (Event, error) {
 	processed := Event{
-		Raw:    evt.Raw,
-		Host:   ep.cfg.HostName,
-		Source: evt.Source,
-		Offset: evt.Offset,
+		Raw:          evt.Raw,
+		Host:         evt.Host,
+		Source:       evt.Source,
+		Offset:       evt.Offset,
+		DuplicateKey: cfg.DuplicateKeyForSource(evt.Source),
+	}
+	if processed.Host == "" {
+		processed.Host = cfg.HostName
 	}
 
-	fields := parser.ExtractFields(strings.ToLower(evt.Raw), ep.cfg.FieldExtractors)
-	if t, ok := fields["_time"]; ok {
-		parsed, err := time.Parse(timeLayout, t)
+	if !evt.Timestamp.IsZero() {
+		processed.Timestamp = evt.Timestamp
+		if cfg.StoreFields {
+			processed.Fields = ExtractFields(cfg, NormalizeCase(cfg, evt.Raw), evt.Source)
+		}
+		return processed, nil
+	}
+
+	fields := ExtractFields(cfg, NormalizeCase(cfg, evt.Raw), evt.Source)
+	if cfg.StoreFields {
+		processed.Fields = fields
+	}
+	processed.Timestamp = time.Now()
+	if t, ok := fields[cfg.TimeFieldForSource(evt.Source)]; ok {
+		parsed, err := parseTime(t, timeLayouts, cfg.TimeZone)
 		if err != nil {
-			log.Printf("failed to parse _time field, will use current time as timestamp: %v\n", err)
-			processed.Timestamp = time.Now()
-		} else {
-			processed.Timestamp = parsed
+			return processed, err
 		}
-	} else {
-		processed.Timestamp = time.Now()
+		processed.Timestamp = parsed
 	}
+	return processed, nil
+}
 
-	ep.adder <- processed
+// parseTime parses t using the first of timeLayouts which matches it.
+// Times without a time zone or offset are assumed to be in loc, or in UTC if loc is nil.
+// Layouts without a year, such as syslog timestamps, are assumed to be from the current year.
+func parseTime(t string, timeLayouts []string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	// Fields are extracted from the lowercased event, so letters like the T and Z in RFC3339 have to be uppercased
+	// again. Names of months and days are matched case insensitively by time.Parse, so they work either way.
+	upper := strings.ToUpper(t)
+	for _, tl := range timeLayouts {
+		parsed, err := time.ParseInLocation(tl, t, loc)
+		if err != nil {
+			parsed, err = time.ParseInLocation(tl, upper, loc)
+		}
+		if err != nil {
+			continue
+		}
+		if parsed.Year() == 0 {
+			parsed = parsed.AddDate(time.Now().Year(), 0, 0)
+		}
+		return parsed, nil
+	}
+	return time.Time{}, fmt.Errorf("'%v' did not match any of timeLayouts=%v", t, timeLayouts)
 }
 
-type repositoryPublisher struct {
-	cfg        *config.Config
-	repository Repository
+func (ep *batchedRepositoryPublisher) Shutdown(ctx context.Context) error {
+	ep.shutdownOnce.Do(func() {
+		close(ep.shutdown)
+	})
+	select {
+	case <-ep.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for publisher to flush events: %w", ctx.Err())
+	}
 }
 
 type debugEventPublisher struct {
 	wrapped EventPublisher
+	logger  logging.Logger
 }
 
-func DebugEventPublisher(wrapped EventPublisher) EventPublisher {
+// DebugEventPublisher creates an EventPublisher which logs every event to logger at LevelDebug before passing it on
+// to wrapped, if wrapped is not nil. If logger is nil the default logger is used.
+func DebugEventPublisher(wrapped EventPublisher, logger logging.Logger) EventPublisher {
 	return &debugEventPublisher{
 		wrapped: wrapped,
+		logger:  logging.OrDefault(logger),
+	}
+}
+
+func (ep *debugEventPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	ep.logger.Debugf("Received event: %v", evt)
+	if ep.wrapped != nil {
+		return ep.wrapped.PublishEvent(evt, timeLayouts)
 	}
+	return nil
 }
 
-func (ep *debugEventPublisher) PublishEvent(evt RawEvent, timeLayout string) {
-	log.Println("Received event:", evt)
+func (ep *debugEventPublisher) Shutdown(ctx context.Context) error {
 	if ep.wrapped != nil {
-		ep.wrapped.PublishEvent(evt, timeLayout)
+		return ep.wrapped.Shutdown(ctx)
 	}
+	return nil
 }
 
 type nopEventPublisher struct {
@@ -124,4 +458,10 @@ func NopEventPublisher() EventPublisher {
 	return &nopEventPublisher{}
 }
 
-func (ep *nopEventPublisher) PublishEvent(_ RawEvent, _ string) {}
+func (ep *nopEventPublisher) PublishEvent(_ RawEvent, _ []string) error {
+	return nil
+}
+
+func (ep *nopEventPublisher) Shutdown(_ context.Context) error {
+	return nil
+}
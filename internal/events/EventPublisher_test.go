@@ -0,0 +1,896 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestBatchedRepositoryPublisher_FlushesWhenBatchSizeIsReached(t *testing.T) {
+	repo := newStubRepo()
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     2,
+			FlushInterval: 1 * time.Hour,
+		},
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+	publisher.PublishEvent(RawEvent{Raw: "event 2", Source: "log.txt", Offset: 8}, []string{"2006/01/02 15:04:05"})
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 2 {
+		t.Fatalf("got unexpected batch size, expected 2 events but got %v", len(batch))
+	}
+}
+
+func TestBatchedRepositoryPublisher_ReplaceDuplicates(t *testing.T) {
+	for _, replaceDuplicates := range []bool{false, true} {
+		repo := newStubRepo()
+		publisher := BatchedRepositoryPublisher(&config.Config{
+			Publisher: &config.PublisherConfig{
+				BatchSize:         1,
+				FlushInterval:     1 * time.Hour,
+				ReplaceDuplicates: replaceDuplicates,
+			},
+		}, repo, nil)
+
+		publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+		repo.waitForBatch(t, 1*time.Second)
+		repo.mu.Lock()
+		upserts := repo.upserts
+		repo.mu.Unlock()
+		if replaceDuplicates && upserts != 1 {
+			t.Fatalf("got unexpected number of upserts with ReplaceDuplicates, expected 1 but got %v", upserts)
+		}
+		if !replaceDuplicates && upserts != 0 {
+			t.Fatalf("got unexpected number of upserts without ReplaceDuplicates, expected 0 but got %v", upserts)
+		}
+	}
+}
+
+func TestBatchedRepositoryPublisher_CallsOnBatchAdded(t *testing.T) {
+	repo := newStubRepo()
+	results := make(chan AddBatchResult, 1)
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     2,
+			FlushInterval: 1 * time.Hour,
+		},
+	}, repo, func(res AddBatchResult) {
+		results <- res
+	})
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+	publisher.PublishEvent(RawEvent{Raw: "event 2", Source: "log.txt", Offset: 8}, []string{"2006/01/02 15:04:05"})
+
+	select {
+	case res := <-results:
+		if len(res.Ids) != 2 {
+			t.Fatalf("got unexpected result, expected 2 ids but got %v", res.Ids)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timed out waiting for onBatchAdded to be called")
+	}
+}
+
+func TestBatchedRepositoryPublisher_UsesFieldExtractorsForSource(t *testing.T) {
+	repo := newStubRepo()
+	cfg := &config.Config{
+		IndexedFiles: []config.IndexedFileConfig{
+			{
+				Filename:        "/var/log/nginx/access.log",
+				TimeLayouts:     []string{"02/Jan/2006:15:04:05 -0700"},
+				FieldExtractors: []*regexp.Regexp{regexp.MustCompile("\\[(?P<_time>[^\\]]+)\\]")},
+			},
+			{
+				Filename:        "/var/log/app/*.log",
+				TimeLayouts:     []string{"2006-01-02 15:04:05.000"},
+				FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^(?P<_time>\\d{4}-\\d\\d-\\d\\d \\d\\d:\\d\\d:\\d\\d\\.\\d{3})")},
+			},
+		},
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^(?P<_time>\\d\\d\\d\\d/\\d\\d/\\d\\d \\d\\d:\\d\\d:\\d\\d)")},
+		Publisher: &config.PublisherConfig{
+			BatchSize:     3,
+			FlushInterval: 1 * time.Hour,
+		},
+	}
+	publisher := BatchedRepositoryPublisher(cfg, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "127.0.0.1 - - [10/Oct/2020:13:55:36 -0700] \"GET / HTTP/1.1\" 200", Source: "/var/log/nginx/access.log", Offset: 0}, cfg.IndexedFiles[0].TimeLayouts)
+	publisher.PublishEvent(RawEvent{Raw: "2020-10-11 08:00:01.250 INFO Started application", Source: "/var/log/app/server.log", Offset: 0}, cfg.IndexedFiles[1].TimeLayouts)
+	publisher.PublishEvent(RawEvent{Raw: "2020/10/12 09:30:00 something happened", Source: "/tmp/other.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 3 {
+		t.Fatalf("got unexpected batch size, expected 3 events but got %v", len(batch))
+	}
+	for i, expected := range []time.Time{
+		time.Date(2020, 10, 10, 20, 55, 36, 0, time.UTC),
+		time.Date(2020, 10, 11, 8, 0, 1, 250000000, time.UTC),
+		time.Date(2020, 10, 12, 9, 30, 0, 0, time.UTC),
+	} {
+		if !batch[i].Timestamp.Equal(expected) {
+			t.Fatalf("got unexpected timestamp for source=%v, expected %v but got %v", batch[i].Source, expected, batch[i].Timestamp)
+		}
+	}
+}
+
+func TestBatchedRepositoryPublisher_StoreFields(t *testing.T) {
+	for _, storeFields := range []bool{false, true} {
+		repo := newStubRepo()
+		cfg := &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+			StoreFields:     storeFields,
+			Publisher: &config.PublisherConfig{
+				BatchSize:     1,
+				FlushInterval: 1 * time.Hour,
+			},
+		}
+		publisher := BatchedRepositoryPublisher(cfg, repo, nil)
+
+		publisher.PublishEvent(RawEvent{Raw: "status=500 user=Alice", Source: "log.txt"}, []string{})
+
+		batch := repo.waitForBatch(t, 1*time.Second)
+		var expected map[string]string
+		if storeFields {
+			expected = map[string]string{"status": "500", "user": "alice"}
+		}
+		if !reflect.DeepEqual(batch[0].Fields, expected) {
+			t.Fatalf("got unexpected fields with storeFields=%v, expected %v but got %v", storeFields, expected, batch[0].Fields)
+		}
+	}
+}
+
+func TestBatchedRepositoryPublisher_MaxRawBytes(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		raw               string
+		reject            bool
+		expectedRaw       string
+		expectedTruncated bool
+		expectedErr       bool
+	}{
+		{"under limit", "123456789", false, "123456789", false, false},
+		{"at limit", "1234567890", false, "1234567890", false, false},
+		{"over limit", "1234567890abc", false, "1234567890", true, false},
+		// The last character is two bytes and would be cut in half at the limit, so it is left out
+		{"over limit multibyte", "123456789åbc", false, "123456789", true, false},
+		{"under limit reject", "123456789", true, "123456789", false, false},
+		{"at limit reject", "1234567890", true, "1234567890", false, false},
+		{"over limit reject", "1234567890abc", true, "", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newStubRepo()
+			publisher := BatchedRepositoryPublisher(&config.Config{
+				StoreFields: true,
+				Publisher: &config.PublisherConfig{
+					BatchSize:       1,
+					FlushInterval:   1 * time.Hour,
+					MaxRawBytes:     10,
+					RejectOversized: tt.reject,
+				},
+			}, repo, nil)
+
+			err := publisher.PublishEvent(RawEvent{Raw: tt.raw, Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+			if tt.expectedErr {
+				if !errors.Is(err, ErrEventTooLarge) {
+					t.Fatalf("got unexpected error, expected ErrEventTooLarge but got %v", err)
+				}
+				select {
+				case batch := <-repo.batches:
+					t.Fatalf("got unexpected batch with numEvents=%v, expected the event to be rejected", len(batch))
+				case <-time.After(100 * time.Millisecond):
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error when publishing: %v", err)
+			}
+			batch := repo.waitForBatch(t, 1*time.Second)
+			if len(batch) != 1 || batch[0].Raw != tt.expectedRaw {
+				t.Fatalf("got unexpected batch, expected one event with raw=%q but got %v", tt.expectedRaw, batch)
+			}
+			if _, truncated := batch[0].Fields[TruncatedField]; truncated != tt.expectedTruncated {
+				t.Fatalf("got unexpected %v field, expected it to be set=%v but got fields=%v", TruncatedField, tt.expectedTruncated, batch[0].Fields)
+			}
+		})
+	}
+}
+
+func TestBatchedRepositoryPublisher_TriesTimeLayoutsInOrder(t *testing.T) {
+	repo := newStubRepo()
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^\\[(?P<_time>[^\\]]+)\\]")},
+		Publisher: &config.PublisherConfig{
+			BatchSize:     4,
+			FlushInterval: 1 * time.Hour,
+		},
+	}, repo, nil)
+	timeLayouts := []string{"2006/01/02 15:04:05", time.RFC3339, "02/Jan/2006:15:04:05 -0700"}
+
+	before := time.Now()
+	publisher.PublishEvent(RawEvent{Raw: "[2020/10/10 13:55:36] first", Source: "log.txt", Offset: 0}, timeLayouts)
+	publisher.PublishEvent(RawEvent{Raw: "[2020-10-11T08:00:01Z] second", Source: "log.txt", Offset: 1}, timeLayouts)
+	publisher.PublishEvent(RawEvent{Raw: "[12/Oct/2020:09:30:00 +0000] third", Source: "log.txt", Offset: 2}, timeLayouts)
+	publisher.PublishEvent(RawEvent{Raw: "[yesterday] fourth", Source: "log.txt", Offset: 3}, timeLayouts)
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 4 {
+		t.Fatalf("got unexpected batch size, expected 4 events but got %v", len(batch))
+	}
+	for i, expected := range []time.Time{
+		time.Date(2020, 10, 10, 13, 55, 36, 0, time.UTC),
+		time.Date(2020, 10, 11, 8, 0, 1, 0, time.UTC),
+		time.Date(2020, 10, 12, 9, 30, 0, 0, time.UTC),
+	} {
+		if !batch[i].Timestamp.Equal(expected) {
+			t.Fatalf("got unexpected timestamp for raw=%v, expected %v but got %v", batch[i].Raw, expected, batch[i].Timestamp)
+		}
+	}
+	if batch[3].Timestamp.Before(before) {
+		t.Fatalf("got unexpected timestamp for raw=%v, expected the current time but got %v", batch[3].Raw, batch[3].Timestamp)
+	}
+}
+
+func TestBatchedRepositoryPublisher_LogsToConfiguredLogger(t *testing.T) {
+	repo := newStubRepo()
+	var logged bytes.Buffer
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^\\[(?P<_time>[^\\]]+)\\]")},
+		Publisher: &config.PublisherConfig{
+			BatchSize:     1,
+			FlushInterval: 1 * time.Hour,
+		},
+		Logger: logging.New(log.New(&logged, "", 0), logging.LevelWarn),
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "[yesterday] something", Source: "log.txt"}, []string{time.RFC3339})
+	repo.waitForBatch(t, 1*time.Second)
+
+	expected := "level=warn failed to parse _time field"
+	if !strings.HasPrefix(logged.String(), expected) {
+		t.Fatalf("got unexpected log output, expected it to start with %q but got %q", expected, logged.String())
+	}
+}
+
+func TestDebugEventPublisher_LogsAtDebug(t *testing.T) {
+	for _, tt := range []struct {
+		minLevel logging.Level
+		expected string
+	}{
+		{logging.LevelDebug, "level=debug Received event: {event 1 "},
+		{logging.LevelInfo, ""},
+	} {
+		var logged bytes.Buffer
+		publisher := DebugEventPublisher(nil, logging.New(log.New(&logged, "", 0), tt.minLevel))
+		err := publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt"}, []string{time.RFC3339})
+		if err != nil {
+			t.Fatalf("got unexpected error when publishing: %v", err)
+		}
+		if !strings.HasPrefix(logged.String(), tt.expected) || (tt.expected == "" && logged.Len() > 0) {
+			t.Fatalf("got unexpected log output for minLevel=%v, expected it to start with %q but got %q", tt.minLevel, tt.expected, logged.String())
+		}
+	}
+}
+
+func TestBatchedRepositoryPublisher_UsesProvidedTimestamp(t *testing.T) {
+	for _, storeFields := range []bool{false, true} {
+		repo := newStubRepo()
+		publisher := BatchedRepositoryPublisher(&config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^\\[(?P<_time>[^\\]]+)\\]"), regexp.MustCompile("(\\w+)=(\\w+)")},
+			StoreFields:     storeFields,
+			Publisher: &config.PublisherConfig{
+				BatchSize:     2,
+				FlushInterval: 1 * time.Hour,
+			},
+		}, repo, nil)
+		timeLayouts := []string{"2006/01/02 15:04:05"}
+		provided := time.Date(2021, 3, 4, 5, 6, 7, 8, time.FixedZone("CET", 60*60))
+
+		publisher.PublishEvent(RawEvent{Raw: "[2020/10/10 13:55:36] status=500", Source: "log.txt", Offset: 0, Timestamp: provided}, timeLayouts)
+		publisher.PublishEvent(RawEvent{Raw: "[yesterday] status=200", Source: "log.txt", Offset: 1, Timestamp: provided}, timeLayouts)
+
+		batch := repo.waitForBatch(t, 1*time.Second)
+		if len(batch) != 2 {
+			t.Fatalf("got unexpected batch size, expected 2 events but got %v", len(batch))
+		}
+		for _, evt := range batch {
+			if evt.Timestamp != provided {
+				t.Fatalf("got unexpected timestamp for raw=%v with storeFields=%v, expected %v but got %v", evt.Raw, storeFields, provided, evt.Timestamp)
+			}
+			if !storeFields && evt.Fields != nil {
+				t.Fatalf("got unexpected fields for raw=%v, expected no fields to be extracted but got %v", evt.Raw, evt.Fields)
+			}
+			if storeFields && evt.Fields["status"] == "" {
+				t.Fatalf("got unexpected fields for raw=%v, expected the status field to be stored but got %v", evt.Raw, evt.Fields)
+			}
+		}
+	}
+}
+
+func TestProcessEvent_ProvidedTimestampSkipsTimeExtraction(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^\\[(?P<_time>[^\\]]+)\\]")},
+	}
+	provided := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	// The _time field can not be parsed, which would be an error if it was extracted
+	processed, err := processEvent(cfg, RawEvent{Raw: "[yesterday] something", Source: "log.txt", Timestamp: provided}, []string{time.RFC3339})
+	if err != nil {
+		t.Fatalf("got unexpected error, expected _time not to be parsed but got %v", err)
+	}
+	if processed.Timestamp != provided {
+		t.Fatalf("got unexpected timestamp, expected %v but got %v", provided, processed.Timestamp)
+	}
+
+	_, err = processEvent(cfg, RawEvent{Raw: "[yesterday] something", Source: "log.txt"}, []string{time.RFC3339})
+	if err == nil {
+		t.Fatalf("got no error without a provided timestamp, expected the unparseable _time field to be an error")
+	}
+}
+
+func TestProcessEvent_ConfiguredTimeField(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^ts=(?P<ts>\\S+)")},
+		TimeField:       "ts",
+		IndexedFiles: []config.IndexedFileConfig{
+			{Filename: "other-*.log", TimeField: "when"},
+		},
+	}
+	layouts := []string{"2006-01-02", time.RFC3339}
+	expected := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	processed, err := processEvent(cfg, RawEvent{Raw: "ts=2021-03-04T05:06:07Z user logged in", Source: "app.log"}, layouts)
+	if err != nil {
+		t.Fatalf("got unexpected error when processing event: %v", err)
+	}
+	if !processed.Timestamp.Equal(expected) {
+		t.Fatalf("got unexpected timestamp, expected %v from the ts field but got %v", expected, processed.Timestamp)
+	}
+
+	// The file overrides the time field, so ts is just another field for its events
+	before := time.Now()
+	processed, err = processEvent(cfg, RawEvent{Raw: "ts=2021-03-04T05:06:07Z user logged in", Source: "other-1.log"}, layouts)
+	if err != nil {
+		t.Fatalf("got unexpected error when processing event from other-1.log: %v", err)
+	}
+	if processed.Timestamp.Before(before) {
+		t.Fatalf("got unexpected timestamp for event from other-1.log, expected the current time but got %v", processed.Timestamp)
+	}
+}
+
+func TestParseTime_TimeZone(t *testing.T) {
+	newYork := time.FixedZone("EST", -5*60*60)
+	for _, tt := range []struct {
+		name     string
+		t        string
+		layout   string
+		loc      *time.Location
+		expected time.Time
+	}{
+		{"no time zone", "2021/01/20 20:29:00", "2006/01/02 15:04:05", nil, time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{"configured time zone", "2021/01/20 20:29:00", "2006/01/02 15:04:05", newYork, time.Date(2021, 1, 21, 1, 29, 0, 0, time.UTC)},
+		{"explicit offset", "2021-01-20t20:29:00+01:00", time.RFC3339, newYork, time.Date(2021, 1, 20, 19, 29, 0, 0, time.UTC)},
+		{"explicit utc", "2021-01-20t20:29:00z", time.RFC3339, newYork, time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := parseTime(tt.t, []string{tt.layout}, tt.loc)
+			if err != nil {
+				t.Fatalf("got unexpected error: %v", err)
+			}
+			if !parsed.Equal(tt.expected) {
+				t.Fatalf("got unexpected time, expected %v but got %v", tt.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestParseTime_AssumesCurrentYear(t *testing.T) {
+	parsed, err := parseTime("Oct 12 09:30:00", []string{time.Stamp}, nil)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if parsed.Year() != time.Now().Year() || parsed.Month() != time.October || parsed.Day() != 12 {
+		t.Fatalf("got unexpected time, expected Oct 12 of the current year but got %v", parsed)
+	}
+}
+
+func TestBatchedRepositoryPublisher_FlushesOnTimer(t *testing.T) {
+	repo := newStubRepo()
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     100,
+			FlushInterval: 10 * time.Millisecond,
+		},
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 1 {
+		t.Fatalf("got unexpected batch size, expected 1 event but got %v", len(batch))
+	}
+}
+
+func TestBatchedRepositoryPublisher_RetriesFailedBatch(t *testing.T) {
+	repo := newStubRepo()
+	repo.failuresLeft = 2
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:         2,
+			FlushInterval:     1 * time.Hour,
+			MaxRetries:        intPtr(3),
+			RetryBackoff:      1 * time.Millisecond,
+			MaxBufferedEvents: 100,
+		},
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+	publisher.PublishEvent(RawEvent{Raw: "event 2", Source: "log.txt", Offset: 8}, []string{"2006/01/02 15:04:05"})
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 2 {
+		t.Fatalf("got unexpected batch size, expected 2 events but got %v", len(batch))
+	}
+	if attempts := repo.getAttempts(); attempts != 3 {
+		t.Fatalf("got unexpected number of attempts, expected 3 but got %v", attempts)
+	}
+}
+
+func TestBatchedRepositoryPublisher_PartialConfigKeepsDefaultRetries(t *testing.T) {
+	repo := newStubRepo()
+	repo.failuresLeft = 2
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     2,
+			FlushInterval: 1 * time.Hour,
+			RetryBackoff:  1 * time.Millisecond,
+		},
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+	publisher.PublishEvent(RawEvent{Raw: "event 2", Source: "log.txt", Offset: 8}, []string{"2006/01/02 15:04:05"})
+
+	repo.waitForBatch(t, 1*time.Second)
+	if attempts := repo.getAttempts(); attempts != 3 {
+		t.Fatalf("got unexpected number of attempts, expected 3 but got %v", attempts)
+	}
+}
+
+func TestBatchedRepositoryPublisher_BuffersBatchWhenRetriesAreExhausted(t *testing.T) {
+	repo := newStubRepo()
+	repo.failuresLeft = 3
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:         100,
+			FlushInterval:     10 * time.Millisecond,
+			MaxRetries:        intPtr(2),
+			RetryBackoff:      1 * time.Millisecond,
+			MaxBufferedEvents: 100,
+		},
+	}, repo, nil)
+
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 1 {
+		t.Fatalf("got unexpected batch size, expected 1 event but got %v", len(batch))
+	}
+	if batch[0].Raw != "event 1" {
+		t.Fatalf("got unexpected event, expected the buffered event but got raw='%v'", batch[0].Raw)
+	}
+	if attempts := repo.getAttempts(); attempts != 4 {
+		t.Fatalf("got unexpected number of attempts, expected 4 but got %v", attempts)
+	}
+}
+
+func TestBatchedRepositoryPublisher_AddsBufferInBatches(t *testing.T) {
+	repo := newStubRepo()
+	repo.failuresLeft = 1
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     2,
+			FlushInterval: 1 * time.Hour,
+			MaxRetries:    intPtr(0),
+		},
+	}, repo, nil)
+
+	// The first batch fails, so the rest of the events are buffered along with it until the publisher is shut down
+	for i := 0; i < 5; i++ {
+		publisher.PublishEvent(RawEvent{Raw: "event", Source: "log.txt", Offset: int64(i)}, []string{"2006/01/02 15:04:05"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err := publisher.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down publisher: %v", err)
+	}
+
+	for _, expected := range []int{2, 2, 1} {
+		batch := repo.waitForBatch(t, 1*time.Second)
+		if len(batch) != expected {
+			t.Fatalf("got unexpected batch size, expected %v events but got %v", expected, len(batch))
+		}
+	}
+}
+
+// failingRepository fails the first failuresLeft calls to AddBatch, and passes the rest on to the wrapped Repository.
+type failingRepository struct {
+	Repository
+	mu           sync.Mutex
+	failuresLeft int
+}
+
+func (repo *failingRepository) AddBatch(events []Event) (AddBatchResult, error) {
+	repo.mu.Lock()
+	if repo.failuresLeft > 0 {
+		repo.failuresLeft--
+		repo.mu.Unlock()
+		return AddBatchResult{}, errors.New("database is locked")
+	}
+	repo.mu.Unlock()
+	return repo.Repository.AddBatch(events)
+}
+
+func (repo *failingRepository) getFailuresLeft() int {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.failuresLeft
+}
+
+func TestBatchedRepositoryPublisher_RetriesLargeBufferWithTrueBatch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// Every connection to :memory: gets its own database
+	db.SetMaxOpenConns(1)
+	sqliteRepo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	repo := &failingRepository{Repository: sqliteRepo, failuresLeft: 1}
+	// The batch size is above the number of events which fit in one INSERT with SQLite's limit on the number of
+	// parameters, and the failed batch is retried along with the events published after it.
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     7000,
+			FlushInterval: 1 * time.Hour,
+			MaxRetries:    intPtr(0),
+		},
+	}, repo, nil)
+
+	numEvents := 7500
+	for i := 0; i < numEvents; i++ {
+		err := publisher.PublishEvent(RawEvent{Raw: "event", Source: "log.txt", Offset: int64(i)}, []string{"2006/01/02 15:04:05"})
+		if err != nil {
+			t.Fatalf("got unexpected error when publishing event: %v", err)
+		}
+	}
+	// The failed batch has to be buffered before shutting down, or the publisher could skip it and add all of the
+	// events at once when it is shut down
+	deadline := time.Now().Add(10 * time.Second)
+	for repo.getFailuresLeft() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the first batch to fail")
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = publisher.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down publisher: %v", err)
+	}
+
+	for _, table := range []string{"Events", "EventContents"} {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			t.Fatalf("got unexpected error when counting events in %v: %v", table, err)
+		}
+		if count != numEvents {
+			t.Fatalf("got unexpected number of events in %v, expected %v but got %v", table, numEvents, count)
+		}
+	}
+}
+
+func TestBatchedRepositoryPublisher_FlushesOnShutdown(t *testing.T) {
+	repo := newStubRepo()
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     100,
+			FlushInterval: 1 * time.Hour,
+		},
+	}, repo, nil)
+
+	for i := 0; i < 3; i++ {
+		publisher.PublishEvent(RawEvent{Raw: "event", Source: "log.txt", Offset: int64(i)}, []string{"2006/01/02 15:04:05"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err := publisher.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down publisher: %v", err)
+	}
+
+	batch := repo.waitForBatch(t, 1*time.Second)
+	if len(batch) != 3 {
+		t.Fatalf("got unexpected batch size, expected 3 events but got %v", len(batch))
+	}
+
+	err = publisher.PublishEvent(RawEvent{Raw: "event after shutdown", Source: "log.txt", Offset: 3}, []string{"2006/01/02 15:04:05"})
+	if !errors.Is(err, ErrPublisherShutdown) {
+		t.Fatalf("got unexpected error when publishing after shutdown, expected %v but got %v", ErrPublisherShutdown, err)
+	}
+	select {
+	case batch := <-repo.batches:
+		t.Fatalf("got unexpected batch after shutdown with numEvents=%v", len(batch))
+	default:
+	}
+}
+
+func TestBatchedRepositoryPublisher_PublishDuringShutdown(t *testing.T) {
+	// An event is only lost if it is sent at just the wrong moment, so the shutdown is repeated many times
+	for i := 0; i < 500; i++ {
+		repo := newStubRepo()
+		publisher := BatchedRepositoryPublisher(&config.Config{
+			Publisher: &config.PublisherConfig{
+				BatchSize:     50,
+				FlushInterval: 1 * time.Hour,
+				// A small queue keeps the publishers waiting to send, so some are still sending when shutting down
+				QueueSize: 1,
+			},
+		}, repo, nil)
+
+		// Every event which PublishEvent accepts must be added, even if it is published while shutting down
+		var accepted int64
+		var wg sync.WaitGroup
+		for p := 0; p < 8; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					err := publisher.PublishEvent(RawEvent{Raw: "event", Source: "log.txt", Offset: int64(p*100 + j)}, []string{"2006/01/02 15:04:05"})
+					if err == nil {
+						atomic.AddInt64(&accepted, 1)
+					} else if !errors.Is(err, ErrPublisherShutdown) {
+						t.Errorf("got unexpected error when publishing, expected nil or %v but got %v", ErrPublisherShutdown, err)
+					}
+				}
+			}(p)
+		}
+		time.Sleep(time.Duration(i%5) * 100 * time.Microsecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := publisher.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("got unexpected error when shutting down publisher: %v", err)
+		}
+		wg.Wait()
+
+		added := 0
+		for len(repo.batches) > 0 {
+			added += len(<-repo.batches)
+		}
+		if int64(added) != atomic.LoadInt64(&accepted) {
+			t.Fatalf("got unexpected number of added events, expected the numAccepted=%v events but got %v", accepted, added)
+		}
+	}
+}
+
+func newBlockedPublisher(t *testing.T, dropWhenFull bool) (NonBlockingEventPublisher, *stubRepo) {
+	repo := newStubRepo()
+	repo.blocked = make(chan struct{})
+	publisher := BatchedRepositoryPublisher(&config.Config{
+		Publisher: &config.PublisherConfig{
+			BatchSize:     1,
+			FlushInterval: 1 * time.Hour,
+			QueueSize:     1,
+			DropWhenFull:  dropWhenFull,
+		},
+	}, repo, nil).(NonBlockingEventPublisher)
+
+	// The first event is taken from the queue and is stuck in AddBatch, the second one fills the queue
+	publisher.PublishEvent(RawEvent{Raw: "event 1", Source: "log.txt", Offset: 0}, []string{"2006/01/02 15:04:05"})
+	for repo.getAttempts() == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	if !publisher.TryPublishEvent(RawEvent{Raw: "event 2", Source: "log.txt", Offset: 1}, []string{"2006/01/02 15:04:05"}) {
+		t.Fatal("expected TryPublishEvent to accept the event while the queue has room")
+	}
+	return publisher, repo
+}
+
+func TestBatchedRepositoryPublisher_TryPublishEventWhenFull(t *testing.T) {
+	publisher, repo := newBlockedPublisher(t, false)
+	defer close(repo.blocked)
+
+	if publisher.TryPublishEvent(RawEvent{Raw: "event 3", Source: "log.txt", Offset: 2}, []string{"2006/01/02 15:04:05"}) {
+		t.Fatal("expected TryPublishEvent to reject the event when the queue is full")
+	}
+}
+
+func TestBatchedRepositoryPublisher_BlocksWhenFull(t *testing.T) {
+	publisher, repo := newBlockedPublisher(t, false)
+
+	published := make(chan struct{})
+	go func() {
+		publisher.PublishEvent(RawEvent{Raw: "event 3", Source: "log.txt", Offset: 2}, []string{"2006/01/02 15:04:05"})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("expected PublishEvent to wait while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(repo.blocked)
+	select {
+	case <-published:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for PublishEvent to return after the repository was unblocked")
+	}
+	for i := 0; i < 3; i++ {
+		repo.waitForBatch(t, 1*time.Second)
+	}
+	if publisher.DroppedEvents() != 0 {
+		t.Fatalf("got unexpected number of dropped events, expected 0 but got %v", publisher.DroppedEvents())
+	}
+}
+
+func TestBatchedRepositoryPublisher_DropsWhenFull(t *testing.T) {
+	publisher, repo := newBlockedPublisher(t, true)
+
+	for i, raw := range []string{"event 3", "event 4"} {
+		err := publisher.PublishEvent(RawEvent{Raw: raw, Source: "log.txt", Offset: int64(i + 2)}, []string{"2006/01/02 15:04:05"})
+		if !errors.Is(err, ErrPublisherQueueFull) {
+			t.Fatalf("got unexpected error when publishing to a full queue, expected %v but got %v", ErrPublisherQueueFull, err)
+		}
+	}
+	if publisher.DroppedEvents() != 2 {
+		t.Fatalf("got unexpected number of dropped events, expected 2 but got %v", publisher.DroppedEvents())
+	}
+
+	close(repo.blocked)
+	for _, expected := range []string{"event 1", "event 2"} {
+		batch := repo.waitForBatch(t, 1*time.Second)
+		if len(batch) != 1 || batch[0].Raw != expected {
+			t.Fatalf("got unexpected batch, expected only '%v' but got %v", expected, batch)
+		}
+	}
+}
+
+type stubRepo struct {
+	mu           sync.Mutex
+	failuresLeft int
+	attempts     int
+	// If blocked is not nil, AddBatch waits until it is closed
+	blocked chan struct{}
+	upserts int
+
+	batches chan []Event
+}
+
+func newStubRepo() *stubRepo {
+	return &stubRepo{
+		batches: make(chan []Event, 100),
+	}
+}
+
+func (repo *stubRepo) AddBatch(events []Event) (AddBatchResult, error) {
+	repo.mu.Lock()
+	repo.attempts++
+	repo.mu.Unlock()
+	if repo.blocked != nil {
+		<-repo.blocked
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if repo.failuresLeft > 0 {
+		repo.failuresLeft--
+		return AddBatchResult{}, errors.New("database is locked")
+	}
+	// The publisher reuses its accumulator, so the batch must be copied before it is handed to the test
+	copied := make([]Event, len(events))
+	copy(copied, events)
+	repo.batches <- copied
+	ids := make([]int64, len(events))
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	return AddBatchResult{Ids: ids, Duplicates: map[string]int64{}}, nil
+}
+
+func (repo *stubRepo) UpsertBatch(events []Event) (AddBatchResult, error) {
+	repo.mu.Lock()
+	repo.upserts++
+	repo.mu.Unlock()
+	return repo.AddBatch(events)
+}
+
+func (repo *stubRepo) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	ret := make(chan FilterStreamPage)
+	close(ret)
+	return ret
+}
+
+func (repo *stubRepo) LatestOffset(host, source string) (int64, bool, error) {
+	return 0, false, nil
+}
+
+func (repo *stubRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (repo *stubRepo) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (repo *stubRepo) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	return []EventWithId{}, nil
+}
+
+func (repo *stubRepo) GetById(id int64) (*EventWithId, error) {
+	return nil, ErrEventNotFound
+}
+
+func (repo *stubRepo) DeleteOlderThan(t time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (repo *stubRepo) TimeRange() (min, max time.Time, err error) {
+	return time.Time{}, time.Time{}, nil
+}
+
+func (repo *stubRepo) Sources() ([]string, error) {
+	return []string{}, nil
+}
+
+func (repo *stubRepo) getAttempts() int {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.attempts
+}
+
+func (repo *stubRepo) waitForBatch(t *testing.T, timeout time.Duration) []Event {
+	select {
+	case batch := <-repo.batches:
+		return batch
+	case <-time.After(timeout):
+		t.Fatalf("timed out after %v waiting for batch to be added", timeout)
+		return nil
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -15,30 +15,53 @@
 package events
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
-	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
-	"github.com/jackbister/logsuck/internal/parser"
 )
 
+// receiveEventsPath is where the recipient accepts events from forwarders.
+const receiveEventsPath = "/v1/receiveEvents"
+
+// receiveEventsRequest is the body a forwarder POSTs to receiveEventsPath. It is gzipped if the request has the header
+// Content-Encoding: gzip.
+type receiveEventsRequest struct {
+	Events []RawEvent
+}
+
 type EventRecipient struct {
-	cfg  *config.Config
-	repo Repository
+	cfg       *config.Config
+	publisher EventPublisher
 }
 
-func NewEventRecipient(cfg *config.Config, repo Repository) *EventRecipient {
-	return &EventRecipient{cfg: cfg, repo: repo}
+// NewEventRecipient creates an EventRecipient which publishes the events it receives from forwarders to publisher.
+func NewEventRecipient(cfg *config.Config, publisher EventPublisher) *EventRecipient {
+	return &EventRecipient{cfg: cfg, publisher: publisher}
 }
 
 func (er *EventRecipient) Serve() error {
 	mux := http.NewServeMux()
+	mux.Handle(receiveEventsPath, er.Handler())
 
-	mux.HandleFunc("/v1/receiveEvents", func(w http.ResponseWriter, r *http.Request) {
+	s := &http.Server{
+		Addr:    er.cfg.Recipient.Address,
+		Handler: mux,
+	}
+
+	log.Printf("Starting EventRecipient on address='%v'\n", er.cfg.Recipient.Address)
+	return s.ListenAndServe()
+}
+
+// Handler returns the http.Handler which decodes a batch of events sent by a forwarder and publishes them.
+// A gzipped batch is decompressed while it is being decoded, so the uncompressed batch is never held in memory.
+// The time layouts configured for the recipient are used to parse the timestamps of the events.
+func (er *EventRecipient) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Body == nil {
 			http.Error(w, "no body: body must be a JSON encoded object", 400)
 			return
@@ -48,58 +71,49 @@ func (er *EventRecipient) Serve() error {
 			http.Error(w, "unsupported method: must be POST", 405)
 			return
 		}
+		var body io.Reader = r.Body
+		switch r.Header.Get("Content-Encoding") {
+		case "", "identity":
+		case "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to decompress body: %v", err), 400)
+				return
+			}
+			defer zr.Close()
+			body = zr
+		default:
+			http.Error(w, fmt.Sprintf("unsupported Content-Encoding: %v", r.Header.Get("Content-Encoding")), 415)
+			return
+		}
 		var req receiveEventsRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
+		err := json.NewDecoder(body).Decode(&req)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to decode JSON: %v", err), 500)
+			http.Error(w, fmt.Sprintf("failed to decode JSON: %v", err), 400)
 			return
 		}
-		processed := make([]Event, len(req.Events))
-		for i, evt := range req.Events {
-			processed[i] = Event{
-				Raw:    evt.Raw,
-				Host:   evt.Host,
-				Source: evt.Source,
-				Offset: evt.Offset,
-			}
-
-			var timeLayout string
-			if tl, ok := er.cfg.Recipient.TimeLayouts[evt.Source]; ok {
-				timeLayout = tl
-			} else {
-				timeLayout = er.cfg.Recipient.TimeLayouts["DEFAULT"]
-			}
-
-			fields := parser.ExtractFields(strings.ToLower(evt.Raw), er.cfg.FieldExtractors)
-			if t, ok := fields["_time"]; ok {
-				parsed, err := time.Parse(timeLayout, t)
-				if err != nil {
-					log.Printf("failed to parse _time field, will use current time as timestamp: %v\n", err)
-					processed[i].Timestamp = time.Now()
-				} else {
-					processed[i].Timestamp = parsed
+		numFailed := 0
+		var firstErr error
+		for _, evt := range req.Events {
+			err := er.publisher.PublishEvent(evt, er.timeLayouts(evt.Source))
+			if err != nil {
+				numFailed++
+				if firstErr == nil {
+					firstErr = err
 				}
-			} else {
-				log.Println("no _time field extracted, will use current time as timestamp")
-				processed[i].Timestamp = time.Now()
 			}
 		}
-		err = er.repo.AddBatch(processed)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to add events to repository: %v", err), 500)
+		if firstErr != nil {
+			// The forwarder will send the whole batch again, the events which were published are skipped as duplicates
+			http.Error(w, fmt.Sprintf("failed to publish numEvents=%v of %v: %v", numFailed, len(req.Events), firstErr), 503)
 			return
 		}
 	})
-
-	s := &http.Server{
-		Addr:    er.cfg.Recipient.Address,
-		Handler: mux,
-	}
-
-	log.Printf("Starting EventRecipient on address='%v'\n", er.cfg.Recipient.Address)
-	return s.ListenAndServe()
 }
 
-type receiveEventsRequest struct {
-	Events []RawEvent
+func (er *EventRecipient) timeLayouts(source string) []string {
+	if tl, ok := er.cfg.Recipient.TimeLayouts[source]; ok {
+		return []string{tl}
+	}
+	return []string{er.cfg.Recipient.TimeLayouts["DEFAULT"]}
 }
@@ -15,8 +15,17 @@
 package events
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/search"
 )
 
@@ -27,8 +36,304 @@ const (
 	SortModeTimestampDesc SortMode = 1
 )
 
+// ErrEventNotFound is returned by GetById when there is no event with the id.
+var ErrEventNotFound = errors.New("event not found")
+
+// ErrInvalidSearch is wrapped by the errors from FilterStream and Count when the search could not be turned into a
+// valid query, such as a full text search expression the database rejects as malformed. It is the search that has to
+// be changed, unlike other errors which mean that something is wrong with the repository.
+var ErrInvalidSearch = errors.New("invalid search")
+
+// DuplicateId is the id in AddBatchResult.Ids of an event which was skipped because it was a duplicate.
+const DuplicateId int64 = -1
+
+// AddBatchResult describes what happened to the events passed to Repository.AddBatch.
+type AddBatchResult struct {
+	// Ids contains the id of each event in the batch at the same index as the event, or DuplicateId if the event was
+	// skipped. The id of an event which replaced the raw of an existing event is the id of the existing event.
+	Ids []int64
+	// Duplicates contains the number of events per source that were skipped because an event with the same
+	// host, source, timestamp and offset already existed.
+	Duplicates map[string]int64
+	// Replaced contains the number of events per source that replaced the raw of an existing event with the same
+	// host, source, timestamp and offset. It is only set by Repository.UpsertBatch.
+	Replaced map[string]int64
+}
+
+// NumDuplicates returns the total number of events that were skipped as duplicates.
+func (res AddBatchResult) NumDuplicates() int64 {
+	var n int64
+	for _, v := range res.Duplicates {
+		n += v
+	}
+	return n
+}
+
+// NumReplaced returns the total number of events that replaced the raw of an existing event.
+func (res AddBatchResult) NumReplaced() int64 {
+	var n int64
+	for _, v := range res.Replaced {
+		n += v
+	}
+	return n
+}
+
+// NumAdded returns the number of events that were added, not counting the ones which replaced an existing event.
+func (res AddBatchResult) NumAdded() int {
+	n := 0
+	for _, id := range res.Ids {
+		if id != DuplicateId {
+			n++
+		}
+	}
+	return n - int(res.NumReplaced())
+}
+
+// contentHash returns the hash of the raw of evt which, together with its host and source, identifies the events it is
+// a duplicate of if it uses config.DuplicateKeyContent. It is NULL for events which use config.DuplicateKeyOffset,
+// so the SQL repositories can have a unique index for each kind of key.
+func contentHash(evt Event) sql.NullString {
+	if evt.DuplicateKey != config.DuplicateKeyContent {
+		return sql.NullString{}
+	}
+	sum := sha256.Sum256([]byte(evt.Raw))
+	return sql.NullString{String: hex.EncodeToString(sum[:]), Valid: true}
+}
+
+// FilterStreamPage is a page of events sent by Repository.FilterStream.
+type FilterStreamPage struct {
+	Events []EventWithId
+	// Err is set if the search failed, in which case this is the last page and Events is empty. A stream which is
+	// closed without sending a page with Err set was searched to the end, even if it did not send any events. A stream
+	// which is closed because its context was cancelled does not send an error since nobody is reading it anymore.
+	Err error
+}
+
+// sendFilterStreamError sends a page with err to ret unless ctx is cancelled first.
+func sendFilterStreamError(ctx context.Context, ret chan<- FilterStreamPage, err error) {
+	select {
+	case ret <- FilterStreamPage{Err: err}:
+	case <-ctx.Done():
+	}
+}
+
 type Repository interface {
-	AddBatch(events []Event) error
-	FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan []EventWithId
+	// AddBatch adds all events in the batch which are not duplicates of an existing event or an earlier event in
+	// the same batch. The batch is added atomically, so if an error is returned none of the events have been added.
+	AddBatch(events []Event) (AddBatchResult, error)
+	// UpsertBatch is like AddBatch, except that an event which is a duplicate of an existing event or an earlier
+	// event in the same batch replaces the raw and stored fields of that event instead of being skipped.
+	// This is useful when a file is read again and the events in it may have been corrected or completed since.
+	UpsertBatch(events []Event) (AddBatchResult, error)
+	// FilterStream sends the events matching srch between searchStartTime and searchEndTime, ordered by timestamp and
+	// then by id. They are sent newest first unless srch.OldestFirst is set.
+	FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage
+	// Count returns the number of events FilterStream would return for the same arguments.
+	Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error)
 	GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error)
+	// GetById returns the event with the given id, or an error wrapping ErrEventNotFound if there is no such event.
+	GetById(id int64) (*EventWithId, error)
+	// DeleteOlderThan deletes all events with a timestamp before t and returns the number of deleted events.
+	DeleteOlderThan(t time.Time) (int64, error)
+	// TimeRange returns the timestamps of the oldest and newest events, or zero times if there are no events.
+	TimeRange() (min, max time.Time, err error)
+	// Sources returns every source there are events from, in alphabetical order.
+	Sources() ([]string, error)
+	// LatestOffset returns the highest offset of the events from source on host, or false if there are no events
+	// from it. A file watcher can use it to resume reading a file after a restart instead of reading it from the
+	// beginning. The host is needed since events forwarded from other hosts often have the same sources as the local
+	// ones, such as /var/log/syslog.
+	LatestOffset(host, source string) (int64, bool, error)
+	// Ping returns an error if the repository can not be searched, such as when the database can not be reached, is
+	// locked or is missing its tables. It is cheap enough to be used as a health check.
+	Ping(ctx context.Context) error
+}
+
+// IndexRebuilder is a Repository which stores the raws separately from its full text index, so that the index can be
+// rebuilt from them if it has been corrupted.
+type IndexRebuilder interface {
+	Repository
+	// RebuildIndex replaces the full text index with a new one containing every event. Adding and searching events
+	// waits until it is done.
+	RebuildIndex(ctx context.Context) error
+}
+
+// GetByIdsContext is like repo.GetByIds, except that the ids are fetched in chunks and ctx is checked between them, so
+// that fetching thousands of events, such as all the events in an expanded bucket of aggregated results, can be
+// cancelled. If ctx is cancelled the events fetched so far are returned together with ctx.Err(), sorted according to
+// sortMode the same way all of them would have been.
+func GetByIdsContext(ctx context.Context, repo Repository, ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	ret := make([]EventWithId, 0, len(ids))
+	var err error
+	for start := 0; start < len(ids); start += getByIdsChunkSize {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		end := start + getByIdsChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		evts, chunkErr := repo.GetByIds(ids[start:end], SortModeNone)
+		if chunkErr != nil {
+			return nil, fmt.Errorf("error getting events by id: %w", chunkErr)
+		}
+		ret = append(ret, evts...)
+	}
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
+	}
+	return ret, err
+}
+
+// querySources returns the distinct sources in the Events table, which looks the same in all SQL repositories.
+func querySources(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT source FROM Events ORDER BY source;")
+	if err != nil {
+		return nil, fmt.Errorf("error getting sources: %w", err)
+	}
+	defer rows.Close()
+	ret := []string{}
+	for rows.Next() {
+		var source string
+		err = rows.Scan(&source)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning source: %w", err)
+		}
+		ret = append(ret, source)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error iterating over sources: %w", err)
+	}
+	return ret, nil
+}
+
+// pingDB checks that db can be reached and that the Events table can be read, which looks the same in all SQL
+// repositories. Reading a row catches a corrupt or locked database, which PingContext alone does not.
+func pingDB(ctx context.Context, db *sql.DB) error {
+	err := db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("error pinging database: %w", err)
+	}
+	var one int
+	err = db.QueryRowContext(ctx, "SELECT 1 FROM Events LIMIT 1;").Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading from Events table: %w", err)
+	}
+	return nil
+}
+
+// queryLatestOffset returns the highest offset in the Events table using stmt, which selects MAX(offset) for the host
+// and source given as its parameters. Only the placeholders differ between the SQL repositories.
+func queryLatestOffset(db *sql.DB, stmt string, host, source string) (int64, bool, error) {
+	// MAX is NULL when there are no events from the source
+	var offset sql.NullInt64
+	err := db.QueryRow(stmt, host, source).Scan(&offset)
+	if err != nil {
+		return 0, false, fmt.Errorf("error getting latest offset of host=%v, source=%v: %w", host, source, err)
+	}
+	return offset.Int64, offset.Valid, nil
+}
+
+// storedFieldFilter is a field which is compared to one or more values using =, which the repositories can filter on
+// using the fields stored when the events were added.
+type storedFieldFilter struct {
+	key    string
+	values []string
+}
+
+// storedFieldFilters returns the filters on stored fields for srch, sorted by field name so that the same search
+// always gives the same query.
+// The values are lowercased, as are the stored values, since the search step matches them case insensitively unless
+// Config.CaseSensitive is set. Values with wildcards are left out, as is any field which has such a value since
+// any of the values should match. So are host and source, which are filtered on separately.
+// Events which do not have a stored value for a field must not be filtered out, since the field may not have been
+// extracted when they were added and is then extracted when searching instead.
+func storedFieldFilters(srch *search.Search) []storedFieldFilter {
+	ret := make([]storedFieldFilter, 0)
+	for key, values := range srch.Fields {
+		if key == "host" || key == "source" || anyWildcard(values) {
+			continue
+		}
+		lowered := make([]string, len(values))
+		for i, v := range values {
+			lowered[i] = strings.ToLower(v)
+		}
+		ret = append(ret, storedFieldFilter{key: key, values: lowered})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].key < ret[j].key
+	})
+	return ret
+}
+
+func anyWildcard(values []string) bool {
+	for _, v := range values {
+		if strings.Contains(v, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// storedFields returns the fields of evt the way they are stored, with lowercased values.
+func storedFields(evt Event) map[string]string {
+	ret := make(map[string]string, len(evt.Fields))
+	for k, v := range evt.Fields {
+		ret[k] = strings.ToLower(v)
+	}
+	return ret
+}
+
+// addFields stores the fields of evt, which was added with the given id, using stmt which inserts an event_id, key
+// and value into the EventFields table.
+func addFields(stmt *sql.Stmt, id int64, evt Event) error {
+	for k, v := range storedFields(evt) {
+		_, err := stmt.Exec(id, k, v)
+		if err != nil {
+			return fmt.Errorf("error adding field %v: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// isFullTextSearchable returns false if value contains a wildcard which full text search can not express.
+// Full text search only supports a trailing wildcard as a prefix query, so values with wildcards anywhere else have to
+// be matched after the events have been retrieved.
+func isFullTextSearchable(value string) bool {
+	i := strings.Index(value, "*")
+	return i == -1 || (i > 0 && i == len(value)-1)
+}
+
+// fullTextSearchableValues returns the values that are full text searchable, sorted so that a search always gives
+// the same query.
+func fullTextSearchableValues(values map[string]struct{}) []string {
+	ret := make([]string, 0, len(values))
+	for _, v := range sortedKeys(values) {
+		if isFullTextSearchable(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// fullTextSearchableGroup returns the values if all of them are full text searchable, or nil otherwise.
+// This is used for groups of values where any of them should match.
+func fullTextSearchableGroup(values map[string]struct{}) []string {
+	ret := fullTextSearchableValues(values)
+	if len(ret) != len(values) {
+		return nil
+	}
+	return ret
 }
@@ -0,0 +1,350 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// inMemoryEventKey identifies the events which are duplicates of each other. contentHash is only set for events which
+// use config.DuplicateKeyContent, in which case timestamp and offset are not.
+type inMemoryEventKey struct {
+	host        string
+	source      string
+	timestamp   int64
+	offset      int64
+	contentHash string
+}
+
+func keyOf(evt Event) inMemoryEventKey {
+	if hash := contentHash(evt); hash.Valid {
+		return inMemoryEventKey{host: evt.Host, source: evt.Source, contentHash: hash.String}
+	}
+	return inMemoryEventKey{host: evt.Host, source: evt.Source, timestamp: evt.Timestamp.UnixNano(), offset: evt.Offset}
+}
+
+type inMemoryRepository struct {
+	mu     sync.RWMutex
+	events []EventWithId
+	keys   map[inMemoryEventKey]struct{}
+	// offsets contains the offset of each event in events.
+	offsets []int64
+	// eventKeys contains the key of each event in events, which is needed to remove it from keys when it is deleted.
+	eventKeys []inMemoryEventKey
+	// fields contains the stored fields of each event in events.
+	fields []map[string]string
+	lastID int64
+}
+
+// InMemoryRepository creates a Repository which keeps all events in memory.
+// It is intended for tests and small setups where persistence is not needed.
+// Fragments, sources and hosts are matched using case insensitive substring matching instead of full text search.
+func InMemoryRepository() Repository {
+	return &inMemoryRepository{
+		events: make([]EventWithId, 0),
+		keys:   map[inMemoryEventKey]struct{}{},
+	}
+}
+
+func (repo *inMemoryRepository) AddBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, false)
+}
+
+func (repo *inMemoryRepository) UpsertBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, true)
+}
+
+func (repo *inMemoryRepository) addBatch(events []Event, upsert bool) (AddBatchResult, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	ret := AddBatchResult{Ids: make([]int64, len(events)), Duplicates: map[string]int64{}, Replaced: map[string]int64{}}
+	for i, evt := range events {
+		key := keyOf(evt)
+		if _, ok := repo.keys[key]; ok {
+			if upsert {
+				ret.Ids[i] = repo.replace(key, evt)
+				ret.Replaced[evt.Source]++
+				continue
+			}
+			ret.Ids[i] = DuplicateId
+			ret.Duplicates[evt.Source]++
+			continue
+		}
+		repo.keys[key] = struct{}{}
+		repo.lastID++
+		id := repo.lastID
+		repo.offsets = append(repo.offsets, evt.Offset)
+		repo.eventKeys = append(repo.eventKeys, key)
+		repo.fields = append(repo.fields, storedFields(evt))
+		repo.events = append(repo.events, EventWithId{
+			Id:        id,
+			Raw:       evt.Raw,
+			Timestamp: evt.Timestamp,
+			Host:      evt.Host,
+			Source:    evt.Source,
+		})
+		ret.Ids[i] = id
+	}
+	for k, v := range ret.Duplicates {
+		log.Printf("Skipped adding numEvents=%v from source=%v because they appear to be duplicates (same duplicate key as an existing event)\n", v, k)
+	}
+	for k, v := range ret.Replaced {
+		log.Printf("Replaced the raw of numEvents=%v from source=%v which were duplicates (same duplicate key as an existing event)\n", v, k)
+	}
+	return ret, nil
+}
+
+// replace sets the raw and stored fields of the event with the given key to those of evt and returns its id.
+// The events are not indexed by key, since replacing events is rare enough that looking through all of them is fine.
+func (repo *inMemoryRepository) replace(key inMemoryEventKey, evt Event) int64 {
+	for i, existing := range repo.events {
+		if repo.eventKeys[i] == key {
+			repo.events[i].Raw = evt.Raw
+			repo.fields[i] = storedFields(evt)
+			return existing.Id
+		}
+	}
+	return DuplicateId
+}
+
+func (repo *inMemoryRepository) DeleteOlderThan(t time.Time) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	kept := make([]EventWithId, 0, len(repo.events))
+	keptOffsets := make([]int64, 0, len(repo.offsets))
+	keptKeys := make([]inMemoryEventKey, 0, len(repo.eventKeys))
+	keptFields := make([]map[string]string, 0, len(repo.fields))
+	for i, evt := range repo.events {
+		if evt.Timestamp.Before(t) {
+			delete(repo.keys, repo.eventKeys[i])
+			continue
+		}
+		kept = append(kept, evt)
+		keptOffsets = append(keptOffsets, repo.offsets[i])
+		keptKeys = append(keptKeys, repo.eventKeys[i])
+		keptFields = append(keptFields, repo.fields[i])
+	}
+	deleted := int64(len(repo.events) - len(kept))
+	repo.events = kept
+	repo.offsets = keptOffsets
+	repo.eventKeys = keptKeys
+	repo.fields = keptFields
+	return deleted, nil
+}
+
+func (repo *inMemoryRepository) TimeRange() (min, max time.Time, err error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	for i, evt := range repo.events {
+		if i == 0 || evt.Timestamp.Before(min) {
+			min = evt.Timestamp
+		}
+		if i == 0 || evt.Timestamp.After(max) {
+			max = evt.Timestamp
+		}
+	}
+	return min, max, nil
+}
+
+func (repo *inMemoryRepository) Sources() ([]string, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	seen := map[string]struct{}{}
+	ret := []string{}
+	for _, evt := range repo.events {
+		if _, ok := seen[evt.Source]; !ok {
+			seen[evt.Source] = struct{}{}
+			ret = append(ret, evt.Source)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (repo *inMemoryRepository) LatestOffset(host, source string) (int64, bool, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	var max int64
+	found := false
+	for i, evt := range repo.events {
+		if evt.Host == host && evt.Source == source && (!found || repo.offsets[i] > max) {
+			max = repo.offsets[i]
+			found = true
+		}
+	}
+	return max, found, nil
+}
+
+// Ping always succeeds, since there is no database which could be unreachable.
+func (repo *inMemoryRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (repo *inMemoryRepository) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	ret := make(chan FilterStreamPage)
+	go func() {
+		defer close(ret)
+		repo.mu.RLock()
+		matching := make([]EventWithId, 0)
+		filters := storedFieldFilters(srch)
+		for i, evt := range repo.events {
+			if matchesSearch(evt, repo.fields[i], srch, filters, searchStartTime, searchEndTime) {
+				matching = append(matching, evt)
+			}
+		}
+		repo.mu.RUnlock()
+
+		// Same order as the SQL repositories, which order by timestamp and then id
+		sort.Slice(matching, func(i, j int) bool {
+			a, b := matching[i], matching[j]
+			if srch.OldestFirst {
+				a, b = b, a
+			}
+			if a.Timestamp.Equal(b.Timestamp) {
+				return a.Id > b.Id
+			}
+			return a.Timestamp.After(b.Timestamp)
+		})
+		for start := 0; start < len(matching); start += filterStreamPageSize {
+			end := start + filterStreamPageSize
+			if end > len(matching) {
+				end = len(matching)
+			}
+			select {
+			case ret <- FilterStreamPage{Events: matching[start:end]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ret
+}
+
+func (repo *inMemoryRepository) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	var count int64
+	filters := storedFieldFilters(srch)
+	for i, evt := range repo.events {
+		if matchesSearch(evt, repo.fields[i], srch, filters, searchStartTime, searchEndTime) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func matchesSearch(evt EventWithId, fields map[string]string, srch *search.Search, filters []storedFieldFilter, searchStartTime, searchEndTime *time.Time) bool {
+	if searchStartTime != nil && evt.Timestamp.Before(*searchStartTime) {
+		return false
+	}
+	if searchEndTime != nil && evt.Timestamp.After(*searchEndTime) {
+		return false
+	}
+	if !matchesAll(evt.Raw, srch.Fragments) || matchesAny(evt.Raw, srch.NotFragments) {
+		return false
+	}
+	// An event can only have one host and source, so multiple values mean any of them should match
+	if (len(srch.Sources) > 0 && !matchesAny(evt.Source, srch.Sources)) || matchesAny(evt.Source, srch.NotSources) {
+		return false
+	}
+	if (len(srch.Hosts) > 0 && !matchesAny(evt.Host, srch.Hosts)) || matchesAny(evt.Host, srch.NotHosts) {
+		return false
+	}
+	for _, f := range filters {
+		// Only events with another value for the field are excluded, events without a stored value are kept
+		if v, ok := fields[f.key]; ok && !containsString(f.values, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo *inMemoryRepository) GetById(id int64) (*EventWithId, error) {
+	evts, _ := repo.GetByIds([]int64{id}, SortModeNone)
+	if len(evts) == 0 {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	return &evts[0], nil
+}
+
+func (repo *inMemoryRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	ret := make([]EventWithId, 0, len(ids))
+	for _, id := range ids {
+		// events is always sorted by id, but ids can be missing since events may have been deleted
+		i := sort.Search(len(repo.events), func(i int) bool {
+			return repo.events[i].Id >= id
+		})
+		if i == len(repo.events) || repo.events[i].Id != id {
+			continue
+		}
+		ret = append(ret, repo.events[i])
+	}
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
+	}
+	return ret, nil
+}
+
+func matchesAll(s string, values map[string]struct{}) bool {
+	for v := range values {
+		if !containsFragment(s, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(s string, values map[string]struct{}) bool {
+	for v := range values {
+		if containsFragment(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFragment returns true if s contains frag, ignoring case. Any '*' in frag matches any number of characters.
+func containsFragment(s, frag string) bool {
+	s = strings.ToLower(s)
+	for _, part := range strings.Split(strings.ToLower(frag), "*") {
+		idx := strings.Index(s, part)
+		if idx == -1 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+type multiRepository struct {
+	repos []Repository
+}
+
+// MultiRepository creates a Repository which searches all of repos as if they were one, for example when the events
+// are split into one SQLite database per day. New events are added to the first repository, so it should be the one
+// which is currently being written to.
+//
+// The ids of the events are made unique across the repositories by interleaving them: the event with id i in
+// repos[n] gets the id i*len(repos)+n. This means that the ids are only valid for the same repos in the same order.
+func MultiRepository(repos ...Repository) Repository {
+	return &multiRepository{repos: repos}
+}
+
+func (repo *multiRepository) globalID(repoIndex int, id int64) int64 {
+	if id == DuplicateId {
+		return DuplicateId
+	}
+	return id*int64(len(repo.repos)) + int64(repoIndex)
+}
+
+// localID returns the index of the repository the event with the given global id is in and its id in that
+// repository.
+func (repo *multiRepository) localID(id int64) (int, int64) {
+	n := int64(len(repo.repos))
+	return int(id % n), id / n
+}
+
+func (repo *multiRepository) toGlobal(repoIndex int, evts []EventWithId) {
+	for i := range evts {
+		evts[i].Id = repo.globalID(repoIndex, evts[i].Id)
+	}
+}
+
+func (repo *multiRepository) AddBatch(events []Event) (AddBatchResult, error) {
+	res, err := repo.repos[0].AddBatch(events)
+	return repo.toGlobalResult(res), err
+}
+
+func (repo *multiRepository) UpsertBatch(events []Event) (AddBatchResult, error) {
+	res, err := repo.repos[0].UpsertBatch(events)
+	return repo.toGlobalResult(res), err
+}
+
+func (repo *multiRepository) toGlobalResult(res AddBatchResult) AddBatchResult {
+	for i, id := range res.Ids {
+		res.Ids[i] = repo.globalID(0, id)
+	}
+	return res
+}
+
+// FilterStream merges the streams of all repositories so that the events are still ordered by timestamp, newest
+// first or oldest first if srch.OldestFirst is set. Every repository returns its events in that order, so the merge
+// only has to keep the current page of each repository and repeatedly take the next event among them.
+// If any of the repositories fails the whole search fails, since the merged stream would otherwise silently be missing
+// events.
+func (repo *multiRepository) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	ret := make(chan FilterStreamPage)
+	go func() {
+		defer close(ret)
+		// The streams of the other repositories are cancelled when returning early because one of them failed
+		streamCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		cursors := &multiCursorHeap{cursors: make([]*multiCursor, 0, len(repo.repos)), oldestFirst: srch.OldestFirst}
+		for i, r := range repo.repos {
+			c := &multiCursor{repoIndex: i, stream: r.FilterStream(streamCtx, srch, searchStartTime, searchEndTime)}
+			ok, err := repo.advance(c)
+			if err != nil {
+				sendFilterStreamError(ctx, ret, err)
+				return
+			}
+			if ok {
+				cursors.cursors = append(cursors.cursors, c)
+			}
+		}
+		heap.Init(cursors)
+		page := make([]EventWithId, 0, filterStreamPageSize)
+		for cursors.Len() > 0 {
+			c := cursors.cursors[0]
+			page = append(page, c.page[0])
+			c.page = c.page[1:]
+			ok := len(c.page) > 0
+			if !ok {
+				var err error
+				ok, err = repo.advance(c)
+				if err != nil {
+					sendFilterStreamError(ctx, ret, err)
+					return
+				}
+			}
+			if ok {
+				heap.Fix(cursors, 0)
+			} else {
+				heap.Pop(cursors)
+			}
+			if len(page) == filterStreamPageSize {
+				select {
+				case ret <- FilterStreamPage{Events: page}:
+				case <-ctx.Done():
+					return
+				}
+				page = make([]EventWithId, 0, filterStreamPageSize)
+			}
+		}
+		if len(page) > 0 {
+			select {
+			case ret <- FilterStreamPage{Events: page}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return ret
+}
+
+// advance receives the next page of c and returns false if its stream is done, or an error if its search failed.
+func (repo *multiRepository) advance(c *multiCursor) (bool, error) {
+	for page := range c.stream {
+		if page.Err != nil {
+			return false, fmt.Errorf("error searching repository %v: %w", c.repoIndex, page.Err)
+		}
+		if len(page.Events) == 0 {
+			continue
+		}
+		repo.toGlobal(c.repoIndex, page.Events)
+		c.page = page.Events
+		return true, nil
+	}
+	return false, nil
+}
+
+// multiCursor is the current page of the stream of one of the repositories in a multiRepository.
+type multiCursor struct {
+	repoIndex int
+	stream    <-chan FilterStreamPage
+	page      []EventWithId
+}
+
+// multiCursorHeap orders the cursors by their first event, newest first unless oldestFirst is set. Events with the
+// same timestamp are ordered by id, the same way the repositories order them.
+type multiCursorHeap struct {
+	cursors     []*multiCursor
+	oldestFirst bool
+}
+
+func (h *multiCursorHeap) Len() int { return len(h.cursors) }
+
+func (h *multiCursorHeap) Less(i, j int) bool {
+	a, b := h.cursors[i].page[0], h.cursors[j].page[0]
+	if h.oldestFirst {
+		a, b = b, a
+	}
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return a.Id > b.Id
+}
+
+func (h *multiCursorHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *multiCursorHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*multiCursor)) }
+
+func (h *multiCursorHeap) Pop() interface{} {
+	old := h.cursors
+	x := old[len(old)-1]
+	h.cursors = old[:len(old)-1]
+	return x
+}
+
+func (repo *multiRepository) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	var total int64
+	for i, r := range repo.repos {
+		count, err := r.Count(ctx, srch, searchStartTime, searchEndTime)
+		if err != nil {
+			return 0, fmt.Errorf("error counting events in repository %v: %w", i, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+func (repo *multiRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	localIds := make([][]int64, len(repo.repos))
+	for _, id := range ids {
+		if id <= 0 {
+			continue
+		}
+		i, localID := repo.localID(id)
+		localIds[i] = append(localIds[i], localID)
+	}
+	byID := make(map[int64]EventWithId, len(ids))
+	for i, r := range repo.repos {
+		if len(localIds[i]) == 0 {
+			continue
+		}
+		evts, err := r.GetByIds(localIds[i], SortModeNone)
+		if err != nil {
+			return nil, fmt.Errorf("error getting events from repository %v: %w", i, err)
+		}
+		repo.toGlobal(i, evts)
+		for _, evt := range evts {
+			byID[evt.Id] = evt
+		}
+	}
+	// The events are put back in the order of ids, which is the order for SortModeNone
+	ret := make([]EventWithId, 0, len(byID))
+	for _, id := range ids {
+		if evt, ok := byID[id]; ok {
+			ret = append(ret, evt)
+		}
+	}
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
+	}
+	return ret, nil
+}
+
+func (repo *multiRepository) GetById(id int64) (*EventWithId, error) {
+	if id <= 0 {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	i, localID := repo.localID(id)
+	evt, err := repo.repos[i].GetById(localID)
+	if err != nil {
+		return nil, err
+	}
+	evt.Id = id
+	return evt, nil
+}
+
+func (repo *multiRepository) DeleteOlderThan(t time.Time) (int64, error) {
+	var total int64
+	for i, r := range repo.repos {
+		deleted, err := r.DeleteOlderThan(t)
+		total += deleted
+		if err != nil {
+			return total, fmt.Errorf("error deleting events in repository %v: %w", i, err)
+		}
+	}
+	return total, nil
+}
+
+func (repo *multiRepository) TimeRange() (min, max time.Time, err error) {
+	for i, r := range repo.repos {
+		rMin, rMax, err := r.TimeRange()
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("error getting time range of repository %v: %w", i, err)
+		}
+		// A repository without events has zero times, which must not become the minimum
+		if rMin.IsZero() && rMax.IsZero() {
+			continue
+		}
+		if min.IsZero() || rMin.Before(min) {
+			min = rMin
+		}
+		if max.IsZero() || rMax.After(max) {
+			max = rMax
+		}
+	}
+	return min, max, nil
+}
+
+func (repo *multiRepository) LatestOffset(host, source string) (int64, bool, error) {
+	var max int64
+	found := false
+	for i, r := range repo.repos {
+		offset, ok, err := r.LatestOffset(host, source)
+		if err != nil {
+			return 0, false, fmt.Errorf("error getting latest offset of repository %v: %w", i, err)
+		}
+		if ok && (!found || offset > max) {
+			max = offset
+			found = true
+		}
+	}
+	return max, found, nil
+}
+
+func (repo *multiRepository) Sources() ([]string, error) {
+	seen := map[string]struct{}{}
+	ret := []string{}
+	for i, r := range repo.repos {
+		sources, err := r.Sources()
+		if err != nil {
+			return nil, fmt.Errorf("error getting sources of repository %v: %w", i, err)
+		}
+		for _, source := range sources {
+			if _, ok := seen[source]; !ok {
+				seen[source] = struct{}{}
+				ret = append(ret, source)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (repo *multiRepository) Ping(ctx context.Context) error {
+	for i, r := range repo.repos {
+		err := r.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("error pinging repository %v: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// newShards returns numRepos repositories where the timestamps of their events are interleaved, so that the events
+// of a search alternate between the repositories.
+func newShards(t *testing.T, numRepos, eventsPerRepo int) []Repository {
+	base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	repos := make([]Repository, numRepos)
+	for n := range repos {
+		repos[n] = repositoryFactories["inMemory"](t)
+		evts := make([]Event, eventsPerRepo)
+		for i := range evts {
+			evts[i] = Event{
+				Raw:       fmt.Sprintf("event %v from shard %v", i, n),
+				Timestamp: base.Add(time.Duration(i*numRepos+n) * time.Second),
+				Host:      "localhost",
+				Source:    fmt.Sprintf("shard-%v.log", n),
+				Offset:    int64(i),
+			}
+		}
+		_, err := repos[n].AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events to shard %v: %v", n, err)
+		}
+	}
+	return repos
+}
+
+func TestMultiRepository_FilterStreamOrder(t *testing.T) {
+	// More events than fit in one page, so that the merge has to fetch more pages from every shard
+	const eventsPerRepo = filterStreamPageSize + filterStreamPageSize/2
+	repo := MultiRepository(newShards(t, 3, eventsPerRepo)...)
+
+	evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+	if len(evts) != 3*eventsPerRepo {
+		t.Fatalf("got unexpected number of events, expected %v but got %v", 3*eventsPerRepo, len(evts))
+	}
+	seen := map[int64]struct{}{}
+	for i, evt := range evts {
+		if i > 0 && !evt.Timestamp.Before(evts[i-1].Timestamp) {
+			t.Fatalf("got unexpected order at index %v, expected timestamp before %v but got %v", i, evts[i-1].Timestamp, evt.Timestamp)
+		}
+		if _, ok := seen[evt.Id]; ok {
+			t.Fatalf("got unexpected duplicate id=%v at index %v", evt.Id, i)
+		}
+		seen[evt.Id] = struct{}{}
+	}
+	oldestFirst := collectFilterStream(repo, &search.Search{OldestFirst: true}, nil, nil)
+	if len(oldestFirst) != len(evts) {
+		t.Fatalf("got unexpected number of events oldest first, expected %v but got %v", len(evts), len(oldestFirst))
+	}
+	for i, evt := range oldestFirst {
+		if evt.Id != evts[len(evts)-1-i].Id {
+			t.Fatalf("got unexpected event oldest first at index %v, expected id=%v but got %v", i, evts[len(evts)-1-i].Id, evt.Id)
+		}
+	}
+
+	// The filters are passed on to every shard
+	evts = collectFilterStream(repo, &search.Search{Sources: map[string]struct{}{"shard-1.log": {}}}, nil, nil)
+	if len(evts) != eventsPerRepo {
+		t.Fatalf("got unexpected number of events from shard-1.log, expected %v but got %v", eventsPerRepo, len(evts))
+	}
+	count, err := repo.Count(context.Background(), &search.Search{}, nil, nil)
+	if err != nil {
+		t.Fatalf("got error when counting events: %v", err)
+	}
+	if count != 3*eventsPerRepo {
+		t.Fatalf("got unexpected count, expected %v but got %v", 3*eventsPerRepo, count)
+	}
+}
+
+func TestMultiRepository_Ids(t *testing.T) {
+	shards := newShards(t, 3, 5)
+	repo := MultiRepository(shards...)
+
+	evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+	ids := make([]int64, len(evts))
+	for i, evt := range evts {
+		ids[i] = evt.Id
+	}
+	byIds, err := repo.GetByIds(ids, SortModeNone)
+	if err != nil {
+		t.Fatalf("got error when getting events by ids: %v", err)
+	}
+	if len(byIds) != len(evts) {
+		t.Fatalf("got unexpected number of events by ids, expected %v but got %v", len(evts), len(byIds))
+	}
+	for i := range evts {
+		if byIds[i] != evts[i] {
+			t.Fatalf("got unexpected event by id at index %v, expected %v but got %v", i, evts[i], byIds[i])
+		}
+		evt, err := repo.GetById(evts[i].Id)
+		if err != nil {
+			t.Fatalf("got error when getting eventId=%v: %v", evts[i].Id, err)
+		}
+		if *evt != evts[i] {
+			t.Fatalf("got unexpected event for eventId=%v, expected %v but got %v", evts[i].Id, evts[i], *evt)
+		}
+	}
+
+	// New events are added to the first shard and get ids which can be used with the other methods
+	res, err := repo.AddBatch([]Event{{Raw: "new event", Timestamp: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), Host: "localhost", Source: "shard-0.log", Offset: 100}})
+	if err != nil {
+		t.Fatalf("got error when adding event: %v", err)
+	}
+	evt, err := repo.GetById(res.Ids[0])
+	if err != nil {
+		t.Fatalf("got error when getting added event: %v", err)
+	}
+	if evt.Raw != "new event" {
+		t.Fatalf("got unexpected added event, expected raw=%q but got %v", "new event", evt)
+	}
+	if count, _ := shards[0].Count(context.Background(), &search.Search{}, nil, nil); count != 6 {
+		t.Fatalf("got unexpected count in the first shard after adding an event, expected 6 but got %v", count)
+	}
+}
+
+func TestMultiRepository_TimeRangeAndSources(t *testing.T) {
+	shards := newShards(t, 3, 5)
+	repo := MultiRepository(append(shards, InMemoryRepository())...)
+	min, max, err := repo.TimeRange()
+	if err != nil {
+		t.Fatalf("got error when getting time range: %v", err)
+	}
+	base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	if !min.Equal(base) || !max.Equal(base.Add(14*time.Second)) {
+		t.Fatalf("got unexpected time range, expected %v to %v but got %v to %v", base, base.Add(14*time.Second), min, max)
+	}
+	sources, err := repo.Sources()
+	if err != nil {
+		t.Fatalf("got error when getting sources: %v", err)
+	}
+	if len(sources) != 3 || sources[0] != "shard-0.log" || sources[2] != "shard-2.log" {
+		t.Fatalf("got unexpected sources, expected one per shard but got %v", sources)
+	}
+}
+
+// failingRepo is a repository whose searches always fail.
+type failingRepo struct {
+	stubRepo
+}
+
+func (repo *failingRepo) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	ret := make(chan FilterStreamPage)
+	go func() {
+		defer close(ret)
+		sendFilterStreamError(ctx, ret, errors.New("search failed"))
+	}()
+	return ret
+}
+
+func TestMultiRepository_FilterStreamError(t *testing.T) {
+	repos := append(newShards(t, 2, filterStreamPageSize*2), &failingRepo{})
+	repo := MultiRepository(repos...)
+
+	_, err := collectFilterStreamErr(repo, &search.Search{}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "search failed") {
+		t.Fatalf("expected the error of the failing repository but got %v", err)
+	}
+}
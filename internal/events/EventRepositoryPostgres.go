@@ -0,0 +1,537 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+const postgresUniqueViolation = "23505"
+
+type postgresRepository struct {
+	db     *sql.DB
+	logger logging.Logger
+}
+
+// PostgresRepository creates a Repository which stores events in a Postgres database.
+// Full text search is implemented using tsvector columns in place of the FTS4 table used by the SQLite repository.
+// The caller is responsible for registering a Postgres driver with database/sql. If logger is nil the default logger
+// is used.
+func PostgresRepository(db *sql.DB, logger logging.Logger) (Repository, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS Events (id BIGSERIAL NOT NULL PRIMARY KEY, host TEXT NOT NULL, source TEXT NOT NULL, timestamp TIMESTAMPTZ NOT NULL, \"offset\" BIGINT NOT NULL, raw TEXT NOT NULL, raw_tsv TSVECTOR NOT NULL, source_tsv TSVECTOR NOT NULL, host_tsv TSVECTOR NOT NULL, content_hash TEXT);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events table: %w", err)
+	}
+	// Tables created before events could use config.DuplicateKeyContent have no content_hash column, and a UNIQUE
+	// constraint on host, source, timestamp and offset which is replaced by the partial unique index below
+	_, err = db.Exec("ALTER TABLE Events ADD COLUMN IF NOT EXISTS content_hash TEXT;")
+	if err != nil {
+		return nil, fmt.Errorf("error adding content_hash column to events table: %w", err)
+	}
+	// Each kind of duplicate key has its own unique index, which only contains the events using that key
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS UX_Events_Offset ON Events(host, source, timestamp, \"offset\") WHERE content_hash IS NULL;")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events offset index: %w", err)
+	}
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS UX_Events_ContentHash ON Events(host, source, content_hash) WHERE content_hash IS NOT NULL;")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events content hash index: %w", err)
+	}
+	_, err = db.Exec("ALTER TABLE Events DROP CONSTRAINT IF EXISTS events_host_source_timestamp_offset_key;")
+	if err != nil {
+		return nil, fmt.Errorf("error dropping old unique constraint of events table: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_Timestamp ON Events(timestamp);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events timestamp index: %w", err)
+	}
+	// Besides looking up events from one source in a time range, this index covers listing the sources
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_SourceTimestamp ON Events(source, timestamp);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events source index: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_RawTsv ON Events USING GIN(raw_tsv);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events raw_tsv index: %w", err)
+	}
+	// The fields are only looked up for one event at a time, so the primary key is the only index needed
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS EventFields (event_id BIGINT NOT NULL REFERENCES Events(id) ON DELETE CASCADE, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(event_id, key));")
+	if err != nil {
+		return nil, fmt.Errorf("error creating eventfields table: %w", err)
+	}
+	return &postgresRepository{
+		db:     db,
+		logger: logging.OrDefault(logger),
+	}, nil
+}
+
+func (repo *postgresRepository) AddBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, false)
+}
+
+func (repo *postgresRepository) UpsertBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, true)
+}
+
+const postgresAddStmt = "INSERT INTO Events (host, source, timestamp, \"offset\", raw, raw_tsv, source_tsv, host_tsv, content_hash) VALUES ($1, $2, $3, $4, $5, to_tsvector('simple', $6), to_tsvector('simple', $7), to_tsvector('simple', $8), $9)"
+
+// postgresUpsertStmt replaces the raw of a duplicate instead of failing. xmax is only zero for rows which were
+// inserted, so it tells whether the event replaced an existing one.
+const postgresUpsertStmt = postgresAddStmt + " ON CONFLICT (host, source, timestamp, \"offset\") WHERE content_hash IS NULL DO UPDATE SET raw = EXCLUDED.raw, raw_tsv = EXCLUDED.raw_tsv RETURNING id, xmax <> 0;"
+
+// postgresUpsertByHashStmt is postgresUpsertStmt for events which use config.DuplicateKeyContent. The conflict target
+// has to name the unique index the event can conflict with, so these events need a statement of their own.
+const postgresUpsertByHashStmt = postgresAddStmt + " ON CONFLICT (host, source, content_hash) WHERE content_hash IS NOT NULL DO UPDATE SET raw = EXCLUDED.raw, raw_tsv = EXCLUDED.raw_tsv RETURNING id, xmax <> 0;"
+
+func (repo *postgresRepository) addBatch(events []Event, upsert bool) (AddBatchResult, error) {
+	startTime := time.Now()
+	ret := AddBatchResult{Ids: make([]int64, len(events)), Duplicates: map[string]int64{}, Replaced: map[string]int64{}}
+	tx, err := repo.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return AddBatchResult{}, fmt.Errorf("error starting transaction for adding event: %w", err)
+	}
+	query := postgresAddStmt + " RETURNING id, false;"
+	hashQuery := query
+	if upsert {
+		query = postgresUpsertStmt
+		hashQuery = postgresUpsertByHashStmt
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add statement: %w", err)
+	}
+	defer stmt.Close()
+	hashStmt, err := tx.Prepare(hashQuery)
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add by content hash statement: %w", err)
+	}
+	defer hashStmt.Close()
+	fieldStmt, err := tx.Prepare("INSERT INTO EventFields (event_id, key, value) VALUES ($1, $2, $3);")
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add field statement: %w", err)
+	}
+	defer fieldStmt.Close()
+	for i, evt := range events {
+		// An error aborts the whole transaction in Postgres, so each insert gets a savepoint
+		// which can be rolled back to if the event turns out to be a duplicate.
+		_, err = tx.Exec("SAVEPOINT add_event;")
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, fmt.Errorf("error creating savepoint: %w", err)
+		}
+		var id int64
+		var replaced bool
+		hash := contentHash(evt)
+		evtStmt := stmt
+		if hash.Valid {
+			evtStmt = hashStmt
+		}
+		err = evtStmt.QueryRow(evt.Host, evt.Source, evt.Timestamp, evt.Offset, evt.Raw, toTsVectorInput(evt.Raw), toTsVectorInput(evt.Source), toTsVectorInput(evt.Host), hash).Scan(&id, &replaced)
+		if err != nil && isUniqueViolation(err) {
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT add_event;")
+			if err != nil {
+				tx.Rollback()
+				return AddBatchResult{}, fmt.Errorf("error rolling back to savepoint after duplicate: %w", err)
+			}
+			ret.Ids[i] = DuplicateId
+			ret.Duplicates[evt.Source]++
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, fmt.Errorf("error executing add statement: %w", err)
+		}
+		if replaced {
+			_, err = tx.Exec("DELETE FROM EventFields WHERE event_id = $1;", id)
+			if err != nil {
+				tx.Rollback()
+				return AddBatchResult{}, fmt.Errorf("error deleting fields of replaced event: %w", err)
+			}
+			ret.Replaced[evt.Source]++
+		}
+		err = addFields(fieldStmt, id, evt)
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, err
+		}
+		ret.Ids[i] = id
+	}
+	err = tx.Commit()
+	if err != nil {
+		return AddBatchResult{}, fmt.Errorf("error committing transaction for adding events: %w", err)
+	}
+	for k, v := range ret.Duplicates {
+		repo.logger.Infof("Skipped adding numEvents=%v from source=%v because they appear to be duplicates (same duplicate key as an existing event)", v, k)
+	}
+	for k, v := range ret.Replaced {
+		repo.logger.Infof("Replaced the raw of numEvents=%v from source=%v which were duplicates (same duplicate key as an existing event)", v, k)
+	}
+	repo.logger.Debugf("added numEvents=%v in timeInMs=%v", ret.NumAdded(), time.Now().Sub(startTime).Milliseconds())
+	return ret, nil
+}
+
+func (repo *postgresRepository) DeleteOlderThan(t time.Time) (int64, error) {
+	startTime := time.Now()
+	res, err := repo.db.Exec("DELETE FROM Events WHERE timestamp < $1;", t)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting events: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting number of deleted events: %w", err)
+	}
+	repo.logger.Infof("deleted numEvents=%v older than %v in timeInMs=%v", deleted, t, time.Now().Sub(startTime).Milliseconds())
+	return deleted, nil
+}
+
+func (repo *postgresRepository) TimeRange() (min, max time.Time, err error) {
+	var nullMin, nullMax sql.NullTime
+	err = repo.db.QueryRow("SELECT MIN(timestamp), MAX(timestamp) FROM Events;").Scan(&nullMin, &nullMax)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error getting time range of events: %w", err)
+	}
+	return nullMin.Time, nullMax.Time, nil
+}
+
+func (repo *postgresRepository) Sources() ([]string, error) {
+	return querySources(repo.db)
+}
+
+func (repo *postgresRepository) LatestOffset(host, source string) (int64, bool, error) {
+	return queryLatestOffset(repo.db, "SELECT MAX(\"offset\") FROM Events WHERE host = $1 AND source = $2;", host, source)
+}
+
+func (repo *postgresRepository) Ping(ctx context.Context) error {
+	return pingDB(ctx, repo.db)
+}
+
+// isUniqueViolation checks the SQLSTATE of err without depending on a specific Postgres driver.
+// Both lib/pq and pgx errors implement SQLState().
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == postgresUniqueViolation
+	}
+	return false
+}
+
+func (repo *postgresRepository) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	startTime := time.Now()
+	ret := make(chan FilterStreamPage)
+	go func() {
+		defer close(ret)
+		var maxID sql.NullInt64
+		err := repo.db.QueryRowContext(ctx, "SELECT MAX(id) FROM Events;").Scan(&maxID)
+		if err != nil {
+			sendFilterStreamError(ctx, ret, fmt.Errorf("error getting max(id) from Events table: %w", err))
+			return
+		}
+		if !maxID.Valid {
+			return
+		}
+		order, cmp := "DESC", "<"
+		if srch.OldestFirst {
+			order, cmp = "ASC", ">"
+		}
+		var lastTimestamp *time.Time
+		var lastID int64
+		for {
+			if ctx.Err() != nil {
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			args := []interface{}{maxID.Int64}
+			stmt := "SELECT id, host, source, timestamp, raw FROM Events WHERE id <= $1"
+			addArg := func(arg interface{}) string {
+				args = append(args, arg)
+				return "$" + strconv.Itoa(len(args))
+			}
+			if searchStartTime != nil {
+				stmt += " AND timestamp >= " + addArg(*searchStartTime)
+			}
+			if searchEndTime != nil {
+				stmt += " AND timestamp <= " + addArg(*searchEndTime)
+			}
+			if lastTimestamp != nil {
+				// Keyset pagination on (timestamp, id) so events sharing a timestamp across a page boundary are not skipped
+				ts := addArg(*lastTimestamp)
+				stmt += " AND (timestamp " + cmp + " " + ts + " OR (timestamp = " + ts + " AND id " + cmp + " " + addArg(lastID) + "))"
+			}
+			if conds := searchConditions(srch, addArg); len(conds) > 0 {
+				stmt += " AND " + strings.Join(conds, " AND ")
+			}
+			stmt += " ORDER BY timestamp " + order + ", id " + order + " LIMIT " + addArg(filterStreamPageSize)
+			res, err := repo.db.QueryContext(ctx, stmt, args...)
+			if err != nil {
+				sendFilterStreamError(ctx, ret, fmt.Errorf("error getting filtered events: %w", err))
+				return
+			}
+			evts := make([]EventWithId, 0, filterStreamPageSize)
+			eventsInPage := 0
+			for res.Next() {
+				var evt EventWithId
+				err := res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+				if err != nil {
+					repo.logger.Errorf("error when scanning result in FilterStream: %v", err)
+				} else {
+					evts = append(evts, evt)
+					lastTimestamp = &evt.Timestamp
+					lastID = evt.Id
+				}
+				eventsInPage++
+			}
+			err = res.Err()
+			res.Close()
+			if ctx.Err() != nil {
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			if err != nil {
+				sendFilterStreamError(ctx, ret, fmt.Errorf("error iterating over filtered events: %w", err))
+				return
+			}
+			select {
+			case ret <- FilterStreamPage{Events: evts}:
+			case <-ctx.Done():
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			if eventsInPage < filterStreamPageSize {
+				endTime := time.Now()
+				repo.logger.Debugf("SQL search completed in timeInMs=%v", endTime.Sub(startTime).Milliseconds())
+				return
+			}
+		}
+	}()
+	return ret
+}
+
+type ftsToken struct {
+	text     string
+	isPrefix bool
+}
+
+// ftsTokens splits s into tokens the same way the FTS4 simple tokenizer would split it, lowercased, with a flag
+// saying whether the token was followed by '*'.
+// Both the stored tsvectors and the tsqueries are built from these tokens. Postgres's own parser would keep things like
+// "log.txt" as a single file lexeme and would then not match a query built from separate tokens.
+func ftsTokens(s string) []ftsToken {
+	tokens := make([]ftsToken, 0, 1)
+	var current strings.Builder
+	endToken := func(isPrefix bool) {
+		if current.Len() == 0 {
+			return
+		}
+		tokens = append(tokens, ftsToken{text: current.String(), isPrefix: isPrefix})
+		current.Reset()
+	}
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			current.WriteRune(r)
+		} else {
+			endToken(r == '*')
+		}
+	}
+	endToken(false)
+	return tokens
+}
+
+// toTsVectorInput returns the tokens of s separated by spaces, which to_tsvector will split back into the same tokens.
+func toTsVectorInput(s string) string {
+	tokens := ftsTokens(s)
+	texts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		texts[i] = tok.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// toTsQuery converts a fragment using the FTS4 MATCH syntax into an equivalent to_tsquery expression.
+// Multiple tokens are treated as a phrase, and a token followed by '*' is treated as a prefix.
+// An empty string is returned if the fragment does not contain any tokens.
+func toTsQuery(frag string) string {
+	tokens := ftsTokens(frag)
+	parts := make([]string, len(tokens))
+	for i, tok := range tokens {
+		parts[i] = tok.text
+		if tok.isPrefix {
+			parts[i] += ":*"
+		}
+	}
+	return strings.Join(parts, " <-> ")
+}
+
+// searchConditions returns the conditions for the hosts, sources, fragments and stored fields in srch.
+// addArg adds a query argument and returns its placeholder.
+func searchConditions(srch *search.Search, addArg func(arg interface{}) string) []string {
+	ret := []string{}
+	// An event can only have one host and source, so multiple values mean any of them should match
+	for _, m := range []struct {
+		column string
+		values map[string]struct{}
+	}{
+		{"host_tsv", srch.Hosts},
+		{"source_tsv", srch.Sources},
+	} {
+		// Values with wildcards the tsquery can not express are matched by the search step after the events have been
+		// retrieved. Since any of the values should match, a single such value means the group has to be left out.
+		conds := make([]string, 0, len(m.values))
+		for _, v := range fullTextSearchableGroup(m.values) {
+			q := toTsQuery(v)
+			if q == "" {
+				continue
+			}
+			conds = append(conds, m.column+" @@ to_tsquery('simple', "+addArg(q)+")")
+		}
+		if len(conds) > 0 {
+			ret = append(ret, "("+strings.Join(conds, " OR ")+")")
+		}
+	}
+	for _, m := range []struct {
+		column string
+		values map[string]struct{}
+		not    bool
+	}{
+		{"host_tsv", srch.NotHosts, true},
+		{"source_tsv", srch.NotSources, true},
+		{"raw_tsv", srch.Fragments, false},
+		{"raw_tsv", srch.NotFragments, true},
+	} {
+		for _, v := range fullTextSearchableValues(m.values) {
+			q := toTsQuery(v)
+			if q == "" {
+				continue
+			}
+			cond := m.column + " @@ to_tsquery('simple', " + addArg(q) + ")"
+			if m.not {
+				cond = "NOT " + cond
+			}
+			ret = append(ret, cond)
+		}
+	}
+	for _, f := range storedFieldFilters(srch) {
+		// Only events with another value for the field are excluded, events without a stored value are kept
+		key := addArg(f.key)
+		values := make([]string, len(f.values))
+		for i, v := range f.values {
+			values[i] = addArg(v)
+		}
+		ret = append(ret, "NOT EXISTS (SELECT 1 FROM EventFields f WHERE f.event_id = Events.id AND f.key = "+key+" AND f.value NOT IN ("+strings.Join(values, ", ")+"))")
+	}
+	return ret
+}
+
+func (repo *postgresRepository) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	args := []interface{}{}
+	addArg := func(arg interface{}) string {
+		args = append(args, arg)
+		return "$" + strconv.Itoa(len(args))
+	}
+	conds := searchConditions(srch, addArg)
+	if searchStartTime != nil {
+		conds = append(conds, "timestamp >= "+addArg(*searchStartTime))
+	}
+	if searchEndTime != nil {
+		conds = append(conds, "timestamp <= "+addArg(*searchEndTime))
+	}
+	stmt := "SELECT COUNT(*) FROM Events"
+	if len(conds) > 0 {
+		stmt += " WHERE " + strings.Join(conds, " AND ")
+	}
+	var count int64
+	err := repo.db.QueryRowContext(ctx, stmt, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting events: %w", err)
+	}
+	return count, nil
+}
+
+func (repo *postgresRepository) GetById(id int64) (*EventWithId, error) {
+	var evt EventWithId
+	err := repo.db.QueryRow("SELECT id, host, source, timestamp, raw FROM Events WHERE id = $1;", id).
+		Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, err)
+	}
+	return &evt, nil
+}
+
+func (repo *postgresRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	ret := make([]EventWithId, 0, len(ids))
+
+	for start := 0; start < len(ids); start += getByIdsChunkSize {
+		end := start + getByIdsChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+
+		var sb strings.Builder
+		sb.WriteString("SELECT id, host, source, timestamp, raw FROM Events WHERE id IN (")
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			if i != 0 {
+				sb.WriteRune(',')
+			}
+			sb.WriteString("$" + strconv.Itoa(i+1))
+			args[i] = id
+		}
+		sb.WriteString(");")
+
+		res, err := repo.db.Query(sb.String(), args...)
+		if err != nil {
+			return nil, fmt.Errorf("error executing GetByIds query: %w", err)
+		}
+		for res.Next() {
+			var evt EventWithId
+			err = res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+			if err != nil {
+				res.Close()
+				return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
+			}
+			ret = append(ret, evt)
+		}
+		err = res.Err()
+		res.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error when iterating over rows in GetByIds: %w", err)
+		}
+	}
+
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
+	}
+
+	return ret, nil
+}
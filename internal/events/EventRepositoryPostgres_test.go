@@ -0,0 +1,59 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import "testing"
+
+var toTsQueryTests = []struct {
+	input    string
+	expected string
+}{
+	{"hello", "hello"},
+	{"Hello", "hello"},
+	{"hel*", "hel:*"},
+	{"*access*", "access:*"},
+	{"log-1.txt", "log <-> 1 <-> txt"},
+	{"o'brien", "o <-> brien"},
+	{"***", ""},
+	{"", ""},
+}
+
+func TestToTsQuery(t *testing.T) {
+	for _, tt := range toTsQueryTests {
+		t.Run(tt.input, func(t *testing.T) {
+			actual := toTsQuery(tt.input)
+			if actual != tt.expected {
+				t.Fatalf("expected toTsQuery('%v') to return '%v' but got '%v'", tt.input, tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestToTsVectorInput(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"access-log.txt", "access log txt"},
+		{"2021-02-01 00:00:00 User's event", "2021 02 01 00 00 00 user s event"},
+		{"web01.example.com", "web01 example com"},
+		{"", ""},
+	} {
+		actual := toTsVectorInput(tt.input)
+		if actual != tt.expected {
+			t.Errorf("expected toTsVectorInput('%v') to return '%v' but got '%v'", tt.input, tt.expected, actual)
+		}
+	}
+}
@@ -17,281 +17,981 @@ package events
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/search"
+
+	"github.com/mattn/go-sqlite3"
 )
 
-const expectedConstraintViolationForDuplicates = "UNIQUE constraint failed: Events.host, Events.source, Events.timestamp, Events.offset"
-const expectedErrorWhenDatabaseIsEmpty = "sql: Scan error on column index 0, name \"MAX(id)\": converting NULL to int is unsupported"
-const filterStreamPageSize = 1000
+// filterStreamPageSize is the number of events FilterStream sends at a time in the repositories which do not have it
+// configured.
+const filterStreamPageSize = config.DefaultFilterStreamPageSize
+const getByIdsChunkSize = 900
+
+// sqliteMaxParams is the maximum number of parameters in one statement, which is the default
+// SQLITE_MAX_VARIABLE_NUMBER since SQLite 3.32.
+const sqliteMaxParams = 32766
+
+// trueBatchChunkSize is the number of events added by each multi-row INSERT when TrueBatch is enabled. The Events
+// table has the most parameters per event.
+const trueBatchChunkSize = sqliteMaxParams / 5
 
 type sqliteRepository struct {
 	db *sql.DB
 
-	cfg *config.SqliteConfig
+	cfg       *config.SqliteConfig
+	ftsModule string
+	pageSize  int
+	logger    logging.Logger
+}
+
+// SqliteDataSourceName returns the name to open the database in cfg with. The busy timeout is set per connection, so
+// it is given to the driver here to apply it to every connection in the pool.
+func SqliteDataSourceName(cfg *config.SqliteConfig) string {
+	dsn := cfg.DatabaseFile + "?cache=shared&_busy_timeout=" + strconv.FormatInt(cfg.BusyTimeout.Milliseconds(), 10)
+	if cfg.WAL {
+		dsn += "&_journal_mode=WAL"
+	}
+	return dsn
 }
 
 func SqliteRepository(db *sql.DB, cfg *config.SqliteConfig) (Repository, error) {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS Events (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, UNIQUE(host, source, timestamp, offset));")
+	ftsModule := cfg.FtsModule
+	if ftsModule == "" {
+		ftsModule = config.SqliteFtsModuleFts4
+	}
+	if ftsModule != config.SqliteFtsModuleFts4 && ftsModule != config.SqliteFtsModuleFts5 {
+		return nil, fmt.Errorf("unknown ftsModule=%v, expected %v or %v", ftsModule, config.SqliteFtsModuleFts4, config.SqliteFtsModuleFts5)
+	}
+	if cfg.FilterStreamPageSize < 0 {
+		return nil, fmt.Errorf("filterStreamPageSize must be a positive integer, got %v", cfg.FilterStreamPageSize)
+	}
+	pageSize := cfg.FilterStreamPageSize
+	if pageSize == 0 {
+		pageSize = config.DefaultFilterStreamPageSize
+	}
+	logger := logging.OrDefault(cfg.Logger)
+	if ftsModule == config.SqliteFtsModuleFts5 && !fts5Available {
+		return nil, fmt.Errorf("ftsModule=%v is configured but logsuck was built without FTS5 support, rebuild with -tags sqlite_fts5", ftsModule)
+	}
+	if cfg.WAL {
+		// The journal mode is stored in the database file, so unlike the busy timeout it only has to be set once
+		var mode string
+		err := db.QueryRow("PRAGMA journal_mode=WAL;").Scan(&mode)
+		if err != nil {
+			return nil, fmt.Errorf("error enabling WAL mode: %w", err)
+		}
+		if mode != "wal" {
+			logger.Warnf("Could not enable WAL mode, will use journalMode=%v", mode)
+		}
+	}
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS Events " + sqliteEventsColumns + ";")
 	if err != nil {
 		return nil, fmt.Errorf("error creating events table: %w", err)
 	}
+	err = addContentHashColumn(db, logger)
+	if err != nil {
+		return nil, err
+	}
+	// Each kind of duplicate key has its own unique index, which only contains the events using that key
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS UX_Events_Offset ON Events(host, source, timestamp, offset) WHERE content_hash IS NULL;")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events offset index: %w", err)
+	}
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS UX_Events_ContentHash ON Events(host, source, content_hash) WHERE content_hash IS NOT NULL;")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events content hash index: %w", err)
+	}
 	_, err = db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_Timestamp ON Events(timestamp);")
 	if err != nil {
 		return nil, fmt.Errorf("error creating events timestamp index: %w", err)
 	}
-	// It seems we have to use FTS4 instead of FTS5? - I could not find an option equivalent to order=DESC for FTS5 and order=DESC makes queries 8-9x faster...
-	_, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS EventRaws USING fts4 (raw TEXT, source TEXT, host TEXT, order=DESC);")
+	// Besides looking up events from one source in a time range, this index covers listing the sources
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS IX_Events_SourceTimestamp ON Events(source, timestamp);")
+	if err != nil {
+		return nil, fmt.Errorf("error creating events source index: %w", err)
+	}
+	// The fields are only looked up for one event at a time, so the primary key is the only index needed
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS EventFields (event_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY(event_id, key)) WITHOUT ROWID;")
+	if err != nil {
+		return nil, fmt.Errorf("error creating eventfields table: %w", err)
+	}
+	definition := eventRawsDefinition(ftsModule, cfg.Tokenizer)
+	existingDefinition, err := eventRawsDefinitionInUse(db)
+	if err != nil {
+		return nil, err
+	}
+	err = createEventContents(db, existingDefinition != "", logger)
 	if err != nil {
-		return nil, fmt.Errorf("error creating eventraws table: %w", err)
+		return nil, err
+	}
+	if existingDefinition == "" {
+		_, err = db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS EventRaws USING " + definition + ";")
+		if err != nil {
+			return nil, fmt.Errorf("error creating eventraws table: %w", err)
+		}
+	} else if existingDefinition != definition {
+		err = rebuildEventRaws(context.Background(), db, existingDefinition, definition, logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &sqliteRepository{
-		db:  db,
-		cfg: cfg,
+		db:        db,
+		cfg:       cfg,
+		ftsModule: ftsModule,
+		pageSize:  pageSize,
+		logger:    logger,
 	}, nil
 }
 
-func (repo *sqliteRepository) AddBatch(events []Event) error {
+// sqliteEventsColumns is the column definition of the Events table. content_hash is only set for events which use
+// config.DuplicateKeyContent.
+const sqliteEventsColumns = "(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, content_hash TEXT)"
+
+// addContentHashColumn migrates an Events table created before events could use config.DuplicateKeyContent. Such a
+// table has a UNIQUE constraint on host, source, timestamp and offset, which must only apply to the events without a
+// content hash. SQLite can not drop a constraint, so the table is rebuilt with the same ids instead.
+func addContentHashColumn(db *sql.DB, logger logging.Logger) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('Events') WHERE name = 'content_hash';").Scan(&n)
+	if err != nil {
+		return fmt.Errorf("error checking columns of events table: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	logger.Infof("Rebuilding the Events table to add the content_hash column. This may take a while if there are many events.")
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for rebuilding events table: %w", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE Events_rebuild " + sqliteEventsColumns + ";",
+		"INSERT INTO Events_rebuild (id, host, source, timestamp, offset) SELECT id, host, source, timestamp, offset FROM Events;",
+		// The sequence is moved over so that the ids of deleted events are not reused, which is what AUTOINCREMENT
+		// guarantees
+		"DELETE FROM sqlite_sequence WHERE name = 'Events_rebuild';",
+		"UPDATE sqlite_sequence SET name = 'Events_rebuild' WHERE name = 'Events';",
+		"DROP TABLE Events;",
+		"ALTER TABLE Events_rebuild RENAME TO Events;",
+	} {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error rebuilding events table: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing rebuilt events table: %w", err)
+	}
+	return nil
+}
+
+// createEventContents creates the EventContents table, which is where the raws are stored so that the EventRaws index
+// can be rebuilt from them. A database created before the table existed only has the raws in EventRaws, so if
+// hasEventRaws is set they are copied from there when the table is created.
+func createEventContents(db *sql.DB, hasEventRaws bool, logger logging.Logger) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'EventContents';").Scan(&n)
+	if err != nil {
+		return fmt.Errorf("error checking existing eventcontents table: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for creating eventcontents table: %w", err)
+	}
+	_, err = tx.Exec("CREATE TABLE EventContents (event_id INTEGER NOT NULL PRIMARY KEY, raw TEXT NOT NULL);")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error creating eventcontents table: %w", err)
+	}
+	if hasEventRaws {
+		logger.Infof("Copying the raws from EventRaws to the new EventContents table. This may take a while if there are many events.")
+		_, err = tx.Exec("INSERT INTO EventContents (event_id, raw) SELECT rowid, raw FROM EventRaws;")
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error copying raws to eventcontents table: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing eventcontents table: %w", err)
+	}
+	return nil
+}
+
+// eventRawsDefinition returns the module and column definition of the EventRaws table for the given FTS module and
+// tokenizer. FTS4 is created with order=DESC, which makes queries 8-9x faster since they return the newest events
+// first. FTS5 has no equivalent option, so the descending order comes only from ordering on the joined Events table.
+//
+// The tokenizer is given as its name followed by its arguments, as in "unicode61 remove_diacritics=2", which is the
+// syntax FTS4 uses. FTS5 separates the name and value of an argument with a space instead, so it is converted.
+func eventRawsDefinition(ftsModule, tokenizer string) string {
+	words := strings.Fields(tokenizer)
+	if ftsModule == config.SqliteFtsModuleFts5 {
+		if len(words) == 0 {
+			return "fts5 (raw, source, host)"
+		}
+		for i, w := range words {
+			words[i] = strings.Replace(w, "=", " ", 1)
+		}
+		return "fts5 (raw, source, host, tokenize='" + strings.Join(words, " ") + "')"
+	}
+	if len(words) == 0 {
+		return "fts4 (raw TEXT, source TEXT, host TEXT, order=DESC)"
+	}
+	for i := 1; i < len(words); i++ {
+		words[i] = "\"" + words[i] + "\""
+	}
+	return "fts4 (raw TEXT, source TEXT, host TEXT, order=DESC, tokenize=" + strings.Join(words, " ") + ")"
+}
+
+// eventRawsDefinitionInUse returns the module and column definition of the existing EventRaws table, or an empty
+// string if it does not exist.
+func eventRawsDefinitionInUse(db *sql.DB) (string, error) {
+	var stmt string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'EventRaws';").Scan(&stmt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error checking existing eventraws table: %w", err)
+	}
+	i := strings.Index(strings.ToLower(stmt), " using ")
+	if i == -1 {
+		return "", fmt.Errorf("error checking existing eventraws table: unexpected definition %q", stmt)
+	}
+	return strings.TrimSpace(stmt[i+len(" using "):]), nil
+}
+
+// rebuildEventRaws replaces the EventRaws table with a new one using the definition to, such as when changing from one
+// FTS module or tokenizer to another, by indexing every raw in EventContents in a new table with the same rowids and
+// then replacing the old table. from is the definition of the old table and is only logged. The old table does not
+// have to exist.
+func rebuildEventRaws(ctx context.Context, db *sql.DB, from, to string, logger logging.Logger) error {
+	startTime := time.Now()
+	logger.Infof("Rebuilding EventRaws from definition=%v to definition=%v, this may take a while for large databases", from, to)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction for rebuilding eventraws table: %w", err)
+	}
+	_, err = tx.Exec("CREATE VIRTUAL TABLE EventRaws_rebuild USING " + to + ";")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error creating eventraws table for rebuild: %w", err)
+	}
+	res, err := tx.Exec("INSERT INTO EventRaws_rebuild (rowid, raw, source, host) SELECT c.event_id, c.raw, e.source, e.host FROM EventContents c INNER JOIN Events e ON e.id = c.event_id;")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error copying events when rebuilding eventraws table: %w", err)
+	}
+	_, err = tx.Exec("DROP TABLE IF EXISTS EventRaws;")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error dropping old eventraws table: %w", err)
+	}
+	_, err = tx.Exec("ALTER TABLE EventRaws_rebuild RENAME TO EventRaws;")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error renaming rebuilt eventraws table: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing rebuilt eventraws table: %w", err)
+	}
+	numEvents, _ := res.RowsAffected()
+	logger.Infof("Rebuilt EventRaws with numEvents=%v in timeInMs=%v", numEvents, time.Now().Sub(startTime).Milliseconds())
+	return nil
+}
+
+// RebuildIndex replaces EventRaws with a new table indexing the raws in EventContents, which fixes an index that has
+// been corrupted or has been dropped.
+func (repo *sqliteRepository) RebuildIndex(ctx context.Context) error {
+	definition := eventRawsDefinition(repo.ftsModule, repo.cfg.Tokenizer)
+	return rebuildEventRaws(ctx, repo.db, definition, definition, repo.logger)
+}
+
+func (repo *sqliteRepository) AddBatch(events []Event) (AddBatchResult, error) {
 	if repo.cfg.TrueBatch {
 		return repo.addBatchTrueBatch(events)
 	} else {
-		return repo.addBatchOneByOne(events)
+		return repo.addBatchOneByOne(events, false)
 	}
 }
 
-const esbBase = "INSERT OR IGNORE INTO Events (host, source, timestamp, offset) VALUES "
+// UpsertBatch always adds the events one by one, even if TrueBatch is set, since the id of each replaced event has
+// to be looked up to replace its raw.
+func (repo *sqliteRepository) UpsertBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatchOneByOne(events, true)
+}
+
+const dsbBase = "SELECT host, source, timestamp, offset FROM Events WHERE content_hash IS NULL AND (host, source, timestamp, offset) IN (VALUES "
+const chsbBase = "SELECT host, source, content_hash FROM Events WHERE content_hash IS NOT NULL AND (host, source, content_hash) IN (VALUES "
+const esbBase = "INSERT INTO Events (host, source, timestamp, offset, content_hash) VALUES "
 const esbBaseLen = len(esbBase)
-const esbPerEvt = "(?, ?, ?, ?)"
-const esbPerEvtLen = len(esbPerEvt)
-const rsbBase = "INSERT INTO EventRaws (raw, source, host) VALUES "
+const rsbBase = "INSERT INTO EventRaws (rowid, raw, source, host) VALUES "
 const rsbBaseLen = len(rsbBase)
-const rsbPerEvt = "(?, ?, ?)"
-const rsbPerEvtLen = len(rsbPerEvt)
+const csbBase = "INSERT INTO EventContents (event_id, raw) VALUES "
+const csbBaseLen = len(csbBase)
+const csbPerEvt = "(?, ?)"
+const csbPerEvtLen = len(csbPerEvt)
+const sbPerEvt = "(?, ?, ?, ?)"
+const sbPerEvtLen = len(sbPerEvt)
+const chsbPerEvt = "(?, ?, ?)"
+const esbPerEvt = "(?, ?, ?, ?, ?)"
+const esbPerEvtLen = len(esbPerEvt)
+const sqliteAddFieldStmt = "INSERT INTO EventFields (event_id, key, value) VALUES (?, ?, ?);"
 
-func (repo *sqliteRepository) addBatchTrueBatch(events []Event) error {
+// writeValuesList writes n comma separated tuples to sb, such as (?, ?, ?, ?).
+func writeValuesList(sb *strings.Builder, tuple string, n int) {
+	for i := 0; i < n; i++ {
+		sb.WriteString(tuple)
+		if i != n-1 {
+			sb.WriteRune(',')
+		}
+	}
+}
+
+func (repo *sqliteRepository) addBatchTrueBatch(events []Event) (AddBatchResult, error) {
 	startTime := time.Now()
+	ret := AddBatchResult{Ids: make([]int64, len(events)), Duplicates: map[string]int64{}}
+	if len(events) == 0 {
+		return ret, nil
+	}
+	tx, err := repo.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return AddBatchResult{}, fmt.Errorf("error starting transaction for adding event batch: %w", err)
+	}
+
+	// Duplicates are filtered out before inserting instead of relying on INSERT OR IGNORE, since the rowids in
+	// EventRaws must match the ids in Events and we need to know which events were skipped to count them.
+	existing, err := repo.existingKeys(tx, events)
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, err
+	}
+	toAdd := make([]Event, 0, len(events))
+	// toAddIndexes contains the index in events of each event in toAdd
+	toAddIndexes := make([]int, 0, len(events))
+	for i, evt := range events {
+		key := keyOf(evt)
+		if _, ok := existing[key]; ok {
+			ret.Ids[i] = DuplicateId
+			ret.Duplicates[evt.Source]++
+			continue
+		}
+		existing[key] = struct{}{}
+		toAdd = append(toAdd, evt)
+		toAddIndexes = append(toAddIndexes, i)
+	}
+
+	if len(toAdd) > 0 {
+		fieldStmt, err := tx.Prepare(sqliteAddFieldStmt)
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, fmt.Errorf("error preparing add field statement: %w", err)
+		}
+		defer fieldStmt.Close()
+		// A large batch, such as the buffer of a publisher retrying after an error, is inserted in chunks so that no
+		// statement has more parameters than SQLite allows.
+		for start := 0; start < len(toAdd); start += trueBatchChunkSize {
+			end := start + trueBatchChunkSize
+			if end > len(toAdd) {
+				end = len(toAdd)
+			}
+			ids, err := insertTrueBatch(tx, fieldStmt, toAdd[start:end])
+			if err != nil {
+				tx.Rollback()
+				return AddBatchResult{}, err
+			}
+			for i, id := range ids {
+				ret.Ids[toAddIndexes[start+i]] = id
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return AddBatchResult{}, fmt.Errorf("error committing transaction for adding event batch: %w", err)
+	}
+	for k, v := range ret.Duplicates {
+		repo.logger.Infof("Skipped adding numEvents=%v from source=%v because they appear to be duplicates (same duplicate key as an existing event)", v, k)
+	}
+	repo.logger.Debugf("added numEvents=%v in timeInMs=%v", ret.NumAdded(), time.Now().Sub(startTime).Milliseconds())
+	return ret, nil
+}
+
+// insertTrueBatch adds events to the Events, EventRaws, EventContents and EventFields tables using one multi-row
+// INSERT per table, and returns the ids of the events. There must be at most trueBatchChunkSize events.
+func insertTrueBatch(tx *sql.Tx, fieldStmt *sql.Stmt, events []Event) ([]int64, error) {
 	var eventSb strings.Builder
-	var rawSb strings.Builder
-	eventSb.Grow(esbBaseLen + esbPerEvtLen*len(events) + len(events))
-	rawSb.Grow(rsbBaseLen + rsbPerEvtLen*len(events) + len(events))
+	eventSb.Grow(esbBaseLen + (esbPerEvtLen+1)*len(events))
 	eventSb.WriteString(esbBase)
+	writeValuesList(&eventSb, esbPerEvt, len(events))
+	esbArgs := make([]interface{}, 0, 5*len(events))
+	for _, evt := range events {
+		esbArgs = append(esbArgs, evt.Host, evt.Source, evt.Timestamp, evt.Offset, contentHash(evt))
+	}
+	res, err := tx.Exec(eventSb.String(), esbArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("error adding event batch to Events table: %w", err)
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error getting event ids after adding event batch: %w", err)
+	}
+	// A multi-row INSERT inside a transaction assigns consecutive ids, so the ids of the batch end at lastID.
+	ids := make([]int64, len(events))
+	for i := range events {
+		ids[i] = lastID - int64(len(events)-1-i)
+	}
+
+	var rawSb strings.Builder
+	rawSb.Grow(rsbBaseLen + (sbPerEvtLen+1)*len(events))
 	rawSb.WriteString(rsbBase)
+	writeValuesList(&rawSb, sbPerEvt, len(events))
+	rsbArgs := make([]interface{}, 0, 4*len(events))
+	for i, evt := range events {
+		rsbArgs = append(rsbArgs, ids[i], evt.Raw, evt.Source, evt.Host)
+	}
+	_, err = tx.Exec(rawSb.String(), rsbArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("error adding event batch to EventRaws table: %w", err)
+	}
 
-	esbArgs := make([]interface{}, 0, 4*len(events))
-	rsbArgs := make([]interface{}, 0, 3*len(events))
+	var contentSb strings.Builder
+	contentSb.Grow(csbBaseLen + (csbPerEvtLen+1)*len(events))
+	contentSb.WriteString(csbBase)
+	writeValuesList(&contentSb, csbPerEvt, len(events))
+	csbArgs := make([]interface{}, 0, 2*len(events))
 	for i, evt := range events {
-		eventSb.WriteString(esbPerEvt)
-		rawSb.WriteString(rsbPerEvt)
-		if i != len(events)-1 {
-			eventSb.WriteRune(',')
-			rawSb.WriteRune(',')
+		csbArgs = append(csbArgs, ids[i], evt.Raw)
+	}
+	_, err = tx.Exec(contentSb.String(), csbArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("error adding event batch to EventContents table: %w", err)
+	}
+
+	for i, evt := range events {
+		err = addFields(fieldStmt, ids[i], evt)
+		if err != nil {
+			return nil, fmt.Errorf("error adding event batch to EventFields table: %w", err)
 		}
-		esbArgs = append(esbArgs, evt.Host, evt.Source, evt.Timestamp, evt.Offset)
-		rsbArgs = append(rsbArgs, evt.Raw, evt.Source, evt.Host)
 	}
+	return ids, nil
+}
 
-	tx, err := repo.db.BeginTx(context.TODO(), nil)
+// existingKeys returns the keys of the events in the batch which already exist in the Events table.
+// The events using each kind of duplicate key are looked up separately, since they are in different indexes.
+func (repo *sqliteRepository) existingKeys(tx *sql.Tx, events []Event) (map[inMemoryEventKey]struct{}, error) {
+	offsetArgs := make([]interface{}, 0, 4*len(events))
+	hashArgs := make([]interface{}, 0)
+	for _, evt := range events {
+		if hash := contentHash(evt); hash.Valid {
+			hashArgs = append(hashArgs, evt.Host, evt.Source, hash.String)
+		} else {
+			offsetArgs = append(offsetArgs, evt.Host, evt.Source, evt.Timestamp, evt.Offset)
+		}
+	}
+	ret := map[inMemoryEventKey]struct{}{}
+	err := lookupExistingKeys(tx, dsbBase, sbPerEvt, 4, offsetArgs, ret, func(rows *sql.Rows) (inMemoryEventKey, error) {
+		var key inMemoryEventKey
+		var timestamp time.Time
+		err := rows.Scan(&key.host, &key.source, &timestamp, &key.offset)
+		key.timestamp = timestamp.UnixNano()
+		return key, err
+	})
 	if err != nil {
-		return fmt.Errorf("error starting transaction for adding event batch: %w", err)
+		return nil, err
 	}
-	rows, err := tx.Query("SELECT MAX(rowid) FROM EventRaws;")
+	err = lookupExistingKeys(tx, chsbBase, chsbPerEvt, 3, hashArgs, ret, func(rows *sql.Rows) (inMemoryEventKey, error) {
+		var key inMemoryEventKey
+		err := rows.Scan(&key.host, &key.source, &key.contentHash)
+		return key, err
+	})
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("error adding event batch: failed to get MAX(rowid): %w", err)
+		return nil, err
 	}
-	prevMaxID := 0
-	if rows.Next() {
-		rows.Scan(&prevMaxID)
+	return ret, nil
+}
+
+// lookupExistingKeys adds the keys matching args to keys, where args contains paramsPerKey values for each key. The
+// keys are looked up in chunks so that no query has more parameters than SQLite allows.
+func lookupExistingKeys(tx *sql.Tx, base, tuple string, paramsPerKey int, args []interface{}, keys map[inMemoryEventKey]struct{}, scan func(*sql.Rows) (inMemoryEventKey, error)) error {
+	chunkSize := (sqliteMaxParams / paramsPerKey) * paramsPerKey
+	for start := 0; start < len(args); start += chunkSize {
+		end := start + chunkSize
+		if end > len(args) {
+			end = len(args)
+		}
+		numKeys := (end - start) / paramsPerKey
+		var sb strings.Builder
+		sb.Grow(len(base) + (len(tuple)+1)*numKeys + 1)
+		sb.WriteString(base)
+		writeValuesList(&sb, tuple, numKeys)
+		sb.WriteRune(')')
+		err := scanExistingKeys(tx, sb.String(), args[start:end], keys, scan)
+		if err != nil {
+			return err
+		}
 	}
-	eventQ := eventSb.String()
-	_, err = tx.Exec(eventQ, esbArgs...)
+	return nil
+}
+
+// scanExistingKeys adds the keys returned by query to keys, using scan to read the key of each row.
+func scanExistingKeys(tx *sql.Tx, query string, args []interface{}, keys map[inMemoryEventKey]struct{}, scan func(*sql.Rows) (inMemoryEventKey, error)) error {
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("error adding event batch to Events table: %w", err)
+		return fmt.Errorf("error looking up duplicates in event batch: %w", err)
 	}
-	rawQ := rawSb.String()
-	res, err := tx.Exec(rawQ, rsbArgs...)
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("error scanning duplicates in event batch: %w", err)
+		}
+		keys[key] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error looking up duplicates in event batch: %w", err)
+	}
+	return nil
+}
+
+// sqliteReplaceStmts are the statements used by UpsertBatch to replace the raw and stored fields of an existing event.
+type sqliteReplaceStmts struct {
+	id           *sql.Stmt
+	idByHash     *sql.Stmt
+	raw          *sql.Stmt
+	content      *sql.Stmt
+	deleteFields *sql.Stmt
+}
+
+func (stmts *sqliteReplaceStmts) Close() {
+	stmts.id.Close()
+	stmts.idByHash.Close()
+	stmts.raw.Close()
+	stmts.content.Close()
+	stmts.deleteFields.Close()
+}
+
+func prepareReplaceStmts(tx *sql.Tx) (*sqliteReplaceStmts, error) {
+	id, err := tx.Prepare("SELECT id FROM Events WHERE host = ? AND source = ? AND timestamp = ? AND offset = ? AND content_hash IS NULL;")
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("error adding event batch to EventRaws table: %w", err)
+		return nil, fmt.Errorf("error preparing get id statement: %w", err)
 	}
-	newMaxID, err := res.LastInsertId()
+	idByHash, err := tx.Prepare("SELECT id FROM Events WHERE host = ? AND source = ? AND content_hash = ?;")
 	if err != nil {
-		log.Printf("got error when getting new max ID to clean up EventRaws: %v", err)
+		id.Close()
+		return nil, fmt.Errorf("error preparing get id by content hash statement: %w", err)
+	}
+	raw, err := tx.Prepare("UPDATE EventRaws SET raw = ? WHERE rowid = ?;")
+	if err != nil {
+		id.Close()
+		idByHash.Close()
+		return nil, fmt.Errorf("error preparing replace raw statement: %w", err)
+	}
+	content, err := tx.Prepare("UPDATE EventContents SET raw = ? WHERE event_id = ?;")
+	if err != nil {
+		id.Close()
+		idByHash.Close()
+		raw.Close()
+		return nil, fmt.Errorf("error preparing replace content statement: %w", err)
+	}
+	deleteFields, err := tx.Prepare("DELETE FROM EventFields WHERE event_id = ?;")
+	if err != nil {
+		id.Close()
+		idByHash.Close()
+		raw.Close()
+		content.Close()
+		return nil, fmt.Errorf("error preparing delete fields statement: %w", err)
+	}
+	return &sqliteReplaceStmts{id: id, idByHash: idByHash, raw: raw, content: content, deleteFields: deleteFields}, nil
+}
+
+// replace replaces the raw and stored fields of the existing event which evt is a duplicate of and returns its id.
+func (stmts *sqliteReplaceStmts) replace(fieldStmt *sql.Stmt, evt Event) (int64, error) {
+	var id int64
+	var err error
+	if hash := contentHash(evt); hash.Valid {
+		err = stmts.idByHash.QueryRow(evt.Host, evt.Source, hash.String).Scan(&id)
 	} else {
-		res, err = tx.Exec("DELETE FROM EventRaws AS er WHERE NOT EXISTS (SELECT 1 FROM Events e WHERE e.ID = er.rowid) AND er.rowid > ? AND er.rowid <= ? AND er.rowid != (SELECT MAX(ID) FROM Events)", prevMaxID, newMaxID)
-		if err != nil {
-			log.Printf("got error when cleaning up EventRaws: %v", err)
-		} else if deleted, err := res.RowsAffected(); err == nil && deleted > 0 {
-			log.Printf("Skipped adding numEvents=%v as they appear to be duplicates (same source, offset and timestamp as an existing event)", deleted)
-		}
+		err = stmts.id.QueryRow(evt.Host, evt.Source, evt.Timestamp, evt.Offset).Scan(&id)
 	}
-	err = tx.Commit()
 	if err != nil {
-		// TODO: Hmm?
+		return 0, fmt.Errorf("error getting id of duplicate event: %w", err)
 	}
-	log.Printf("added numEvents=%v in timeInMs=%v\n", len(events), time.Now().Sub(startTime).Milliseconds())
-	return nil
+	_, err = stmts.raw.Exec(evt.Raw, id)
+	if err != nil {
+		return 0, fmt.Errorf("error executing replace raw statement: %w", err)
+	}
+	_, err = stmts.content.Exec(evt.Raw, id)
+	if err != nil {
+		return 0, fmt.Errorf("error executing replace content statement: %w", err)
+	}
+	_, err = stmts.deleteFields.Exec(id)
+	if err != nil {
+		return 0, fmt.Errorf("error executing delete fields statement: %w", err)
+	}
+	err = addFields(fieldStmt, id, evt)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
 }
 
-func (repo *sqliteRepository) addBatchOneByOne(events []Event) error {
+func (repo *sqliteRepository) addBatchOneByOne(events []Event, upsert bool) (AddBatchResult, error) {
 	startTime := time.Now()
-	ret := make([]int64, len(events))
+	ret := AddBatchResult{Ids: make([]int64, len(events)), Duplicates: map[string]int64{}, Replaced: map[string]int64{}}
 	tx, err := repo.db.BeginTx(context.TODO(), nil)
 	if err != nil {
-		return fmt.Errorf("error starting transaction for adding event: %w", err)
+		return AddBatchResult{}, fmt.Errorf("error starting transaction for adding event: %w", err)
+	}
+	eventQuery := "INSERT INTO Events(host, source, timestamp, offset, content_hash) VALUES(?, ?, ?, ?, ?);"
+	if upsert {
+		// The duplicate is replaced after the insert has been ignored, since the raw and EventFields have to be
+		// updated as well and they are only linked to Events by id. The conflict target is left out since the event
+		// can conflict with either of the unique indexes depending on its duplicate key.
+		eventQuery = "INSERT INTO Events(host, source, timestamp, offset, content_hash) VALUES(?, ?, ?, ?, ?) ON CONFLICT DO NOTHING;"
+	}
+	// The statements are prepared once per batch instead of being parsed again for every event
+	eventStmt, err := tx.Prepare(eventQuery)
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add statement: %w", err)
+	}
+	defer eventStmt.Close()
+	rawStmt, err := tx.Prepare("INSERT INTO EventRaws (rowid, raw, source, host) VALUES (?, ?, ?, ?);")
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add raw statement: %w", err)
+	}
+	defer rawStmt.Close()
+	contentStmt, err := tx.Prepare("INSERT INTO EventContents (event_id, raw) VALUES (?, ?);")
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add content statement: %w", err)
+	}
+	defer contentStmt.Close()
+	fieldStmt, err := tx.Prepare(sqliteAddFieldStmt)
+	if err != nil {
+		tx.Rollback()
+		return AddBatchResult{}, fmt.Errorf("error preparing add field statement: %w", err)
+	}
+	defer fieldStmt.Close()
+	var replaceStmts *sqliteReplaceStmts
+	if upsert {
+		replaceStmts, err = prepareReplaceStmts(tx)
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, err
+		}
+		defer replaceStmts.Close()
 	}
-	numberOfDuplicates := map[string]int64{}
 	for i, evt := range events {
-		res, err := tx.Exec("INSERT INTO Events(host, source, timestamp, offset) VALUES(?, ?, ?, ?);", evt.Host, evt.Source, evt.Timestamp, evt.Offset)
-		// Surely this can't be the right way to check for this error...
-		if err != nil && err.Error() == expectedConstraintViolationForDuplicates {
-			numberOfDuplicates[evt.Source]++
+		res, err := eventStmt.Exec(evt.Host, evt.Source, evt.Timestamp, evt.Offset, contentHash(evt))
+		if err != nil && isDuplicateError(err) {
+			ret.Ids[i] = DuplicateId
+			ret.Duplicates[evt.Source]++
 			continue
 		}
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("error executing add statement: %w", err)
+			return AddBatchResult{}, fmt.Errorf("error executing add statement: %w", err)
+		}
+		if upsert {
+			affected, err := res.RowsAffected()
+			if err != nil {
+				tx.Rollback()
+				return AddBatchResult{}, fmt.Errorf("error getting number of added events after insert: %w", err)
+			}
+			if affected == 0 {
+				id, err := replaceStmts.replace(fieldStmt, evt)
+				if err != nil {
+					tx.Rollback()
+					return AddBatchResult{}, err
+				}
+				ret.Ids[i] = id
+				ret.Replaced[evt.Source]++
+				continue
+			}
 		}
 		id, err := res.LastInsertId()
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("error getting event id after insert: %w", err)
+			return AddBatchResult{}, fmt.Errorf("error getting event id after insert: %w", err)
+		}
+		_, err = rawStmt.Exec(id, evt.Raw, evt.Source, evt.Host)
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, fmt.Errorf("error executing add raw statement: %w", err)
 		}
-		_, err = tx.Exec("INSERT INTO EventRaws (rowid, raw, source, host) SELECT LAST_INSERT_ROWID(), ?, ?, ?;", evt.Raw, evt.Source, evt.Host)
+		_, err = contentStmt.Exec(id, evt.Raw)
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("error executing add raw statement: %w", err)
+			return AddBatchResult{}, fmt.Errorf("error executing add content statement: %w", err)
 		}
-		ret[i] = id
+		err = addFields(fieldStmt, id, evt)
+		if err != nil {
+			tx.Rollback()
+			return AddBatchResult{}, err
+		}
+		ret.Ids[i] = id
 	}
 	err = tx.Commit()
 	if err != nil {
-		// TODO: Hmm?
+		return AddBatchResult{}, fmt.Errorf("error committing transaction for adding events: %w", err)
 	}
-	for k, v := range numberOfDuplicates {
-		log.Printf("Skipped adding numEvents=%v from source=%v because they appear to be duplicates (same source, offset and timestamp as an existing event)\n", v, k)
+	for k, v := range ret.Duplicates {
+		repo.logger.Infof("Skipped adding numEvents=%v from source=%v because they appear to be duplicates (same duplicate key as an existing event)", v, k)
 	}
-	log.Printf("added numEvents=%v in timeInMs=%v\n", len(events), time.Now().Sub(startTime).Milliseconds())
-	return nil
+	for k, v := range ret.Replaced {
+		repo.logger.Infof("Replaced the raw of numEvents=%v from source=%v which were duplicates (same duplicate key as an existing event)", v, k)
+	}
+	repo.logger.Debugf("added numEvents=%v in timeInMs=%v", ret.NumAdded(), time.Now().Sub(startTime).Milliseconds())
+	return ret, nil
 }
 
-func (repo *sqliteRepository) FilterStream(srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan []EventWithId {
+func (repo *sqliteRepository) DeleteOlderThan(t time.Time) (int64, error) {
 	startTime := time.Now()
-	ret := make(chan []EventWithId)
+	tx, err := repo.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction for deleting events: %w", err)
+	}
+	// EventRaws, EventContents and EventFields are only linked to Events by id, so they must be deleted first and in
+	// the same transaction to not leave any orphans behind.
+	_, err = tx.Exec("DELETE FROM EventRaws WHERE rowid IN (SELECT id FROM Events WHERE timestamp < ?);", t)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error deleting from EventRaws table: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM EventContents WHERE event_id IN (SELECT id FROM Events WHERE timestamp < ?);", t)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error deleting from EventContents table: %w", err)
+	}
+	_, err = tx.Exec("DELETE FROM EventFields WHERE event_id IN (SELECT id FROM Events WHERE timestamp < ?);", t)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error deleting from EventFields table: %w", err)
+	}
+	res, err := tx.Exec("DELETE FROM Events WHERE timestamp < ?;", t)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error deleting from Events table: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error getting number of deleted events: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("error committing transaction for deleting events: %w", err)
+	}
+	repo.logger.Infof("deleted numEvents=%v older than %v in timeInMs=%v", deleted, t, time.Now().Sub(startTime).Milliseconds())
+	return deleted, nil
+}
+
+func (repo *sqliteRepository) TimeRange() (min, max time.Time, err error) {
+	// MIN and MAX would return the timestamps as strings since the result has no column type, but ORDER BY + LIMIT
+	// keeps the type and uses IX_Events_Timestamp just the same.
+	err = repo.db.QueryRow("SELECT timestamp FROM Events ORDER BY timestamp ASC LIMIT 1;").Scan(&min)
+	if err == sql.ErrNoRows {
+		return time.Time{}, time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error getting oldest timestamp: %w", err)
+	}
+	err = repo.db.QueryRow("SELECT timestamp FROM Events ORDER BY timestamp DESC LIMIT 1;").Scan(&max)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error getting newest timestamp: %w", err)
+	}
+	return min, max, nil
+}
+
+func (repo *sqliteRepository) Sources() ([]string, error) {
+	return querySources(repo.db)
+}
+
+// LatestOffset uses IX_Events_SourceTimestamp to only look at the events from source, and checks the host of each.
+func (repo *sqliteRepository) LatestOffset(host, source string) (int64, bool, error) {
+	return queryLatestOffset(repo.db, "SELECT MAX(offset) FROM Events WHERE host = ? AND source = ?;", host, source)
+}
+
+func (repo *sqliteRepository) Ping(ctx context.Context) error {
+	return pingDB(ctx, repo.db)
+}
+
+// isDuplicateError returns true if err is caused by an event violating one of the unique indexes on the Events table,
+// meaning that an event with the same duplicate key already exists.
+func isDuplicateError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	return false
+}
+
+func (repo *sqliteRepository) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	startTime := time.Now()
+	ret := make(chan FilterStreamPage)
 	go func() {
 		defer close(ret)
-		res, err := repo.db.Query("SELECT MAX(id) FROM Events;")
+		// MAX(id) is NULL when there are no events, in which case there is nothing to search
+		var maxIDOrNull sql.NullInt64
+		err := repo.db.QueryRowContext(ctx, "SELECT MAX(id) FROM Events;").Scan(&maxIDOrNull)
 		if err != nil {
-			log.Println("error when getting max(id) from Events table in FilterStream:", err)
+			sendFilterStreamError(ctx, ret, fmt.Errorf("error getting max(id) from Events table: %w", err))
 			return
 		}
-		if !res.Next() {
-			res.Close()
-			log.Println("weird state in FilterStream, expected one result when getting max(id) from Events but got 0")
+		if !maxIDOrNull.Valid {
 			return
 		}
-		var maxID int
-		err = res.Scan(&maxID)
-		res.Close()
+		maxID := maxIDOrNull.Int64
+		minID, maxInRange, ok, err := repo.idRange(ctx, searchStartTime, searchEndTime)
 		if err != nil {
-			if err.Error() == expectedErrorWhenDatabaseIsEmpty {
+			sendFilterStreamError(ctx, ret, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if maxInRange < maxID {
+			maxID = maxInRange
+		}
+		filter := repo.searchFilter(srch)
+		// The raws are read from EventContents, so EventRaws is only joined when there is something to match. CROSS
+		// JOIN makes Events the outer table, so the raws are looked up by id for the events in the range.
+		from := "Events e CROSS JOIN EventContents c ON c.event_id = e.id"
+		if filter.matchString != "" {
+			from = "Events e INNER JOIN EventRaws r ON r.rowid = e.id INNER JOIN EventContents c ON c.event_id = e.id"
+		}
+
+		order, cmp := "DESC", "<"
+		if srch.OldestFirst {
+			order, cmp = "ASC", ">"
+		}
+		// The snippet comes from the full text search of the raw, so there is nothing to select unless there are fragments
+		// in the MATCH. The host and source are matched using full text search too, but are not part of the snippet.
+		var snippetColumn string
+		var snippetArgs []interface{}
+		if srch.Snippet != nil && filter.matchString != "" && len(fullTextSearchableValues(srch.Fragments)) > 0 {
+			snippetColumn, snippetArgs, err = repo.snippetColumn(srch.Snippet)
+			if err != nil {
+				sendFilterStreamError(ctx, ret, err)
 				return
 			}
-			log.Println("error when scanning max(id) in FilterStream:", err)
-			return
 		}
-		var lastTimestamp string
+
+		var lastTimestamp *time.Time
+		var lastID int64
 		for {
-			stmt := "SELECT e.id, e.host, e.source, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.id <= " + strconv.Itoa(maxID)
+			if ctx.Err() != nil {
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			stmt := "SELECT e.id, e.host, e.source, e.timestamp, c.raw" + snippetColumn + " FROM " + from + " WHERE e.id <= ? AND e.id >= ?"
+			args := append(append([]interface{}{}, snippetArgs...), maxID, minID)
 			if searchStartTime != nil {
-				stmt += " AND e.timestamp >= '" + searchStartTime.String() + "'"
+				stmt += " AND e.timestamp >= ?"
+				args = append(args, *searchStartTime)
 			}
 			if searchEndTime != nil {
-				stmt += " AND e.timestamp <= '" + searchEndTime.String() + "'"
-			}
-			if lastTimestamp != "" {
-				stmt += " AND e.timestamp < '" + lastTimestamp + "'"
+				stmt += " AND e.timestamp <= ?"
+				args = append(args, *searchEndTime)
 			}
-			includes := map[string][]string{}
-			nots := map[string][]string{}
-			hostIncludes := make([]string, 0, len(srch.Hosts))
-			for h := range srch.Hosts {
-				hostIncludes = append(hostIncludes, h)
+			if lastTimestamp != nil {
+				// Keyset pagination on (timestamp, id). Comparing only the timestamp would skip events sharing the
+				// timestamp of the last event on the previous page. IX_Events_Timestamp includes the rowid so this is
+				// still an index range scan.
+				stmt += " AND (e.timestamp, e.id) " + cmp + " (?, ?)"
+				args = append(args, *lastTimestamp, lastID)
 			}
-			includes["host"] = hostIncludes
-			hostNots := make([]string, 0, len(srch.NotHosts))
-			for h := range srch.NotHosts {
-				hostNots = append(hostNots, h)
+			if filter.matchString != "" {
+				// The range is repeated for the rowids since the full text search can only skip the matches outside of
+				// it if the constraint is on EventRaws itself
+				stmt += " AND r.rowid >= ? AND r.rowid <= ? AND EventRaws MATCH ?"
+				args = append(args, minID, maxID, filter.matchString)
 			}
-			nots["host"] = hostNots
-			sourceIncludes := make([]string, 0, len(srch.Sources))
-			for s := range srch.Sources {
-				sourceIncludes = append(sourceIncludes, s)
+			if filter.notMatchString != "" {
+				// The subquery is run again for every page, so it is limited to the range as well to avoid going
+				// through every match of a common term in the whole table each time
+				stmt += " AND e.id NOT IN (SELECT rowid FROM EventRaws WHERE rowid >= ? AND rowid <= ? AND EventRaws MATCH ?)"
+				args = append(args, minID, maxID, filter.notMatchString)
 			}
-			includes["source"] = sourceIncludes
-			sourceNots := make([]string, 0, len(srch.NotSources))
-			for s := range srch.NotSources {
-				sourceNots = append(sourceNots, s)
+			for _, cond := range filter.conds {
+				stmt += " AND " + cond
 			}
-			nots["source"] = sourceNots
-			rawIncludes := make([]string, 0, len(srch.Fragments))
-			for f := range srch.Fragments {
-				rawIncludes = append(rawIncludes, f)
+			args = append(args, filter.args...)
+			stmt += " ORDER BY e.timestamp " + order + ", e.id " + order + " LIMIT ?"
+			args = append(args, repo.pageSize)
+			if repo.cfg.QueryLog != "" {
+				repo.logger.Infof("executing stmt %v %v", stmt, args)
 			}
-			includes["raw"] = rawIncludes
-			rawNots := make([]string, 0, len(srch.NotFragments))
-			for f := range srch.NotFragments {
-				rawNots = append(rawNots, f)
+			if repo.cfg.QueryLog == config.SqliteQueryLogExplain {
+				repo.logQueryPlan(ctx, stmt, args)
 			}
-			nots["raw"] = rawNots
-
-			matchString := ""
-			for k, v := range includes {
-				for _, s := range v {
-					matchString += k + ":" + s + " "
-				}
-			}
-			for k, v := range nots {
-				for _, s := range v {
-					matchString += "NOT " + k + ":" + s + " "
-				}
-			}
-
-			if len(matchString) > 0 {
-				stmt += " AND EventRaws MATCH '" + matchString + "'"
-			}
-			stmt += " ORDER BY e.timestamp DESC LIMIT " + strconv.Itoa(filterStreamPageSize)
-			log.Println("executing stmt", stmt)
-			res, err = repo.db.Query(stmt)
+			pageStartTime := time.Now()
+			res, err := repo.db.QueryContext(ctx, stmt, args...)
 			if err != nil {
-				log.Println("error when getting filtered events in FilterStream:", err)
+				sendFilterStreamError(ctx, ret, fmt.Errorf("error getting filtered events: %w", classifyMatchError(err)))
 				return
 			}
-			evts := make([]EventWithId, 0, filterStreamPageSize)
+			evts := make([]EventWithId, 0, repo.pageSize)
 			eventsInPage := 0
 			for res.Next() {
 				var evt EventWithId
-				err := res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+				dest := []interface{}{&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw}
+				if snippetColumn != "" {
+					dest = append(dest, &evt.Snippet)
+				}
+				err := res.Scan(dest...)
 				if err != nil {
-					log.Printf("error when scanning result in FilterStream: %v\n", err)
+					repo.logger.Errorf("error when scanning result in FilterStream: %v", err)
 				} else {
 					evts = append(evts, evt)
+					lastTimestamp = &evt.Timestamp
+					lastID = evt.Id
 				}
 				eventsInPage++
-				lastTimestamp = evt.Timestamp.String()
 			}
+			err = res.Err()
 			res.Close()
-			ret <- evts
-			if eventsInPage < filterStreamPageSize {
+			if ctx.Err() != nil {
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			if err != nil {
+				sendFilterStreamError(ctx, ret, fmt.Errorf("error iterating over filtered events: %w", classifyMatchError(err)))
+				return
+			}
+			if repo.cfg.QueryLog == config.SqliteQueryLogExplain {
+				repo.logger.Infof("FilterStream page returned numRows=%v in timeInMs=%v", eventsInPage, time.Now().Sub(pageStartTime).Milliseconds())
+			}
+			select {
+			case ret <- FilterStreamPage{Events: evts}:
+			case <-ctx.Done():
+				repo.logger.Debugf("FilterStream was cancelled: %v", ctx.Err())
+				return
+			}
+			if eventsInPage < repo.pageSize {
 				endTime := time.Now()
-				log.Printf("SQL search completed in timeInMs=%v", endTime.Sub(startTime))
+				repo.logger.Debugf("SQL search completed in timeInMs=%v", endTime.Sub(startTime).Milliseconds())
 				return
 			}
 		}
@@ -299,39 +999,386 @@ func (repo *sqliteRepository) FilterStream(srch *search.Search, searchStartTime,
 	return ret
 }
 
-func (repo *sqliteRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
-	ret := make([]EventWithId, len(ids))
+// snippetColumn returns the column which selects the snippet described by opts, with a leading comma, and its
+// arguments. The two FTS modules take the same arguments to snippet() in a different order.
+func (repo *sqliteRepository) snippetColumn(opts *search.SnippetOptions) (string, []interface{}, error) {
+	tokens := opts.Tokens
+	if tokens == 0 {
+		tokens = search.DefaultSnippetTokens
+	}
+	if tokens < 0 || tokens > search.MaxSnippetTokens {
+		return "", nil, fmt.Errorf("snippet tokens must be between 1 and %v, got %v", search.MaxSnippetTokens, tokens)
+	}
+	// The raw is the first column of EventRaws
+	args := []interface{}{opts.Start, opts.End, opts.Ellipsis, tokens}
+	if repo.ftsModule == config.SqliteFtsModuleFts5 {
+		return ", snippet(EventRaws, 0, ?, ?, ?, ?)", args, nil
+	}
+	return ", snippet(EventRaws, ?, ?, ?, 0, ?)", args, nil
+}
+
+// logQueryPlan logs the plan SQLite uses for stmt, one line per step of the plan. Errors are logged instead of
+// returned since the plan is only used for debugging.
+func (repo *sqliteRepository) logQueryPlan(ctx context.Context, stmt string, args []interface{}) {
+	rows, err := repo.db.QueryContext(ctx, "EXPLAIN QUERY PLAN "+stmt, args...)
+	if err != nil {
+		repo.logger.Errorf("error when getting query plan in FilterStream: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, parent, notUsed int64
+		var detail string
+		err = rows.Scan(&id, &parent, &notUsed, &detail)
+		if err != nil {
+			repo.logger.Errorf("error when scanning query plan in FilterStream: %v", err)
+			return
+		}
+		repo.logger.Infof("query plan: id=%v parent=%v detail=%v", id, parent, detail)
+	}
+	if err = rows.Err(); err != nil {
+		repo.logger.Errorf("error when iterating over query plan in FilterStream: %v", err)
+	}
+}
+
+// idRange returns the lowest and highest id of the events between searchStartTime and searchEndTime, or false if
+// there are none. Only events with ids in this range need to be searched, which makes full text search much faster
+// for short time ranges in big databases since it would otherwise go through the matches in the whole table.
+// The range is exact even if events are not added in the order of their timestamps, but is then wider than it has to
+// be. The ids are found using IX_Events_Timestamp, which takes time proportional to the number of events in the time
+// range, so if there is no start time every id up to the highest is used instead of looking at the whole index.
+func (repo *sqliteRepository) idRange(ctx context.Context, searchStartTime, searchEndTime *time.Time) (int64, int64, bool, error) {
+	if searchStartTime == nil {
+		return 0, math.MaxInt64, true, nil
+	}
+	stmt := "SELECT MIN(id), MAX(id) FROM Events WHERE timestamp >= ?"
+	args := []interface{}{*searchStartTime}
+	if searchEndTime != nil {
+		stmt += " AND timestamp <= ?"
+		args = append(args, *searchEndTime)
+	}
+	var minID, maxID sql.NullInt64
+	err := repo.db.QueryRowContext(ctx, stmt, args...).Scan(&minID, &maxID)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error getting id range: %w", err)
+	}
+	if !minID.Valid {
+		return 0, 0, false, nil
+	}
+	return minID.Int64, maxID.Int64, true, nil
+}
+
+// sqliteSearchFilter is the part of a query which filters on the hosts, sources and fragments in a search.
+type sqliteSearchFilter struct {
+	// matchString is the FTS MATCH expression the events must match, and notMatchString matches the events to exclude.
+	// Either can be empty.
+	matchString    string
+	notMatchString string
+	// conds are additional conditions on the raw and the stored fields, which need the EventContents table to be
+	// joined as c and the Events table to be aliased as e.
+	conds []string
+	args  []interface{}
+}
 
-	// TODO: I'm PRETTY sure this code is garbage
-	stmt := "SELECT e.id, e.host, e.source, e.timestamp, r.raw FROM Events e INNER JOIN EventRaws r ON r.rowid = e.id WHERE e.id IN ("
-	for i, id := range ids {
-		if i == len(ids)-1 {
-			stmt += strconv.FormatInt(id, 10)
+// searchFilter returns the filter for the hosts, sources, fragments and stored fields in srch.
+func (repo *sqliteRepository) searchFilter(srch *search.Search) sqliteSearchFilter {
+	var ret sqliteSearchFilter
+	includes := map[string][]string{}
+	nots := map[string][]string{}
+	// Values with wildcards that full text search can not express are left out, which makes the query match more events
+	// than the search. The search step filters those out afterwards. Since an event only has one host and source, a
+	// single such value means the whole group of values has to be left out.
+	includes["host"] = fullTextSearchableGroup(srch.Hosts)
+	nots["host"] = fullTextSearchableValues(srch.NotHosts)
+	includes["source"] = fullTextSearchableGroup(srch.Sources)
+	nots["source"] = fullTextSearchableValues(srch.NotSources)
+	rawIncludes := make([]string, 0, len(srch.Fragments))
+	phraseIncludes := []string{}
+	for _, f := range sortedKeys(srch.Fragments) {
+		if repo.isFts4Phrase(f) {
+			// A phrase without any words, such as "()", would not match anything, so it is only matched using LIKE
+			if isFullTextSearchable(f) && containsWord(f) {
+				phraseIncludes = append(phraseIncludes, f)
+			}
+			ret.conds = append(ret.conds, "c.raw LIKE ? ESCAPE '\\'")
+			ret.args = append(ret.args, likePattern(f))
+		} else if isFullTextSearchable(f) {
+			rawIncludes = append(rawIncludes, f)
+			// The tokenizer drops the punctuation between the words of a fragment such as a-b, so the match also finds
+			// events containing "a b". LIKE makes sure that the fragment is in the raw as it was written.
+			if isMultiToken(f) {
+				ret.conds = append(ret.conds, "c.raw LIKE ? ESCAPE '\\'")
+				ret.args = append(ret.args, likePattern(f))
+			}
+		}
+	}
+	includes["raw"] = rawIncludes
+	rawNots := make([]string, 0, len(srch.NotFragments))
+	for _, f := range sortedKeys(srch.NotFragments) {
+		// The tokenizer drops the punctuation between the words of a fragment such as a-b, so matching it would also
+		// exclude events containing "a b". Such fragments are excluded using LIKE instead, which matches them exactly.
+		if repo.isFts4Phrase(f) || isMultiToken(f) {
+			ret.conds = append(ret.conds, "c.raw NOT LIKE ? ESCAPE '\\'")
+			ret.args = append(ret.args, likePattern(f))
+		} else if isFullTextSearchable(f) {
+			rawNots = append(rawNots, f)
+		}
+	}
+	nots["raw"] = rawNots
+	for _, f := range storedFieldFilters(srch) {
+		// Only events with another value for the field are excluded, events without a stored value are kept
+		ret.conds = append(ret.conds, "NOT EXISTS (SELECT 1 FROM EventFields f WHERE f.event_id = e.id AND f.key = ? AND f.value NOT IN (?"+strings.Repeat(", ?", len(f.values)-1)+"))")
+		ret.args = append(ret.args, f.key)
+		for _, v := range f.values {
+			ret.args = append(ret.args, v)
+		}
+	}
+
+	ret.matchString, ret.notMatchString = repo.matchExpression(includes, phraseIncludes, nots)
+	return ret
+}
+
+// ftsColumns are the columns of EventRaws in the order their terms are added to a MATCH expression. The order is
+// always the same so that a search always gives the same query. FTS4 does not match anything when a raw term which is
+// split into several tokens, such as c++, is followed by AND, so the host and source terms are put before the raw
+// terms.
+var ftsColumns = []string{"host", "source", "raw"}
+
+// matchExpression returns the MATCH expression for events which have any of the included values for host and source,
+// all of the included raw values and phrases, and none of the negated values, such as
+// (source:a OR source:b) AND raw:x AND raw:y NOT source:c NOT raw:z
+//
+// Some negations can not be part of that expression, and are instead returned in notMatchString which matches the
+// events to exclude, such as source:c OR raw:z. NOT is a binary operator in FTS, so if there are no included values
+// all of the negations are returned in notMatchString. FTS4 only negates the first token of a term which is split into
+// several tokens, such as NOT host:host-b, which would exclude every event with a host containing "host". So those
+// terms are always returned in notMatchString for FTS4.
+func (repo *sqliteRepository) matchExpression(includes map[string][]string, phrases []string, nots map[string][]string) (matchString, notMatchString string) {
+	included := []string{}
+	for _, column := range ftsColumns {
+		values := includes[column]
+		if len(values) == 0 {
+			continue
+		}
+		terms := make([]string, len(values))
+		for i, v := range values {
+			terms[i] = repo.matchTerm(column, v)
+		}
+		if column == "raw" || len(terms) == 1 {
+			included = append(included, terms...)
 		} else {
-			stmt += strconv.FormatInt(id, 10) + ","
+			// An event can only have one host and source, so multiple values mean any of them should match
+			included = append(included, "("+strings.Join(terms, " OR ")+")")
 		}
 	}
-	stmt += ")"
+	// FTS4 can not restrict a phrase to a column, so phrases match any column and the LIKE conditions make sure that
+	// the phrase is actually in the raw.
+	for _, f := range phrases {
+		included = append(included, "\""+strings.ReplaceAll(f, "\"", " ")+"\"")
+	}
+	negated := []string{}
+	excluded := []string{}
+	for _, column := range ftsColumns {
+		for _, v := range nots[column] {
+			if len(included) == 0 || (repo.ftsModule == config.SqliteFtsModuleFts4 && isMultiToken(v)) {
+				excluded = append(excluded, repo.matchTerm(column, v))
+			} else {
+				negated = append(negated, repo.matchTerm(column, v))
+			}
+		}
+	}
+	notMatchString = strings.Join(excluded, " OR ")
 
-	if sortMode == SortModeTimestampDesc {
-		stmt += " ORDER BY e.timestamp DESC;"
-	} else {
-		stmt += ";"
+	if len(included) == 0 {
+		return "", notMatchString
 	}
+	// The included terms are joined with an explicit AND since FTS5 does not treat a term followed by a parenthesized
+	// group as an implicit AND.
+	matchString = strings.Join(included, " AND ")
+	if len(negated) > 0 {
+		if len(included) > 1 {
+			matchString = "(" + matchString + ")"
+		}
+		matchString += " NOT " + strings.Join(negated, " NOT ")
+	}
+	return matchString, notMatchString
+}
 
-	res, err := repo.db.Query(stmt)
+// isMultiToken returns true if the tokenizer splits value into several tokens, because it contains characters other
+// than letters and digits. A trailing wildcard does not count since it makes value a prefix query.
+func isMultiToken(value string) bool {
+	return strings.IndexFunc(strings.TrimSuffix(value, "*"), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) != -1
+}
+
+// fts4SyntaxChars are the characters which are part of the FTS4 query syntax even within a term. A quote starts a
+// phrase, parentheses group terms and a colon restricts a term to a column, so a term containing them either causes a
+// syntax error or matches the wrong events.
+const fts4SyntaxChars = "\"():"
+
+// isFts4Phrase returns true if FTS4 is used and fragment has to be matched as a phrase, because it contains whitespace
+// or one of fts4SyntaxChars. Within a phrase those characters only separate the words, like any other punctuation.
+// FTS5 does not need this since matchTerm quotes every term for it.
+func (repo *sqliteRepository) isFts4Phrase(fragment string) bool {
+	return repo.ftsModule == config.SqliteFtsModuleFts4 && (strings.IndexFunc(fragment, unicode.IsSpace) != -1 || strings.ContainsAny(fragment, fts4SyntaxChars))
+}
+
+// containsWord returns true if value contains a letter or digit, meaning that the tokenizer finds at least one word.
+func containsWord(value string) bool {
+	return strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) != -1
+}
+
+// likePattern returns a LIKE pattern with \ as the escape character which matches fragment anywhere in a string,
+// with the wildcards in fragment matching anything.
+func likePattern(fragment string) string {
+	s := strings.ReplaceAll(fragment, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "%", "\\%")
+	s = strings.ReplaceAll(s, "_", "\\_")
+	return "%" + strings.ReplaceAll(s, "*", "%") + "%"
+}
+
+func (repo *sqliteRepository) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	minID, maxID, ok, err := repo.idRange(ctx, searchStartTime, searchEndTime)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, nil
+	}
+	filter := repo.searchFilter(srch)
+	stmt := "SELECT COUNT(*) FROM Events e"
+	conds := []string{}
+	args := []interface{}{}
+	if filter.matchString != "" {
+		stmt += " INNER JOIN EventRaws r ON r.rowid = e.id"
+		conds = append(conds, "r.rowid >= ? AND r.rowid <= ? AND EventRaws MATCH ?")
+		args = append(args, minID, maxID, filter.matchString)
+	}
+	if len(filter.conds) > 0 {
+		if filter.matchString != "" {
+			stmt += " INNER JOIN EventContents c ON c.event_id = e.id"
+		} else {
+			stmt += " CROSS JOIN EventContents c ON c.event_id = e.id"
+		}
+	}
+	if filter.notMatchString != "" {
+		conds = append(conds, "e.id NOT IN (SELECT rowid FROM EventRaws WHERE rowid >= ? AND rowid <= ? AND EventRaws MATCH ?)")
+		args = append(args, minID, maxID, filter.notMatchString)
+	}
+	conds = append(conds, filter.conds...)
+	args = append(args, filter.args...)
+	if searchStartTime != nil {
+		conds = append(conds, "e.timestamp >= ?")
+		args = append(args, *searchStartTime)
+	}
+	if searchEndTime != nil {
+		conds = append(conds, "e.timestamp <= ?")
+		args = append(args, *searchEndTime)
+	}
+	if len(conds) > 0 {
+		stmt += " WHERE " + strings.Join(conds, " AND ")
+	}
+	var count int64
+	err = repo.db.QueryRowContext(ctx, stmt, args...).Scan(&count)
 	if err != nil {
-		return nil, fmt.Errorf("error executing GetByIds query: %w", err)
+		return 0, fmt.Errorf("error counting events: %w", classifyMatchError(err))
 	}
-	defer res.Close()
+	return count, nil
+}
+
+// ftsSyntaxErrors are parts of the messages SQLite gives when a MATCH expression is not valid FTS4 or FTS5 syntax.
+var ftsSyntaxErrors = []string{
+	"malformed MATCH expression",
+	"fts5: syntax error",
+	"unterminated string",
+	"unknown special query",
+}
 
-	idx := 0
-	for res.Next() {
-		err = res.Scan(&ret[idx].Id, &ret[idx].Host, &ret[idx].Source, &ret[idx].Timestamp, &ret[idx].Raw)
+// classifyMatchError returns err wrapped in ErrInvalidSearch if it is caused by a MATCH expression which SQLite could
+// not parse, so that it can be told apart from errors in the database itself. Other errors are returned as they are.
+// The message of err is kept since it shows which part of the expression was rejected.
+func classifyMatchError(err error) error {
+	msg := err.Error()
+	for _, s := range ftsSyntaxErrors {
+		if strings.Contains(msg, s) {
+			return fmt.Errorf("%w: %v", ErrInvalidSearch, err)
+		}
+	}
+	return err
+}
+
+// matchTerm returns an FTS MATCH term which matches value in column.
+// FTS4 splits barewords containing punctuation into phrases by itself, but FTS5 treats punctuation outside of a string
+// as a syntax error. So for FTS5 the value is quoted, keeping a trailing * outside the quotes as a prefix query.
+func (repo *sqliteRepository) matchTerm(column, value string) string {
+	if repo.ftsModule != config.SqliteFtsModuleFts5 {
+		return column + ":" + value
+	}
+	prefix := ""
+	if strings.HasSuffix(value, "*") {
+		value = strings.TrimSuffix(value, "*")
+		prefix = "*"
+	}
+	return column + ":\"" + strings.ReplaceAll(value, "\"", "\"\"") + "\"" + prefix
+}
+
+func (repo *sqliteRepository) GetById(id int64) (*EventWithId, error) {
+	var evt EventWithId
+	err := repo.db.QueryRow("SELECT e.id, e.host, e.source, e.timestamp, c.raw FROM Events e CROSS JOIN EventContents c ON c.event_id = e.id WHERE e.id = ?;", id).
+		Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, err)
+	}
+	return &evt, nil
+}
+
+func (repo *sqliteRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	ret := make([]EventWithId, 0, len(ids))
+
+	// SQLite limits the number of host parameters in a statement, so the ids are split into multiple queries
+	for start := 0; start < len(ids); start += getByIdsChunkSize {
+		end := start + getByIdsChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+
+		stmt := "SELECT e.id, e.host, e.source, e.timestamp, c.raw FROM Events e CROSS JOIN EventContents c ON c.event_id = e.id WHERE e.id IN (?" + strings.Repeat(",?", len(chunk)-1) + ");"
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+
+		res, err := repo.db.Query(stmt, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error executing GetByIds query: %w", err)
+		}
+		for res.Next() {
+			var evt EventWithId
+			err = res.Scan(&evt.Id, &evt.Host, &evt.Source, &evt.Timestamp, &evt.Raw)
+			if err != nil {
+				res.Close()
+				return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
+			}
+			ret = append(ret, evt)
+		}
+		err = res.Err()
+		res.Close()
 		if err != nil {
-			return nil, fmt.Errorf("error when scanning row in GetByIds: %w", err)
+			return nil, fmt.Errorf("error when iterating over rows in GetByIds: %w", err)
 		}
-		idx++
+	}
+
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
 	}
 
 	return ret, nil
@@ -0,0 +1,122 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build sqlite_fts5 || fts5
+// +build sqlite_fts5 fts5
+
+package events
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func init() {
+	repositoryFactories["sqliteFts5"] = func(t testing.TB) Repository {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+		}
+		repo, err := SqliteRepository(db, &config.SqliteConfig{
+			DatabaseFile: ":memory:",
+			TrueBatch:    true,
+			FtsModule:    config.SqliteFtsModuleFts5,
+		})
+		if err != nil {
+			t.Fatalf("got error when creating events repo: %v", err)
+		}
+		return repo
+	}
+}
+
+var migrationSearches = []*search.Search{
+	{},
+	{Fragments: map[string]struct{}{"user": {}}},
+	{Fragments: map[string]struct{}{"log*": {}}},
+	{NotFragments: map[string]struct{}{"out": {}}},
+	{Sources: map[string]struct{}{"access.txt": {}}},
+	{Hosts: map[string]struct{}{"host-a": {}, "host-b": {}}, NotSources: map[string]struct{}{"error.txt": {}}},
+}
+
+func searchIds(repo Repository) [][]int64 {
+	ret := make([][]int64, len(migrationSearches))
+	for i, srch := range migrationSearches {
+		for _, evt := range collectFilterStream(repo, srch, nil, nil) {
+			ret[i] = append(ret[i], evt.Id)
+		}
+	}
+	return ret
+}
+
+func TestSqliteRepository_RebuildsEventRawsWhenFtsModuleChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsuck-fts")
+	if err != nil {
+		t.Fatalf("got error when creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "logsuck.db")
+
+	open := func(ftsModule string) (*sql.DB, Repository) {
+		db, err := sql.Open("sqlite3", dbFile)
+		if err != nil {
+			t.Fatalf("got error when opening SQLite database: %v", err)
+		}
+		repo, err := SqliteRepository(db, &config.SqliteConfig{
+			DatabaseFile: dbFile,
+			TrueBatch:    true,
+			FtsModule:    ftsModule,
+		})
+		if err != nil {
+			t.Fatalf("got error when creating events repo with ftsModule=%v: %v", ftsModule, err)
+		}
+		return db, repo
+	}
+
+	db, repo := open(config.SqliteFtsModuleFts4)
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	expected := searchIds(repo)
+	db.Close()
+
+	for _, ftsModule := range []string{config.SqliteFtsModuleFts5, config.SqliteFtsModuleFts4} {
+		db, repo = open(ftsModule)
+		definition, err := eventRawsDefinitionInUse(db)
+		if err != nil {
+			t.Fatalf("got error when checking eventraws definition: %v", err)
+		}
+		if expected := eventRawsDefinition(ftsModule, ""); definition != expected {
+			t.Fatalf("TestSqliteRepository_RebuildsEventRawsWhenFtsModuleChanges expected definition=%v but got %v", expected, definition)
+		}
+		got := searchIds(repo)
+		for i := range expected {
+			if len(got[i]) != len(expected[i]) {
+				t.Fatalf("TestSqliteRepository_RebuildsEventRawsWhenFtsModuleChanges got unexpected result for search %+v after migrating to %v, expected %v but got %v", migrationSearches[i], ftsModule, expected[i], got[i])
+			}
+			for j := range expected[i] {
+				if got[i][j] != expected[i][j] {
+					t.Fatalf("TestSqliteRepository_RebuildsEventRawsWhenFtsModuleChanges got unexpected result for search %+v after migrating to %v, expected %v but got %v", migrationSearches[i], ftsModule, expected[i], got[i])
+				}
+			}
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !sqlite_fts5 && !fts5
+// +build !sqlite_fts5,!fts5
+
+package events
+
+// fts5Available is true when go-sqlite3 has been built with FTS5 support, which requires the sqlite_fts5 build tag.
+const fts5Available = false
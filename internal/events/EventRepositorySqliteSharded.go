@@ -0,0 +1,526 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// shardFileLayout is the name of the database file of each shard, as a time layout for the day of the shard.
+const shardFileLayout = "events-2006-01-02.db"
+
+// shardIDBits is the number of bits of an event id which are the id of the event in its shard. The rest of the id is
+// the day of the shard, so the ids stay unique and increasing across shards and are the same after a restart.
+const shardIDBits = 40
+
+// shardLength is the time range each shard contains events from.
+const shardLength = 24 * time.Hour
+
+type sqliteShard struct {
+	day  int64
+	path string
+	db   *sql.DB
+	repo Repository
+	// users counts the callers which have gotten the shard from the repository and not released it yet. It is only
+	// added to while the shard is in the shards map, so once it has been removed from the map the shard can be closed
+	// after waiting for users.
+	users sync.WaitGroup
+}
+
+func (s *sqliteShard) release() {
+	s.users.Done()
+}
+
+func releaseShards(shards []*sqliteShard) {
+	for _, s := range shards {
+		s.release()
+	}
+}
+
+type shardedSqliteRepository struct {
+	cfg    *config.SqliteConfig
+	logger logging.Logger
+
+	mu sync.RWMutex
+	// shards contains the shards by their day, as the number of days since the Unix epoch in UTC.
+	shards map[int64]*sqliteShard
+	// removing contains a channel for each day whose shard is being removed, which is closed once its files are gone.
+	// The shard of such a day is not created again until then, since it would use the same files.
+	removing map[int64]chan struct{}
+}
+
+// ShardedSqliteRepository creates a Repository which stores the events of each day (in UTC) in its own SQLite
+// database in cfg.ShardDirectory. The shards already in the directory are opened, and the shard of a day is created
+// when the first event of that day is added.
+//
+// Searches only read the shards of the days in their time range. Deleting old events removes the files of the days
+// which are entirely expired instead of deleting the events one by one.
+// Adding a batch with events from several days is only atomic per shard, so if an error is returned the events of
+// some days may have been added. Adding the batch again skips those events as duplicates.
+func ShardedSqliteRepository(cfg *config.SqliteConfig) (Repository, error) {
+	err := os.MkdirAll(cfg.ShardDirectory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating shard directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(cfg.ShardDirectory, "events-*.db"))
+	if err != nil {
+		return nil, fmt.Errorf("error finding shards: %w", err)
+	}
+	repo := &shardedSqliteRepository{
+		cfg:      cfg,
+		logger:   logging.OrDefault(cfg.Logger),
+		shards:   map[int64]*sqliteShard{},
+		removing: map[int64]chan struct{}{},
+	}
+	for _, path := range paths {
+		t, err := time.Parse(shardFileLayout, filepath.Base(path))
+		if err != nil {
+			repo.logger.Warnf("Ignoring file=%v in shard directory since its name is not the name of a shard: %v", path, err)
+			continue
+		}
+		s, err := repo.shard(dayOf(t))
+		if err != nil {
+			return nil, err
+		}
+		s.release()
+	}
+	repo.logger.Infof("Opened numShards=%v in shardDirectory=%v", len(repo.shards), cfg.ShardDirectory)
+	return repo, nil
+}
+
+// dayOf returns the number of days between the Unix epoch and t in UTC.
+func dayOf(t time.Time) int64 {
+	return t.UTC().Truncate(shardLength).Unix() / int64(shardLength/time.Second)
+}
+
+func dayStart(d int64) time.Time {
+	return time.Unix(d*int64(shardLength/time.Second), 0).UTC()
+}
+
+// shard returns the shard of day d, opening or creating its database if it is not open already. The caller must
+// release the shard when it is done with it.
+func (repo *shardedSqliteRepository) shard(d int64) (*sqliteShard, error) {
+	repo.mu.RLock()
+	s, ok := repo.shards[d]
+	if ok {
+		s.users.Add(1)
+	}
+	repo.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+	repo.mu.Lock()
+	for {
+		if s, ok := repo.shards[d]; ok {
+			s.users.Add(1)
+			repo.mu.Unlock()
+			return s, nil
+		}
+		removed, ok := repo.removing[d]
+		if !ok {
+			break
+		}
+		repo.mu.Unlock()
+		<-removed
+		repo.mu.Lock()
+	}
+	defer repo.mu.Unlock()
+	shardCfg := *repo.cfg
+	shardCfg.DatabaseFile = filepath.Join(repo.cfg.ShardDirectory, dayStart(d).Format(shardFileLayout))
+	db, err := sql.Open("sqlite3", SqliteDataSourceName(&shardCfg))
+	if err != nil {
+		return nil, fmt.Errorf("error opening shard=%v: %w", shardCfg.DatabaseFile, err)
+	}
+	shardRepo, err := SqliteRepository(db, &shardCfg)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating repository for shard=%v: %w", shardCfg.DatabaseFile, err)
+	}
+	s = &sqliteShard{day: d, path: shardCfg.DatabaseFile, db: db, repo: shardRepo}
+	s.users.Add(1)
+	repo.shards[d] = s
+	return s, nil
+}
+
+// shardsBetween returns the shards which may contain events between start and end, newest first. A nil start or end
+// means that the range is unbounded in that direction. The caller must release the shards when it is done with them.
+func (repo *shardedSqliteRepository) shardsBetween(start, end *time.Time) []*sqliteShard {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	ret := make([]*sqliteShard, 0, len(repo.shards))
+	for d, s := range repo.shards {
+		if start != nil && d < dayOf(*start) {
+			continue
+		}
+		if end != nil && d > dayOf(*end) {
+			continue
+		}
+		s.users.Add(1)
+		ret = append(ret, s)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].day > ret[j].day
+	})
+	return ret
+}
+
+func shardEventID(d, id int64) int64 {
+	if id == DuplicateId {
+		return DuplicateId
+	}
+	return d<<shardIDBits | id
+}
+
+func (repo *shardedSqliteRepository) AddBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, Repository.AddBatch)
+}
+
+func (repo *shardedSqliteRepository) UpsertBatch(events []Event) (AddBatchResult, error) {
+	return repo.addBatch(events, Repository.UpsertBatch)
+}
+
+func (repo *shardedSqliteRepository) addBatch(events []Event, add func(Repository, []Event) (AddBatchResult, error)) (AddBatchResult, error) {
+	// indexes contains the indexes in events of the events of each day
+	indexes := map[int64][]int{}
+	days := []int64{}
+	for i, evt := range events {
+		d := dayOf(evt.Timestamp)
+		if d < 0 {
+			return AddBatchResult{}, fmt.Errorf("error adding event with timestamp=%v: events from before 1970 can not be sharded", evt.Timestamp)
+		}
+		if _, ok := indexes[d]; !ok {
+			days = append(days, d)
+		}
+		indexes[d] = append(indexes[d], i)
+	}
+	ret := AddBatchResult{Ids: make([]int64, len(events)), Duplicates: map[string]int64{}, Replaced: map[string]int64{}}
+	for _, d := range days {
+		s, err := repo.shard(d)
+		if err != nil {
+			return AddBatchResult{}, err
+		}
+		dayEvents := make([]Event, len(indexes[d]))
+		for i, index := range indexes[d] {
+			dayEvents[i] = events[index]
+		}
+		res, err := add(s.repo, dayEvents)
+		s.release()
+		if err != nil {
+			return AddBatchResult{}, fmt.Errorf("error adding events to shard=%v: %w", s.path, err)
+		}
+		for i, index := range indexes[d] {
+			ret.Ids[index] = shardEventID(d, res.Ids[i])
+		}
+		for k, v := range res.Duplicates {
+			ret.Duplicates[k] += v
+		}
+		for k, v := range res.Replaced {
+			ret.Replaced[k] += v
+		}
+	}
+	return ret, nil
+}
+
+// FilterStream searches the shards one at a time, newest first, or oldest first if srch.OldestFirst is set. The shards
+// do not overlap in time, so that keeps the events ordered by timestamp without having to merge the streams of the
+// shards.
+func (repo *shardedSqliteRepository) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan FilterStreamPage {
+	ret := make(chan FilterStreamPage)
+	go func() {
+		defer close(ret)
+		shards := repo.shardsBetween(searchStartTime, searchEndTime)
+		if srch.OldestFirst {
+			for i, j := 0, len(shards)-1; i < j; i, j = i+1, j-1 {
+				shards[i], shards[j] = shards[j], shards[i]
+			}
+		}
+		// Each shard is released as soon as it has been searched, so that removing it does not have to wait for the
+		// rest of the search
+		searched := 0
+		defer func() { releaseShards(shards[searched:]) }()
+		for _, s := range shards {
+			for page := range s.repo.FilterStream(ctx, srch, searchStartTime, searchEndTime) {
+				if page.Err != nil {
+					sendFilterStreamError(ctx, ret, fmt.Errorf("error searching shard=%v: %w", s.path, page.Err))
+					return
+				}
+				for i := range page.Events {
+					page.Events[i].Id = shardEventID(s.day, page.Events[i].Id)
+				}
+				select {
+				case ret <- page:
+				case <-ctx.Done():
+					return
+				}
+			}
+			s.release()
+			searched++
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return ret
+}
+
+func (repo *shardedSqliteRepository) Count(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) (int64, error) {
+	var total int64
+	shards := repo.shardsBetween(searchStartTime, searchEndTime)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		count, err := s.repo.Count(ctx, srch, searchStartTime, searchEndTime)
+		if err != nil {
+			return 0, fmt.Errorf("error counting events in shard=%v: %w", s.path, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// existingShard returns the shard which the event with the given id is in and the id of the event in the shard.
+// nil is returned if there is no such shard. The caller must release the shard if it is not nil.
+func (repo *shardedSqliteRepository) existingShard(id int64) (*sqliteShard, int64) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	s := repo.shards[id>>shardIDBits]
+	if s != nil {
+		s.users.Add(1)
+	}
+	return s, id & (1<<shardIDBits - 1)
+}
+
+func (repo *shardedSqliteRepository) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	shards := map[*sqliteShard][]int64{}
+	for _, id := range ids {
+		if id <= 0 {
+			continue
+		}
+		if s, localID := repo.existingShard(id); s != nil {
+			shards[s] = append(shards[s], localID)
+		}
+	}
+	// existingShard is called for every id, so each shard is released as many times as it has ids
+	defer func() {
+		for s, localIds := range shards {
+			for range localIds {
+				s.release()
+			}
+		}
+	}()
+	byID := make(map[int64]EventWithId, len(ids))
+	for s, localIds := range shards {
+		evts, err := s.repo.GetByIds(localIds, SortModeNone)
+		if err != nil {
+			return nil, fmt.Errorf("error getting events from shard=%v: %w", s.path, err)
+		}
+		for _, evt := range evts {
+			evt.Id = shardEventID(s.day, evt.Id)
+			byID[evt.Id] = evt
+		}
+	}
+	// The events are put back in the order of ids, which is the order for SortModeNone
+	ret := make([]EventWithId, 0, len(byID))
+	for _, id := range ids {
+		if evt, ok := byID[id]; ok {
+			ret = append(ret, evt)
+		}
+	}
+	if sortMode == SortModeTimestampDesc {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return ret[i].Timestamp.After(ret[j].Timestamp)
+		})
+	}
+	return ret, nil
+}
+
+func (repo *shardedSqliteRepository) GetById(id int64) (*EventWithId, error) {
+	if id <= 0 {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	s, localID := repo.existingShard(id)
+	if s == nil {
+		return nil, fmt.Errorf("error getting eventId=%v: %w", id, ErrEventNotFound)
+	}
+	defer s.release()
+	evt, err := s.repo.GetById(localID)
+	if err != nil {
+		return nil, err
+	}
+	evt.Id = id
+	return evt, nil
+}
+
+// DeleteOlderThan removes the shards of the days which are entirely before t, and deletes the events before t from
+// the shard of the day t is in.
+func (repo *shardedSqliteRepository) DeleteOlderThan(t time.Time) (int64, error) {
+	var deleted int64
+	shards := repo.shardsBetween(nil, &t)
+	for i, s := range shards {
+		var n int64
+		var err error
+		if dayStart(s.day).Add(shardLength).After(t) {
+			n, err = s.repo.DeleteOlderThan(t)
+			s.release()
+			if err != nil {
+				err = fmt.Errorf("error deleting events in shard=%v: %w", s.path, err)
+			}
+		} else {
+			n, err = repo.removeShard(s)
+		}
+		deleted += n
+		if err != nil {
+			releaseShards(shards[i+1:])
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// removeShard closes the database of s and removes its files, and returns the number of events it contained. The
+// caller must have gotten s from the repository, and s is released by removeShard. The shard is closed once everyone
+// else using it has released it, so searches which are reading from it are not interrupted.
+func (repo *shardedSqliteRepository) removeShard(s *sqliteShard) (int64, error) {
+	count, err := s.repo.Count(context.Background(), &search.Search{}, nil, nil)
+	if err != nil {
+		s.release()
+		return 0, fmt.Errorf("error counting events in shard=%v before removing it: %w", s.path, err)
+	}
+	removed := make(chan struct{})
+	repo.mu.Lock()
+	delete(repo.shards, s.day)
+	repo.removing[s.day] = removed
+	repo.mu.Unlock()
+	defer func() {
+		repo.mu.Lock()
+		delete(repo.removing, s.day)
+		repo.mu.Unlock()
+		close(removed)
+	}()
+	s.release()
+	s.users.Wait()
+	err = s.db.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error closing shard=%v before removing it: %w", s.path, err)
+	}
+	// The write-ahead log and shared memory files only exist when WAL is enabled
+	for _, path := range []string{s.path, s.path + "-wal", s.path + "-shm"} {
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("error removing shard file=%v: %w", path, err)
+		}
+	}
+	repo.logger.Infof("Removed shard=%v with numEvents=%v", s.path, count)
+	return count, nil
+}
+
+func (repo *shardedSqliteRepository) TimeRange() (min, max time.Time, err error) {
+	shards := repo.shardsBetween(nil, nil)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		sMin, sMax, err := s.repo.TimeRange()
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("error getting time range of shard=%v: %w", s.path, err)
+		}
+		if sMin.IsZero() && sMax.IsZero() {
+			continue
+		}
+		if min.IsZero() || sMin.Before(min) {
+			min = sMin
+		}
+		if max.IsZero() || sMax.After(max) {
+			max = sMax
+		}
+	}
+	return min, max, nil
+}
+
+// LatestOffset looks in every shard, since the events are sharded by their timestamps and not by when they were added,
+// so the event with the highest offset can be in any of them.
+func (repo *shardedSqliteRepository) LatestOffset(host, source string) (int64, bool, error) {
+	var max int64
+	found := false
+	shards := repo.shardsBetween(nil, nil)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		offset, ok, err := s.repo.LatestOffset(host, source)
+		if err != nil {
+			return 0, false, fmt.Errorf("error getting latest offset of shard=%v: %w", s.path, err)
+		}
+		if ok && (!found || offset > max) {
+			max = offset
+			found = true
+		}
+	}
+	return max, found, nil
+}
+
+func (repo *shardedSqliteRepository) Sources() ([]string, error) {
+	seen := map[string]struct{}{}
+	ret := []string{}
+	shards := repo.shardsBetween(nil, nil)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		sources, err := s.repo.Sources()
+		if err != nil {
+			return nil, fmt.Errorf("error getting sources of shard=%v: %w", s.path, err)
+		}
+		for _, source := range sources {
+			if _, ok := seen[source]; !ok {
+				seen[source] = struct{}{}
+				ret = append(ret, source)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Ping pings every shard, since a search can read from any of them.
+func (repo *shardedSqliteRepository) Ping(ctx context.Context) error {
+	shards := repo.shardsBetween(nil, nil)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		err := s.repo.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("error pinging shard=%v: %w", s.path, err)
+		}
+	}
+	return nil
+}
+
+// RebuildIndex rebuilds the index of every shard, one at a time.
+func (repo *shardedSqliteRepository) RebuildIndex(ctx context.Context) error {
+	shards := repo.shardsBetween(nil, nil)
+	defer releaseShards(shards)
+	for _, s := range shards {
+		err := s.repo.(IndexRebuilder).RebuildIndex(ctx)
+		if err != nil {
+			return fmt.Errorf("error rebuilding index of shard=%v: %w", s.path, err)
+		}
+	}
+	return nil
+}
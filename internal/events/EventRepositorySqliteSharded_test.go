@@ -0,0 +1,265 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// newShardedRepo creates a sharded repository in a new temporary directory, with 4 events per day on the 1st, 2nd
+// and 3rd of February 2021.
+func newShardedRepo(t *testing.T) (Repository, *config.SqliteConfig) {
+	return newShardedRepoWithConfig(t, &config.SqliteConfig{TrueBatch: true})
+}
+
+// newShardedRepoWithConfig is like newShardedRepo but uses cfg, with ShardDirectory set to the temporary directory.
+func newShardedRepoWithConfig(t *testing.T, cfg *config.SqliteConfig) (Repository, *config.SqliteConfig) {
+	dir, err := ioutil.TempDir("", "logsuck-shards")
+	if err != nil {
+		t.Fatalf("got error when creating temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cfg.ShardDirectory = dir
+	repo, err := ShardedSqliteRepository(cfg)
+	if err != nil {
+		t.Fatalf("got error when creating sharded repository: %v", err)
+	}
+	evts := []Event{}
+	for d := 1; d <= 3; d++ {
+		for h := 0; h < 24; h += 6 {
+			evts = append(evts, Event{
+				Raw:       fmt.Sprintf("event on day %v at hour %v", d, h),
+				Timestamp: time.Date(2021, 2, d, h, 0, 0, 0, time.UTC),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(len(evts)),
+			})
+		}
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	return repo, cfg
+}
+
+func TestShardedSqliteRepository_WritesToShardOfDay(t *testing.T) {
+	_, cfg := newShardedRepo(t)
+	for _, name := range []string{"events-2021-02-01.db", "events-2021-02-02.db", "events-2021-02-03.db"} {
+		db, err := sql.Open("sqlite3", filepath.Join(cfg.ShardDirectory, name))
+		if err != nil {
+			t.Fatalf("got error when opening shard %v: %v", name, err)
+		}
+		defer db.Close()
+		var count int
+		var minTimestamp, maxTimestamp time.Time
+		err = db.QueryRow("SELECT COUNT(*) FROM Events;").Scan(&count)
+		if err != nil {
+			t.Fatalf("got error when counting events in shard %v: %v", name, err)
+		}
+		err = db.QueryRow("SELECT timestamp FROM Events ORDER BY timestamp ASC LIMIT 1;").Scan(&minTimestamp)
+		if err != nil {
+			t.Fatalf("got error when getting oldest event in shard %v: %v", name, err)
+		}
+		err = db.QueryRow("SELECT timestamp FROM Events ORDER BY timestamp DESC LIMIT 1;").Scan(&maxTimestamp)
+		if err != nil {
+			t.Fatalf("got error when getting newest event in shard %v: %v", name, err)
+		}
+		if count != 4 || minTimestamp.Format(shardFileLayout) != name || maxTimestamp.Format(shardFileLayout) != name {
+			t.Fatalf("got unexpected events in shard %v, expected 4 events from that day but got count=%v from %v to %v", name, count, minTimestamp, maxTimestamp)
+		}
+	}
+}
+
+func TestShardedSqliteRepository_SearchAcrossDays(t *testing.T) {
+	repo, cfg := newShardedRepo(t)
+
+	evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+	if len(evts) != 12 {
+		t.Fatalf("got unexpected number of events, expected 12 but got %v", len(evts))
+	}
+	for i := 1; i < len(evts); i++ {
+		if !evts[i].Timestamp.Before(evts[i-1].Timestamp) || evts[i].Id >= evts[i-1].Id {
+			t.Fatalf("got unexpected order at index %v, expected timestamp and id before %v but got %v", i, evts[i-1], evts[i])
+		}
+	}
+
+	// From 18:00 on the 1st to 06:00 on the 3rd spans all three shards
+	start := time.Date(2021, 2, 1, 18, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 2, 3, 6, 0, 0, 0, time.UTC)
+	evts = collectFilterStream(repo, &search.Search{}, &start, &end)
+	if len(evts) != 7 || !evts[0].Timestamp.Equal(end) || !evts[6].Timestamp.Equal(start) {
+		t.Fatalf("got unexpected events between %v and %v, expected 7 events but got %v", start, end, evts)
+	}
+	// Oldest first the shards are searched in the opposite order
+	oldestFirst := collectFilterStream(repo, &search.Search{OldestFirst: true}, &start, &end)
+	if len(oldestFirst) != len(evts) {
+		t.Fatalf("got unexpected number of events oldest first between %v and %v, expected %v but got %v", start, end, len(evts), len(oldestFirst))
+	}
+	for i, evt := range oldestFirst {
+		if evt.Id != evts[len(evts)-1-i].Id {
+			t.Fatalf("got unexpected events oldest first between %v and %v, expected the reverse of %v but got %v", start, end, evts, oldestFirst)
+		}
+	}
+	count, err := repo.Count(context.Background(), &search.Search{Fragments: map[string]struct{}{"hour": {}}}, &start, &end)
+	if err != nil {
+		t.Fatalf("got error when counting events: %v", err)
+	}
+	if count != 7 {
+		t.Fatalf("got unexpected count between %v and %v, expected 7 but got %v", start, end, count)
+	}
+
+	// The ids are the same after the shards are opened again
+	reopened, err := ShardedSqliteRepository(cfg)
+	if err != nil {
+		t.Fatalf("got error when opening sharded repository again: %v", err)
+	}
+	for _, expected := range evts {
+		evt, err := reopened.GetById(expected.Id)
+		if err != nil {
+			t.Fatalf("got error when getting eventId=%v: %v", expected.Id, err)
+		}
+		if evt.Raw != expected.Raw {
+			t.Fatalf("got unexpected event for eventId=%v, expected raw=%q but got %v", expected.Id, expected.Raw, evt)
+		}
+	}
+	byIds, err := reopened.GetByIds([]int64{evts[6].Id, evts[0].Id}, SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when getting events by ids: %v", err)
+	}
+	if len(byIds) != 2 || byIds[0].Id != evts[0].Id || byIds[1].Id != evts[6].Id {
+		t.Fatalf("got unexpected events by ids, expected %v and %v but got %v", evts[0].Id, evts[6].Id, byIds)
+	}
+}
+
+func TestShardedSqliteRepository_RebuildIndex(t *testing.T) {
+	repo, cfg := newShardedRepo(t)
+	srch := &search.Search{Fragments: map[string]struct{}{"hour": {}}}
+	expected := collectFilterStream(repo, srch, nil, nil)
+
+	db, err := sql.Open("sqlite3", filepath.Join(cfg.ShardDirectory, "events-2021-02-02.db"))
+	if err != nil {
+		t.Fatalf("got error when opening shard: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec("DELETE FROM EventRaws;")
+	if err != nil {
+		t.Fatalf("got error when emptying index of shard: %v", err)
+	}
+	if evts := collectFilterStream(repo, srch, nil, nil); len(evts) != 8 {
+		t.Fatalf("got unexpected number of events with one shard missing from the index, expected 8 but got %v", len(evts))
+	}
+
+	err = repo.(IndexRebuilder).RebuildIndex(context.Background())
+	if err != nil {
+		t.Fatalf("got error when rebuilding index: %v", err)
+	}
+	expectedIds := make([]int64, len(expected))
+	for i, evt := range expected {
+		expectedIds[i] = evt.Id
+	}
+	verifyIds(t, collectFilterStream(repo, srch, nil, nil), expectedIds)
+}
+
+func TestShardedSqliteRepository_DeleteOlderThan(t *testing.T) {
+	repo, cfg := newShardedRepo(t)
+
+	deleted, err := repo.DeleteOlderThan(time.Date(2021, 2, 2, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+	if deleted != 6 {
+		t.Fatalf("got unexpected number of deleted events, expected 6 but got %v", deleted)
+	}
+	// The shard of the 1st is removed entirely, while the 2nd only has the events before noon deleted
+	if _, err := os.Stat(filepath.Join(cfg.ShardDirectory, "events-2021-02-01.db")); !os.IsNotExist(err) {
+		t.Fatalf("got unexpected result when checking for the expired shard, expected it to be removed but got err=%v", err)
+	}
+	min, max, err := repo.TimeRange()
+	if err != nil {
+		t.Fatalf("got error when getting time range: %v", err)
+	}
+	if !min.Equal(time.Date(2021, 2, 2, 12, 0, 0, 0, time.UTC)) || !max.Equal(time.Date(2021, 2, 3, 18, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got unexpected time range after deleting events, got %v to %v", min, max)
+	}
+	if evts := collectFilterStream(repo, &search.Search{}, nil, nil); len(evts) != 6 {
+		t.Fatalf("got unexpected number of events after deleting, expected 6 but got %v", len(evts))
+	}
+}
+
+func TestShardedSqliteRepository_DeleteOlderThanWaitsForSearch(t *testing.T) {
+	repo, cfg := newShardedRepoWithConfig(t, &config.SqliteConfig{TrueBatch: true, FilterStreamPageSize: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The search reads one event at a time starting in the shard of the 1st, which is removed while it is being read
+	pages := repo.FilterStream(ctx, &search.Search{OldestFirst: true}, nil, nil)
+	first := <-pages
+	if first.Err != nil || len(first.Events) != 1 {
+		t.Fatalf("got unexpected first page, expected 1 event but got %v events and err=%v", len(first.Events), first.Err)
+	}
+	type deleteResult struct {
+		deleted int64
+		err     error
+	}
+	deleteResults := make(chan deleteResult, 1)
+	go func() {
+		deleted, err := repo.DeleteOlderThan(time.Date(2021, 2, 2, 0, 0, 0, 0, time.UTC))
+		deleteResults <- deleteResult{deleted, err}
+	}()
+	count, err := repo.Count(ctx, &search.Search{}, nil, nil)
+	if err != nil {
+		t.Fatalf("got error when counting events while the shard is being removed: %v", err)
+	}
+	if count != 8 && count != 12 {
+		t.Fatalf("got unexpected count while the shard is being removed, expected 8 or 12 but got %v", count)
+	}
+	select {
+	case res := <-deleteResults:
+		t.Fatalf("got unexpected result from DeleteOlderThan before the search finished reading the shard: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	evts := first.Events
+	for page := range pages {
+		if page.Err != nil {
+			t.Fatalf("got error from search while the shard is being removed: %v", page.Err)
+		}
+		evts = append(evts, page.Events...)
+	}
+	if len(evts) != 12 {
+		t.Fatalf("got unexpected number of events from search, expected 12 but got %v", len(evts))
+	}
+	res := <-deleteResults
+	if res.err != nil {
+		t.Fatalf("got error when deleting events: %v", res.err)
+	}
+	if res.deleted != 4 {
+		t.Fatalf("got unexpected number of deleted events, expected 4 but got %v", res.deleted)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.ShardDirectory, "events-2021-02-01.db")); !os.IsNotExist(err) {
+		t.Fatalf("got unexpected result when checking for the expired shard, expected it to be removed but got err=%v", err)
+	}
+}
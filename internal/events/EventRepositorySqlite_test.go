@@ -15,13 +15,30 @@
 package events
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 func TestAddBatchTrueBatch(t *testing.T) {
@@ -47,7 +64,7 @@ func TestAddBatchTrueBatch(t *testing.T) {
 		},
 	})
 
-	evts, err := repo.GetByIds([]int64{0}, SortModeNone)
+	evts, err := repo.GetByIds([]int64{1}, SortModeNone)
 	if err != nil {
 		t.Fatalf("got error when retrieving event: %v", err)
 	}
@@ -79,7 +96,7 @@ func TestAddBatchOneByOne(t *testing.T) {
 		},
 	})
 
-	evts, err := repo.GetByIds([]int64{0}, SortModeNone)
+	evts, err := repo.GetByIds([]int64{1}, SortModeNone)
 	if err != nil {
 		t.Fatalf("got error when retrieving event: %v", err)
 	}
@@ -87,3 +104,1513 @@ func TestAddBatchOneByOne(t *testing.T) {
 		t.Fatalf("got unexpected number of events, expected 1 event but got %v", len(evts))
 	}
 }
+
+func TestAddBatchOneByOne_SkipsDuplicates(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    false,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	evt := Event{
+		Raw:       "2021-02-01 00:00:00 log event",
+		Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		Host:      "localhost",
+		Source:    "log.txt",
+		Offset:    0,
+	}
+	_, err = repo.AddBatch([]Event{evt})
+	if err != nil {
+		t.Fatalf("got error when adding event: %v", err)
+	}
+	_, err = repo.AddBatch([]Event{evt})
+	if err != nil {
+		t.Fatalf("got error when adding duplicate event, expected it to be skipped: %v", err)
+	}
+
+	evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+	if len(evts) != 1 {
+		t.Fatalf("got unexpected number of events, expected 1 event but got %v", len(evts))
+	}
+}
+
+func TestSqliteRepository_Fts5RequiresBuildTag(t *testing.T) {
+	if fts5Available {
+		t.Skip("built with FTS5 support")
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	_, err = SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		FtsModule:    config.SqliteFtsModuleFts5,
+	})
+	if err == nil {
+		t.Fatalf("TestSqliteRepository_Fts5RequiresBuildTag expected an error when FTS5 is not available but got nil")
+	}
+}
+
+func TestSqliteRepository_Tokenizer(t *testing.T) {
+	ftsModules := []string{config.SqliteFtsModuleFts4}
+	if fts5Available {
+		ftsModules = append(ftsModules, config.SqliteFtsModuleFts5)
+	}
+	for _, ftsModule := range ftsModules {
+		// The default tokenizer of FTS5 is unicode61, which removes diacritics unless told not to
+		for _, tt := range []struct {
+			tokenizer    string
+			search       string
+			expected     int
+			expectedFts5 int
+		}{
+			{"", "cafe", 0, 1},
+			{"", "connected", 0, 0},
+			{"unicode61 remove_diacritics=0", "cafe", 0, 0},
+			{"unicode61 remove_diacritics=2", "cafe", 1, 1},
+			{"unicode61 remove_diacritics=2", "crème", 1, 1},
+			{"porter", "connected", 1, 1},
+			{"porter", "connections", 1, 1},
+			{"porter", "failing", 1, 1},
+		} {
+			t.Run(ftsModule+"/"+tt.tokenizer+"/"+tt.search, func(t *testing.T) {
+				db, err := sql.Open("sqlite3", ":memory:")
+				if err != nil {
+					t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+				}
+				defer db.Close()
+				repo, err := SqliteRepository(db, &config.SqliteConfig{
+					DatabaseFile: ":memory:",
+					TrueBatch:    true,
+					FtsModule:    ftsModule,
+					Tokenizer:    tt.tokenizer,
+				})
+				if err != nil {
+					t.Fatalf("got error when creating events repo: %v", err)
+				}
+				_, err = repo.AddBatch([]Event{
+					{Raw: "order for café creme", Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), Host: "localhost", Source: "orders.txt"},
+					{Raw: "database connection failed", Timestamp: time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC), Host: "localhost", Source: "error.txt"},
+				})
+				if err != nil {
+					t.Fatalf("got error when adding events: %v", err)
+				}
+				srch, err := search.Parse(tt.search)
+				if err != nil {
+					t.Fatalf("got error when parsing search: %v", err)
+				}
+				expected := tt.expected
+				if ftsModule == config.SqliteFtsModuleFts5 {
+					expected = tt.expectedFts5
+				}
+				evts := collectFilterStream(repo, srch, nil, nil)
+				if len(evts) != expected {
+					t.Fatalf("got unexpected number of events, expected %v but got %v", expected, len(evts))
+				}
+			})
+		}
+	}
+}
+
+func TestSqliteRepository_Snippet(t *testing.T) {
+	ftsModules := []string{config.SqliteFtsModuleFts4}
+	if fts5Available {
+		ftsModules = append(ftsModules, config.SqliteFtsModuleFts5)
+	}
+	for _, ftsModule := range ftsModules {
+		// The modules choose a little differently which part of the event to put in the snippet, so only the parts
+		// which are the same for both are checked
+		for _, tt := range []struct {
+			search   string
+			snippet  *search.SnippetOptions
+			expected []string
+		}{
+			{"fox", &search.SnippetOptions{Start: "<b>", End: "</b>", Ellipsis: "...", Tokens: 5}, []string{"brown <b>fox</b> jumps"}},
+			{"fox dog", &search.SnippetOptions{Start: "[", End: "]", Ellipsis: "~"}, []string{"[fox] jumps over the lazy [dog] and then some more words here~"}},
+			// Without fragments there is no full text search of the raw to get a snippet from
+			{"host=localhost", &search.SnippetOptions{Start: "[", End: "]"}, []string{"", ""}},
+			{"fox", nil, []string{""}},
+		} {
+			t.Run(ftsModule+"/"+tt.search, func(t *testing.T) {
+				db, err := sql.Open("sqlite3", ":memory:")
+				if err != nil {
+					t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+				}
+				defer db.Close()
+				repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, FtsModule: ftsModule})
+				if err != nil {
+					t.Fatalf("got error when creating events repo: %v", err)
+				}
+				_, err = repo.AddBatch([]Event{
+					{Raw: "the quick brown fox jumps over the lazy dog and then some more words here and there", Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), Host: "localhost", Source: "a.txt"},
+					{Raw: "nothing to see", Timestamp: time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC), Host: "localhost", Source: "a.txt", Offset: 1},
+				})
+				if err != nil {
+					t.Fatalf("got error when adding events: %v", err)
+				}
+				srch, err := search.Parse(tt.search)
+				if err != nil {
+					t.Fatalf("got error when parsing search: %v", err)
+				}
+				srch.Snippet = tt.snippet
+				evts := collectFilterStream(repo, srch, nil, nil)
+				if len(evts) != len(tt.expected) {
+					t.Fatalf("got unexpected number of events, expected %v but got %v", len(tt.expected), len(evts))
+				}
+				for i, evt := range evts {
+					if (tt.expected[i] == "" && evt.Snippet != "") || !strings.Contains(evt.Snippet, tt.expected[i]) {
+						t.Fatalf("got unexpected snippet for eventId=%v, expected it to contain %q but got %q", evt.Id, tt.expected[i], evt.Snippet)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSqliteRepository_SnippetTooManyTokens(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	srch := &search.Search{Fragments: map[string]struct{}{"user": {}}, Snippet: &search.SnippetOptions{Tokens: search.MaxSnippetTokens + 1}}
+	_, err = collectFilterStreamErr(repo, srch, nil, nil)
+	if err == nil {
+		t.Fatal("got no error when asking for a snippet with too many tokens, expected an error")
+	}
+}
+
+func TestSqliteRepository_InvalidMatchExpression(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, FtsModule: config.SqliteFtsModuleFts4})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// FTS4 terms restricted to a column are not quoted, so a quote in a host is an unterminated phrase
+	srch, err := search.Parse(`host="a\"b"`)
+	if err != nil {
+		t.Fatalf("got unexpected error when parsing search: %v", err)
+	}
+
+	_, err = collectFilterStreamErr(repo, srch, nil, nil)
+	if !errors.Is(err, ErrInvalidSearch) {
+		t.Fatalf("got unexpected error from FilterStream, expected ErrInvalidSearch but got %v", err)
+	}
+	_, err = repo.Count(context.Background(), srch, nil, nil)
+	if !errors.Is(err, ErrInvalidSearch) {
+		t.Fatalf("got unexpected error from Count, expected ErrInvalidSearch but got %v", err)
+	}
+
+	// An error which is not caused by the search is not classified as an invalid search
+	db.Close()
+	_, err = collectFilterStreamErr(repo, &search.Search{Fragments: map[string]struct{}{"user": {}}}, nil, nil)
+	if err == nil {
+		t.Fatal("got no error from FilterStream after closing the database, expected an error")
+	}
+	if errors.Is(err, ErrInvalidSearch) {
+		t.Fatalf("got ErrInvalidSearch from FilterStream after closing the database, expected another error but got %v", err)
+	}
+}
+
+func TestSqliteRepository_RebuildsEventRawsWhenTokenizerChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsuck-tokenizer")
+	if err != nil {
+		t.Fatalf("got error when creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "logsuck.db")
+
+	open := func(tokenizer string) (*sql.DB, Repository) {
+		db, err := sql.Open("sqlite3", dbFile)
+		if err != nil {
+			t.Fatalf("got error when opening SQLite database: %v", err)
+		}
+		repo, err := SqliteRepository(db, &config.SqliteConfig{
+			DatabaseFile: dbFile,
+			TrueBatch:    true,
+			Tokenizer:    tokenizer,
+		})
+		if err != nil {
+			t.Fatalf("got error when creating events repo with tokenizer=%v: %v", tokenizer, err)
+		}
+		return db, repo
+	}
+
+	db, repo := open("")
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	srch, err := search.Parse("connected")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	verifyIds(t, collectFilterStream(repo, srch, nil, nil), []int64{})
+	db.Close()
+
+	db, repo = open("porter")
+	defer db.Close()
+	definition, err := eventRawsDefinitionInUse(db)
+	if err != nil {
+		t.Fatalf("got error when checking eventraws definition: %v", err)
+	}
+	if expected := eventRawsDefinition(config.SqliteFtsModuleFts4, "porter"); definition != expected {
+		t.Fatalf("got unexpected eventraws definition, expected %v but got %v", expected, definition)
+	}
+	verifyIds(t, collectFilterStream(repo, srch, nil, nil), []int64{3})
+}
+
+// rebuildIndexSearches are the searches whose results must be the same after the index has been rebuilt.
+var rebuildIndexSearches = []string{"user", "logged out again", "host=host-a", "NOT user", "database source=error.txt", ""}
+
+// searchResults returns the events each of rebuildIndexSearches finds in repo.
+func searchResults(t *testing.T, repo Repository) map[string][]EventWithId {
+	ret := map[string][]EventWithId{}
+	for _, s := range rebuildIndexSearches {
+		srch, err := search.Parse(s)
+		if err != nil {
+			t.Fatalf("got error when parsing search %q: %v", s, err)
+		}
+		evts, err := collectFilterStreamErr(repo, srch, nil, nil)
+		if err != nil {
+			t.Fatalf("got error when searching for %q: %v", s, err)
+		}
+		ret[s] = evts
+	}
+	return ret
+}
+
+func TestSqliteRepository_RebuildIndex(t *testing.T) {
+	ftsModules := []string{config.SqliteFtsModuleFts4}
+	if fts5Available {
+		ftsModules = append(ftsModules, config.SqliteFtsModuleFts5)
+	}
+	for _, ftsModule := range ftsModules {
+		for _, trueBatch := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%v trueBatch=%v", ftsModule, trueBatch), func(t *testing.T) {
+				db, err := sql.Open("sqlite3", ":memory:")
+				if err != nil {
+					t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+				}
+				defer db.Close()
+				db.SetMaxOpenConns(1)
+				repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: trueBatch, FtsModule: ftsModule})
+				if err != nil {
+					t.Fatalf("got error when creating events repo: %v", err)
+				}
+				_, err = repo.AddBatch(suiteEvents)
+				if err != nil {
+					t.Fatalf("got error when adding events: %v", err)
+				}
+				// The replaced and deleted raws must be left out of the rebuilt index as well
+				replaced := suiteEvents[1]
+				replaced.Raw = "2021-02-01 00:00:01 user logged out again"
+				_, err = repo.UpsertBatch([]Event{replaced})
+				if err != nil {
+					t.Fatalf("got error when replacing event: %v", err)
+				}
+				_, err = repo.DeleteOlderThan(suiteEvents[1].Timestamp)
+				if err != nil {
+					t.Fatalf("got error when deleting events: %v", err)
+				}
+				expected := searchResults(t, repo)
+				if len(expected["logged out again"]) != 1 || len(expected[""]) != 2 {
+					t.Fatalf("got unexpected results before rebuilding the index: %v", expected)
+				}
+
+				for _, stmt := range []string{"DELETE FROM EventRaws;", "DROP TABLE EventRaws;"} {
+					_, err = db.Exec(stmt)
+					if err != nil {
+						t.Fatalf("got error when executing %q: %v", stmt, err)
+					}
+					err = repo.(IndexRebuilder).RebuildIndex(context.Background())
+					if err != nil {
+						t.Fatalf("got error when rebuilding index after %q: %v", stmt, err)
+					}
+					if actual := searchResults(t, repo); !reflect.DeepEqual(actual, expected) {
+						t.Fatalf("got unexpected results after %q and rebuilding the index, expected %v but got %v", stmt, expected, actual)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSqliteRepository_ReadsRawsWithoutIndex(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	res, err := repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// The raws are stored in EventContents, so the events can still be read without the full text index
+	_, err = db.Exec("DROP TABLE EventRaws;")
+	if err != nil {
+		t.Fatalf("got error when dropping EventRaws table: %v", err)
+	}
+
+	evt, err := repo.GetById(res.Ids[0])
+	if err != nil {
+		t.Fatalf("got unexpected error from GetById: %v", err)
+	}
+	if evt.Raw != suiteEvents[0].Raw {
+		t.Fatalf("got unexpected raw from GetById, expected %q but got %q", suiteEvents[0].Raw, evt.Raw)
+	}
+	evts, err := repo.GetByIds(res.Ids, SortModeNone)
+	if err != nil {
+		t.Fatalf("got unexpected error from GetByIds: %v", err)
+	}
+	if len(evts) != len(suiteEvents) {
+		t.Fatalf("got unexpected number of events from GetByIds, expected %v but got %v", len(suiteEvents), len(evts))
+	}
+	evts, err = collectFilterStreamErr(repo, &search.Search{}, nil, nil)
+	if err != nil {
+		t.Fatalf("got unexpected error from FilterStream: %v", err)
+	}
+	if len(evts) != len(suiteEvents) {
+		t.Fatalf("got unexpected number of events from FilterStream, expected %v but got %v", len(suiteEvents), len(evts))
+	}
+}
+
+func TestSqliteRepository_CopiesRawsToEventContents(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	expected := searchResults(t, repo)
+	// Databases created before EventContents existed only have the raws in EventRaws
+	_, err = db.Exec("DROP TABLE EventContents;")
+	if err != nil {
+		t.Fatalf("got error when dropping eventcontents table: %v", err)
+	}
+
+	repo, err = SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when opening events repo again: %v", err)
+	}
+	err = repo.(IndexRebuilder).RebuildIndex(context.Background())
+	if err != nil {
+		t.Fatalf("got error when rebuilding index: %v", err)
+	}
+	if actual := searchResults(t, repo); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got unexpected results after copying the raws and rebuilding the index, expected %v but got %v", expected, actual)
+	}
+}
+
+func TestSqliteRepository_AddsContentHashToOldEventsTable(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	// The Events table as it was created before events could use config.DuplicateKeyContent
+	for _, stmt := range []string{
+		"CREATE TABLE Events (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, host TEXT NOT NULL, source TEXT NOT NULL, timestamp DATETIME NOT NULL, offset BIGINT NOT NULL, UNIQUE(host, source, timestamp, offset));",
+		"INSERT INTO Events (host, source, timestamp, offset) VALUES ('host-a', 'access.txt', '2021-02-01 00:00:00+00:00', 0), ('host-a', 'access.txt', '2021-02-01 00:00:01+00:00', 33), ('host-a', 'access.txt', '2021-02-01 00:00:02+00:00', 66);",
+		"DELETE FROM Events WHERE id = 3;",
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("got error when creating old events table: %v", err)
+		}
+	}
+
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM Events WHERE id IN (1, 2) AND content_hash IS NULL;").Scan(&count)
+	if err != nil || count != 2 {
+		t.Fatalf("expected the existing events to keep their ids, got count=%v and err=%v", count, err)
+	}
+
+	t0 := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	res, err := repo.AddBatch([]Event{
+		// A duplicate of the event with id 1, which must still be detected after the rebuild
+		{Raw: "user logged in", Timestamp: t0, Host: "host-a", Source: "access.txt", Offset: 0},
+		// The same timestamp and offset as the event with id 1 but using the content key, so it is not a duplicate
+		{Raw: "user logged in", Timestamp: t0, Host: "host-a", Source: "access.txt", Offset: 0, DuplicateKey: config.DuplicateKeyContent},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// The id of the deleted event is not reused
+	expectedIds := []int64{DuplicateId, 4}
+	if len(res.Ids) != 2 || res.Ids[0] != expectedIds[0] || res.Ids[1] != expectedIds[1] {
+		t.Fatalf("got unexpected ids, expected %v but got %v", expectedIds, res.Ids)
+	}
+
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+dsbBase+sbPerEvt+");", "host-a", "access.txt", t0, 0)
+	if err != nil {
+		t.Fatalf("got error when getting query plan: %v", err)
+	}
+	defer rows.Close()
+	plan := ""
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		err = rows.Scan(&id, &parent, &notUsed, &detail)
+		if err != nil {
+			t.Fatalf("got error when scanning query plan: %v", err)
+		}
+		plan += detail + "\n"
+	}
+	if !strings.Contains(plan, "UX_Events_Offset") {
+		t.Fatalf("expected the query plan for looking up duplicates to use UX_Events_Offset but got:\n%v", plan)
+	}
+}
+
+func TestEventRawsDefinition(t *testing.T) {
+	for _, tt := range []struct {
+		ftsModule, tokenizer, expected string
+	}{
+		{config.SqliteFtsModuleFts4, "", "fts4 (raw TEXT, source TEXT, host TEXT, order=DESC)"},
+		{config.SqliteFtsModuleFts4, "porter", "fts4 (raw TEXT, source TEXT, host TEXT, order=DESC, tokenize=porter)"},
+		{config.SqliteFtsModuleFts4, "unicode61 remove_diacritics=2 tokenchars=-", "fts4 (raw TEXT, source TEXT, host TEXT, order=DESC, tokenize=unicode61 \"remove_diacritics=2\" \"tokenchars=-\")"},
+		{config.SqliteFtsModuleFts5, "", "fts5 (raw, source, host)"},
+		{config.SqliteFtsModuleFts5, "porter unicode61 remove_diacritics=2", "fts5 (raw, source, host, tokenize='porter unicode61 remove_diacritics 2')"},
+	} {
+		if actual := eventRawsDefinition(tt.ftsModule, tt.tokenizer); actual != tt.expected {
+			t.Fatalf("got unexpected definition for ftsModule=%v tokenizer=%v, expected %v but got %v", tt.ftsModule, tt.tokenizer, tt.expected, actual)
+		}
+	}
+}
+
+func TestDeleteOlderThan_DeletesRaws(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	_, err = repo.DeleteOlderThan(suiteEvents[2].Timestamp)
+	if err != nil {
+		t.Fatalf("got error when deleting events: %v", err)
+	}
+
+	for _, table := range []string{"Events", "EventRaws"} {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			t.Fatalf("got error when counting rows in %v: %v", table, err)
+		}
+		if count != 1 {
+			t.Fatalf("TestDeleteOlderThan_DeletesRaws expected 1 row in %v but got %v", table, count)
+		}
+	}
+	var rowid int64
+	err = db.QueryRow("SELECT rowid FROM EventRaws").Scan(&rowid)
+	if err != nil {
+		t.Fatalf("got error when getting remaining raw: %v", err)
+	}
+	if rowid != 3 {
+		t.Fatalf("TestDeleteOlderThan_DeletesRaws expected the raw of id=3 to remain but got rowid=%v", rowid)
+	}
+}
+
+func TestGetByIds_MissingId(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	_, err = repo.AddBatch([]Event{
+		{
+			Raw:       "2021-02-01 00:00:00 log event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    0,
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding event: %v", err)
+	}
+
+	evts, err := repo.GetByIds([]int64{1, 1000}, SortModeNone)
+	if err != nil {
+		t.Fatalf("got error when retrieving events: %v", err)
+	}
+	if len(evts) != 1 {
+		t.Fatalf("got unexpected number of events, expected 1 event but got %v", len(evts))
+	}
+	if evts[0].Id != 1 {
+		t.Fatalf("got unexpected event, expected id=1 but got id=%v", evts[0].Id)
+	}
+}
+
+func TestGetByIds_ErrorWhileIterating(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	res, err := repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	// Replace Events with a view where reading the id of the last event fails with an integer overflow, so the query
+	// fails after the first rows have been returned
+	lastID := res.Ids[len(res.Ids)-1]
+	for _, stmt := range []string{
+		"ALTER TABLE Events RENAME TO Events_real;",
+		fmt.Sprintf("CREATE VIEW Events AS SELECT CASE WHEN id = %v THEN abs(-9223372036854775808) ELSE id END AS id, host, source, timestamp FROM Events_real;", lastID),
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("got error when executing %q: %v", stmt, err)
+		}
+	}
+
+	evts, err := repo.GetByIds(res.Ids, SortModeNone)
+	if err == nil {
+		t.Fatalf("expected an error when iterating over the rows fails but got numEvents=%v", len(evts))
+	}
+}
+
+func TestGetByIds_ManyIds(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	const numEvents = 2500
+	evts := make([]Event, numEvents)
+	ids := make([]int64, numEvents)
+	for i := range evts {
+		evts[i] = Event{
+			Raw:       "log event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+		ids[i] = int64(i + 1)
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	res, err := repo.GetByIds(ids, SortModeTimestampDesc)
+	if err != nil {
+		t.Fatalf("got error when retrieving events: %v", err)
+	}
+	if len(res) != numEvents {
+		t.Fatalf("got unexpected number of events, expected %v events but got %v", numEvents, len(res))
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i].Timestamp.After(res[i-1].Timestamp) {
+			t.Fatalf("got events in unexpected order, event at index %v is newer than the event before it", i)
+		}
+	}
+}
+
+func TestIsDuplicateError(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	_, err = db.Exec("CREATE TABLE Test (value TEXT NOT NULL, UNIQUE(value));")
+	if err != nil {
+		t.Fatalf("got error when creating table: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO Test (value) VALUES ('a');")
+	if err != nil {
+		t.Fatalf("got error when inserting value: %v", err)
+	}
+	_, err = db.Exec("INSERT INTO Test (value) VALUES ('a');")
+	if !isDuplicateError(err) {
+		t.Fatalf("expected isDuplicateError to return true for err=%v", err)
+	}
+	_, err = db.Exec("INSERT INTO Test (value) VALUES (NULL);")
+	if isDuplicateError(err) {
+		t.Fatalf("expected isDuplicateError to return false for err=%v", err)
+	}
+}
+
+func TestFilterStream_QuotesInSearch(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	_, err = repo.AddBatch([]Event{
+		{
+			Raw:       "2021-02-01 00:00:00 user's event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "o'brien.txt",
+			Offset:    0,
+		},
+		{
+			Raw:       "2021-02-01 00:00:01 other event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    0,
+		},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	srch, err := search.Parse("user's source=o'brien.txt")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	evts := collectFilterStream(repo, srch, nil, nil)
+	if len(evts) != 1 {
+		t.Fatalf("got unexpected number of events, expected 1 event but got %v", len(evts))
+	}
+	if evts[0].Source != "o'brien.txt" {
+		t.Fatalf("got unexpected source, expected 'o'brien.txt' but got '%v'", evts[0].Source)
+	}
+
+	srch, err = search.Parse("\"'; DROP TABLE Events; --\"")
+	if err != nil {
+		t.Fatalf("got error when parsing search: %v", err)
+	}
+	evts = collectFilterStream(repo, srch, nil, nil)
+	if len(evts) != 0 {
+		t.Fatalf("got unexpected number of events, expected 0 events but got %v", len(evts))
+	}
+	evts = collectFilterStream(repo, &search.Search{}, nil, nil)
+	if len(evts) != 2 {
+		t.Fatalf("got unexpected number of events after injection attempt, expected 2 events but got %v", len(evts))
+	}
+}
+
+func TestFilterStream_TimeBounds(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	evts := make([]Event, 3)
+	for i := range evts {
+		evts[i] = Event{
+			Raw:       "log event",
+			Timestamp: time.Date(2021, 2, 1, i, 0, 0, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	startTime := time.Date(2021, 2, 1, 1, 0, 0, 0, time.UTC)
+	endTime := time.Date(2021, 2, 1, 1, 30, 0, 0, time.UTC)
+	res := collectFilterStream(repo, &search.Search{}, &startTime, &endTime)
+	if len(res) != 1 {
+		t.Fatalf("got unexpected number of events, expected 1 event but got %v", len(res))
+	}
+	if !res[0].Timestamp.Equal(startTime) {
+		t.Fatalf("got unexpected timestamp, expected %v but got %v", startTime, res[0].Timestamp)
+	}
+}
+
+func TestSqliteRepository_QueryLog(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		queryLog          string
+		expectedStatement bool
+		expectedPlan      bool
+	}{
+		{"off", "", false, false},
+		{"statements", config.SqliteQueryLogStatements, true, false},
+		{"explain", config.SqliteQueryLogExplain, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+			}
+			defer db.Close()
+			// Only the statements are logged at info, the rest of a search is logged at debug
+			var logged bytes.Buffer
+			logger := logging.New(log.New(&logged, "", 0), logging.LevelInfo)
+			repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, QueryLog: tt.queryLog, Logger: logger})
+			if err != nil {
+				t.Fatalf("got error when creating events repo: %v", err)
+			}
+			_, err = repo.AddBatch(suiteEvents)
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+
+			logged.Reset()
+			evts := collectFilterStream(repo, &search.Search{Fragments: map[string]struct{}{"user": {}}}, nil, nil)
+			if len(evts) != 2 {
+				t.Fatalf("got unexpected number of events, expected 2 but got %v", len(evts))
+			}
+
+			output := logged.String()
+			if strings.Contains(output, "level=info executing stmt") != tt.expectedStatement {
+				t.Fatalf("got unexpected log output, expected statement to be logged=%v but got %q", tt.expectedStatement, output)
+			}
+			if strings.Contains(output, "level=info query plan: ") != tt.expectedPlan || strings.Contains(output, "numRows=2") != tt.expectedPlan {
+				t.Fatalf("got unexpected log output, expected query plan and rows to be logged=%v but got %q", tt.expectedPlan, output)
+			}
+			if !tt.expectedStatement && output != "" {
+				t.Fatalf("got unexpected log output, expected nothing to be logged at info without queryLog but got %q", output)
+			}
+		})
+	}
+}
+
+func TestSqliteRepository_LogsAtDebug(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	var logged bytes.Buffer
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, Logger: logging.New(log.New(&logged, "", 0), logging.LevelDebug)})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	collectFilterStream(repo, &search.Search{Fragments: map[string]struct{}{"user": {}}}, nil, nil)
+
+	output := logged.String()
+	for _, expected := range []string{"level=debug added numEvents=", "level=debug SQL search completed"} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("got unexpected log output, expected it to contain %q but got %q", expected, output)
+		}
+	}
+	if strings.Contains(output, "executing stmt") {
+		t.Fatalf("got unexpected log output, expected statements not to be logged without queryLog but got %q", output)
+	}
+}
+
+// collectFilterStream returns every event FilterStream sends. It panics if the search fails, since none of the tests
+// using it expect that.
+func collectFilterStream(repo Repository, srch *search.Search, startTime, endTime *time.Time) []EventWithId {
+	ret, err := collectFilterStreamErr(repo, srch, startTime, endTime)
+	if err != nil {
+		panic(fmt.Sprintf("got unexpected error from FilterStream: %v", err))
+	}
+	return ret
+}
+
+// collectFilterStreamErr returns every event FilterStream sends before it is closed, and the error if it sent one.
+func collectFilterStreamErr(repo Repository, srch *search.Search, startTime, endTime *time.Time) ([]EventWithId, error) {
+	ret := []EventWithId{}
+	var err error
+	for page := range repo.FilterStream(context.Background(), srch, startTime, endTime) {
+		if page.Err != nil {
+			err = page.Err
+		}
+		ret = append(ret, page.Events...)
+	}
+	return ret, err
+}
+
+// countingDriver wraps the SQLite driver and counts the queries executed on its connections.
+type countingDriver struct {
+	sqlite3.SQLiteDriver
+	queries int64
+}
+
+type countingConn struct {
+	*sqlite3.SQLiteConn
+	driver *countingDriver
+}
+
+func (d *countingDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), driver: d}, nil
+}
+
+func (c *countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddInt64(&c.driver.queries, 1)
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+var countingDriverInstance = &countingDriver{}
+var registerCountingDriver sync.Once
+
+func TestFilterStream_NoQueriesAfterCancel(t *testing.T) {
+	registerCountingDriver.Do(func() {
+		sql.Register("sqlite3_counting", countingDriverInstance)
+	})
+	db, err := sql.Open("sqlite3_counting", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// Every connection to :memory: is its own database
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	const numEvents = filterStreamPageSize * 5
+	evts := make([]Event, numEvents)
+	for i := range evts {
+		evts[i] = Event{
+			Raw:       "log event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	atomic.StoreInt64(&countingDriverInstance.queries, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	pages := repo.FilterStream(ctx, &search.Search{}, nil, nil)
+	<-pages
+	cancel()
+	received := filterStreamPageSize
+	for page := range pages {
+		received += len(page.Events)
+	}
+
+	// One query for max(id), one for the first page and at most one for a page which was already running when
+	// cancel was called
+	if queries := atomic.LoadInt64(&countingDriverInstance.queries); queries < 2 || queries > 3 {
+		t.Fatalf("got unexpected number of queries, expected 2 or 3 but got %v", queries)
+	}
+	if received >= numEvents {
+		t.Fatalf("expected FilterStream to stop before all numEvents=%v were received", numEvents)
+	}
+}
+
+func TestSqliteRepository_SourceIndexIsUsed(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// The query plans have to be read from the same in-memory database the repository created its tables in
+	db.SetMaxOpenConns(1)
+	_, err = SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:"})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+
+	for _, query := range []string{
+		"SELECT DISTINCT source FROM Events ORDER BY source;",
+		"SELECT id FROM Events WHERE source = 'access.txt' AND timestamp >= '2021-02-01' AND timestamp <= '2021-02-02';",
+	} {
+		rows, err := db.Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatalf("got error when getting query plan for '%v': %v", query, err)
+		}
+		plan := ""
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			err = rows.Scan(&id, &parent, &notUsed, &detail)
+			if err != nil {
+				t.Fatalf("got error when scanning query plan for '%v': %v", query, err)
+			}
+			plan += detail + "\n"
+		}
+		rows.Close()
+		if !strings.Contains(plan, "IX_Events_SourceTimestamp") {
+			t.Fatalf("expected the query plan for '%v' to use IX_Events_SourceTimestamp but got:\n%v", query, plan)
+		}
+	}
+}
+
+func BenchmarkSqliteRepository_FilterStreamShortTimeRange(b *testing.B) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		b.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true})
+	if err != nil {
+		b.Fatalf("got error when creating events repo: %v", err)
+	}
+	const numEvents = 200000
+	start := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	evts := make([]Event, config.DefaultPublisherBatchSize)
+	for added := 0; added < numEvents; added += len(evts) {
+		for i := range evts {
+			evts[i] = Event{
+				Raw:       "log event",
+				Timestamp: start.Add(time.Duration(added+i) * time.Second),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(added + i),
+			}
+		}
+		_, err = repo.AddBatch(evts)
+		if err != nil {
+			b.Fatalf("got error when adding events: %v", err)
+		}
+	}
+	// The last 100 seconds, which is 100 events at the end of the table
+	searchStart := start.Add((numEvents - 100) * time.Second)
+	srch := &search.Search{Fragments: map[string]struct{}{"event": {}}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		total := len(collectFilterStream(repo, srch, &searchStart, nil))
+		if total != 100 {
+			b.Fatalf("got unexpected number of events, expected 100 but got %v", total)
+		}
+	}
+}
+
+func TestSqliteRepository_MatchExpression(t *testing.T) {
+	set := func(values ...string) map[string]struct{} {
+		ret := make(map[string]struct{}, len(values))
+		for _, v := range values {
+			ret[v] = struct{}{}
+		}
+		return ret
+	}
+	for _, tt := range []struct {
+		name             string
+		ftsModule        string
+		srch             search.Search
+		expectedMatch    string
+		expectedNotMatch string
+	}{
+		{"empty", config.SqliteFtsModuleFts4, search.Search{}, "", ""},
+		{"fragments", config.SqliteFtsModuleFts4, search.Search{Fragments: set("y", "x")}, "raw:x AND raw:y", ""},
+		{"source", config.SqliteFtsModuleFts4, search.Search{Sources: set("a")}, "source:a", ""},
+		{"sources", config.SqliteFtsModuleFts4, search.Search{Sources: set("b", "a")}, "(source:a OR source:b)", ""},
+		{"not sources", config.SqliteFtsModuleFts4, search.Search{NotSources: set("d", "c")}, "", "source:c OR source:d"},
+		{"sources and fragments", config.SqliteFtsModuleFts4, search.Search{Sources: set("a", "b"), Fragments: set("x", "y")},
+			"(source:a OR source:b) AND raw:x AND raw:y", ""},
+		{"sources and not sources", config.SqliteFtsModuleFts4, search.Search{Sources: set("a", "b"), NotSources: set("c")},
+			"(source:a OR source:b) NOT source:c", ""},
+		{"not sources and fragments", config.SqliteFtsModuleFts4, search.Search{NotSources: set("c"), Fragments: set("x", "y")},
+			"(raw:x AND raw:y) NOT source:c", ""},
+		{"sources, not sources and fragments", config.SqliteFtsModuleFts4, search.Search{Sources: set("a", "b"), NotSources: set("c", "d"), Fragments: set("x", "y")},
+			"((source:a OR source:b) AND raw:x AND raw:y) NOT source:c NOT source:d", ""},
+		{"every column", config.SqliteFtsModuleFts4, search.Search{
+			Hosts: set("h"), NotHosts: set("i"), Sources: set("a"), NotSources: set("c"), Fragments: set("x"), NotFragments: set("z"),
+		}, "(host:h AND source:a AND raw:x) NOT host:i NOT source:c NOT raw:z", ""},
+		{"only negations", config.SqliteFtsModuleFts4, search.Search{NotHosts: set("i"), NotSources: set("c"), NotFragments: set("z")},
+			"", "host:i OR source:c OR raw:z"},
+		// A source with a wildcard which full text search can not express can not be part of the group of sources
+		{"unsearchable source", config.SqliteFtsModuleFts4, search.Search{Sources: set("a", "*b"), NotSources: set("*c"), Fragments: set("x")},
+			"raw:x", ""},
+		// FTS4 only negates the first token of a term which is split into several tokens
+		{"multi-token not sources", config.SqliteFtsModuleFts4, search.Search{Sources: set("a"), NotSources: set("c", "error.txt"), NotFragments: set("z")},
+			"source:a NOT source:c NOT raw:z", "source:error.txt"},
+		{"phrase", config.SqliteFtsModuleFts4, search.Search{Sources: set("a"), Fragments: set("x y")}, "source:a AND \"x y\"", ""},
+		{"fts5", config.SqliteFtsModuleFts5, search.Search{Sources: set("a.txt", "b"), NotSources: set("c"), Fragments: set("x*", "y++")},
+			"((source:\"a.txt\" OR source:\"b\") AND raw:\"x\"* AND raw:\"y++\") NOT source:\"c\"", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &sqliteRepository{ftsModule: tt.ftsModule}
+			filter := repo.searchFilter(&tt.srch)
+			if filter.matchString != tt.expectedMatch {
+				t.Fatalf("TestSqliteRepository_MatchExpression expected matchString='%v' but got '%v'", tt.expectedMatch, filter.matchString)
+			}
+			if filter.notMatchString != tt.expectedNotMatch {
+				t.Fatalf("TestSqliteRepository_MatchExpression expected notMatchString='%v' but got '%v'", tt.expectedNotMatch, filter.notMatchString)
+			}
+		})
+	}
+}
+
+func TestSqliteRepository_ConcurrentWritesAndReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logsuck-wal")
+	if err != nil {
+		t.Fatalf("got error when creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &config.SqliteConfig{
+		DatabaseFile: filepath.Join(dir, "logsuck.db"),
+		TrueBatch:    true,
+		WAL:          true,
+		BusyTimeout:  config.DefaultSqliteBusyTimeout,
+	}
+	db, err := sql.Open("sqlite3", SqliteDataSourceName(cfg))
+	if err != nil {
+		t.Fatalf("got error when opening SQLite database: %v", err)
+	}
+	defer db.Close()
+	repo, err := SqliteRepository(db, cfg)
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	var mode string
+	err = db.QueryRow("PRAGMA journal_mode;").Scan(&mode)
+	if err != nil {
+		t.Fatalf("got error when checking journal mode: %v", err)
+	}
+	if mode != "wal" {
+		t.Fatalf("got unexpected journal mode, expected wal but got %v", mode)
+	}
+
+	const batches = 50
+	const batchSize = 100
+	timestamp := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		for b := 0; b < batches; b++ {
+			evts := make([]Event, batchSize)
+			for i := range evts {
+				evts[i] = Event{Raw: "concurrent event", Timestamp: timestamp, Host: "localhost", Source: "log.txt", Offset: int64(b*batchSize + i)}
+			}
+			if _, err := repo.AddBatch(evts); err != nil {
+				errs <- fmt.Errorf("error adding batch %v: %w", b, err)
+				return
+			}
+		}
+	}()
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srch := &search.Search{Fragments: map[string]struct{}{"concurrent": {}}}
+			for ctx.Err() == nil {
+				if _, err := repo.Count(context.Background(), srch, nil, nil); err != nil {
+					errs <- fmt.Errorf("error counting events: %w", err)
+					return
+				}
+				if _, err := repo.GetByIds([]int64{1, 2, 3}, SortModeNone); err != nil {
+					errs <- fmt.Errorf("error getting events: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("got unexpected error while writing and reading concurrently: %v", err)
+	}
+
+	count, err := repo.Count(context.Background(), &search.Search{}, nil, nil)
+	if err != nil {
+		t.Fatalf("got error when counting events: %v", err)
+	}
+	if count != batches*batchSize {
+		t.Fatalf("got unexpected number of events, expected %v but got %v", batches*batchSize, count)
+	}
+}
+
+func TestAddBatch_ErrorInMiddleAddsNothing(t *testing.T) {
+	for _, trueBatch := range []bool{true, false} {
+		t.Run(fmt.Sprintf("trueBatch=%v", trueBatch), func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+			}
+			defer db.Close()
+			// Every connection to :memory: gets its own database, so the trigger must be created on the one connection
+			db.SetMaxOpenConns(1)
+			repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: trueBatch})
+			if err != nil {
+				t.Fatalf("got error when creating events repo: %v", err)
+			}
+			_, err = db.Exec("CREATE TRIGGER FailInsert BEFORE INSERT ON Events WHEN NEW.host = 'fail' BEGIN SELECT RAISE(ABORT, 'injected failure'); END;")
+			if err != nil {
+				t.Fatalf("got error when creating trigger: %v", err)
+			}
+			_, err = repo.AddBatch(suiteEvents[:1])
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+
+			// The duplicate comes before the failing event, and there are new events on both sides of them
+			failing := suiteEvents[2]
+			failing.Host = "fail"
+			res, err := repo.AddBatch([]Event{suiteEvents[1], suiteEvents[0], failing, suiteEvents[2]})
+			if err == nil {
+				t.Fatal("expected an error when adding a batch with a failing event but got nil")
+			}
+			if res.Ids != nil || res.NumAdded() != 0 || res.NumDuplicates() != 0 {
+				t.Fatalf("got unexpected result after error, expected an empty result but got %+v", res)
+			}
+			evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+			if len(evts) != 1 || evts[0].Id != 1 {
+				t.Fatalf("got unexpected events after failed batch, expected only id=1 but got %v", evts)
+			}
+
+			// Nothing from the failed batch should be left behind, so adding it again without the failing event works
+			res, err = repo.AddBatch([]Event{suiteEvents[1], suiteEvents[0], suiteEvents[2]})
+			if err != nil {
+				t.Fatalf("got error when adding batch again: %v", err)
+			}
+			if len(res.Ids) != 3 || res.Ids[0] == DuplicateId || res.Ids[1] != DuplicateId || res.Ids[2] == DuplicateId {
+				t.Fatalf("got unexpected ids when adding batch again, expected [<id>, %v, <id>] but got %v", DuplicateId, res.Ids)
+			}
+			evts, err = repo.GetByIds([]int64{res.Ids[0], res.Ids[2]}, SortModeNone)
+			if err != nil {
+				t.Fatalf("got error when getting events: %v", err)
+			}
+			if len(evts) != 2 || evts[0].Raw != suiteEvents[1].Raw || evts[1].Raw != suiteEvents[2].Raw {
+				t.Fatalf("got unexpected events for returned ids, expected raws %q and %q but got %v", suiteEvents[1].Raw, suiteEvents[2].Raw, evts)
+			}
+		})
+	}
+}
+
+func TestFilterStream_NotFragmentsAreExcludedByQuery(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	repo, err := SqliteRepository(db, &config.SqliteConfig{
+		DatabaseFile: ":memory:",
+		TrueBatch:    true,
+	})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	// Most events contain the common term which is excluded
+	evts := make([]Event, 200)
+	for i := range evts {
+		raw := fmt.Sprintf("request %v DEBUG cache lookup", i)
+		if i%10 == 0 {
+			raw = fmt.Sprintf("request %v error debugger attached", i)
+		} else if i%10 == 5 {
+			raw = fmt.Sprintf("request %v debug-mode enabled", i)
+		}
+		evts[i] = Event{Raw: raw, Host: "localhost", Source: "app.log", Offset: int64(i), Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC)}
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	all := collectFilterStream(repo, &search.Search{}, nil, nil)
+
+	for _, tt := range []struct {
+		fragments    []string
+		notFragments []string
+		goFilter     *regexp.Regexp
+		expected     int
+	}{
+		{nil, []string{"debug"}, regexp.MustCompile(`(?i)\bdebug\b`), 20},
+		{[]string{"request"}, []string{"debug"}, regexp.MustCompile(`(?i)\bdebug\b`), 20},
+		{nil, []string{"debug*"}, regexp.MustCompile(`(?i)\bdebug`), 0},
+		{nil, []string{"cache", "error"}, regexp.MustCompile(`(?i)\b(cache|error)\b`), 20},
+	} {
+		t.Run(strings.Join(tt.fragments, ",")+"_"+strings.Join(tt.notFragments, ","), func(t *testing.T) {
+			srch := &search.Search{Fragments: map[string]struct{}{}, NotFragments: map[string]struct{}{}}
+			for _, f := range tt.fragments {
+				srch.Fragments[f] = struct{}{}
+			}
+			for _, f := range tt.notFragments {
+				srch.NotFragments[f] = struct{}{}
+			}
+			actual := collectFilterStream(repo, srch, nil, nil)
+
+			// The repository should return only the events that filtering every event in Go keeps
+			expectedIds := []int64{}
+			for _, evt := range all {
+				if !tt.goFilter.MatchString(evt.Raw) {
+					expectedIds = append(expectedIds, evt.Id)
+				}
+			}
+			if len(expectedIds) != tt.expected {
+				t.Fatalf("got unexpected number of events from the Go filter, expected %v but got %v", tt.expected, len(expectedIds))
+			}
+			verifyIds(t, actual, expectedIds)
+		})
+	}
+}
+
+func TestFilterStream_NotFragmentsInTimeRange(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	// A small page size makes the excluded events be looked up once for each of several pages
+	repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, FilterStreamPageSize: 3})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	evts := make([]Event, 200)
+	for i := range evts {
+		raw := fmt.Sprintf("request %v DEBUG cache lookup", i)
+		if i%10 == 0 {
+			raw = fmt.Sprintf("request %v error", i)
+		}
+		evts[i] = Event{Raw: raw, Host: "localhost", Source: "app.log", Offset: int64(i), Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC)}
+	}
+	res, err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	startTime := time.Date(2021, 2, 1, 0, 1, 40, 0, time.UTC)
+	endTime := time.Date(2021, 2, 1, 0, 2, 59, 0, time.UTC)
+	srch := &search.Search{NotFragments: map[string]struct{}{"debug": {}}}
+	// The events are returned newest first
+	expectedIds := []int64{}
+	for i := 170; i >= 100; i -= 10 {
+		expectedIds = append(expectedIds, res.Ids[i])
+	}
+	verifyIds(t, collectFilterStream(repo, srch, &startTime, &endTime), expectedIds)
+	count, err := repo.Count(context.Background(), srch, &startTime, &endTime)
+	if err != nil {
+		t.Fatalf("got unexpected error when counting events: %v", err)
+	}
+	if count != int64(len(expectedIds)) {
+		t.Fatalf("got unexpected count, expected %v but got %v", len(expectedIds), count)
+	}
+}
+
+func TestFilterStream_MultiTokenFragmentsMatchExactly(t *testing.T) {
+	ftsModules := []string{config.SqliteFtsModuleFts4}
+	if fts5Available {
+		ftsModules = append(ftsModules, config.SqliteFtsModuleFts5)
+	}
+	for _, ftsModule := range ftsModules {
+		for _, tt := range []struct {
+			fragment string
+			expected []string
+		}{
+			{"a-b", []string{"x a-b y"}},
+			{"10.0.0.1", []string{"from 10.0.0.1 to"}},
+			{"a-b*", []string{"x a-b y", "x a-bc y"}},
+		} {
+			t.Run(ftsModule+"/"+tt.fragment, func(t *testing.T) {
+				db, err := sql.Open("sqlite3", ":memory:")
+				if err != nil {
+					t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+				}
+				defer db.Close()
+				repo, err := SqliteRepository(db, &config.SqliteConfig{DatabaseFile: ":memory:", TrueBatch: true, FtsModule: ftsModule})
+				if err != nil {
+					t.Fatalf("got error when creating events repo: %v", err)
+				}
+				raws := []string{"x a b y", "x a-b y", "x a-bc y", "from 10.0.0.1 to", "from 10 0 0 1 to"}
+				evts := make([]Event, len(raws))
+				for i, raw := range raws {
+					evts[i] = Event{Raw: raw, Host: "localhost", Source: "app.log", Offset: int64(i), Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC)}
+				}
+				_, err = repo.AddBatch(evts)
+				if err != nil {
+					t.Fatalf("got error when adding events: %v", err)
+				}
+				srch := &search.Search{Fragments: map[string]struct{}{tt.fragment: {}}}
+				actual := []string{}
+				for _, evt := range collectFilterStream(repo, srch, nil, nil) {
+					actual = append(actual, evt.Raw)
+				}
+				sort.Strings(actual)
+				if !reflect.DeepEqual(actual, tt.expected) {
+					t.Fatalf("got unexpected events, expected %v but got %v", tt.expected, actual)
+				}
+				count, err := repo.Count(context.Background(), srch, nil, nil)
+				if err != nil {
+					t.Fatalf("got unexpected error when counting events: %v", err)
+				}
+				if count != int64(len(tt.expected)) {
+					t.Fatalf("got unexpected count, expected %v but got %v", len(tt.expected), count)
+				}
+			})
+		}
+	}
+}
+
+func TestFilterStream_SendsErrorWhenQueryFails(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	// Every connection to :memory: is its own database
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	// An empty repository is not searched at all, so there has to be an event for the query to fail
+	_, err = repo.AddBatch(suiteEvents)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	_, err = db.Exec("DROP TABLE EventContents;")
+	if err != nil {
+		t.Fatalf("got error when dropping EventContents table: %v", err)
+	}
+
+	evts, err := collectFilterStreamErr(repo, &search.Search{}, nil, nil)
+	if err == nil {
+		t.Fatal("expected FilterStream to send an error when the query fails")
+	}
+	if len(evts) != 0 {
+		t.Fatalf("got unexpected numEvents=%v from a failed search", len(evts))
+	}
+}
+
+func TestSqliteRepository_PingFails(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		breakDB func(db *sql.DB) error
+	}{
+		{"closed database", func(db *sql.DB) error { return db.Close() }},
+		{"missing table", func(db *sql.DB) error {
+			_, err := db.Exec("DROP TABLE Events;")
+			return err
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", ":memory:")
+			if err != nil {
+				t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+			}
+			// Every connection to :memory: is its own database
+			db.SetMaxOpenConns(1)
+			repo, err := SqliteRepository(db, &config.SqliteConfig{})
+			if err != nil {
+				t.Fatalf("got error when creating events repo: %v", err)
+			}
+			err = tt.breakDB(db)
+			if err != nil {
+				t.Fatalf("got error when breaking the database: %v", err)
+			}
+			err = repo.Ping(context.Background())
+			if err == nil {
+				t.Fatal("expected Ping to return an error")
+			}
+		})
+	}
+}
+
+func TestSqliteRepository_FilterStreamPageSize(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db, &config.SqliteConfig{FilterStreamPageSize: 7})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	evts := make([]Event, 20)
+	for i := range evts {
+		evts[i] = Event{
+			Raw:       "log event",
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	_, err = repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	pageSizes := []int{}
+	for page := range repo.FilterStream(context.Background(), &search.Search{}, nil, nil) {
+		if page.Err != nil {
+			t.Fatalf("got unexpected error when searching: %v", page.Err)
+		}
+		pageSizes = append(pageSizes, len(page.Events))
+	}
+	if expected := []int{7, 7, 6}; !reflect.DeepEqual(pageSizes, expected) {
+		t.Fatalf("got unexpected page sizes, expected %v but got %v", expected, pageSizes)
+	}
+
+	_, err = SqliteRepository(db, &config.SqliteConfig{FilterStreamPageSize: -1})
+	if err == nil {
+		t.Fatal("expected an error when creating a repository with a negative page size")
+	}
+}
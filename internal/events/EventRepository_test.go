@@ -0,0 +1,1223 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// The tests in this file are ran against every Repository implementation to make sure they behave the same way.
+
+var repositoryFactories = map[string]func(t testing.TB) Repository{
+	"sqlite": func(t testing.TB) Repository {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+		}
+		repo, err := SqliteRepository(db, &config.SqliteConfig{
+			DatabaseFile: ":memory:",
+			TrueBatch:    true,
+		})
+		if err != nil {
+			t.Fatalf("got error when creating events repo: %v", err)
+		}
+		return repo
+	},
+	"sqliteOneByOne": func(t testing.TB) Repository {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+		}
+		repo, err := SqliteRepository(db, &config.SqliteConfig{
+			DatabaseFile: ":memory:",
+			TrueBatch:    false,
+		})
+		if err != nil {
+			t.Fatalf("got error when creating events repo: %v", err)
+		}
+		return repo
+	},
+	"inMemory": func(t testing.TB) Repository {
+		return InMemoryRepository()
+	},
+}
+
+func forEachRepository(t *testing.T, test func(t *testing.T, repo Repository)) {
+	for name, factory := range repositoryFactories {
+		t.Run(name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+var suiteEvents = []Event{
+	{
+		Raw:       "2021-02-01 00:00:00 user logged in",
+		Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		Host:      "host-a",
+		Source:    "access.txt",
+		Offset:    0,
+	},
+	{
+		Raw:       "2021-02-01 00:00:01 user logged out",
+		Timestamp: time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC),
+		Host:      "host-a",
+		Source:    "access.txt",
+		Offset:    33,
+	},
+	{
+		Raw:       "2021-02-01 00:00:02 database connection failed",
+		Timestamp: time.Date(2021, 2, 1, 0, 0, 2, 0, time.UTC),
+		Host:      "host-b",
+		Source:    "error.txt",
+		Offset:    0,
+	},
+}
+
+func TestRepository_Duplicates(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		_, err = repo.AddBatch(suiteEvents[:1])
+		if err != nil {
+			t.Fatalf("got error when adding duplicate event: %v", err)
+		}
+		evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+		if len(evts) != len(suiteEvents) {
+			t.Fatalf("got unexpected number of events, expected %v but got %v", len(suiteEvents), len(evts))
+		}
+	})
+}
+
+func TestRepository_AddBatchResult(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		res, err := repo.AddBatch(suiteEvents[:2])
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		if len(res.Ids) != 2 || res.Ids[0] != 1 || res.Ids[1] != 2 || res.NumAdded() != 2 || res.NumDuplicates() != 0 {
+			t.Fatalf("got unexpected result for first batch, expected ids [1, 2] and no duplicates but got %+v", res)
+		}
+
+		// suiteEvents[2] is new, the rest are duplicates of either the first batch or an earlier event in the same batch
+		res, err = repo.AddBatch([]Event{suiteEvents[1], suiteEvents[2], suiteEvents[0], suiteEvents[2]})
+		if err != nil {
+			t.Fatalf("got error when adding mixed batch: %v", err)
+		}
+		expectedIds := []int64{DuplicateId, 3, DuplicateId, DuplicateId}
+		if len(res.Ids) != len(expectedIds) || res.NumAdded() != 1 {
+			t.Fatalf("got unexpected ids for mixed batch, expected %v but got %v", expectedIds, res.Ids)
+		}
+		for i := range expectedIds {
+			if res.Ids[i] != expectedIds[i] {
+				t.Fatalf("got unexpected ids for mixed batch, expected %v but got %v", expectedIds, res.Ids)
+			}
+		}
+		if res.NumDuplicates() != 3 || res.Duplicates["access.txt"] != 2 || res.Duplicates["error.txt"] != 1 {
+			t.Fatalf("got unexpected duplicates for mixed batch, expected access.txt=2 and error.txt=1 but got %v", res.Duplicates)
+		}
+
+		// The returned id must refer to the event at the same index in the batch
+		evts, err := repo.GetByIds(res.Ids[1:2], SortModeNone)
+		if err != nil {
+			t.Fatalf("got error when getting events: %v", err)
+		}
+		if len(evts) != 1 || evts[0].Raw != suiteEvents[2].Raw {
+			t.Fatalf("got unexpected event for returned id, expected raw=%q but got %v", suiteEvents[2].Raw, evts)
+		}
+		evts = collectFilterStream(repo, &search.Search{Fragments: map[string]struct{}{"database": {}}}, nil, nil)
+		if len(evts) != 1 || evts[0].Id != 3 {
+			t.Fatalf("got unexpected search result after mixed batch, expected only id=3 but got %v", evts)
+		}
+	})
+}
+
+func TestRepository_DuplicateKeys(t *testing.T) {
+	t0 := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	evt := func(raw, source string, offset int64, ts time.Time, duplicateKey string) Event {
+		return Event{Raw: raw, Timestamp: ts, Host: "receiver", Source: source, Offset: offset, DuplicateKey: duplicateKey}
+	}
+	for _, tt := range []struct {
+		name        string
+		evts        []Event
+		expectedIds []int64
+	}{
+		{
+			name: "offset key adds identical lines at different offsets",
+			evts: []Event{
+				evt("connection reset", "net", 0, t0, config.DuplicateKeyOffset),
+				evt("connection reset", "net", 17, t0, config.DuplicateKeyOffset),
+				evt("connection reset", "net", 0, t0, ""),
+			},
+			expectedIds: []int64{1, 2, DuplicateId},
+		},
+		{
+			name: "content key skips identical lines at different offsets and timestamps",
+			evts: []Event{
+				evt("connection reset", "net", 0, t0, config.DuplicateKeyContent),
+				evt("connection reset", "net", 17, t0.Add(time.Second), config.DuplicateKeyContent),
+				evt("connection reset", "other", 0, t0, config.DuplicateKeyContent),
+			},
+			expectedIds: []int64{1, DuplicateId, 2},
+		},
+		{
+			name: "content key adds different lines at the same offset and timestamp",
+			evts: []Event{
+				evt("connection opened", "net", 0, t0, config.DuplicateKeyContent),
+				evt("connection closed", "net", 0, t0, config.DuplicateKeyContent),
+			},
+			expectedIds: []int64{1, 2},
+		},
+		{
+			name: "keys do not conflict with each other",
+			evts: []Event{
+				evt("connection reset", "net", 0, t0, config.DuplicateKeyOffset),
+				evt("connection reset", "net", 0, t0, config.DuplicateKeyContent),
+				evt("connection reset", "net", 5, t0, config.DuplicateKeyContent),
+			},
+			expectedIds: []int64{1, 2, DuplicateId},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachRepository(t, func(t *testing.T, repo Repository) {
+				// Duplicates are detected both within a batch and against events added by an earlier batch
+				res, err := repo.AddBatch(tt.evts)
+				if err != nil {
+					t.Fatalf("got error when adding events: %v", err)
+				}
+				if !reflect.DeepEqual(res.Ids, tt.expectedIds) {
+					t.Fatalf("got unexpected ids, expected %v but got %v", tt.expectedIds, res.Ids)
+				}
+				res, err = repo.AddBatch(tt.evts)
+				if err != nil {
+					t.Fatalf("got error when adding events again: %v", err)
+				}
+				if res.NumAdded() != 0 || res.NumDuplicates() != int64(len(tt.evts)) {
+					t.Fatalf("got unexpected result when adding events again, expected only duplicates but got %+v", res)
+				}
+			})
+		})
+	}
+}
+
+func TestRepository_UpsertBatchContentKey(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		t0 := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		original := Event{Raw: "connection reset", Timestamp: t0, Host: "receiver", Source: "net", DuplicateKey: config.DuplicateKeyContent, Fields: map[string]string{"attempt": "1"}}
+		res, err := repo.UpsertBatch([]Event{original})
+		if err != nil || res.NumAdded() != 1 {
+			t.Fatalf("got unexpected result when adding event, expected it to be added but got %+v and err=%v", res, err)
+		}
+		replacement := original
+		replacement.Offset = 40
+		replacement.Timestamp = t0.Add(time.Minute)
+		replacement.Fields = map[string]string{"attempt": "2"}
+		res, err = repo.UpsertBatch([]Event{replacement})
+		if err != nil {
+			t.Fatalf("got error when upserting event: %v", err)
+		}
+		if res.NumReplaced() != 1 || res.NumAdded() != 0 || res.Ids[0] != 1 {
+			t.Fatalf("got unexpected result when upserting event, expected it to replace id=1 but got %+v", res)
+		}
+		evts := collectFilterStream(repo, &search.Search{Fields: map[string][]string{"attempt": {"2"}}}, nil, nil)
+		if len(evts) != 1 || evts[0].Id != 1 {
+			t.Fatalf("got unexpected events after upsert, expected the fields of id=1 to be replaced but got %v", evts)
+		}
+	})
+}
+
+func TestRepository_UpsertBatch(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ts := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		original := Event{Raw: "status=200 request done", Timestamp: ts, Host: "h", Source: "s", Offset: 0, Fields: map[string]string{"status": "200"}}
+		_, err := repo.AddBatch([]Event{
+			original,
+			{Raw: "status=200 other request", Timestamp: ts.Add(1 * time.Second), Host: "h", Source: "s", Offset: 1, Fields: map[string]string{"status": "200"}},
+		})
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		corrected := Event{Raw: "status=500 request failed", Timestamp: ts, Host: "h", Source: "s", Offset: 0, Fields: map[string]string{"status": "500"}}
+
+		// Without upserting the corrected event is skipped like any other duplicate
+		res, err := repo.AddBatch([]Event{corrected})
+		if err != nil {
+			t.Fatalf("got error when adding corrected event: %v", err)
+		}
+		if res.NumDuplicates() != 1 || res.NumReplaced() != 0 {
+			t.Fatalf("got unexpected result when adding corrected event, expected it to be skipped but got %+v", res)
+		}
+		evt, err := repo.GetById(1)
+		if err != nil {
+			t.Fatalf("got error when getting event: %v", err)
+		}
+		if evt.Raw != original.Raw {
+			t.Fatalf("got unexpected raw after adding corrected event, expected %q but got %q", original.Raw, evt.Raw)
+		}
+
+		res, err = repo.UpsertBatch([]Event{
+			corrected,
+			{Raw: "status=404 not found", Timestamp: ts.Add(2 * time.Second), Host: "h", Source: "s", Offset: 2, Fields: map[string]string{"status": "404"}},
+		})
+		if err != nil {
+			t.Fatalf("got error when upserting events: %v", err)
+		}
+		// SQLite may use up an id for the ignored insert of a replaced event, so the id of the added event is not known
+		if len(res.Ids) != 2 || res.Ids[0] != 1 || res.Ids[1] <= 2 || res.NumAdded() != 1 || res.NumReplaced() != 1 || res.Replaced["s"] != 1 || res.NumDuplicates() != 0 {
+			t.Fatalf("got unexpected result when upserting events, expected id=1 to be replaced and one event to be added but got %+v", res)
+		}
+		addedID := res.Ids[1]
+		evt, err = repo.GetById(1)
+		if err != nil {
+			t.Fatalf("got error when getting event: %v", err)
+		}
+		if evt.Raw != corrected.Raw {
+			t.Fatalf("got unexpected raw after upserting corrected event, expected %q but got %q", corrected.Raw, evt.Raw)
+		}
+		for _, tt := range []struct {
+			name     string
+			srch     *search.Search
+			expected []int64
+		}{
+			{"new raw", &search.Search{Fragments: map[string]struct{}{"failed": {}}}, []int64{1}},
+			{"old raw", &search.Search{Fragments: map[string]struct{}{"done": {}}}, []int64{}},
+			{"new field", &search.Search{Fields: map[string][]string{"status": {"500"}}}, []int64{1}},
+			{"old field", &search.Search{Fields: map[string][]string{"status": {"200"}}}, []int64{2}},
+			{"added", &search.Search{Fields: map[string][]string{"status": {"404"}}}, []int64{addedID}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				verifyIds(t, collectFilterStream(repo, tt.srch, nil, nil), tt.expected)
+			})
+		}
+
+		// A duplicate of an earlier event in the same batch replaces that event as well
+		res, err = repo.UpsertBatch([]Event{
+			{Raw: "first", Timestamp: ts.Add(3 * time.Second), Host: "h", Source: "s", Offset: 3},
+			{Raw: "second", Timestamp: ts.Add(3 * time.Second), Host: "h", Source: "s", Offset: 3},
+		})
+		if err != nil {
+			t.Fatalf("got error when upserting duplicates in the same batch: %v", err)
+		}
+		if len(res.Ids) != 2 || res.Ids[0] <= addedID || res.Ids[1] != res.Ids[0] || res.NumAdded() != 1 || res.NumReplaced() != 1 {
+			t.Fatalf("got unexpected result when upserting duplicates in the same batch, expected both to get the same id but got %+v", res)
+		}
+		evt, err = repo.GetById(res.Ids[0])
+		if err != nil {
+			t.Fatalf("got error when getting event: %v", err)
+		}
+		if evt.Raw != "second" {
+			t.Fatalf("got unexpected raw after upserting duplicates in the same batch, expected %q but got %q", "second", evt.Raw)
+		}
+	})
+}
+
+func TestRepository_GetById(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		evt, err := repo.GetById(2)
+		if err != nil {
+			t.Fatalf("got error when getting event: %v", err)
+		}
+		if evt.Id != 2 || evt.Raw != suiteEvents[1].Raw || evt.Host != suiteEvents[1].Host || evt.Source != suiteEvents[1].Source || !evt.Timestamp.Equal(suiteEvents[1].Timestamp) {
+			t.Fatalf("got unexpected event, expected id=2 with raw=%q but got %+v", suiteEvents[1].Raw, evt)
+		}
+
+		evt, err = repo.GetById(int64(len(suiteEvents) + 1))
+		if !errors.Is(err, ErrEventNotFound) {
+			t.Fatalf("got unexpected error when getting missing event, expected ErrEventNotFound but got %v", err)
+		}
+		if evt != nil {
+			t.Fatalf("got unexpected event when getting missing event, expected nil but got %+v", evt)
+		}
+	})
+}
+
+func TestRepository_DeleteOlderThan(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		deleted, err := repo.DeleteOlderThan(suiteEvents[1].Timestamp)
+		if err != nil {
+			t.Fatalf("got error when deleting events: %v", err)
+		}
+		if deleted != 1 {
+			t.Fatalf("got unexpected number of deleted events, expected 1 but got %v", deleted)
+		}
+		evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+		if len(evts) != 2 || evts[0].Id != 3 || evts[1].Id != 2 {
+			t.Fatalf("got unexpected events after deleting, expected ids [3, 2] but got %v", evts)
+		}
+		evts = collectFilterStream(repo, &search.Search{Fragments: map[string]struct{}{"in": {}}}, nil, nil)
+		if len(evts) != 0 {
+			t.Fatalf("got unexpected events when searching for deleted event, expected none but got %v", evts)
+		}
+		evts, err = repo.GetByIds([]int64{1, 2}, SortModeNone)
+		if err != nil {
+			t.Fatalf("got error when getting events: %v", err)
+		}
+		if len(evts) != 1 || evts[0].Id != 2 {
+			t.Fatalf("got unexpected events from GetByIds after deleting, expected only id=2 but got %v", evts)
+		}
+
+		// A deleted event is no longer a duplicate, and must not reuse the id of an existing event
+		res, err := repo.AddBatch(suiteEvents[:1])
+		if err != nil {
+			t.Fatalf("got error when adding deleted event again: %v", err)
+		}
+		if len(res.Ids) != 1 || res.Ids[0] != 4 {
+			t.Fatalf("got unexpected ids when adding deleted event again, expected [4] but got %v", res.Ids)
+		}
+	})
+}
+
+func TestRepository_TimeRangeAndSources(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		min, max, err := repo.TimeRange()
+		if err != nil {
+			t.Fatalf("got error when getting time range of empty repository: %v", err)
+		}
+		if !min.IsZero() || !max.IsZero() {
+			t.Fatalf("got unexpected time range of empty repository, expected zero times but got %v - %v", min, max)
+		}
+		sources, err := repo.Sources()
+		if err != nil {
+			t.Fatalf("got error when getting sources of empty repository: %v", err)
+		}
+		if len(sources) != 0 {
+			t.Fatalf("got unexpected sources of empty repository, expected none but got %v", sources)
+		}
+
+		// Add the events out of order to make sure the time range does not depend on the order they were added in
+		_, err = repo.AddBatch([]Event{suiteEvents[2], suiteEvents[0], suiteEvents[1]})
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		min, max, err = repo.TimeRange()
+		if err != nil {
+			t.Fatalf("got error when getting time range: %v", err)
+		}
+		if !min.Equal(suiteEvents[0].Timestamp) || !max.Equal(suiteEvents[2].Timestamp) {
+			t.Fatalf("got unexpected time range, expected %v - %v but got %v - %v", suiteEvents[0].Timestamp, suiteEvents[2].Timestamp, min, max)
+		}
+		sources, err = repo.Sources()
+		if err != nil {
+			t.Fatalf("got error when getting sources: %v", err)
+		}
+		if len(sources) != 2 || sources[0] != "access.txt" || sources[1] != "error.txt" {
+			t.Fatalf("got unexpected sources, expected [access.txt error.txt] but got %v", sources)
+		}
+	})
+}
+
+func TestRepository_Ping(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		err := repo.Ping(context.Background())
+		if err != nil {
+			t.Fatalf("got error when pinging empty repository: %v", err)
+		}
+		_, err = repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		err = repo.Ping(context.Background())
+		if err != nil {
+			t.Fatalf("got error when pinging repository: %v", err)
+		}
+	})
+}
+
+func TestRepository_LatestOffset(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, ok, err := repo.LatestOffset("localhost", "log.txt")
+		if err != nil {
+			t.Fatalf("got error when getting latest offset of empty repository: %v", err)
+		}
+		if ok {
+			t.Fatal("got unexpected ok when getting latest offset of empty repository")
+		}
+
+		base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		// The offsets increase but the timestamps do not, so the latest offset is not the one of the newest event.
+		// The same file on another host, such as from a forwarder, is further along but must not be used.
+		for i, offset := range []int64{0, 40, 85, 120} {
+			_, err = repo.AddBatch([]Event{
+				{Raw: "log event", Timestamp: base.Add(time.Duration(-i) * time.Second), Host: "localhost", Source: "log.txt", Offset: offset},
+				{Raw: "other event", Timestamp: base, Host: "localhost", Source: "other.txt", Offset: offset * 10},
+				{Raw: "forwarded event", Timestamp: base, Host: "otherhost", Source: "log.txt", Offset: offset * 10},
+			})
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+			latest, ok, err := repo.LatestOffset("localhost", "log.txt")
+			if err != nil {
+				t.Fatalf("got error when getting latest offset: %v", err)
+			}
+			if !ok || latest != offset {
+				t.Fatalf("got unexpected latest offset, expected %v but got %v (ok=%v)", offset, latest, ok)
+			}
+		}
+		latest, ok, err := repo.LatestOffset("otherhost", "log.txt")
+		if err != nil {
+			t.Fatalf("got error when getting latest offset of other host: %v", err)
+		}
+		if !ok || latest != 1200 {
+			t.Fatalf("got unexpected latest offset of other host, expected 1200 but got %v (ok=%v)", latest, ok)
+		}
+		for _, tt := range []struct{ host, source string }{{"localhost", "missing.txt"}, {"missinghost", "log.txt"}} {
+			_, ok, err = repo.LatestOffset(tt.host, tt.source)
+			if err != nil {
+				t.Fatalf("got error when getting latest offset of host=%v, source=%v: %v", tt.host, tt.source, err)
+			}
+			if ok {
+				t.Fatalf("got unexpected ok when getting latest offset of host=%v, source=%v without events", tt.host, tt.source)
+			}
+		}
+	})
+}
+
+func TestRepository_Count(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		startTime := suiteEvents[1].Timestamp
+		for _, tt := range []struct {
+			name      string
+			srch      *search.Search
+			startTime *time.Time
+		}{
+			{"all", &search.Search{}, nil},
+			{"fragment", &search.Search{Fragments: map[string]struct{}{"user": {}}}, nil},
+			{"not fragment", &search.Search{NotFragments: map[string]struct{}{"out": {}}}, nil},
+			{"source and not fragment", &search.Search{Sources: map[string]struct{}{"access.txt": {}}, NotFragments: map[string]struct{}{"out": {}}}, nil},
+			{"hosts", &search.Search{Hosts: map[string]struct{}{"host-a": {}, "host-b": {}}}, nil},
+			{"start time", &search.Search{}, &startTime},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				count, err := repo.Count(context.Background(), tt.srch, tt.startTime, nil)
+				if err != nil {
+					t.Fatalf("got error when counting events: %v", err)
+				}
+				evts := collectFilterStream(repo, tt.srch, tt.startTime, nil)
+				if count != int64(len(evts)) {
+					t.Fatalf("got unexpected count, expected %v to match FilterStream but got %v", len(evts), count)
+				}
+			})
+		}
+	})
+}
+
+func TestRepository_StoredFields(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		ts := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		_, err := repo.AddBatch([]Event{
+			{Raw: "status=200 user=Alice", Timestamp: ts, Host: "h", Source: "s", Offset: 0, Fields: map[string]string{"status": "200", "user": "Alice"}},
+			{Raw: "status=500 user=bob", Timestamp: ts.Add(1 * time.Second), Host: "h", Source: "s", Offset: 1, Fields: map[string]string{"status": "500", "user": "bob"}},
+			{Raw: "status=404", Timestamp: ts.Add(2 * time.Second), Host: "h", Source: "s", Offset: 2, Fields: map[string]string{"status": "404"}},
+			{Raw: "status=500 added without fields", Timestamp: ts.Add(3 * time.Second), Host: "h", Source: "s", Offset: 3},
+		})
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		for _, tt := range []struct {
+			name     string
+			srch     *search.Search
+			expected []int64
+		}{
+			{"one value", &search.Search{Fields: map[string][]string{"status": {"500"}}}, []int64{4, 2}},
+			{"any value", &search.Search{Fields: map[string][]string{"status": {"200", "404"}}}, []int64{4, 3, 1}},
+			{"case insensitive", &search.Search{Fields: map[string][]string{"user": {"alice"}}}, []int64{4, 3, 1}},
+			{"several fields", &search.Search{Fields: map[string][]string{"status": {"500"}, "user": {"bob"}}}, []int64{4, 2}},
+			{"wildcard is not filtered", &search.Search{Fields: map[string][]string{"status": {"5*"}}}, []int64{4, 3, 2, 1}},
+			{"not stored", &search.Search{Fields: map[string][]string{"missing": {"1"}}}, []int64{4, 3, 2, 1}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				evts := collectFilterStream(repo, tt.srch, nil, nil)
+				verifyIds(t, evts, tt.expected)
+				count, err := repo.Count(context.Background(), tt.srch, nil, nil)
+				if err != nil {
+					t.Fatalf("got error when counting events: %v", err)
+				}
+				if count != int64(len(tt.expected)) {
+					t.Fatalf("got unexpected count, expected %v but got %v", len(tt.expected), count)
+				}
+			})
+		}
+	})
+}
+
+func TestRepository_Phrases(t *testing.T) {
+	raws := []string{
+		"connection refused by peer",
+		"refused connection",
+		"disk 100% full",
+		"disk 100x full",
+		"user_name is connection refused",
+	}
+	evts := make([]Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = Event{
+			Raw:       raw,
+			Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC),
+			Host:      "localhost",
+			Source:    "log.txt",
+			Offset:    int64(i),
+		}
+	}
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		for _, tt := range []struct {
+			name     string
+			srch     *search.Search
+			expected []int64
+		}{
+			{"phrase", &search.Search{Fragments: map[string]struct{}{"connection refused": {}}}, []int64{5, 1}},
+			{"phrase with fragment", &search.Search{Fragments: map[string]struct{}{"connection refused": {}, "peer": {}}}, []int64{1}},
+			{"not phrase", &search.Search{Fragments: map[string]struct{}{"connection": {}}, NotFragments: map[string]struct{}{"connection refused": {}}}, []int64{2}},
+			{"only not phrase", &search.Search{NotFragments: map[string]struct{}{"connection refused": {}}}, []int64{4, 3, 2}},
+			{"phrase with percent", &search.Search{Fragments: map[string]struct{}{"100% full": {}}}, []int64{3}},
+			{"phrase with underscore", &search.Search{Fragments: map[string]struct{}{"user_name is": {}}}, []int64{5}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				got := collectFilterStream(repo, tt.srch, nil, nil)
+				if len(got) != len(tt.expected) {
+					t.Fatalf("got unexpected events, expected ids %v but got %v", tt.expected, got)
+				}
+				for i := range got {
+					if got[i].Id != tt.expected[i] {
+						t.Fatalf("got unexpected events, expected ids %v but got %v", tt.expected, got)
+					}
+				}
+				count, err := repo.Count(context.Background(), tt.srch, nil, nil)
+				if err != nil {
+					t.Fatalf("got error when counting events: %v", err)
+				}
+				if count != int64(len(tt.expected)) {
+					t.Fatalf("got unexpected count, expected %v but got %v", len(tt.expected), count)
+				}
+			})
+		}
+	})
+}
+
+func TestRepository_GetByIds(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		evts, err := repo.GetByIds([]int64{1, 3, 100}, SortModeTimestampDesc)
+		if err != nil {
+			t.Fatalf("got error when getting events: %v", err)
+		}
+		if len(evts) != 2 {
+			t.Fatalf("got unexpected number of events, expected 2 but got %v", len(evts))
+		}
+		if evts[0].Id != 3 || evts[1].Id != 1 {
+			t.Fatalf("got unexpected ids or order, expected [3, 1] but got [%v, %v]", evts[0].Id, evts[1].Id)
+		}
+		if evts[0].Raw != suiteEvents[2].Raw || evts[0].Host != suiteEvents[2].Host || evts[0].Source != suiteEvents[2].Source {
+			t.Fatalf("got unexpected event contents: %v", evts[0])
+		}
+	})
+}
+
+// cancellingRepo cancels a context after its first call to GetByIds.
+type cancellingRepo struct {
+	Repository
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (repo *cancellingRepo) GetByIds(ids []int64, sortMode SortMode) ([]EventWithId, error) {
+	repo.calls++
+	repo.cancel()
+	return repo.Repository.GetByIds(ids, sortMode)
+}
+
+func TestRepository_GetByIdsContext(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		numEvents := getByIdsChunkSize + 10
+		ids := make([]int64, 0, numEvents)
+		for start := 0; start < numEvents; start += 100 {
+			evts := make([]Event, 0, 100)
+			for i := start; i < start+100 && i < numEvents; i++ {
+				evts = append(evts, Event{
+					Raw:       fmt.Sprintf("event %v", i),
+					Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+					Host:      "host-a",
+					Source:    "access.txt",
+					Offset:    int64(i),
+				})
+			}
+			res, err := repo.AddBatch(evts)
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+			ids = append(ids, res.Ids...)
+		}
+
+		evts, err := GetByIdsContext(context.Background(), repo, ids, SortModeTimestampDesc)
+		if err != nil {
+			t.Fatalf("got error when getting events: %v", err)
+		}
+		if len(evts) != numEvents || evts[0].Id != ids[numEvents-1] || evts[numEvents-1].Id != ids[0] {
+			t.Fatalf("got unexpected events, expected %v events in descending timestamp order but got %v", numEvents, len(evts))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cancelling := &cancellingRepo{Repository: repo, cancel: cancel}
+		evts, err = GetByIdsContext(ctx, cancelling, ids, SortModeTimestampDesc)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled but got %v", err)
+		}
+		if cancelling.calls != 1 {
+			t.Fatalf("expected GetByIds to be called once before the cancellation was noticed but it was called %v times", cancelling.calls)
+		}
+		if len(evts) != getByIdsChunkSize || evts[0].Id != ids[getByIdsChunkSize-1] {
+			t.Fatalf("expected the first chunk of %v events in descending timestamp order but got %v events", getByIdsChunkSize, len(evts))
+		}
+	})
+}
+
+func TestRepository_PersistsHost(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		evts, err := repo.GetByIds([]int64{1, 2, 3}, SortModeNone)
+		if err != nil {
+			t.Fatalf("got error when getting events: %v", err)
+		}
+		for _, evt := range evts {
+			expected := suiteEvents[evt.Id-1].Host
+			if evt.Host != expected {
+				t.Fatalf("got unexpected host from GetByIds for id=%v, expected '%v' but got '%v'", evt.Id, expected, evt.Host)
+			}
+		}
+		for _, evt := range collectFilterStream(repo, &search.Search{}, nil, nil) {
+			expected := suiteEvents[evt.Id-1].Host
+			if evt.Host != expected {
+				t.Fatalf("got unexpected host from FilterStream for id=%v, expected '%v' but got '%v'", evt.Id, expected, evt.Host)
+			}
+		}
+	})
+}
+
+func TestRepository_PreservesRawCase(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		raw := "2021-02-01 00:00:00 ERROR User=Alice Failed To Log In"
+		res, err := repo.AddBatch([]Event{{
+			Raw:       raw,
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+			Host:      "host-a",
+			Source:    "access.txt",
+		}})
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		evt, err := repo.GetById(res.Ids[0])
+		if err != nil {
+			t.Fatalf("got error when getting event: %v", err)
+		}
+		if evt.Raw != raw {
+			t.Fatalf("got unexpected raw from GetById, expected '%v' but got '%v'", raw, evt.Raw)
+		}
+		for _, s := range []string{"error", "FAILED", "alice"} {
+			srch, err := search.Parse(s)
+			if err != nil {
+				t.Fatalf("got error when parsing search: %v", err)
+			}
+			evts := collectFilterStream(repo, srch, nil, nil)
+			if len(evts) != 1 || evts[0].Raw != raw {
+				t.Fatalf("got unexpected events from FilterStream for search=%v, expected raw '%v' but got %v", s, raw, evts)
+			}
+		}
+	})
+}
+
+var filterStreamSuiteTests = []struct {
+	search      string
+	expectedIds []int64
+}{
+	{"", []int64{3, 2, 1}},
+	{"user", []int64{2, 1}},
+	{"NOT out user", []int64{1}},
+	{"user NOT out", []int64{1}},
+	{"source=error.txt", []int64{3}},
+	{"host=host-b", []int64{3}},
+	{"host!=host-b", []int64{2, 1}},
+	{"host=host-a NOT out", []int64{1}},
+	{"NOT out", []int64{3, 1}},
+	{"conn*", []int64{3}},
+	{"source=acc*", []int64{2, 1}},
+	{"source!=err*", []int64{2, 1}},
+	{"source IN (acc*, err*)", []int64{3, 2, 1}},
+	{"source IN (access.txt, error.txt)", []int64{3, 2, 1}},
+	{"host IN (host-b, host-c)", []int64{3}},
+	{"source NOT IN (error.txt, other.txt)", []int64{2, 1}},
+	{"source NOT IN (error.txt, access.txt)", []int64{}},
+	{"user source IN (error.txt, access.txt) NOT out", []int64{1}},
+	{"source IN (access.txt, error.txt) source!=error.txt", []int64{2, 1}},
+	{"source IN (access.txt, error.txt) source!=error.txt logged NOT out", []int64{1}},
+	{"source!=access.txt NOT database", []int64{}},
+	{"source!=error.txt host!=host-b user NOT in", []int64{2}},
+	{"nonexistent", []int64{}},
+}
+
+func TestRepository_FilterStream(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		for _, tt := range filterStreamSuiteTests {
+			t.Run(tt.search, func(t *testing.T) {
+				srch, err := search.Parse(tt.search)
+				if err != nil {
+					t.Fatalf("got error when parsing search: %v", err)
+				}
+				evts := collectFilterStream(repo, srch, nil, nil)
+				verifyIds(t, evts, tt.expectedIds)
+			})
+		}
+	})
+}
+
+func TestRepository_FilterStreamFtsSyntax(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		raws := []string{`opened c:\path\file.txt`, `opened c path file`, `range a-b done`, `range a b done`, `say "hi" now`, `say hi now`, `call f(x) ok`, `call f x ok`}
+		evts := make([]Event, len(raws))
+		for i, raw := range raws {
+			evts[i] = Event{Raw: raw, Timestamp: time.Date(2021, 2, 1, 0, 0, i, 0, time.UTC), Host: "localhost", Source: "log.txt", Offset: int64(i)}
+		}
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		set := func(values ...string) map[string]struct{} {
+			ret := map[string]struct{}{}
+			for _, v := range values {
+				ret[v] = struct{}{}
+			}
+			return ret
+		}
+		// The repositories may return more events than the fragments match, since the search step filters them
+		// afterwards, but they must not fail or leave out any of the matching events
+		for _, tt := range []struct {
+			fragment    string
+			expectedIds []int64
+		}{
+			{`c:\path`, []int64{1}},
+			{`key:value`, []int64{}},
+			{`a-b`, []int64{3}},
+			{`-b`, []int64{3}},
+			{`"hi"`, []int64{5}},
+			{`say "hi`, []int64{5}},
+			{`f(x)`, []int64{7}},
+			{`(x`, []int64{7}},
+			{`x)`, []int64{7}},
+			{`()`, []int64{}},
+		} {
+			t.Run(tt.fragment, func(t *testing.T) {
+				received, err := collectFilterStreamErr(repo, &search.Search{Fragments: set(tt.fragment)}, nil, nil)
+				if err != nil {
+					t.Fatalf("got unexpected error when searching for %q: %v", tt.fragment, err)
+				}
+				for _, id := range tt.expectedIds {
+					found := false
+					for _, evt := range received {
+						found = found || evt.Id == id
+					}
+					if !found {
+						t.Fatalf("expected the search for %q to include eventId=%v but got %v", tt.fragment, id, received)
+					}
+				}
+			})
+		}
+		// Negated fragments have to be matched exactly, since the search step can not add back the events which the
+		// repository left out
+		for _, tt := range []struct {
+			fragment    string
+			notFragment string
+			expectedIds []int64
+		}{
+			{"opened", `c:\path`, []int64{2}},
+			{"range", `a-b`, []int64{4}},
+			{"say", `"hi"`, []int64{6}},
+			{"call", `f(x)`, []int64{8}},
+			{"", `a-b`, []int64{8, 7, 6, 5, 4, 2, 1}},
+		} {
+			t.Run(tt.fragment+" NOT "+tt.notFragment, func(t *testing.T) {
+				srch := &search.Search{NotFragments: set(tt.notFragment)}
+				if tt.fragment != "" {
+					srch.Fragments = set(tt.fragment)
+				}
+				received, err := collectFilterStreamErr(repo, srch, nil, nil)
+				if err != nil {
+					t.Fatalf("got unexpected error when searching for NOT %q: %v", tt.notFragment, err)
+				}
+				verifyIds(t, received, tt.expectedIds)
+			})
+		}
+	})
+}
+
+func TestRepository_FilterStreamEmpty(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		var logged bytes.Buffer
+		log.SetOutput(&logged)
+		defer log.SetOutput(os.Stderr)
+
+		for _, s := range []string{"", "user", "NOT user", "host=host-a"} {
+			srch, err := search.Parse(s)
+			if err != nil {
+				t.Fatalf("got error when parsing search: %v", err)
+			}
+			evts, err := collectFilterStreamErr(repo, srch, nil, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error when searching an empty repository: %v", err)
+			}
+			verifyIds(t, evts, []int64{})
+		}
+		if logged.Len() > 0 {
+			t.Fatalf("got unexpected log output when searching an empty repository: %v", logged.String())
+		}
+	})
+}
+
+func TestRepository_FilterStreamTimeBounds(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		_, err := repo.AddBatch(suiteEvents)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		startTime := time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC)
+		endTime := time.Date(2021, 2, 1, 0, 0, 1, 500, time.UTC)
+		evts := collectFilterStream(repo, &search.Search{}, &startTime, &endTime)
+		verifyIds(t, evts, []int64{2})
+	})
+}
+
+func TestRepository_FilterStreamPaging(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		const numEvents = filterStreamPageSize*2 + 10
+		evts := make([]Event, numEvents)
+		for i := range evts {
+			evts[i] = Event{
+				Raw:       "log event",
+				Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(i),
+			}
+		}
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		pages := 0
+		total := 0
+		for page := range repo.FilterStream(context.Background(), &search.Search{}, nil, nil) {
+			if len(page.Events) > filterStreamPageSize {
+				t.Fatalf("got page with numEvents=%v, expected at most %v", len(page.Events), filterStreamPageSize)
+			}
+			pages++
+			total += len(page.Events)
+		}
+		if pages != 3 {
+			t.Fatalf("got unexpected number of pages, expected 3 but got %v", pages)
+		}
+		if total != numEvents {
+			t.Fatalf("got unexpected number of events, expected %v but got %v", numEvents, total)
+		}
+	})
+}
+
+func TestRepository_FilterStreamPagingDuplicateTimestamps(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		// Groups of 300 events share each timestamp, so several groups straddle a page boundary
+		const numEvents = filterStreamPageSize*2 + 500
+		evts := make([]Event, numEvents)
+		for i := range evts {
+			evts[i] = Event{
+				Raw:       "log event",
+				Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i/300) * time.Second),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(i),
+			}
+		}
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		received := make([]EventWithId, 0, numEvents)
+		for page := range repo.FilterStream(context.Background(), &search.Search{}, nil, nil) {
+			received = append(received, page.Events...)
+		}
+		if len(received) != numEvents {
+			t.Fatalf("got unexpected number of events, expected %v but got %v", numEvents, len(received))
+		}
+		for i := 1; i < len(received); i++ {
+			prev, cur := received[i-1], received[i]
+			if cur.Timestamp.After(prev.Timestamp) || (cur.Timestamp.Equal(prev.Timestamp) && cur.Id >= prev.Id) {
+				t.Fatalf("got events out of order at index %v, id=%v timestamp=%v came after id=%v timestamp=%v", i, cur.Id, cur.Timestamp, prev.Id, prev.Timestamp)
+			}
+		}
+	})
+}
+
+func TestRepository_FilterStreamOldestFirst(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		// Groups of 300 events share each timestamp so that groups straddle page boundaries, and every other group is
+		// added first so that the ids are not in the same order as the timestamps
+		const numEvents = filterStreamPageSize*2 + 500
+		evts := make([]Event, 0, numEvents)
+		for _, parity := range []int{1, 0} {
+			for i := 0; i < numEvents; i++ {
+				if (i/300)%2 != parity {
+					continue
+				}
+				evts = append(evts, Event{
+					Raw:       "log event",
+					Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i/300) * time.Second),
+					Host:      "localhost",
+					Source:    "log.txt",
+					Offset:    int64(i),
+				})
+			}
+		}
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+		start := time.Date(2021, 2, 1, 0, 0, 1, 0, time.UTC)
+		newestFirst := collectFilterStream(repo, &search.Search{}, &start, nil)
+		oldestFirst := collectFilterStream(repo, &search.Search{OldestFirst: true}, &start, nil)
+		if len(oldestFirst) != numEvents-300 || len(newestFirst) != len(oldestFirst) {
+			t.Fatalf("got unexpected number of events, expected %v but got %v newest first and %v oldest first", numEvents-300, len(newestFirst), len(oldestFirst))
+		}
+		for i, evt := range oldestFirst {
+			if expected := newestFirst[len(newestFirst)-1-i]; evt.Id != expected.Id {
+				t.Fatalf("got unexpected event at index %v, expected the reverse of the newest first order with id=%v but got id=%v", i, expected.Id, evt.Id)
+			}
+		}
+	})
+}
+
+func TestRepository_FilterStreamOutOfOrderTimestamps(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		// The events are added in a different order than their timestamps, as when an old log file is read after a
+		// newer one, so the ids are not in the same order as the timestamps
+		base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+		minutes := []int{30, 31, 32, 0, 1, 2, 60, 10, 11, 45}
+		evts := make([]Event, len(minutes))
+		for i, m := range minutes {
+			raw := "alpha event"
+			if i%2 == 1 {
+				raw = "beta event"
+			}
+			evts[i] = Event{Raw: raw, Timestamp: base.Add(time.Duration(m) * time.Minute), Host: "h", Source: "s", Offset: int64(i)}
+		}
+		for i := range evts {
+			_, err := repo.AddBatch(evts[i : i+1])
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+		}
+		at := func(m int) *time.Time {
+			t := base.Add(time.Duration(m) * time.Minute)
+			return &t
+		}
+		for _, tt := range []struct {
+			name        string
+			srch        *search.Search
+			start, end  *time.Time
+			expectedIds []int64
+		}{
+			{"start", &search.Search{}, at(31), nil, []int64{7, 10, 3, 2}},
+			{"start and end", &search.Search{}, at(1), at(11), []int64{9, 8, 6, 5}},
+			{"fragment", &search.Search{Fragments: map[string]struct{}{"beta": {}}}, at(1), at(45), []int64{10, 2, 8, 6}},
+			{"not fragment", &search.Search{NotFragments: map[string]struct{}{"beta": {}}}, at(1), at(45), []int64{3, 1, 9, 5}},
+			{"end", &search.Search{Fragments: map[string]struct{}{"alpha": {}}}, nil, at(10), []int64{5}},
+			{"empty range", &search.Search{Fragments: map[string]struct{}{"event": {}}}, at(12), at(29), []int64{}},
+			{"after last event", &search.Search{}, at(61), nil, []int64{}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				verifyIds(t, collectFilterStream(repo, tt.srch, tt.start, tt.end), tt.expectedIds)
+				count, err := repo.Count(context.Background(), tt.srch, tt.start, tt.end)
+				if err != nil {
+					t.Fatalf("got error when counting events: %v", err)
+				}
+				if count != int64(len(tt.expectedIds)) {
+					t.Fatalf("got unexpected count, expected %v but got %v", len(tt.expectedIds), count)
+				}
+			})
+		}
+	})
+}
+
+func BenchmarkRepository_FilterStream(b *testing.B) {
+	benchmarkFilterStream(b, &search.Search{})
+}
+
+func BenchmarkRepository_FilterStreamFragment(b *testing.B) {
+	benchmarkFilterStream(b, &search.Search{Fragments: map[string]struct{}{"event": {}}})
+}
+
+func benchmarkFilterStream(b *testing.B, srch *search.Search) {
+	for name, factory := range repositoryFactories {
+		b.Run(name, func(b *testing.B) {
+			repo := factory(b)
+			const numEvents = filterStreamPageSize * 50
+			evts := make([]Event, numEvents)
+			for i := range evts {
+				evts[i] = Event{
+					Raw:       "log event",
+					Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+					Host:      "localhost",
+					Source:    "log.txt",
+					Offset:    int64(i),
+				}
+			}
+			// Added in chunks of the publisher's default batch size, since a single true batch insert of all events
+			// would exceed SQLite's limit on the number of variables
+			for start := 0; start < numEvents; start += config.DefaultPublisherBatchSize {
+				end := start + config.DefaultPublisherBatchSize
+				if end > numEvents {
+					end = numEvents
+				}
+				_, err := repo.AddBatch(evts[start:end])
+				if err != nil {
+					b.Fatalf("got error when adding events: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				total := 0
+				for page := range repo.FilterStream(context.Background(), srch, nil, nil) {
+					total += len(page.Events)
+				}
+				if total != numEvents {
+					b.Fatalf("got unexpected number of events, expected %v but got %v", numEvents, total)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRepository_AddBatch(b *testing.B) {
+	for name, factory := range repositoryFactories {
+		b.Run(name, func(b *testing.B) {
+			repo := factory(b)
+			const batchSize = 1000
+			evts := make([]Event, batchSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Every batch gets new offsets so that none of the events are skipped as duplicates
+				for j := range evts {
+					evts[j] = Event{
+						Raw:       "2021-02-01 00:00:00 log event",
+						Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+						Host:      "localhost",
+						Source:    "log.txt",
+						Offset:    int64(i*batchSize + j),
+					}
+				}
+				_, err := repo.AddBatch(evts)
+				if err != nil {
+					b.Fatalf("got error when adding events: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRepository_FilterStreamCancellation(t *testing.T) {
+	forEachRepository(t, func(t *testing.T, repo Repository) {
+		const numEvents = filterStreamPageSize * 3
+		evts := make([]Event, numEvents)
+		for i := range evts {
+			evts[i] = Event{
+				Raw:       "log event",
+				Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+				Host:      "localhost",
+				Source:    "log.txt",
+				Offset:    int64(i),
+			}
+		}
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("got error when adding events: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pages := repo.FilterStream(ctx, &search.Search{}, nil, nil)
+		_, ok := <-pages
+		if !ok {
+			t.Fatal("got unexpected !ok when receiving first page")
+		}
+		cancel()
+		// Give the goroutine time to notice the cancellation while nobody is receiving
+		time.Sleep(100 * time.Millisecond)
+
+		select {
+		case page, ok := <-pages:
+			if ok {
+				t.Fatalf("got unexpected page with numEvents=%v after cancelling, expected the channel to be closed", len(page.Events))
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timed out waiting for FilterStream to close the channel after cancelling")
+		}
+	})
+}
+
+func verifyIds(t *testing.T, evts []EventWithId, expectedIds []int64) {
+	if len(evts) != len(expectedIds) {
+		t.Fatalf("got unexpected number of events, expected %v but got %v", len(expectedIds), len(evts))
+	}
+	for i, evt := range evts {
+		if evt.Id != expectedIds[i] {
+			t.Fatalf("got unexpected id at index %v, expected %v but got %v", i, expectedIds[i], evt.Id)
+		}
+	}
+}
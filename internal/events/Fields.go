@@ -0,0 +1,68 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/parser"
+)
+
+// ExtractFields extracts the fields in input, which is the raw string of an event from source, using the field
+// extractors, key=value extraction and JSON extraction configured for that source.
+// If the same field is extracted in several ways the field extractors take precedence over JSON, which takes
+// precedence over key=value pairs.
+// Field names are always lowercase, so if cfg.CaseSensitive or cfg.PreserveFieldCase is set only the names are
+// lowercased and the values keep the case they have in input.
+func ExtractFields(cfg *config.Config, input, source string) map[string]string {
+	ret := map[string]string{}
+	if cfg.KeyValueExtractionForSource(source) {
+		merge(ret, parser.ExtractKeyValueFields(input))
+	}
+	if cfg.JSONExtractionForSource(source) {
+		merge(ret, parser.ExtractJSONFields(input))
+	}
+	merge(ret, parser.ExtractFields(input, cfg.FieldExtractorsForSource(source)))
+	if cfg.CaseSensitive || cfg.PreserveFieldCase {
+		lowercaseNames(ret)
+	}
+	return ret
+}
+
+func merge(into, fields map[string]string) {
+	for k, v := range fields {
+		into[k] = v
+	}
+}
+
+func lowercaseNames(fields map[string]string) {
+	for k, v := range fields {
+		if lower := strings.ToLower(k); lower != k {
+			delete(fields, k)
+			fields[lower] = v
+		}
+	}
+}
+
+// NormalizeCase returns raw the way it is searched and has its fields extracted, which is lowercased unless
+// cfg.CaseSensitive or cfg.PreserveFieldCase is set. Searches are still case insensitive with cfg.PreserveFieldCase,
+// since fragments and field values are then matched using case insensitive regular expressions.
+func NormalizeCase(cfg *config.Config, raw string) string {
+	if cfg.CaseSensitive || cfg.PreserveFieldCase {
+		return raw
+	}
+	return strings.ToLower(raw)
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/parser"
+)
+
+func TestExtractFields_JSONExtraction(t *testing.T) {
+	enabled, disabled := true, false
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+		JSONExtraction:  true,
+		IndexedFiles: []config.IndexedFileConfig{
+			{Filename: "plain.log", JSONExtraction: &disabled},
+			{Filename: "json-*.log", JSONExtraction: &enabled},
+		},
+	}
+	for _, tt := range []struct {
+		name     string
+		input    string
+		source   string
+		expected map[string]string
+	}{
+		{"json", `{"user": {"id": 1}, "msg": "hi"}`, "app.log", map[string]string{"user.id": "1", "msg": "hi"}},
+		{"plain", "user=2 logged in", "app.log", map[string]string{"user": "2"}},
+		{"field extractors take precedence", `{"user": "json", "msg": "user=regex"}`, "app.log", map[string]string{"user": "regex", "msg": "user=regex"}},
+		{"disabled for source", `{"user": {"id": 1}}`, "plain.log", map[string]string{}},
+		{"enabled for source", `{"user": {"id": 1}}`, "json-1.log", map[string]string{"user.id": "1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := ExtractFields(cfg, tt.input, tt.source)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("got unexpected fields, expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExtractFields_KeyValueExtraction(t *testing.T) {
+	enabled := true
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^(?P<level>\\w+):")},
+		IndexedFiles: []config.IndexedFileConfig{
+			{Filename: "*.log", KeyValueExtraction: &enabled, JSONExtraction: &enabled},
+		},
+	}
+	for _, tt := range []struct {
+		name     string
+		input    string
+		source   string
+		expected map[string]string
+	}{
+		{"pairs", `user=bob msg="logged in"`, "app.log", map[string]string{"user": "bob", "msg": "logged in"}},
+		{"field extractors take precedence", `error: level=debug user=bob`, "app.log", map[string]string{"level": "error", "user": "bob"}},
+		{"json takes precedence", `{"user": "json", "msg": "user=kv"}`, "app.log", map[string]string{"user": "json", "msg": "user=kv"}},
+		{"disabled for source", `user=bob`, "app.txt", map[string]string{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := ExtractFields(cfg, tt.input, tt.source)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("got unexpected fields, expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExtractFields_CaseSensitive(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors:    []*regexp.Regexp{regexp.MustCompile("^(?P<Level>[A-Z]+):")},
+		KeyValueExtraction: true,
+		CaseSensitive:      true,
+	}
+	actual := ExtractFields(cfg, NormalizeCase(cfg, "WARN: userId=Alice Path=/API"), "app.log")
+	expected := map[string]string{"level": "WARN", "userid": "Alice", "path": "/API"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got unexpected fields, expected %v but got %v", expected, actual)
+	}
+
+	cfg.CaseSensitive = false
+	actual = ExtractFields(cfg, NormalizeCase(cfg, "WARN: userId=Alice Path=/API"), "app.log")
+	expected = map[string]string{"userid": "alice", "path": "/api"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got unexpected fields, expected %v but got %v", expected, actual)
+	}
+}
+
+func TestExtractFields_PreserveFieldCase(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors:    []*regexp.Regexp{regexp.MustCompile("^(?P<Level>[A-Z]+):")},
+		KeyValueExtraction: true,
+		PreserveFieldCase:  true,
+	}
+	raw := "WARN: userId=Alice Path=/API"
+	if normalized := NormalizeCase(cfg, raw); normalized != raw {
+		t.Fatalf("expected raw to keep its case but got %v", normalized)
+	}
+	actual := ExtractFields(cfg, NormalizeCase(cfg, raw), "app.log")
+	expected := map[string]string{"level": "WARN", "userid": "Alice", "path": "/API"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("got unexpected fields, expected %v but got %v", expected, actual)
+	}
+}
+
+var benchmarkFieldExtractors = []string{
+	"(\\w+)=(\\w+)",
+	"^(?P<_time>\\d\\d\\d\\d/\\d\\d/\\d\\d \\d\\d:\\d\\d:\\d\\d.\\d\\d\\d\\d\\d\\d)",
+}
+
+var benchmarkFieldInputs = []string{
+	"2021/02/01 12:34:56.789012 user=bob action=login status=200",
+	"2021/02/01 12:34:57.000001 no fields here",
+	"key=value",
+	"",
+}
+
+// extractFieldsCompilingPerEvent is how fields used to be extracted, by compiling the field extractors for every event.
+func extractFieldsCompilingPerEvent(input string, exprs []string) map[string]string {
+	rexes := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		rexes[i] = regexp.MustCompile(expr)
+	}
+	return parser.ExtractFields(input, rexes)
+}
+
+func benchmarkFieldsConfig(b testing.TB) *config.Config {
+	cfg := &config.Config{}
+	for _, expr := range benchmarkFieldExtractors {
+		rex, err := config.CompileFieldExtractor(expr)
+		if err != nil {
+			b.Fatalf("got error when compiling field extractor %v: %v", expr, err)
+		}
+		cfg.FieldExtractors = append(cfg.FieldExtractors, rex)
+	}
+	return cfg
+}
+
+func TestExtractFields_CompiledExtractorsMatchPerEventCompilation(t *testing.T) {
+	cfg := benchmarkFieldsConfig(t)
+	for _, input := range benchmarkFieldInputs {
+		expected := extractFieldsCompilingPerEvent(input, benchmarkFieldExtractors)
+		actual := ExtractFields(cfg, input, "app.log")
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("got unexpected fields for input=%v, expected %v but got %v", input, expected, actual)
+		}
+	}
+}
+
+func BenchmarkExtractFields(b *testing.B) {
+	b.Run("compiledPerEvent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			extractFieldsCompilingPerEvent(benchmarkFieldInputs[i%len(benchmarkFieldInputs)], benchmarkFieldExtractors)
+		}
+	})
+	b.Run("compiledAtLoad", func(b *testing.B) {
+		cfg := benchmarkFieldsConfig(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ExtractFields(cfg, benchmarkFieldInputs[i%len(benchmarkFieldInputs)], "app.log")
+		}
+	})
+}
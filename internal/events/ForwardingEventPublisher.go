@@ -16,61 +16,120 @@ package events
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
 )
 
-const forwardChunkSize = 1000
+const (
+	forwardChunkSize = 1000
+	// maxForwardRetryBackoff caps how long the forwarder will wait between attempts while the recipient is failing,
+	// so that events are forwarded reasonably soon after the recipient comes back.
+	maxForwardRetryBackoff = 1 * time.Minute
+	defaultForwardTimeout  = 30 * time.Second
+)
 
 type forwardingEventPublisher struct {
-	cfg *config.Config
+	endpoint   string
+	httpClient *http.Client
+
+	flushInterval     time.Duration
+	retryBackoff      time.Duration
+	maxBufferedEvents int
+	compress          bool
 
 	accumulated []RawEvent
 	adder       chan<- RawEvent
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	done         chan struct{}
 }
 
-func ForwardingEventPublisher(cfg *config.Config) EventPublisher {
+// ForwardingEventPublisher returns an EventPublisher which sends events to the recipient at cfg.RecipientAddress
+// instead of storing them locally. Events are batched and sent as JSON, gzipped if cfg.Compress is set, and a batch
+// which cannot be sent is kept in memory and retried with an exponential backoff. If httpClient is nil, a client with
+// a default timeout is used.
+func ForwardingEventPublisher(cfg *config.ForwarderConfig, httpClient *http.Client) EventPublisher {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultForwardTimeout}
+	}
 	adder := make(chan RawEvent)
 	ep := forwardingEventPublisher{
-		cfg: cfg,
+		endpoint:   strings.TrimSuffix(cfg.RecipientAddress, "/") + receiveEventsPath,
+		httpClient: httpClient,
+
+		flushInterval:     config.DefaultForwarderFlushInterval,
+		retryBackoff:      config.DefaultForwarderRetryBackoff,
+		maxBufferedEvents: config.DefaultForwarderMaxBufferedEvents,
+		compress:          cfg.Compress,
 
 		accumulated: make([]RawEvent, 0, forwardChunkSize),
 		adder:       adder,
+
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if cfg.FlushInterval > 0 {
+		ep.flushInterval = cfg.FlushInterval
+	}
+	if cfg.RetryBackoff > 0 {
+		ep.retryBackoff = cfg.RetryBackoff
+	}
+	if cfg.MaxBufferedEvents > 0 {
+		ep.maxBufferedEvents = cfg.MaxBufferedEvents
 	}
 
 	go func() {
-		lastErrorTime := time.Now().Add(-5 * time.Second)
-		timeout := time.After(1 * time.Second)
+		var nextAttempt time.Time
+		backoff := ep.retryBackoff
+		forward := func() {
+			err := ep.forward()
+			if err != nil {
+				log.Printf("error when forwarding events, will retry in %v: %v\n", backoff, err)
+				nextAttempt = time.Now().Add(backoff)
+				backoff *= 2
+				if backoff > maxForwardRetryBackoff {
+					backoff = maxForwardRetryBackoff
+				}
+			} else {
+				nextAttempt = time.Time{}
+				backoff = ep.retryBackoff
+			}
+			ep.dropExcessEvents()
+		}
+		timeout := time.After(ep.flushInterval)
 		for {
-			now := time.Now()
 			select {
 			case <-timeout:
-				if len(ep.accumulated) > 0 {
-					err := ep.forward()
-					if err != nil {
-						log.Println("error when adding events:", err)
-						lastErrorTime = time.Now()
-					}
-					ep.dropExcessEvents()
+				if len(ep.accumulated) > 0 && !time.Now().Before(nextAttempt) {
+					forward()
 				}
-				timeout = time.After(1 * time.Second)
+				timeout = time.After(ep.flushInterval)
 			case evt := <-adder:
 				ep.accumulated = append(ep.accumulated, evt)
-				if len(ep.accumulated) >= forwardChunkSize && now.Sub(lastErrorTime).Seconds() > 1 {
+				if len(ep.accumulated) >= forwardChunkSize && !time.Now().Before(nextAttempt) {
+					forward()
+					timeout = time.After(ep.flushInterval)
+				}
+			case <-ep.shutdown:
+				if len(ep.accumulated) > 0 {
 					err := ep.forward()
 					if err != nil {
-						log.Println("error when adding events:", err)
-						lastErrorTime = time.Now()
+						log.Printf("error when forwarding events during shutdown, numEvents=%v will be lost: %v\n", len(ep.accumulated), err)
 					}
-					ep.dropExcessEvents()
-					timeout = time.After(1 * time.Second)
 				}
+				close(ep.done)
+				return
 			}
 		}
 	}()
@@ -78,8 +137,25 @@ func ForwardingEventPublisher(cfg *config.Config) EventPublisher {
 	return &ep
 }
 
-func (ep *forwardingEventPublisher) PublishEvent(evt RawEvent, timeLayout string) {
-	ep.adder <- evt
+func (ep *forwardingEventPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	select {
+	case ep.adder <- evt:
+		return nil
+	case <-ep.shutdown:
+		return ErrPublisherShutdown
+	}
+}
+
+func (ep *forwardingEventPublisher) Shutdown(ctx context.Context) error {
+	ep.shutdownOnce.Do(func() {
+		close(ep.shutdown)
+	})
+	select {
+	case <-ep.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for forwarder to forward events: %w", ctx.Err())
+	}
 }
 
 func (ep *forwardingEventPublisher) forward() error {
@@ -93,23 +169,14 @@ func (ep *forwardingEventPublisher) forward() error {
 		req := receiveEventsRequest{
 			Events: evts,
 		}
-		serialized, err := json.Marshal(req)
+		serialized, err := ep.serialize(req)
 		if err != nil {
 			ep.accumulated = ep.accumulated[chunkSize:]
 			return fmt.Errorf("failed to serialize events for forwarding. Events will not be buffered: %w", err)
 		}
-		resp, err := http.Post(ep.cfg.Forwarder.RecipientAddress+"/v1/receiveEvents", "application/json", bytes.NewReader(serialized))
+		err = ep.post(serialized)
 		if err != nil {
-			return fmt.Errorf("failed to forward events. Events will be buffered: %w", err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode/100 != 2 {
-			bodyBytes, err := ioutil.ReadAll(resp.Body)
-			bodyString := ""
-			if err == nil {
-				bodyString = string(bodyBytes)
-			}
-			return fmt.Errorf("failed to forward events: got non-200 statusCode=%v, body='%v'. Events will be buffered", resp.StatusCode, bodyString)
+			return err
 		}
 		log.Printf("forwarded numEvents=%v in timeInMs=%v\n", len(evts), time.Now().Sub(startTime).Milliseconds())
 		ep.accumulated = ep.accumulated[chunkSize:]
@@ -117,14 +184,57 @@ func (ep *forwardingEventPublisher) forward() error {
 	return nil
 }
 
+// serialize encodes req as JSON, which is gzipped while it is being encoded if ep.compress is set.
+func (ep *forwardingEventPublisher) serialize(req receiveEventsRequest) ([]byte, error) {
+	if !ep.compress {
+		return json.Marshal(req)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	err := json.NewEncoder(zw).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ep *forwardingEventPublisher) post(serialized []byte) error {
+	req, err := http.NewRequest("POST", ep.endpoint, bytes.NewReader(serialized))
+	if err != nil {
+		return fmt.Errorf("failed to create request for forwarding events. Events will be buffered: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ep.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := ep.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to forward events. Events will be buffered: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		bodyString := ""
+		if err == nil {
+			bodyString = string(bodyBytes)
+		}
+		return fmt.Errorf("failed to forward events: got non-200 statusCode=%v, body='%v'. Events will be buffered", resp.StatusCode, bodyString)
+	}
+	return nil
+}
+
 func (ep *forwardingEventPublisher) dropExcessEvents() {
-	if len(ep.accumulated) > ep.cfg.Forwarder.MaxBufferedEvents {
-		log.Printf("number of buffered events exceeded maxBufferedEvents=%v, will drop events to keep buffer size down.\n", ep.cfg.Forwarder.MaxBufferedEvents)
-		numOver := len(ep.accumulated) - ep.cfg.Forwarder.MaxBufferedEvents
+	if len(ep.accumulated) > ep.maxBufferedEvents {
+		log.Printf("number of buffered events exceeded maxBufferedEvents=%v, will drop events to keep buffer size down.\n", ep.maxBufferedEvents)
+		numOver := len(ep.accumulated) - ep.maxBufferedEvents
 		ep.accumulated = ep.accumulated[numOver:] // TODO: Is the GC actually able to free the memory of ep.accumulated[:numOver] here? I'm assuming it will if the slice is reallocated later due to appending?
-	} else if quota := float64(len(ep.accumulated)) / float64(ep.cfg.Forwarder.MaxBufferedEvents); quota > 0.7 {
+	} else if quota := float64(len(ep.accumulated)) / float64(ep.maxBufferedEvents); quota > 0.7 {
 		log.Printf("warning: number of buffered events is %.2f %% of maxBufferedEvents (%v/%v). If maxBufferedEvents is exceeded events will be lost. "+
 			"This may indicate a connection problem or the recipient instance is not running.\n",
-			quota*100, len(ep.accumulated), ep.cfg.Forwarder.MaxBufferedEvents)
+			quota*100, len(ep.accumulated), ep.maxBufferedEvents)
 	}
 }
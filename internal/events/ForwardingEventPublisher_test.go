@@ -0,0 +1,235 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+)
+
+// flakyRecipient serves an EventRecipient which publishes to publisher, but responds with an error instead for the
+// requests whose number (starting at 1) is in fail. The Content-Encoding of every request is kept in encodings.
+type flakyRecipient struct {
+	mu        sync.Mutex
+	requests  int
+	encodings []string
+	fail      map[int]bool
+	handler   http.Handler
+}
+
+func newFlakyRecipient(t *testing.T, publisher EventPublisher, fail ...int) (*flakyRecipient, *httptest.Server) {
+	fr := &flakyRecipient{
+		fail:    map[int]bool{},
+		handler: NewEventRecipient(&config.Config{Recipient: &config.RecipientConfig{}}, publisher).Handler(),
+	}
+	for _, n := range fail {
+		fr.fail[n] = true
+	}
+	mux := http.NewServeMux()
+	mux.Handle(receiveEventsPath, fr)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return fr, srv
+}
+
+func (fr *flakyRecipient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fr.mu.Lock()
+	fr.requests++
+	fr.encodings = append(fr.encodings, r.Header.Get("Content-Encoding"))
+	fail := fr.fail[fr.requests]
+	fr.mu.Unlock()
+	if fail {
+		http.Error(w, "recipient is unavailable", 503)
+		return
+	}
+	fr.handler.ServeHTTP(w, r)
+}
+
+func (fr *flakyRecipient) numRequests() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.requests
+}
+
+func testForwarderConfig(srv *httptest.Server) *config.ForwarderConfig {
+	return &config.ForwarderConfig{
+		Enabled:          true,
+		RecipientAddress: srv.URL,
+		FlushInterval:    10 * time.Millisecond,
+		RetryBackoff:     10 * time.Millisecond,
+	}
+}
+
+func TestForwardingEventPublisher(t *testing.T) {
+	rp := &recordingPublisher{}
+	_, srv := newFlakyRecipient(t, rp)
+	ep := ForwardingEventPublisher(testForwarderConfig(srv), srv.Client())
+
+	for _, raw := range []string{"a", "b", "c"} {
+		ep.PublishEvent(RawEvent{Raw: raw, Host: "forwarder", Source: "log.txt"}, nil)
+	}
+	waitForEvents(t, rp, 3)
+	err := shutdownWithTimeout(ep)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	rp.Shutdown(context.Background())
+
+	rp.verify(t, []string{"a", "b", "c"})
+	err = ep.PublishEvent(RawEvent{Raw: "d"}, nil)
+	if !errors.Is(err, ErrPublisherShutdown) {
+		t.Fatalf("got unexpected error when publishing after shutdown, expected %v but got %v", ErrPublisherShutdown, err)
+	}
+}
+
+func TestForwardingEventPublisher_Retry(t *testing.T) {
+	rp := &recordingPublisher{}
+	fr, srv := newFlakyRecipient(t, rp, 1, 2)
+	ep := ForwardingEventPublisher(testForwarderConfig(srv), srv.Client())
+
+	for _, raw := range []string{"a", "b", "c"} {
+		ep.PublishEvent(RawEvent{Raw: raw}, nil)
+	}
+	waitForEvents(t, rp, 3)
+	err := shutdownWithTimeout(ep)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	rp.Shutdown(context.Background())
+
+	rp.verify(t, []string{"a", "b", "c"})
+	if fr.numRequests() < 3 {
+		t.Fatalf("got unexpected number of requests, expected at least 3 but got %v", fr.numRequests())
+	}
+}
+
+func TestForwardingEventPublisher_PartialFailure(t *testing.T) {
+	rp := &recordingPublisher{}
+	_, srv := newFlakyRecipient(t, rp, 2)
+	ep := &forwardingEventPublisher{
+		endpoint:          srv.URL + receiveEventsPath,
+		httpClient:        srv.Client(),
+		maxBufferedEvents: config.DefaultForwarderMaxBufferedEvents,
+	}
+	expected := make([]string, forwardChunkSize*2+forwardChunkSize/2)
+	for i := range expected {
+		expected[i] = fmt.Sprint(i)
+		ep.accumulated = append(ep.accumulated, RawEvent{Raw: expected[i]})
+	}
+
+	err := ep.forward()
+	if err == nil {
+		t.Fatal("expected an error since the second chunk failed but got nil")
+	}
+	if len(ep.accumulated) != len(expected)-forwardChunkSize {
+		t.Fatalf("got unexpected number of buffered events, expected %v but got %v", len(expected)-forwardChunkSize, len(ep.accumulated))
+	}
+	err = ep.forward()
+	if err != nil {
+		t.Fatalf("got unexpected error when forwarding again: %v", err)
+	}
+	if len(ep.accumulated) != 0 {
+		t.Fatalf("got unexpected number of buffered events, expected 0 but got %v", len(ep.accumulated))
+	}
+	rp.Shutdown(context.Background())
+
+	// Every event is received once, since the chunk which succeeded is not sent again
+	rp.verify(t, expected)
+}
+
+func TestForwardingEventPublisher_Compress(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprint(compress), func(t *testing.T) {
+			rp := &recordingPublisher{}
+			fr, srv := newFlakyRecipient(t, rp)
+			cfg := testForwarderConfig(srv)
+			cfg.Compress = compress
+			ep := ForwardingEventPublisher(cfg, srv.Client())
+
+			for _, raw := range []string{"a", "b", "c"} {
+				ep.PublishEvent(RawEvent{Raw: raw}, nil)
+			}
+			waitForEvents(t, rp, 3)
+			err := shutdownWithTimeout(ep)
+			if err != nil {
+				t.Fatalf("got unexpected error when shutting down: %v", err)
+			}
+			rp.Shutdown(context.Background())
+
+			rp.verify(t, []string{"a", "b", "c"})
+			expected := ""
+			if compress {
+				expected = "gzip"
+			}
+			fr.mu.Lock()
+			defer fr.mu.Unlock()
+			for _, encoding := range fr.encodings {
+				if encoding != expected {
+					t.Fatalf("got unexpected Content-Encoding, expected %q but got %q", expected, encoding)
+				}
+			}
+		})
+	}
+}
+
+func TestEventRecipient_Handler_ContentEncoding(t *testing.T) {
+	body := `{"Events": [{"Raw": "a"}, {"Raw": "b"}]}`
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	for _, tt := range []struct {
+		name           string
+		encoding       string
+		body           []byte
+		expectedStatus int
+		expectedRaws   []string
+	}{
+		{"uncompressed", "", []byte(body), 200, []string{"a", "b"}},
+		{"identity", "identity", []byte(body), 200, []string{"a", "b"}},
+		{"gzip", "gzip", gzipped.Bytes(), 200, []string{"a", "b"}},
+		{"gzip header with uncompressed body", "gzip", []byte(body), 400, []string{}},
+		{"truncated gzip", "gzip", gzipped.Bytes()[:gzipped.Len()/2], 400, []string{}},
+		{"unsupported encoding", "br", []byte(body), 415, []string{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := &recordingPublisher{}
+			handler := NewEventRecipient(&config.Config{Recipient: &config.RecipientConfig{}}, rp).Handler()
+			req := httptest.NewRequest("POST", receiveEventsPath, bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("got unexpected status, expected %v but got %v with body %v", tt.expectedStatus, rec.Code, strings.TrimSpace(rec.Body.String()))
+			}
+			rp.Shutdown(context.Background())
+			rp.verify(t, tt.expectedRaws)
+		})
+	}
+}
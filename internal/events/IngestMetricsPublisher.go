@@ -0,0 +1,146 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultIngestMetricsWindow is the length of the sliding window an IngestMetricsPublisher computes rates over.
+const DefaultIngestMetricsWindow = 1 * time.Minute
+
+// ingestMetricsBuckets is the number of parts the window is split into. The window slides one part at a time, so the
+// events of the oldest part stop counting all at once.
+const ingestMetricsBuckets = 60
+
+// SourceIngestRate is the number of events and bytes which were published for a source during the window.
+type SourceIngestRate struct {
+	Source          string
+	Events          int64
+	Bytes           int64
+	EventsPerSecond float64
+	BytesPerSecond  float64
+	// LastEvent is when the last event was published for the source, which tells how long a source which has gone
+	// silent has been silent.
+	LastEvent time.Time
+}
+
+type sourceIngestMetrics struct {
+	// events and bytes are rings of counts, where bucket i counts the events published during the bucket long period
+	// periods[i]. A bucket is reset when it is reused for a new period.
+	events, bytes []int64
+	periods       []int64
+	lastEvent     time.Time
+}
+
+// IngestMetricsPublisher is an EventPublisher which counts the events and bytes published for each source before
+// passing the events on to another publisher, so that a source which has gone silent or is flooding can be spotted.
+type IngestMetricsPublisher struct {
+	wrapped EventPublisher
+	window  time.Duration
+	bucket  time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	sources map[string]*sourceIngestMetrics
+}
+
+// NewIngestMetricsPublisher creates an IngestMetricsPublisher which computes rates over window, or over
+// DefaultIngestMetricsWindow if window is not positive.
+func NewIngestMetricsPublisher(wrapped EventPublisher, window time.Duration) *IngestMetricsPublisher {
+	if window <= 0 {
+		window = DefaultIngestMetricsWindow
+	}
+	bucket := window / ingestMetricsBuckets
+	if bucket <= 0 {
+		bucket = 1
+	}
+	return &IngestMetricsPublisher{
+		wrapped: wrapped,
+		window:  window,
+		bucket:  bucket,
+		now:     time.Now,
+		sources: map[string]*sourceIngestMetrics{},
+	}
+}
+
+// PublishEvent counts evt for its source and publishes it to the wrapped publisher. Events are counted even if the
+// wrapped publisher drops them, since the rates are meant to show how much the sources are logging.
+// Only the first event from a source allocates anything.
+func (ep *IngestMetricsPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	now := ep.now()
+	period := now.UnixNano() / int64(ep.bucket)
+	i := int(period % ingestMetricsBuckets)
+
+	ep.mu.Lock()
+	m, ok := ep.sources[evt.Source]
+	if !ok {
+		m = &sourceIngestMetrics{
+			events:  make([]int64, ingestMetricsBuckets),
+			bytes:   make([]int64, ingestMetricsBuckets),
+			periods: make([]int64, ingestMetricsBuckets),
+		}
+		ep.sources[evt.Source] = m
+	}
+	if m.periods[i] != period {
+		m.periods[i] = period
+		m.events[i] = 0
+		m.bytes[i] = 0
+	}
+	m.events[i]++
+	m.bytes[i] += int64(len(evt.Raw))
+	m.lastEvent = now
+	ep.mu.Unlock()
+
+	return ep.wrapped.PublishEvent(evt, timeLayouts)
+}
+
+// Snapshot returns the rates of every source which has published an event, ordered by source. Sources which have not
+// published anything during the window are included with rates of 0.
+func (ep *IngestMetricsPublisher) Snapshot() []SourceIngestRate {
+	period := ep.now().UnixNano() / int64(ep.bucket)
+	seconds := ep.window.Seconds()
+
+	ep.mu.Lock()
+	ret := make([]SourceIngestRate, 0, len(ep.sources))
+	for source, m := range ep.sources {
+		r := SourceIngestRate{
+			Source:    source,
+			LastEvent: m.lastEvent,
+		}
+		for i, p := range m.periods {
+			if p > period-ingestMetricsBuckets && p <= period {
+				r.Events += m.events[i]
+				r.Bytes += m.bytes[i]
+			}
+		}
+		r.EventsPerSecond = float64(r.Events) / seconds
+		r.BytesPerSecond = float64(r.Bytes) / seconds
+		ret = append(ret, r)
+	}
+	ep.mu.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Source < ret[j].Source
+	})
+	return ret
+}
+
+func (ep *IngestMetricsPublisher) Shutdown(ctx context.Context) error {
+	return ep.wrapped.Shutdown(ctx)
+}
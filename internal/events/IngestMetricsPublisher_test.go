@@ -0,0 +1,107 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func verifyRate(t *testing.T, actual SourceIngestRate, expected SourceIngestRate) {
+	if actual.Source != expected.Source || actual.Events != expected.Events || actual.Bytes != expected.Bytes ||
+		actual.EventsPerSecond != expected.EventsPerSecond || actual.BytesPerSecond != expected.BytesPerSecond ||
+		!actual.LastEvent.Equal(expected.LastEvent) {
+		t.Fatalf("got unexpected rate, expected %+v but got %+v", expected, actual)
+	}
+}
+
+func TestIngestMetricsPublisher_Rates(t *testing.T) {
+	wrapped := &recordingPublisher{}
+	clock := &fakeClock{t: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	ep := NewIngestMetricsPublisher(wrapped, 1*time.Minute)
+	ep.now = clock.now
+	start := clock.t
+
+	for i := 0; i < 30; i++ {
+		ep.PublishEvent(RawEvent{Raw: "0123456789", Source: "access.log"}, nil)
+		clock.t = clock.t.Add(1 * time.Second)
+	}
+	ep.PublishEvent(RawEvent{Raw: "boom", Source: "error.log"}, nil)
+
+	rates := ep.Snapshot()
+	if len(rates) != 2 {
+		t.Fatalf("got unexpected number of sources, expected 2 but got %v", len(rates))
+	}
+	verifyRate(t, rates[0], SourceIngestRate{Source: "access.log", Events: 30, Bytes: 300, EventsPerSecond: 0.5, BytesPerSecond: 5, LastEvent: start.Add(29 * time.Second)})
+	verifyRate(t, rates[1], SourceIngestRate{Source: "error.log", Events: 1, Bytes: 4, EventsPerSecond: 1.0 / 60, BytesPerSecond: 4.0 / 60, LastEvent: start.Add(30 * time.Second)})
+
+	// After a minute the first 30 events of access.log have slid out of the window one by one
+	clock.t = start.Add(75 * time.Second)
+	rates = ep.Snapshot()
+	verifyRate(t, rates[0], SourceIngestRate{Source: "access.log", Events: 14, Bytes: 140, EventsPerSecond: 14.0 / 60, BytesPerSecond: 140.0 / 60, LastEvent: start.Add(29 * time.Second)})
+
+	// A source which has gone silent is still included, with a rate of 0
+	clock.t = start.Add(10 * time.Minute)
+	ep.PublishEvent(RawEvent{Raw: "boom again", Source: "error.log"}, nil)
+	rates = ep.Snapshot()
+	verifyRate(t, rates[0], SourceIngestRate{Source: "access.log", LastEvent: start.Add(29 * time.Second)})
+	verifyRate(t, rates[1], SourceIngestRate{Source: "error.log", Events: 1, Bytes: 10, EventsPerSecond: 1.0 / 60, BytesPerSecond: 10.0 / 60, LastEvent: start.Add(10 * time.Minute)})
+
+	err := shutdownWithTimeout(ep)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	if len(wrapped.raws) != 32 {
+		t.Fatalf("got unexpected number of events published to the wrapped publisher, expected 32 but got %v", len(wrapped.raws))
+	}
+}
+
+func TestIngestMetricsPublisher_ReusesBuckets(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)}
+	ep := NewIngestMetricsPublisher(NopEventPublisher(), 10*time.Second)
+	ep.now = clock.now
+
+	// Every bucket is reused several times, and only the events of the last window should be counted
+	for i := 0; i < 1000; i++ {
+		ep.PublishEvent(RawEvent{Raw: "x", Source: "app.log"}, nil)
+		clock.t = clock.t.Add(100 * time.Millisecond)
+	}
+	clock.t = clock.t.Add(-100 * time.Millisecond)
+	rates := ep.Snapshot()
+	// The window is split into parts of 10s/60, so the last 60 parts hold the events of the last 10 seconds
+	if rates[0].Events < 99 || rates[0].Events > 101 {
+		t.Fatalf("got unexpected number of events in the window, expected about 100 but got %v", rates[0].Events)
+	}
+}
+
+func TestIngestMetricsPublisher_PublishDoesNotAllocate(t *testing.T) {
+	ep := NewIngestMetricsPublisher(NopEventPublisher(), 1*time.Minute)
+	evt := RawEvent{Raw: "an event", Source: "app.log"}
+	ep.PublishEvent(evt, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		ep.PublishEvent(evt, nil)
+	})
+	if allocs != 0 {
+		t.Fatalf("got unexpected allocations when publishing, expected 0 but got %v", allocs)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+)
+
+// LiveTailBufferSize is the number of events a subscriber of a LiveTail can fall behind before it is dropped.
+const LiveTailBufferSize = 1000
+
+// LiveTailFilter decides whether a subscriber of a LiveTail should get evt. It returns the fields of evt along with
+// the decision, so that they do not have to be extracted again.
+type LiveTailFilter func(evt EventWithId) (map[string]string, bool)
+
+type liveTailSubscriber struct {
+	filter LiveTailFilter
+	input  chan EventWithId
+	output chan EventWithExtractedFields
+}
+
+// LiveTail is an EventPublisher which publishes the events it gets to another publisher, such as a
+// BatchedRepositoryPublisher, and passes them on to its subscribers as they arrive, so that the events matching a
+// search can be followed without polling the repository.
+//
+// The events may not have been stored when the subscribers get them, so their Id is always 0.
+type LiveTail struct {
+	cfg     *config.Config
+	wrapped EventPublisher
+	logger  logging.Logger
+
+	// mu protects the inputs of the subscribers from being sent to after they have been closed
+	mu          sync.RWMutex
+	subscribers map[*liveTailSubscriber]struct{}
+	shutdown    bool
+}
+
+func NewLiveTail(cfg *config.Config, wrapped EventPublisher) *LiveTail {
+	return &LiveTail{
+		cfg:         cfg,
+		wrapped:     wrapped,
+		logger:      logging.OrDefault(cfg.Logger),
+		subscribers: map[*liveTailSubscriber]struct{}{},
+	}
+}
+
+// Subscribe returns a channel which gets every event published after the call which filter includes. The subscription
+// ends and the channel is closed when ctx is done or the LiveTail is shut down.
+// Publishing never waits for a subscriber. A subscriber which falls more than LiveTailBufferSize events behind is
+// dropped instead, which closes its channel once it has read the events it had already been sent.
+func (lt *LiveTail) Subscribe(ctx context.Context, filter LiveTailFilter) <-chan EventWithExtractedFields {
+	s := &liveTailSubscriber{
+		filter: filter,
+		input:  make(chan EventWithId, LiveTailBufferSize),
+		output: make(chan EventWithExtractedFields),
+	}
+	lt.mu.Lock()
+	if lt.shutdown {
+		lt.mu.Unlock()
+		close(s.output)
+		return s.output
+	}
+	lt.subscribers[s] = struct{}{}
+	lt.mu.Unlock()
+	go lt.run(ctx, s)
+	return s.output
+}
+
+// Subscribers returns the number of active subscriptions.
+func (lt *LiveTail) Subscribers() int {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+	return len(lt.subscribers)
+}
+
+// PublishEvent publishes evt to the wrapped publisher and, if it was accepted, passes it on to every subscriber.
+// Since the subscribers filter the events on their own goroutines, evt is only processed once regardless of the
+// number of subscribers, and not at all if there are none.
+func (lt *LiveTail) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	if err := lt.wrapped.PublishEvent(evt, timeLayouts); err != nil {
+		return err
+	}
+	lt.mu.RLock()
+	if len(lt.subscribers) == 0 {
+		lt.mu.RUnlock()
+		return nil
+	}
+	// Errors parsing the timestamp are logged by the wrapped publisher, there is no need to log them twice
+	processed, _ := processEvent(lt.cfg, evt, timeLayouts)
+	e := EventWithId{
+		Raw:       processed.Raw,
+		Timestamp: processed.Timestamp,
+		Host:      processed.Host,
+		Source:    processed.Source,
+	}
+	var slow []*liveTailSubscriber
+	for s := range lt.subscribers {
+		select {
+		case s.input <- e:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	lt.mu.RUnlock()
+
+	for _, s := range slow {
+		lt.logger.Warnf("live tail subscriber fell more than %v events behind and was dropped", LiveTailBufferSize)
+		lt.unsubscribe(s)
+	}
+	return nil
+}
+
+// Shutdown ends every subscription and shuts down the wrapped publisher. The subscribers still get the events they
+// had already been sent.
+func (lt *LiveTail) Shutdown(ctx context.Context) error {
+	lt.mu.Lock()
+	lt.shutdown = true
+	for s := range lt.subscribers {
+		delete(lt.subscribers, s)
+		close(s.input)
+	}
+	lt.mu.Unlock()
+	return lt.wrapped.Shutdown(ctx)
+}
+
+func (lt *LiveTail) run(ctx context.Context, s *liveTailSubscriber) {
+	defer close(s.output)
+	defer lt.unsubscribe(s)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt, ok := <-s.input:
+			if !ok {
+				return
+			}
+			fields, include := s.filter(evt)
+			if !include {
+				continue
+			}
+			select {
+			case s.output <- EventWithExtractedFields{
+				Id:        evt.Id,
+				Raw:       evt.Raw,
+				Timestamp: evt.Timestamp,
+				Host:      evt.Host,
+				Source:    evt.Source,
+				Fields:    fields,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// unsubscribe removes s from the subscribers and closes its input, unless that has already been done.
+func (lt *LiveTail) unsubscribe(s *liveTailSubscriber) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if _, ok := lt.subscribers[s]; !ok {
+		return
+	}
+	delete(lt.subscribers, s)
+	close(s.input)
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+)
+
+func containsFilter(s string) LiveTailFilter {
+	return func(evt EventWithId) (map[string]string, bool) {
+		return map[string]string{"host": evt.Host}, strings.Contains(evt.Raw, s)
+	}
+}
+
+func receiveEvent(t *testing.T, evts <-chan EventWithExtractedFields) (EventWithExtractedFields, bool) {
+	select {
+	case evt, ok := <-evts:
+		return evt, ok
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out waiting for live tail event")
+		return EventWithExtractedFields{}, false
+	}
+}
+
+func waitForSubscribers(t *testing.T, lt *LiveTail, n int) {
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) {
+		if lt.Subscribers() == n {
+			return
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v subscribers, got %v", n, lt.Subscribers())
+}
+
+func TestLiveTail_SubscriberReceivesMatchingEvents(t *testing.T) {
+	wrapped := &recordingPublisher{}
+	lt := NewLiveTail(&config.Config{
+		HostName:        "localhost",
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("^\\[(?P<_time>[^\\]]+)\\]")},
+	}, wrapped)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	evts := lt.Subscribe(ctx, containsFilter("error"))
+
+	lt.PublishEvent(RawEvent{Raw: "[2021-01-02T03:04:05Z] an error", Source: "log.txt"}, []string{time.RFC3339})
+	lt.PublishEvent(RawEvent{Raw: "[2021-01-02T03:04:06Z] all good", Source: "log.txt"}, []string{time.RFC3339})
+	lt.PublishEvent(RawEvent{Raw: "[2021-01-02T03:04:07Z] another error", Host: "other", Source: "log.txt"}, []string{time.RFC3339})
+
+	first, _ := receiveEvent(t, evts)
+	if first.Raw != "[2021-01-02T03:04:05Z] an error" || first.Host != "localhost" || first.Source != "log.txt" {
+		t.Fatalf("got unexpected first event %v", first)
+	}
+	if expected := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC); !first.Timestamp.Equal(expected) {
+		t.Fatalf("got unexpected timestamp, expected %v but got %v", expected, first.Timestamp)
+	}
+	if first.Fields["host"] != "localhost" {
+		t.Fatalf("got unexpected fields, expected the fields returned by the filter but got %v", first.Fields)
+	}
+	second, _ := receiveEvent(t, evts)
+	if second.Raw != "[2021-01-02T03:04:07Z] another error" || second.Host != "other" {
+		t.Fatalf("got unexpected second event %v", second)
+	}
+
+	err := shutdownWithTimeout(lt)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	if _, ok := receiveEvent(t, evts); ok {
+		t.Fatal("expected the channel to be closed after shutting down")
+	}
+	wrapped.verify(t, []string{"[2021-01-02T03:04:05Z] an error", "[2021-01-02T03:04:06Z] all good", "[2021-01-02T03:04:07Z] another error"})
+}
+
+func TestLiveTail_UnsubscribesWhenContextIsDone(t *testing.T) {
+	lt := NewLiveTail(&config.Config{}, NopEventPublisher())
+	ctx, cancel := context.WithCancel(context.Background())
+	evts := lt.Subscribe(ctx, containsFilter(""))
+	other := lt.Subscribe(context.Background(), containsFilter(""))
+	if lt.Subscribers() != 2 {
+		t.Fatalf("got unexpected number of subscribers, expected 2 but got %v", lt.Subscribers())
+	}
+
+	cancel()
+	if _, ok := receiveEvent(t, evts); ok {
+		t.Fatal("expected the channel to be closed after the context was canceled")
+	}
+	waitForSubscribers(t, lt, 1)
+
+	// The remaining subscriber still gets the events
+	lt.PublishEvent(RawEvent{Raw: "still here"}, nil)
+	if evt, _ := receiveEvent(t, other); evt.Raw != "still here" {
+		t.Fatalf("got unexpected event, expected 'still here' but got %v", evt)
+	}
+}
+
+func TestLiveTail_DropsSlowSubscriber(t *testing.T) {
+	lt := NewLiveTail(&config.Config{}, NopEventPublisher())
+	evts := lt.Subscribe(context.Background(), containsFilter(""))
+
+	// The subscriber is not reading, so publishing has to drop it instead of waiting for it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < LiveTailBufferSize+10; i++ {
+			lt.PublishEvent(RawEvent{Raw: fmt.Sprint(i)}, nil)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timed out publishing events, publishing should not wait for a slow subscriber")
+	}
+	waitForSubscribers(t, lt, 0)
+
+	// The events which had already been sent are still received before the channel is closed
+	received := 0
+	for range evts {
+		received++
+	}
+	if received < LiveTailBufferSize || received > LiveTailBufferSize+1 {
+		t.Fatalf("got unexpected number of events, expected %v or %v but got %v", LiveTailBufferSize, LiveTailBufferSize+1, received)
+	}
+}
+
+func TestLiveTail_SubscribeAfterShutdown(t *testing.T) {
+	lt := NewLiveTail(&config.Config{}, NopEventPublisher())
+	err := shutdownWithTimeout(lt)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	if _, ok := receiveEvent(t, lt.Subscribe(context.Background(), containsFilter(""))); ok {
+		t.Fatal("expected the channel to be closed when subscribing after shutting down")
+	}
+	if lt.Subscribers() != 0 {
+		t.Fatalf("got unexpected number of subscribers, expected 0 but got %v", lt.Subscribers())
+	}
+}
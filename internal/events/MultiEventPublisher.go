@@ -0,0 +1,180 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+)
+
+// multiEventPublisherQueueSize is the number of events a publisher wrapped by a MultiEventPublisher can fall behind
+// the others before events are dropped for it.
+const multiEventPublisherQueueSize = config.DefaultPublisherBatchSize
+
+type queuedEvent struct {
+	evt         RawEvent
+	timeLayouts []string
+}
+
+// multiEventPublisherSink is one of the publishers wrapped by a MultiEventPublisher, with its own queue of events.
+type multiEventPublisherSink struct {
+	index     int
+	publisher EventPublisher
+	queue     chan queuedEvent
+	done      chan struct{}
+	logger    logging.Logger
+	// dropped must only be accessed atomically
+	dropped int64
+	// failed is the number of events the publisher returned an error for. It is only accessed by run.
+	failed int64
+}
+
+type multiEventPublisher struct {
+	sinks  []*multiEventPublisherSink
+	logger logging.Logger
+
+	// mu protects the queues from being sent to after they have been closed by Shutdown
+	mu       sync.RWMutex
+	shutdown bool
+}
+
+// MultiEventPublisher creates an EventPublisher which publishes every event to each of publishers, such as a
+// BatchedRepositoryPublisher and a ForwardingEventPublisher to both store events and forward them.
+// Every publisher gets its own queue and goroutine, so that one which is slow or panics does not stop the others from
+// getting the events. If a publisher falls too far behind, events are dropped for it rather than waiting for it, and
+// if it panics the event it was publishing is dropped for it. It keeps getting the events after that either way.
+// Problems with the publishers are logged to cfg.Logger.
+func MultiEventPublisher(cfg *config.Config, publishers ...EventPublisher) EventPublisher {
+	logger := logging.OrDefault(cfg.Logger)
+	ep := &multiEventPublisher{
+		sinks:  make([]*multiEventPublisherSink, len(publishers)),
+		logger: logger,
+	}
+	for i, p := range publishers {
+		s := &multiEventPublisherSink{
+			index:     i,
+			publisher: p,
+			queue:     make(chan queuedEvent, multiEventPublisherQueueSize),
+			done:      make(chan struct{}),
+			logger:    logger,
+		}
+		ep.sinks[i] = s
+		go s.run()
+	}
+	return ep
+}
+
+// PublishEvent queues evt for every publisher. Since the publishers publish it later, errors they return are only
+// logged. An error is returned if evt was dropped for any of the publishers because it was falling behind.
+func (ep *multiEventPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	if ep.shutdown {
+		return ErrPublisherShutdown
+	}
+	numDropped := 0
+	for _, s := range ep.sinks {
+		select {
+		case s.queue <- queuedEvent{evt: evt, timeLayouts: timeLayouts}:
+		default:
+			numDropped++
+			// Logging every dropped event would flood the log while the publisher is behind
+			if n := atomic.AddInt64(&s.dropped, 1); n == 1 || n%1000 == 0 {
+				s.logger.Warnf("publisher %v is not keeping up with the others, numDropped=%v events have been dropped for it", s.index, n)
+			}
+		}
+	}
+	if numDropped > 0 {
+		return fmt.Errorf("event was dropped for numPublishers=%v of %v: %w", numDropped, len(ep.sinks), ErrPublisherQueueFull)
+	}
+	return nil
+}
+
+// Shutdown waits for every publisher to publish the events in its queue and then shuts them down.
+// If several publishers fail to shut down, the first error is returned and the others are logged.
+func (ep *multiEventPublisher) Shutdown(ctx context.Context) error {
+	ep.mu.Lock()
+	if !ep.shutdown {
+		ep.shutdown = true
+		for _, s := range ep.sinks {
+			close(s.queue)
+		}
+	}
+	ep.mu.Unlock()
+
+	errs := make([]error, len(ep.sinks))
+	var wg sync.WaitGroup
+	for i, s := range ep.sinks {
+		wg.Add(1)
+		go func(i int, s *multiEventPublisherSink) {
+			defer wg.Done()
+			errs[i] = s.shutdown(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+	var ret error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if ret == nil {
+			ret = err
+		} else {
+			ep.logger.Errorf("%v", err)
+		}
+	}
+	return ret
+}
+
+func (s *multiEventPublisherSink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		s.publish(e)
+	}
+}
+
+func (s *multiEventPublisherSink) publish(e queuedEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Errorf("publisher %v panicked while publishing an event, the event was dropped for it: %v", s.index, r)
+		}
+	}()
+	err := s.publisher.PublishEvent(e.evt, e.timeLayouts)
+	if err != nil {
+		s.failed++
+		if s.failed == 1 || s.failed%1000 == 0 {
+			s.logger.Errorf("publisher %v failed to publish an event, numFailed=%v events have failed for it: %v", s.index, s.failed, err)
+		}
+	}
+}
+
+func (s *multiEventPublisherSink) shutdown(ctx context.Context) (err error) {
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for publisher %v to publish its queued events: %w", s.index, ctx.Err())
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("publisher %v panicked while shutting down: %v", s.index, r)
+		}
+	}()
+	return s.publisher.Shutdown(ctx)
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/logging"
+)
+
+// recordingPublisher records the raws of the events it gets. It panics when publishing an event with the raw
+// panicOn, and waits for blocked to be closed before publishing anything if it is not nil.
+type recordingPublisher struct {
+	mu        sync.Mutex
+	raws      []string
+	shutdowns int32
+
+	panicOn         string
+	panicOnShutdown bool
+	blocked         chan struct{}
+}
+
+func (rp *recordingPublisher) PublishEvent(evt RawEvent, timeLayouts []string) error {
+	if rp.blocked != nil {
+		<-rp.blocked
+	}
+	if evt.Raw == rp.panicOn {
+		panic("cannot publish " + evt.Raw)
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.raws = append(rp.raws, evt.Raw)
+	return nil
+}
+
+func (rp *recordingPublisher) Shutdown(ctx context.Context) error {
+	atomic.AddInt32(&rp.shutdowns, 1)
+	if rp.panicOnShutdown {
+		panic("cannot shut down")
+	}
+	return nil
+}
+
+func (rp *recordingPublisher) verify(t *testing.T, expected []string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if fmt.Sprint(rp.raws) != fmt.Sprint(expected) {
+		t.Fatalf("got unexpected events, expected %v but got %v", expected, rp.raws)
+	}
+	if atomic.LoadInt32(&rp.shutdowns) != 1 {
+		t.Fatalf("got unexpected number of shutdowns, expected 1 but got %v", rp.shutdowns)
+	}
+}
+
+func waitForEvents(t *testing.T, rp *recordingPublisher, n int) {
+	deadline := time.Now().Add(1 * time.Second)
+	for time.Now().Before(deadline) {
+		rp.mu.Lock()
+		received := len(rp.raws)
+		rp.mu.Unlock()
+		if received >= n {
+			return
+		}
+		time.Sleep(1 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v events", n)
+}
+
+func shutdownWithTimeout(ep EventPublisher) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	return ep.Shutdown(ctx)
+}
+
+func TestMultiEventPublisher_PublishesToAll(t *testing.T) {
+	publishers := []*recordingPublisher{{}, {}, {}}
+	ep := MultiEventPublisher(&config.Config{Logger: logging.Nop()}, publishers[0], publishers[1], publishers[2])
+
+	for _, raw := range []string{"a", "b", "c"} {
+		ep.PublishEvent(RawEvent{Raw: raw}, nil)
+	}
+	err := shutdownWithTimeout(ep)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+	// Events published after Shutdown are dropped
+	err = ep.PublishEvent(RawEvent{Raw: "d"}, nil)
+	if !errors.Is(err, ErrPublisherShutdown) {
+		t.Fatalf("got unexpected error when publishing after shutdown, expected %v but got %v", ErrPublisherShutdown, err)
+	}
+
+	for _, p := range publishers {
+		p.verify(t, []string{"a", "b", "c"})
+	}
+}
+
+func TestMultiEventPublisher_ContainsPanics(t *testing.T) {
+	panicking := &recordingPublisher{panicOn: "b", panicOnShutdown: true}
+	other := &recordingPublisher{}
+	var buf bytes.Buffer
+	ep := MultiEventPublisher(&config.Config{Logger: logging.New(log.New(&buf, "", 0), logging.LevelDebug)}, panicking, other)
+
+	for _, raw := range []string{"a", "b", "c"} {
+		ep.PublishEvent(RawEvent{Raw: raw}, nil)
+	}
+	err := shutdownWithTimeout(ep)
+	if err == nil {
+		t.Fatal("expected an error since a publisher panicked when shutting down but got nil")
+	}
+	if !strings.Contains(buf.String(), "level=error publisher 0 panicked while publishing an event") {
+		t.Fatalf("expected the panic to be logged to the configured logger but got %q", buf.String())
+	}
+
+	panicking.verify(t, []string{"a", "c"})
+	other.verify(t, []string{"a", "b", "c"})
+}
+
+func TestMultiEventPublisher_DropsForSlowPublisher(t *testing.T) {
+	slow := &recordingPublisher{blocked: make(chan struct{})}
+	other := &recordingPublisher{}
+	ep := MultiEventPublisher(&config.Config{Logger: logging.Nop()}, slow, other)
+
+	// The slow publisher may have taken the first event out of its queue and be blocked on it, so it can hold the
+	// queue size or one more event before events are dropped for it
+	const numEvents = multiEventPublisherQueueSize + 10
+	expected := make([]string, numEvents)
+	for i := range expected {
+		expected[i] = fmt.Sprint(i)
+		if i == multiEventPublisherQueueSize {
+			// Give the other publisher time to catch up so that no events are dropped for it
+			waitForEvents(t, other, i)
+		}
+		ep.PublishEvent(RawEvent{Raw: expected[i]}, nil)
+	}
+	close(slow.blocked)
+	err := shutdownWithTimeout(ep)
+	if err != nil {
+		t.Fatalf("got unexpected error when shutting down: %v", err)
+	}
+
+	other.verify(t, expected)
+	slow.mu.Lock()
+	received := len(slow.raws)
+	slow.mu.Unlock()
+	if received < multiEventPublisherQueueSize || received > multiEventPublisherQueueSize+1 {
+		t.Fatalf("got unexpected number of events for the slow publisher, expected %v or %v but got %v", multiEventPublisherQueueSize, multiEventPublisherQueueSize+1, received)
+	}
+	dropped := atomic.LoadInt64(&ep.(*multiEventPublisher).sinks[0].dropped)
+	if dropped != int64(numEvents-received) {
+		t.Fatalf("got unexpected number of dropped events, expected %v but got %v", numEvents-received, dropped)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RetentionCheckInterval is how often RunRetention deletes expired events when running logsuck.
+const RetentionCheckInterval = 1 * time.Hour
+
+// RunRetention deletes the events in repo which are older than retentionPeriod, once immediately and then every
+// interval, until ctx is cancelled. It is meant to be ran in its own goroutine.
+func RunRetention(ctx context.Context, repo Repository, retentionPeriod, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := repo.DeleteOlderThan(time.Now().Add(-retentionPeriod))
+		if err != nil {
+			log.Printf("error when deleting events older than retentionPeriod=%v: %v\n", retentionPeriod, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
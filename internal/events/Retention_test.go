@@ -0,0 +1,64 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestRunRetention(t *testing.T) {
+	repo := InMemoryRepository()
+	now := time.Now()
+	_, err := repo.AddBatch([]Event{
+		{Raw: "old event", Timestamp: now.Add(-2 * time.Hour), Host: "localhost", Source: "log.txt", Offset: 0},
+		{Raw: "new event", Timestamp: now, Host: "localhost", Source: "log.txt", Offset: 10},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunRetention(ctx, repo, 1*time.Hour, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		evts := collectFilterStream(repo, &search.Search{}, nil, nil)
+		if len(evts) == 1 {
+			if evts[0].Raw != "new event" {
+				t.Fatalf("TestRunRetention expected the new event to be kept but got %v", evts[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TestRunRetention timed out waiting for the old event to be deleted, got %v", evts)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("TestRunRetention expected RunRetention to return after cancelling")
+	}
+}
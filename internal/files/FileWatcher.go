@@ -46,20 +46,31 @@ type FileWatcher struct {
 
 	commands       chan FileWatcherCommand
 	eventPublisher events.EventPublisher
+	repo           events.Repository
 	file           *os.File
 
 	currentOffset int64
-	readBuf       []byte
-	workingBuf    []byte
+	// skipThrough is the offset of the last event that was stored before a restart. Events up to and including it are
+	// not published again. It is -1 when no events are skipped.
+	skipThrough int64
+	// resume is true until the file has been opened for the first time, which is when reading resumes after the last
+	// stored event instead of at the beginning of the file.
+	resume     bool
+	readBuf    []byte
+	workingBuf []byte
+	joiner     multilineJoiner
 }
 
-// NewFileWatcher returns a FileWatcher which will watch a file and publish events according to the IndexedFileConfig
+// NewFileWatcher returns a FileWatcher which will watch a file and publish events according to the IndexedFileConfig.
+// If repo is not nil, the file is read from the last event stored from it instead of from the beginning, so that a
+// restart does not read the whole file again. repo is nil when the events are forwarded to another instance.
 func NewFileWatcher(
 	fileConfig config.IndexedFileConfig,
 	filename string,
 	hostName string,
 	commands chan FileWatcherCommand,
 	eventPublisher events.EventPublisher,
+	repo events.Repository,
 ) (*FileWatcher, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -90,11 +101,15 @@ func NewFileWatcher(
 
 		commands:       commands,
 		eventPublisher: eventPublisher,
+		repo:           repo,
 		file:           nil,
 
 		currentOffset: 0,
+		skipThrough:   -1,
+		resume:        repo != nil,
 		readBuf:       make([]byte, 4096),
 		workingBuf:    make([]byte, 0, 4096),
+		joiner:        multilineJoiner{eventStart: fileConfig.EventStart},
 	}, nil
 }
 
@@ -107,9 +122,11 @@ out:
 		select {
 		case cmd := <-fw.commands:
 			if cmd == CommandStop {
+				fw.flushJoiner()
 				break out
 			} else if cmd == CommandReopen && fw.file != nil {
 				fw.readToEnd()
+				fw.flushJoiner()
 				fw.file.Close()
 				fw.file = nil
 			}
@@ -122,27 +139,70 @@ out:
 			} else {
 				fw.file = f
 				fw.currentOffset = 0
+				// A reopened file has been rolled, so the stored offsets are from the previous file
+				fw.skipThrough = -1
 				fw.workingBuf = fw.workingBuf[:0]
-				log.Printf("opened filename=%s\n", fw.filename)
+				if fw.resume {
+					fw.resume = false
+					fw.seekToLatestOffset()
+				}
+				log.Printf("opened filename=%s at offset=%v\n", fw.filename, fw.currentOffset)
 			}
 		}
-		if fw.file != nil {
-			fw.readToEnd()
+		if fw.file != nil && !fw.readToEnd() {
+			// Nothing has been written since the last read, so the event being joined is assumed to be complete
+			fw.flushJoiner()
 		}
 	}
 }
 
-func (fw *FileWatcher) readToEnd() {
+// seekToLatestOffset moves to the last event stored from the file, which is published again by the next read unless
+// it is skipped. The event has to be read since its length is not stored, and the next event starts right after it.
+// If the file is shorter than the offset it has been truncated since the events were stored, and is read from the
+// beginning.
+func (fw *FileWatcher) seekToLatestOffset() {
+	offset, ok, err := fw.repo.LatestOffset(fw.hostName, fw.filename)
+	if err != nil {
+		log.Printf("error getting latest offset of filename=%s, will read the file from the beginning: %v\n", fw.filename, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	info, err := fw.file.Stat()
+	if err != nil {
+		log.Printf("error getting size of filename=%s, will read the file from the beginning: %v\n", fw.filename, err)
+		return
+	}
+	if offset >= info.Size() {
+		log.Printf("filename=%s is shorter than the latest stored offset=%v, will read the file from the beginning\n", fw.filename, offset)
+		return
+	}
+	_, err = fw.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		log.Printf("error seeking to offset=%v in filename=%s, will read the file from the beginning: %v\n", offset, fw.filename, err)
+		fw.file.Seek(0, io.SeekStart)
+		return
+	}
+	fw.currentOffset = offset
+	fw.skipThrough = offset
+}
+
+// readToEnd reads and publishes the events written since the last read and returns false if nothing had been written.
+func (fw *FileWatcher) readToEnd() bool {
+	anyRead := false
 	for read, err := fw.file.Read(fw.readBuf); read != 0; read, err = fw.file.Read(fw.readBuf) {
 		if err != nil && err != io.EOF {
 			log.Println("Unexpected error=" + err.Error() + ", will abort FileWatcher for filename=" + fw.filename)
 			break
 		}
+		anyRead = true
 		fw.workingBuf = append(fw.workingBuf, fw.readBuf[:read]...)
 		if fw.fileConfig.EventDelimiter.Match(fw.workingBuf) {
 			fw.handleEvents()
 		}
 	}
+	return anyRead
 }
 
 func (fw *FileWatcher) handleEvents() {
@@ -152,16 +212,55 @@ func (fw *FileWatcher) handleEvents() {
 	// so we need to look them up to get the offset right
 	delimiters := fw.fileConfig.EventDelimiter.FindAllString(s, -1)
 	split := fw.fileConfig.EventDelimiter.Split(s, -1)
+	evts := make([]events.RawEvent, 0, len(split)-1)
 	for i, raw := range split[:len(split)-1] {
-		evt := events.RawEvent{
+		evt, ok := fw.joiner.add(events.RawEvent{
 			Raw:    raw,
 			Host:   fw.hostName,
 			Source: fw.filename,
 			Offset: fw.currentOffset,
+		}, delimiters[i])
+		if ok {
+			evts = append(evts, evt)
 		}
-		fw.eventPublisher.PublishEvent(evt, fw.fileConfig.TimeLayout)
 		fw.currentOffset += int64(len(raw)) + int64(len(delimiters[i]))
 	}
+	fw.publish(evts)
 	fw.workingBuf = fw.workingBuf[:0]
 	fw.workingBuf = append(fw.workingBuf, []byte(split[len(split)-1])...)
 }
+
+// flushJoiner publishes the multiline event which is being joined, if there is one.
+func (fw *FileWatcher) flushJoiner() {
+	if evt, ok := fw.joiner.flush(); ok {
+		fw.publish([]events.RawEvent{evt})
+	}
+}
+
+func (fw *FileWatcher) publish(evts []events.RawEvent) {
+	if fw.skipThrough >= 0 {
+		kept := evts[:0]
+		for _, evt := range evts {
+			if evt.Offset > fw.skipThrough {
+				kept = append(kept, evt)
+			}
+		}
+		evts = kept
+	}
+	numFailed := 0
+	var firstErr error
+	for _, evt := range evts {
+		err := fw.eventPublisher.PublishEvent(evt, fw.fileConfig.TimeLayouts)
+		if err != nil {
+			numFailed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		// Logging once per read rather than once per event, since a publisher which is shut down or full will usually
+		// fail every event
+		log.Printf("failed to publish numEvents=%v from filename=%v: %v\n", numFailed, fw.filename, firstErr)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// MaxJoinedEventLength is the longest raw a multiline event can get before it is published even though the next
+// piece continues it. Without a limit an eventStart regex which never matches would keep the whole file in memory.
+const MaxJoinedEventLength = 1024 * 1024
+
+// multilineJoiner joins the pieces of a file which are split by the event delimiter into events. A piece which
+// matches eventStart begins a new event and the other pieces are appended to the event before them, together with the
+// delimiter between them.
+//
+// Since there is no way to know that an event is complete until the next one begins, the last event is kept until
+// flush is called.
+type multilineJoiner struct {
+	eventStart *regexp.Regexp
+
+	pending          *events.RawEvent
+	pendingRaw       strings.Builder
+	pendingDelimiter string
+}
+
+// add adds a piece of the file, where evt.Raw is the piece and delimiter is the delimiter which followed it in the
+// file. It returns the previous event if evt begins a new one.
+func (j *multilineJoiner) add(evt events.RawEvent, delimiter string) (events.RawEvent, bool) {
+	if j.eventStart == nil {
+		return evt, true
+	}
+	if j.pending != nil && !j.eventStart.MatchString(evt.Raw) &&
+		j.pendingRaw.Len()+len(j.pendingDelimiter)+len(evt.Raw) <= MaxJoinedEventLength {
+		j.pendingRaw.WriteString(j.pendingDelimiter)
+		j.pendingRaw.WriteString(evt.Raw)
+		j.pendingDelimiter = delimiter
+		return events.RawEvent{}, false
+	}
+	ret, ok := j.flush()
+	j.pending = &evt
+	j.pendingRaw.WriteString(evt.Raw)
+	j.pendingDelimiter = delimiter
+	return ret, ok
+}
+
+// flush returns the event which is being joined, if there is one, and forgets it.
+func (j *multilineJoiner) flush() (events.RawEvent, bool) {
+	if j.pending == nil {
+		return events.RawEvent{}, false
+	}
+	ret := *j.pending
+	ret.Raw = j.pendingRaw.String()
+	j.pending = nil
+	j.pendingRaw.Reset()
+	j.pendingDelimiter = ""
+	return ret, true
+}
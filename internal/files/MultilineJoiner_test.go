@@ -0,0 +1,124 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// joinAll splits s on newlines and joins the pieces the way FileWatcher does, returning every event including the
+// last one which is only returned by flush.
+func joinAll(eventStart *regexp.Regexp, s string) []events.RawEvent {
+	j := multilineJoiner{eventStart: eventStart}
+	ret := []events.RawEvent{}
+	var offset int64
+	for _, piece := range strings.Split(s, "\n") {
+		if evt, ok := j.add(events.RawEvent{Raw: piece, Source: "app.log", Offset: offset}, "\n"); ok {
+			ret = append(ret, evt)
+		}
+		offset += int64(len(piece)) + 1
+	}
+	if evt, ok := j.flush(); ok {
+		ret = append(ret, evt)
+	}
+	return ret
+}
+
+func verifyJoined(t *testing.T, name string, actual []events.RawEvent, expectedRaws []string, expectedOffsets []int64) {
+	if len(actual) != len(expectedRaws) {
+		t.Fatalf("%v expected %v events but got %v: %v", name, len(expectedRaws), len(actual), actual)
+	}
+	for i, evt := range actual {
+		if evt.Raw != expectedRaws[i] {
+			t.Fatalf("%v expected event %v to have raw=%q but got %q", name, i, expectedRaws[i], evt.Raw)
+		}
+		if evt.Offset != expectedOffsets[i] {
+			t.Fatalf("%v expected event %v to have offset=%v but got %v", name, i, expectedOffsets[i], evt.Offset)
+		}
+		if evt.Source != "app.log" {
+			t.Fatalf("%v expected event %v to keep source=app.log but got %v", name, i, evt.Source)
+		}
+	}
+}
+
+func TestMultilineJoiner_JavaStackTrace(t *testing.T) {
+	first := "2021-03-01 12:00:00 ERROR Request failed\n" +
+		"java.lang.IllegalStateException: boom\n" +
+		"\tat com.example.Handler.handle(Handler.java:42)\n" +
+		"\tat com.example.Server.run(Server.java:17)\n" +
+		"Caused by: java.io.IOException: connection reset\n" +
+		"\t... 2 more"
+	second := "2021-03-01 12:00:01 INFO Request succeeded"
+	third := "2021-03-01 12:00:02 ERROR Another failure\n" +
+		"java.lang.NullPointerException"
+
+	actual := joinAll(regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `), first+"\n"+second+"\n"+third)
+
+	verifyJoined(t, "TestMultilineJoiner_JavaStackTrace", actual,
+		[]string{first, second, third},
+		[]int64{0, int64(len(first) + 1), int64(len(first) + 1 + len(second) + 1)})
+}
+
+func TestMultilineJoiner_Indentation(t *testing.T) {
+	s := "{\n" +
+		"  \"level\": \"info\"\n" +
+		"}\n" +
+		"plain line\n" +
+		"config:\n" +
+		"    a: 1\n" +
+		"\tb: 2"
+
+	actual := joinAll(regexp.MustCompile(`^\S`), s)
+
+	verifyJoined(t, "TestMultilineJoiner_Indentation", actual,
+		[]string{"{\n  \"level\": \"info\"", "}", "plain line", "config:\n    a: 1\n\tb: 2"},
+		[]int64{0, 20, 22, 33})
+}
+
+func TestMultilineJoiner_WithoutEventStart(t *testing.T) {
+	actual := joinAll(nil, "a\n\tb\nc")
+
+	verifyJoined(t, "TestMultilineJoiner_WithoutEventStart", actual,
+		[]string{"a", "\tb", "c"},
+		[]int64{0, 2, 5})
+}
+
+func TestMultilineJoiner_ContinuationFirst(t *testing.T) {
+	// A file which starts in the middle of an event, for example after being rolled, gets the continuation lines as an
+	// event of their own
+	actual := joinAll(regexp.MustCompile(`^\S`), "\tat com.example.Main\n\tat com.example.Other\nnext")
+
+	verifyJoined(t, "TestMultilineJoiner_ContinuationFirst", actual,
+		[]string{"\tat com.example.Main\n\tat com.example.Other", "next"},
+		[]int64{0, 43})
+}
+
+func TestMultilineJoiner_MaxLength(t *testing.T) {
+	line := strings.Repeat("x", MaxJoinedEventLength/3)
+	actual := joinAll(regexp.MustCompile(`^START`), "START\n"+line+"\n"+line+"\n"+line)
+
+	if len(actual) != 2 {
+		t.Fatalf("TestMultilineJoiner_MaxLength expected the event to be split in 2 but got %v events", len(actual))
+	}
+	for i, evt := range actual {
+		if len(evt.Raw) > MaxJoinedEventLength {
+			t.Fatalf("TestMultilineJoiner_MaxLength expected event %v to be at most %v long but got %v", i, MaxJoinedEventLength, len(evt.Raw))
+		}
+	}
+}
@@ -18,12 +18,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
-	"strconv"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/pipeline"
 )
 
@@ -32,6 +31,7 @@ type Engine struct {
 	cfg       *config.Config
 	eventRepo events.Repository
 	jobRepo   Repository
+	logger    logging.Logger
 }
 
 func NewEngine(cfg *config.Config, eventRepo events.Repository, jobRepo Repository) *Engine {
@@ -40,6 +40,7 @@ func NewEngine(cfg *config.Config, eventRepo events.Repository, jobRepo Reposito
 		cfg:       cfg,
 		eventRepo: eventRepo,
 		jobRepo:   jobRepo,
+		logger:    logging.OrDefault(cfg.Logger),
 	}
 }
 
@@ -71,30 +72,41 @@ func (e *Engine) StartJob(query string, startTime, endTime *time.Time) (*int64,
 				if !ok {
 					break out
 				}
+				if res.Aggregate != nil {
+					e.logger.Debugf("jobId=%v produced an aggregate with numRows=%v", *id, len(res.Aggregate.Rows))
+					err := e.jobRepo.SetAggregate(*id, res.Aggregate)
+					if err != nil {
+						e.logger.Errorf("failed to store aggregate for jobId=%v: %v", *id, err)
+					}
+				}
+				if res.Err != nil {
+					// The events found before the search failed are kept, so the job shows as much as it could
+					if errors.Is(res.Err, events.ErrInvalidSearch) {
+						e.logger.Warnf("jobId=%v failed because its search is invalid: %v", *id, res.Err)
+					} else {
+						e.logger.Errorf("jobId=%v failed: %v", *id, res.Err)
+					}
+				}
+				if res.Truncated {
+					e.logger.Warnf("jobId=%v produced a truncated result, some events were dropped by the pipeline", *id)
+				}
 				evts := res.Events
-				log.Println("got", len(evts), "matching events")
+				e.logger.Debugf("jobId=%v got numEvents=%v matching events", *id, len(evts))
 				if len(evts) > 0 {
-					converted := make([]events.EventIdAndTimestamp, len(evts))
-					for i, evt := range evts {
-						converted[i] = events.EventIdAndTimestamp{
-							Id:        evt.Id,
-							Timestamp: evt.Timestamp,
-						}
-					}
-					err := e.jobRepo.AddResults(*id, converted)
+					err := e.jobRepo.AddResults(*id, evts)
 					if err != nil {
-						log.Println("Failed to add events to jobId=" + strconv.FormatInt(*id, 10) + ", error: " + err.Error())
+						e.logger.Errorf("Failed to add events to jobId=%v, error: %v", *id, err)
 						// TODO: Retry?
 						continue
 					}
 					fields := gatherFieldStats(evts)
 					err = e.jobRepo.AddFieldStats(*id, fields)
 					if err != nil {
-						log.Println("Failed to add field stats to jobId=" + strconv.FormatInt(*id, 10) + ", error: " + err.Error())
+						e.logger.Errorf("Failed to add field stats to jobId=%v, error: %v", *id, err)
 					}
 				}
 			case <-done:
-				log.Println("<-done")
+				e.logger.Debugf("jobId=%v was cancelled", *id)
 				wasCancelled = true
 				break out
 			}
@@ -108,7 +120,7 @@ func (e *Engine) StartJob(query string, startTime, endTime *time.Time) (*int64,
 		}
 		err = e.jobRepo.UpdateState(*id, state)
 		if err != nil {
-			log.Println("Failed to update jobId=" + strconv.FormatInt(*id, 10) + " when updating to finished state. err=" + err.Error())
+			e.logger.Errorf("Failed to update jobId=%v when updating to finished state. err=%v", *id, err)
 		}
 	}()
 	return id, nil
@@ -120,14 +132,14 @@ func (e *Engine) Abort(jobId int64) error {
 		cancelFunc()
 		return nil
 	}
-	log.Printf("Attempted to cancel jobId=%v but there was no cancelFunc in the cancels map. Will verify that state is aborted or finished.\n", jobId)
+	e.logger.Infof("Attempted to cancel jobId=%v but there was no cancelFunc in the cancels map. Will verify that state is aborted or finished.", jobId)
 	job, err := e.jobRepo.Get(jobId)
 	if err != nil {
-		log.Printf("Got error when verifying that jobId=%v is aborted or finished. The job is in an unknown state.\n", jobId)
+		e.logger.Errorf("Got error when verifying that jobId=%v is aborted or finished. The job is in an unknown state.", jobId)
 		return errors.New("job does not appear to be running, but the state in the repository could not be verified")
 	}
 	if job.State == JobStateRunning {
-		log.Printf("jobId=%v has no entry in the cancels map, but state is running. Will set state to aborted. This may signify that there is a bug and the job may actually still be running.\n", jobId)
+		e.logger.Warnf("jobId=%v has no entry in the cancels map, but state is running. Will set state to aborted. This may signify that there is a bug and the job may actually still be running.", jobId)
 		err = e.jobRepo.UpdateState(jobId, JobStateAborted)
 		if err != nil {
 			return errors.New("job does not appear to be running, but the state in the repository could not be set to aborted")
@@ -0,0 +1,209 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestEngine(t *testing.T) (*Engine, events.Repository, Repository) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Every connection to :memory: gets its own database, so the repositories must share a single connection
+	db.SetMaxOpenConns(1)
+	eventRepo, err := events.SqliteRepository(db, &config.SqliteConfig{})
+	if err != nil {
+		t.Fatalf("got error when creating events repo: %v", err)
+	}
+	jobRepo, err := SqliteRepository(db)
+	if err != nil {
+		t.Fatalf("got error when creating jobs repo: %v", err)
+	}
+	cfg := &config.Config{KeyValueExtraction: true, Logger: logging.Nop()}
+	return NewEngine(cfg, eventRepo, jobRepo), eventRepo, jobRepo
+}
+
+// runJob starts a job for the query over all time and returns its results once it has finished.
+func runJob(t *testing.T, engine *Engine, jobRepo Repository, query string) []events.EventWithExtractedFields {
+	id, err := engine.StartJob(query, nil, nil)
+	if err != nil {
+		t.Fatalf("got error when starting job for query=%v: %v", query, err)
+	}
+	waitForJob(t, jobRepo, *id)
+	results, err := jobRepo.GetResults(*id, 0, 100)
+	if err != nil {
+		t.Fatalf("got error when getting results for query=%v: %v", query, err)
+	}
+	return results
+}
+
+func waitForJob(t *testing.T, jobRepo Repository, id int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jobRepo.Get(id)
+		if err != nil {
+			t.Fatalf("got error when getting jobId=%v: %v", id, err)
+		}
+		if job.State != JobStateRunning {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobId=%v did not finish in time", id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func resultIds(results []events.EventWithExtractedFields) []int64 {
+	ids := make([]int64, len(results))
+	for i, r := range results {
+		ids[i] = r.Id
+	}
+	return ids
+}
+
+func TestEngine_SortedResultsKeepTheirOrder(t *testing.T) {
+	engine, eventRepo, jobRepo := newTestEngine(t)
+	sizes := []int{30, 500, 7, 120, 45}
+	evts := make([]events.Event, len(sizes))
+	for i, size := range sizes {
+		evts[i] = events.Event{
+			Raw:       fmt.Sprintf("request handled bytes=%v", size),
+			Host:      "localhost",
+			Source:    "access.log",
+			Offset:    int64(i),
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	res, err := eventRepo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	actual := resultIds(runJob(t, engine, jobRepo, "request | sort bytes desc"))
+	expected := []int64{res.Ids[1], res.Ids[3], res.Ids[4], res.Ids[0], res.Ids[2]}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected results sorted by bytes=%v but got %v", expected, actual)
+	}
+}
+
+func TestEngine_OldestFirstResults(t *testing.T) {
+	engine, eventRepo, jobRepo := newTestEngine(t)
+	evts := make([]events.Event, 5)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:       fmt.Sprintf("trace step=%v", i),
+			Host:      "localhost",
+			Source:    "trace.log",
+			Offset:    int64(i),
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	res, err := eventRepo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	// sort _time asc directly after the search is done by the repository, reverse is done by the pipeline
+	for _, query := range []string{"trace | sort _time asc", "trace | reverse"} {
+		actual := resultIds(runJob(t, engine, jobRepo, query))
+		if !reflect.DeepEqual(actual, res.Ids) {
+			t.Fatalf("expected results oldest first=%v for query=%v but got %v", res.Ids, query, actual)
+		}
+	}
+}
+
+func TestEngine_StoresTransactions(t *testing.T) {
+	engine, eventRepo, jobRepo := newTestEngine(t)
+	raws := []string{"session=a login", "session=b login", "session=a logout"}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "localhost",
+			Source:    "app.log",
+			Offset:    int64(i),
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i*10, 0, time.UTC),
+		}
+	}
+	_, err := eventRepo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	results := runJob(t, engine, jobRepo, "session=a | transaction session")
+	if len(results) != 1 {
+		t.Fatalf("expected a single transaction but got %v", results)
+	}
+	actual := results[0]
+	if actual.Raw != "session=a login\nsession=a logout" {
+		t.Fatalf("expected the raws of both events in the transaction but got raw=%q", actual.Raw)
+	}
+	if actual.Fields["eventcount"] != "2" || actual.Fields["duration"] != "20" {
+		t.Fatalf("expected eventcount=2 and duration=20 but got fields=%v", actual.Fields)
+	}
+	if actual.Host != "localhost" || actual.Source != "app.log" {
+		t.Fatalf("expected host=localhost and source=app.log but got host=%v and source=%v", actual.Host, actual.Source)
+	}
+}
+
+func TestEngine_StoresFieldsFromThePipeline(t *testing.T) {
+	engine, eventRepo, jobRepo := newTestEngine(t)
+	_, err := eventRepo.AddBatch([]events.Event{{
+		Raw:       "request handled status=200 bytes=2500",
+		Host:      "localhost",
+		Source:    "access.log",
+		Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC),
+	}})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+
+	id, err := engine.StartJob("request | eval kb=bytes/1000 | rename status as code | fillnull user | fields kb code user", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when starting job: %v", err)
+	}
+	waitForJob(t, jobRepo, *id)
+	results, err := jobRepo.GetResults(*id, 0, 10)
+	if err != nil {
+		t.Fatalf("got error when getting results: %v", err)
+	}
+	expected := map[string]string{"kb": "2.5", "code": "200", "user": "0"}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Fields, expected) {
+		t.Fatalf("expected a single result with fields=%v but got %v", expected, results)
+	}
+	// The field list in the GUI is made from the same fields as the results
+	occurrences, err := jobRepo.GetFieldOccurences(*id)
+	if err != nil {
+		t.Fatalf("got error when getting field occurrences: %v", err)
+	}
+	expectedOccurrences := map[string]int{"kb": 1, "code": 1, "user": 1}
+	if !reflect.DeepEqual(occurrences, expectedOccurrences) {
+		t.Fatalf("expected field occurrences=%v but got %v", expectedOccurrences, occurrences)
+	}
+}
@@ -18,17 +18,24 @@ import (
 	"time"
 
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/pipeline"
 )
 
 type Repository interface {
-	AddResults(id int64, events []events.EventIdAndTimestamp) error
+	// AddResults stores the events as the job's pipeline produced them, after the results added before.
+	AddResults(id int64, events []events.EventWithExtractedFields) error
 	AddFieldStats(id int64, fields []FieldStats) error
 	Get(id int64) (*Job, error)
-	GetResults(id int64, skip int, take int) (eventIds []int64, err error)
+	// GetAggregate returns the table produced by the job, or nil if the job has not produced one.
+	GetAggregate(id int64) (*pipeline.AggregateResult, error)
+	// GetResults returns the job's results in the order the job's pipeline produced them.
+	GetResults(id int64, skip int, take int) ([]events.EventWithExtractedFields, error)
 	GetFieldOccurences(id int64) (map[string]int, error)
 	GetFieldValues(id int64, fieldName string) (map[string]int, error)
 	GetNumMatchedEvents(id int64) (int64, error)
 	Insert(query string, startTime, endTime *time.Time) (id *int64, err error)
+	// SetAggregate stores the table produced by the job, replacing any table stored before.
+	SetAggregate(id int64, aggregate *pipeline.AggregateResult) error
 	UpdateState(id int64, state JobState) error
 }
 
@@ -16,11 +16,13 @@ package jobs
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/pipeline"
 )
 
 type sqliteRepository struct {
@@ -32,35 +34,131 @@ func SqliteRepository(db *sql.DB) (Repository, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error when creating Jobs table: %w", err)
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobResults (job_id INTEGER NOT NULL, event_id INTEGER NOT NULL, timestamp DATETIME NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id), FOREIGN KEY(event_id) REFERENCES Events(id));")
+	// seq is the position of the result in the output of the job's pipeline, which may have sorted the events. The
+	// results are stored as the pipeline produced them, since steps such as transaction or eval create events and
+	// fields which can not be found by looking up event_id.
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobResults (job_id INTEGER NOT NULL, seq INTEGER NOT NULL DEFAULT 0, event_id INTEGER NOT NULL, timestamp DATETIME NOT NULL, host TEXT NOT NULL DEFAULT '', source TEXT NOT NULL DEFAULT '', raw TEXT NOT NULL DEFAULT '', fields TEXT NOT NULL DEFAULT '{}', FOREIGN KEY(job_id) REFERENCES Jobs(id), FOREIGN KEY(event_id) REFERENCES Events(id));")
 	if err != nil {
 		return nil, fmt.Errorf("error when creating JobResults table: %w", err)
 	}
+	err = addJobResultsColumn(db, "seq", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return nil, err
+	}
+	err = addJobResultsEventColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS JobResults_job_id_seq_idx ON JobResults(job_id, seq);")
+	if err != nil {
+		return nil, fmt.Errorf("error when creating index on JobResults table: %w", err)
+	}
 	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobFieldValues (job_id INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, occurrences INTEGER NOT NULL, UNIQUE(job_id, key, value), FOREIGN KEY(job_id) REFERENCES Jobs(id));")
 	if err != nil {
 		return nil, fmt.Errorf("error when creating JobFieldValues table: %w", err)
 	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS JobAggregates (job_id INTEGER NOT NULL PRIMARY KEY, aggregate TEXT NOT NULL, FOREIGN KEY(job_id) REFERENCES Jobs(id));")
+	if err != nil {
+		return nil, fmt.Errorf("error when creating JobAggregates table: %w", err)
+	}
 	return &sqliteRepository{
 		db: db,
 	}, nil
 }
 
-func (repo *sqliteRepository) AddResults(id int64, events []events.EventIdAndTimestamp) error {
-	if len(events) == 0 {
+// addJobResultsColumn adds the column to a JobResults table created before the column existed.
+func addJobResultsColumn(db *sql.DB, name, definition string) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('JobResults') WHERE name = ?;", name).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("error checking columns of JobResults table: %w", err)
+	}
+	if n > 0 {
 		return nil
 	}
-	idString := strconv.FormatInt(id, 10)
-	stmt := "INSERT INTO JobResults (job_id, event_id, timestamp) VALUES "
-	for i, evt := range events {
-		stmt += "(" + idString + ", " + strconv.FormatInt(evt.Id, 10) + ", '" + evt.Timestamp.String() + "')"
-		if i != len(events)-1 {
-			stmt += ", "
+	_, err = db.Exec("ALTER TABLE JobResults ADD COLUMN " + name + " " + definition + ";")
+	if err != nil {
+		return fmt.Errorf("error when adding column=%v to JobResults table: %w", name, err)
+	}
+	return nil
+}
+
+// addJobResultsEventColumns adds the columns holding the events to a JobResults table created before the events were
+// stored. The results already in such a table only have an event id, which is not enough to show them the way their
+// pipeline produced them, so they are removed.
+func addJobResultsEventColumns(db *sql.DB) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('JobResults') WHERE name = 'raw';").Scan(&n)
+	if err != nil {
+		return fmt.Errorf("error checking columns of JobResults table: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for adding event columns to JobResults table: %w", err)
+	}
+	for _, stmt := range []string{
+		"DELETE FROM JobResults;",
+		"ALTER TABLE JobResults ADD COLUMN host TEXT NOT NULL DEFAULT '';",
+		"ALTER TABLE JobResults ADD COLUMN source TEXT NOT NULL DEFAULT '';",
+		"ALTER TABLE JobResults ADD COLUMN raw TEXT NOT NULL DEFAULT '';",
+		"ALTER TABLE JobResults ADD COLUMN fields TEXT NOT NULL DEFAULT '{}';",
+	} {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error adding event columns to JobResults table: %w", err)
 		}
 	}
-	stmt += ";"
-	_, err := repo.db.Exec(stmt)
+	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("error adding results to jobId=%v: %w", id, err)
+		return fmt.Errorf("error committing event columns of JobResults table: %w", err)
+	}
+	return nil
+}
+
+func (repo *sqliteRepository) AddResults(id int64, evts []events.EventWithExtractedFields) error {
+	if len(evts) == 0 {
+		return nil
+	}
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction for adding results to jobId=%v: %w", id, err)
+	}
+	// The results of a job are only added by the goroutine running it, so the next seq can not be taken by anyone else
+	var nextSeq int64
+	err = tx.QueryRow("SELECT COALESCE(MAX(seq) + 1, 0) FROM JobResults WHERE job_id=?;", id).Scan(&nextSeq)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error getting next seq for jobId=%v: %w", id, err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO JobResults (job_id, seq, event_id, timestamp, host, source, raw, fields) VALUES (?, ?, ?, ?, ?, ?, ?, ?);")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing statement for adding results to jobId=%v: %w", id, err)
+	}
+	defer stmt.Close()
+	for i, evt := range evts {
+		fields := evt.Fields
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		serializedFields, err := json.Marshal(fields)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error when serializing fields of result for jobId=%v: %w", id, err)
+		}
+		_, err = stmt.Exec(id, nextSeq+int64(i), evt.Id, evt.Timestamp, evt.Host, evt.Source, evt.Raw, string(serializedFields))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error adding results to jobId=%v: %w", id, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error committing results for jobId=%v: %w", id, err)
 	}
 	return nil
 }
@@ -99,22 +197,56 @@ func (repo *sqliteRepository) Get(id int64) (*Job, error) {
 	return &job, nil
 }
 
-func (repo *sqliteRepository) GetResults(jobId int64, skip int, take int) ([]int64, error) {
-	res, err := repo.db.Query("SELECT event_id FROM JobResults WHERE job_id=? ORDER BY timestamp DESC LIMIT ? OFFSET ?;", jobId, take, skip)
+func (repo *sqliteRepository) GetAggregate(id int64) (*pipeline.AggregateResult, error) {
+	res, err := repo.db.Query("SELECT aggregate FROM JobAggregates WHERE job_id=?;", id)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting aggregate for jobId=%v: %w", id, err)
+	}
+	defer res.Close()
+	if !res.Next() {
+		if err := res.Err(); err != nil {
+			return nil, fmt.Errorf("error when getting aggregate for jobId=%v: %w", id, err)
+		}
+		return nil, nil
+	}
+	var serialized string
+	err = res.Scan(&serialized)
+	if err != nil {
+		return nil, fmt.Errorf("error reading aggregate for jobId=%v: %w", id, err)
+	}
+	var aggregate pipeline.AggregateResult
+	err = json.Unmarshal([]byte(serialized), &aggregate)
+	if err != nil {
+		return nil, fmt.Errorf("error when deserializing aggregate for jobId=%v: %w", id, err)
+	}
+	return &aggregate, nil
+}
+
+func (repo *sqliteRepository) GetResults(jobId int64, skip int, take int) ([]events.EventWithExtractedFields, error) {
+	res, err := repo.db.Query("SELECT event_id, timestamp, host, source, raw, fields FROM JobResults WHERE job_id=? ORDER BY seq LIMIT ? OFFSET ?;", jobId, take, skip)
 	if err != nil {
 		return nil, fmt.Errorf("error when getting results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
 	}
 	defer res.Close()
-	ids := make([]int64, 0, take)
+	ret := make([]events.EventWithExtractedFields, 0, take)
 	for res.Next() {
-		var id int64
-		err = res.Scan(&id)
+		var evt events.EventWithExtractedFields
+		var serializedFields string
+		err = res.Scan(&evt.Id, &evt.Timestamp, &evt.Host, &evt.Source, &evt.Raw, &serializedFields)
+		if err != nil {
+			return nil, fmt.Errorf("error reading result from database when getting results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
+		}
+		err = json.Unmarshal([]byte(serializedFields), &evt.Fields)
 		if err != nil {
-			return nil, fmt.Errorf("error reading event id from database when getting results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
+			return nil, fmt.Errorf("error when deserializing fields of result for jobId=%v: %w", jobId, err)
 		}
-		ids = append(ids, id)
+		ret = append(ret, evt)
+	}
+	err = res.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error when iterating over results for jobId=%v, skip=%v, take=%v: %w", jobId, skip, take, err)
 	}
-	return ids, nil
+	return ret, nil
 }
 
 func (repo *sqliteRepository) GetFieldOccurences(id int64) (map[string]int, error) {
@@ -186,6 +318,18 @@ func (repo *sqliteRepository) Insert(query string, startTime, endTime *time.Time
 	return &id, nil
 }
 
+func (repo *sqliteRepository) SetAggregate(id int64, aggregate *pipeline.AggregateResult) error {
+	serialized, err := json.Marshal(aggregate)
+	if err != nil {
+		return fmt.Errorf("error when serializing aggregate for jobId=%v: %w", id, err)
+	}
+	_, err = repo.db.Exec("INSERT INTO JobAggregates (job_id, aggregate) VALUES(?, ?) ON CONFLICT (job_id) DO UPDATE SET aggregate=excluded.aggregate;", id, string(serialized))
+	if err != nil {
+		return fmt.Errorf("error when setting aggregate for jobId=%v: %w", id, err)
+	}
+	return nil
+}
+
 func (repo *sqliteRepository) UpdateState(id int64, state JobState) error {
 	_, err := repo.db.Exec("UPDATE Jobs SET state=? WHERE id=?;", state, id)
 	if err != nil {
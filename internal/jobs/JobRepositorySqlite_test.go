@@ -0,0 +1,126 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/pipeline"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSqliteRepository_Aggregate(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	repo, err := SqliteRepository(db)
+	if err != nil {
+		t.Fatalf("got error when creating jobs repo: %v", err)
+	}
+	id, err := repo.Insert("| stats count, avg(bytes) by host", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when inserting job: %v", err)
+	}
+
+	aggregate, err := repo.GetAggregate(*id)
+	if err != nil {
+		t.Fatalf("got error when getting aggregate before it was set: %v", err)
+	}
+	if aggregate != nil {
+		t.Fatalf("expected no aggregate before it was set but got %v", aggregate)
+	}
+
+	count, avg := 3.0, 1.5
+	first := &pipeline.AggregateResult{
+		GroupBy: []string{"host"},
+		Columns: []string{"count", "avg(bytes)"},
+		Rows: []pipeline.AggregateRow{
+			{Group: []string{"localhost"}, Values: []*float64{&count, &avg}},
+			{Group: []string{""}, Values: []*float64{&count, nil}},
+		},
+	}
+	second := &pipeline.AggregateResult{
+		GroupBy: []string{"host"},
+		Columns: []string{"count", "avg(bytes)"},
+		Rows:    []pipeline.AggregateRow{{Group: []string{"localhost"}, Values: []*float64{&count, &avg}}},
+	}
+	for _, expected := range []*pipeline.AggregateResult{first, second} {
+		err = repo.SetAggregate(*id, expected)
+		if err != nil {
+			t.Fatalf("got error when setting aggregate: %v", err)
+		}
+		aggregate, err = repo.GetAggregate(*id)
+		if err != nil {
+			t.Fatalf("got error when getting aggregate: %v", err)
+		}
+		if !reflect.DeepEqual(aggregate, expected) {
+			t.Fatalf("expected aggregate %+v but got %+v", expected, aggregate)
+		}
+	}
+}
+
+func TestSqliteRepository_MigratesJobResults(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("got error when creating in-memory SQLite database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		"CREATE TABLE JobResults (job_id INTEGER NOT NULL, event_id INTEGER NOT NULL, timestamp DATETIME NOT NULL);",
+		"INSERT INTO JobResults (job_id, event_id, timestamp) VALUES (1, 1, '2021-01-20 20:29:00');",
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("got error when creating old JobResults table: %v", err)
+		}
+	}
+	repo, err := SqliteRepository(db)
+	if err != nil {
+		t.Fatalf("got error when creating jobs repo: %v", err)
+	}
+	id, err := repo.Insert("request", nil, nil)
+	if err != nil {
+		t.Fatalf("got error when inserting job: %v", err)
+	}
+	expected := []events.EventWithExtractedFields{{
+		Id:        2,
+		Raw:       "request handled",
+		Host:      "localhost",
+		Source:    "access.log",
+		Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC),
+		Fields:    map[string]string{"status": "200"},
+	}}
+	err = repo.AddResults(*id, expected)
+	if err != nil {
+		t.Fatalf("got error when adding results: %v", err)
+	}
+	// The old result belonged to the job with the same id, but it can not be shown so it is gone
+	actual, err := repo.GetResults(*id, 0, 10)
+	if err != nil {
+		t.Fatalf("got error when getting results: %v", err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected results %+v but got %+v", expected, actual)
+	}
+}
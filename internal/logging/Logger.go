@@ -0,0 +1,112 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the level with the given name, which is one of "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%v', expected one of debug, info, warn or error", s)
+}
+
+// Logger is what logsuck logs to. The format is like fmt.Printf, and a newline is added if it is missing.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type levelLogger struct {
+	minLevel Level
+	// output is log.Output or the Output method of a *log.Logger
+	output func(calldepth int, s string) error
+}
+
+// New creates a Logger which writes the messages with at least minLevel to out, prefixed by their level.
+func New(out *log.Logger, minLevel Level) Logger {
+	return &levelLogger{minLevel: minLevel, output: out.Output}
+}
+
+// Default returns the Logger used when none is configured. It writes messages of LevelInfo and above using the
+// standard log package, so they go wherever log.SetOutput has directed them.
+func Default() Logger {
+	return &levelLogger{minLevel: LevelInfo, output: log.Output}
+}
+
+// OrDefault returns l, or Default() if l is nil.
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+func (l *levelLogger) logf(level Level, format string, args []interface{}) {
+	if level < l.minLevel {
+		return
+	}
+	// The call depth makes log.Lshortfile point at the caller of Debugf etc. instead of this file
+	l.output(3, "level="+level.String()+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *levelLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+func (l *levelLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args) }
+func (l *levelLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args) }
+func (l *levelLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
+
+type nopLogger struct{}
+
+// Nop returns a Logger which discards every message.
+func Nop() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestLogger_MinLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(log.New(&buf, "", 0), LevelWarn)
+
+	l.Debugf("debug %v", 1)
+	l.Infof("info %v", 2)
+	l.Warnf("warn %v", 3)
+	l.Errorf("error %v", 4)
+
+	expected := "level=warn warn 3\nlevel=error error 4\n"
+	if buf.String() != expected {
+		t.Fatalf("got unexpected output, expected %q but got %q", expected, buf.String())
+	}
+}
+
+func TestLogger_Nop(t *testing.T) {
+	// Nothing to check except that it does not panic, since there is nowhere for the messages to go
+	l := Nop()
+	l.Debugf("debug")
+	l.Errorf("error %v", 1)
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected Level
+	}{
+		{"debug", LevelDebug},
+		{"INFO", LevelInfo},
+		{"Warn", LevelWarn},
+		{"error", LevelError},
+	} {
+		actual, err := ParseLevel(tt.input)
+		if err != nil {
+			t.Fatalf("got unexpected error for input=%v: %v", tt.input, err)
+		}
+		if actual != tt.expected {
+			t.Fatalf("got unexpected level for input=%v, expected %v but got %v", tt.input, tt.expected, actual)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("got no error for an unknown level, expected an error")
+	}
+}
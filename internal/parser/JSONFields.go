@@ -0,0 +1,68 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExtractJSONFields returns the fields of input if it is a JSON object, or nil otherwise.
+// Nested objects and arrays are flattened, so {"user": {"id": 1}, "tags": ["a", "b"]} gives the fields user.id=1,
+// tags[0]=a and tags[1]=b. Null values and empty objects and arrays do not give any fields.
+func ExtractJSONFields(input string) map[string]string {
+	trimmed := strings.TrimSpace(input)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil
+	}
+	// Anything after the object means the line only starts with JSON
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil
+	}
+	ret := map[string]string{}
+	flattenJSON("", obj, ret)
+	return ret
+}
+
+func flattenJSON(key string, value interface{}, into map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if key == "" {
+				flattenJSON(k, child, into)
+			} else {
+				flattenJSON(key+"."+k, child, into)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJSON(key+"["+strconv.Itoa(i)+"]", child, into)
+		}
+	case string:
+		into[key] = v
+	case json.Number:
+		into[key] = v.String()
+	case bool:
+		into[key] = strconv.FormatBool(v)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractJSONFields(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected map[string]string
+	}{
+		{`{"level": "info", "status": 200, "ok": true}`, map[string]string{"level": "info", "status": "200", "ok": "true"}},
+		{`{"user": {"id": 12, "name": {"first": "ada"}}}`, map[string]string{"user.id": "12", "user.name.first": "ada"}},
+		{`{"tags": ["a", "b"], "items": [{"id": 1}, {"id": 2.5}]}`, map[string]string{"tags[0]": "a", "tags[1]": "b", "items[0].id": "1", "items[1].id": "2.5"}},
+		{`  {"empty": {}, "none": [], "missing": null}  `, map[string]string{}},
+		{`{"big": 12345678901234567890}`, map[string]string{"big": "12345678901234567890"}},
+		{`plain text status=200`, nil},
+		{`["not", "an", "object"]`, nil},
+		{`{"unclosed": "object"`, nil},
+		{`{"a": 1} trailing text`, nil},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			actual := ExtractJSONFields(tt.input)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestExtractJSONFields expected fields=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// keyValueRegexp matches key=value and key="quoted value" pairs. The first group makes sure the key is not the end of
+// a longer word, since Go's regexp does not support lookbehind.
+var keyValueRegexp = regexp.MustCompile(`(?:^|[^\w.\-])([A-Za-z_][\w.\-]*)=("(?:[^"\\]|\\.)*"|[^\s"]\S*)`)
+
+var keyValueUnescaper = strings.NewReplacer(`\"`, `"`, `\\`, `\`)
+
+// ExtractKeyValueFields returns the key=value pairs in input as fields.
+// Values can be quoted to contain whitespace, as in msg="hello world", and quotes inside a quoted value are escaped
+// with a backslash. An unquoted value continues until the next whitespace, so it can contain =. If a key is repeated
+// the last value is used, the same as for other field extractors.
+func ExtractKeyValueFields(input string) map[string]string {
+	ret := map[string]string{}
+	for _, match := range keyValueRegexp.FindAllStringSubmatch(input, -1) {
+		value := match[2]
+		if strings.HasPrefix(value, "\"") {
+			value = keyValueUnescaper.Replace(value[1 : len(value)-1])
+		}
+		ret[match[1]] = value
+	}
+	return ret
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractKeyValueFields(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected map[string]string
+	}{
+		{`level=error status=500`, map[string]string{"level": "error", "status": "500"}},
+		{`msg="connection refused" user=bob`, map[string]string{"msg": "connection refused", "user": "bob"}},
+		{`msg="said \"hi\" twice" path="C:\\logs"`, map[string]string{"msg": `said "hi" twice`, "path": `C:\logs`}},
+		{`empty="" next=1`, map[string]string{"empty": "", "next": "1"}},
+		{`query=a=b&c=d`, map[string]string{"query": "a=b&c=d"}},
+		{`retry=1 retry=2 retry=3`, map[string]string{"retry": "3"}},
+		{`user.id=12 http-status=404 _time=now`, map[string]string{"user.id": "12", "http-status": "404", "_time": "now"}},
+		{`no pairs here = at all`, map[string]string{}},
+		{`1abc=x =y key= unclosed="quote`, map[string]string{}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			actual := ExtractKeyValueFields(tt.input)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestExtractKeyValueFields expected fields=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -15,8 +15,6 @@
 package parser
 
 import (
-	"errors"
-	"fmt"
 	"regexp"
 	"strings"
 	"unicode/utf8"
@@ -25,16 +23,22 @@ import (
 type tokenType int
 
 const (
-	tokenString       tokenType = 0
-	tokenQuotedString           = 1
-	tokenWhitespace             = 2
-	tokenEquals                 = 3
-	tokenNotEquals              = 4
-	tokenLparen                 = 5
-	tokenRparen                 = 6
-	tokenPipe                   = 7
-	tokenComma                  = 8
-	tokenKeyword                = 9
+	tokenString          tokenType = 0
+	tokenQuotedString              = 1
+	tokenWhitespace                = 2
+	tokenEquals                    = 3
+	tokenNotEquals                 = 4
+	tokenLparen                    = 5
+	tokenRparen                    = 6
+	tokenPipe                      = 7
+	tokenComma                     = 8
+	tokenKeyword                   = 9
+	tokenGreater                   = 10
+	tokenGreaterOrEquals           = 11
+	tokenLess                      = 12
+	tokenLessOrEquals              = 13
+	tokenRegexEquals               = 14
+	tokenRegexNotEquals            = 15
 
 	tokenInvalid = 0xBEEF
 )
@@ -42,20 +46,25 @@ const (
 type token struct {
 	typ   tokenType
 	value string
+	// offset is the byte offset of the token in the input
+	offset int
 }
 
 type tokenizer struct {
 	tokens        []token
 	insideString  bool
 	currentString strings.Builder
+	// offset is the byte offset of the token currently being read
+	offset int
 }
 
 var keywords = [...]string{
 	"IN",
 	"NOT",
+	"OR",
 }
 
-const symbols = "!=|(),"
+const symbols = "!=|(),<>"
 const whiteSpace = " \n\t"
 
 var wordDelimiters = symbols + whiteSpace
@@ -74,22 +83,57 @@ func (tk *tokenizer) tokenize(input string) ([]token, error) {
 
 	for i := 0; i < len(input); i++ {
 		r, _ := utf8.DecodeRuneInString(input[i:])
+		tk.offset = i
 		if strings.ContainsRune(whiteSpace, r) {
 			tk.addToken(token{
 				typ:   tokenWhitespace,
 				value: string(r),
 			})
+		} else if strings.HasPrefix(input[i:], "=~") {
+			tk.addToken(token{
+				typ:   tokenRegexEquals,
+				value: "=~",
+			})
+			i++
 		} else if r == '=' {
 			tk.addToken(token{
 				typ:   tokenEquals,
 				value: "=",
 			})
+		} else if strings.HasPrefix(input[i:], "!~") {
+			tk.addToken(token{
+				typ:   tokenRegexNotEquals,
+				value: "!~",
+			})
+			i++
 		} else if strings.HasPrefix(input[i:], "!=") {
 			tk.addToken(token{
 				typ:   tokenNotEquals,
 				value: "!=",
 			})
 			i++
+		} else if strings.HasPrefix(input[i:], ">=") {
+			tk.addToken(token{
+				typ:   tokenGreaterOrEquals,
+				value: ">=",
+			})
+			i++
+		} else if r == '>' {
+			tk.addToken(token{
+				typ:   tokenGreater,
+				value: ">",
+			})
+		} else if strings.HasPrefix(input[i:], "<=") {
+			tk.addToken(token{
+				typ:   tokenLessOrEquals,
+				value: "<=",
+			})
+			i++
+		} else if r == '<' {
+			tk.addToken(token{
+				typ:   tokenLess,
+				value: "<",
+			})
 		} else if r == '(' {
 			tk.addToken(token{
 				typ:   tokenLparen,
@@ -112,23 +156,36 @@ func (tk *tokenizer) tokenize(input string) ([]token, error) {
 			})
 		} else if r == '"' {
 			if i == len(input)-1 {
-				return nil, errors.New("unclosed quote at end of string")
+				return nil, &ParseError{Token: "\"", Offset: i, Message: "unclosed quote at end of string"}
 			}
 			remainder := input[i+1:]
-			endLocation := stringEndRegexp.FindStringIndex(remainder)
-			if len(endLocation) == 0 {
-				return nil, errors.New("Unclosed quote at offset " + fmt.Sprint(i))
+			if remainder[0] == '"' {
+				// stringEndRegexp would treat the closing quote of an empty string as the character before the quote
+				tk.addToken(token{
+					typ:   tokenQuotedString,
+					value: "",
+				})
+				i++
+			} else {
+				endLocation := stringEndRegexp.FindStringIndex(remainder)
+				if len(endLocation) == 0 {
+					return nil, &ParseError{Token: input[i:], Offset: i, Message: "unclosed quote"}
+				}
+				str := remainder[:endLocation[0]+1]
+				str = strings.ReplaceAll(str, "\\\"", "\"")
+				tk.addToken(token{
+					typ:   tokenQuotedString,
+					value: str,
+				})
+				i += endLocation[1]
 			}
-			str := remainder[:endLocation[0]+1]
-			str = strings.ReplaceAll(str, "\\\"", "\"")
-			tk.addToken(token{
-				typ:   tokenQuotedString,
-				value: str,
-			})
-			i += endLocation[1]
 		} else {
 			remainder := input[i:]
 			endLocation := strings.IndexAny(remainder, wordDelimiters)
+			if endLocation == 0 {
+				// A symbol which is not part of any of the operators above, such as a lone !
+				return nil, &ParseError{Token: string(r), Offset: i, Message: "unknown operator"}
+			}
 			var str string
 			if endLocation == -1 {
 				str = remainder
@@ -182,6 +239,15 @@ func (tk *tokenizer) handleQuote(str string, quoteIndex int) {
 	}
 }
 
+// source returns the token as it could have been written in the input, with quoted strings quoted and escaped again.
+func (t *token) source() string {
+	if t.typ == tokenQuotedString {
+		return "\"" + strings.ReplaceAll(t.value, "\"", "\\\"") + "\""
+	}
+	return t.value
+}
+
 func (tk *tokenizer) addToken(t token) {
+	t.offset = tk.offset
 	tk.tokens = append(tk.tokens, t)
 }
@@ -33,6 +33,36 @@ var tokNotEquals = token{
 	value: "!=",
 }
 
+var tokRegexEquals = token{
+	typ:   tokenRegexEquals,
+	value: "=~",
+}
+
+var tokRegexNotEquals = token{
+	typ:   tokenRegexNotEquals,
+	value: "!~",
+}
+
+var tokGreater = token{
+	typ:   tokenGreater,
+	value: ">",
+}
+
+var tokGreaterOrEquals = token{
+	typ:   tokenGreaterOrEquals,
+	value: ">=",
+}
+
+var tokLess = token{
+	typ:   tokenLess,
+	value: "<",
+}
+
+var tokLessOrEquals = token{
+	typ:   tokenLessOrEquals,
+	value: "<=",
+}
+
 var tokLparen = token{
 	typ:   tokenLparen,
 	value: "(",
@@ -102,6 +132,13 @@ var tokenTests = []struct {
 			tokQuoted("quoted with \"escaped quotes\""),
 		},
 	},
+	{
+		"\"\" \"\"", false, []token{
+			tokQuoted(""),
+			tokSpace,
+			tokQuoted(""),
+		},
+	},
 	{
 		"\"multiple\" \"quoted\"\"strings\"", false, []token{
 			tokQuoted("multiple"),
@@ -161,6 +198,48 @@ var tokenTests = []struct {
 			tokComma,
 		},
 	},
+	{
+		">", false, []token{
+			tokGreater,
+		},
+	},
+	{
+		">=", false, []token{
+			tokGreaterOrEquals,
+		},
+	},
+	{
+		"<", false, []token{
+			tokLess,
+		},
+	},
+	{
+		"<=", false, []token{
+			tokLessOrEquals,
+		},
+	},
+	{
+		"path=~\"^/api/v[0-9]+\" user!~adm.*", false, []token{
+			tokString("path"),
+			tokRegexEquals,
+			tokQuoted("^/api/v[0-9]+"),
+			tokSpace,
+			tokString("user"),
+			tokRegexNotEquals,
+			tokString("adm.*"),
+		},
+	},
+	{
+		"status>=500 time<0.2", false, []token{
+			tokString("status"),
+			tokGreaterOrEquals,
+			tokString("500"),
+			tokSpace,
+			tokString("time"),
+			tokLess,
+			tokString("0.2"),
+		},
+	},
 	{
 		"source=*test* testval IN (\"a bit\", of) | everything", false, []token{
 			tokString("source"),
@@ -0,0 +1,47 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import "fmt"
+
+// ParseError is returned when a search or pipeline can not be parsed. It says where in the input the problem is so
+// that it can be pointed out to the user.
+type ParseError struct {
+	// Token is the part of the input which could not be parsed. It is empty if the input ended unexpectedly.
+	Token string
+	// Offset is the byte offset of Token in the parsed string, or the length of the string if it ended unexpectedly.
+	Offset  int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%v at offset %v", e.Message, e.Offset)
+	}
+	return fmt.Sprintf("%v at offset %v near '%v'", e.Message, e.Offset, e.Token)
+}
+
+// errorf returns a ParseError for the next token, or for the end of the input if there are no tokens left.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	if len(p.tokens) == 0 {
+		return &ParseError{Offset: p.inputLen, Message: fmt.Sprintf(format, args...)}
+	}
+	return tokenErrorf(&p.tokens[0], format, args...)
+}
+
+// tokenErrorf returns a ParseError for tok.
+func tokenErrorf(tok *token, format string, args ...interface{}) error {
+	return &ParseError{Token: tok.source(), Offset: tok.offset, Message: fmt.Sprintf(format, args...)}
+}
@@ -15,14 +15,14 @@
 package parser
 
 import (
-	"errors"
-	"fmt"
 	"log"
 	"regexp"
 )
 
 type parser struct {
 	tokens []token
+	// inputLen is the length of the parsed string, which is used as the offset of errors at the end of the input
+	inputLen int
 }
 
 func (p *parser) peek() tokenType {
@@ -41,10 +41,10 @@ func (p *parser) peekValue() string {
 
 func (p *parser) require(expected tokenType) (*token, error) {
 	if len(p.tokens) == 0 {
-		return nil, errors.New("Unexpected end of string, expected tokenType=" + fmt.Sprint(expected))
+		return nil, p.errorf("unexpected end of string, expected tokenType=%v", expected)
 	}
 	if p.tokens[0].typ != expected {
-		return nil, errors.New("Unexpected tokenType=" + fmt.Sprint(p.tokens[0].typ) + ", expected tokenType=" + fmt.Sprint(expected))
+		return nil, p.errorf("unexpected tokenType=%v, expected tokenType=%v", p.tokens[0].typ, expected)
 	}
 	ret := &p.tokens[0]
 	p.tokens = p.tokens[1:]
@@ -54,7 +54,7 @@ func (p *parser) require(expected tokenType) (*token, error) {
 func (p *parser) parseParenList() ([]string, error) {
 	ret := make([]string, 0)
 	if p.peek() != tokenLparen {
-		return nil, errors.New("unexpected token, expected '(' after 'IN'")
+		return nil, p.errorf("unexpected token, expected '(' after 'IN'")
 	}
 	p.take()
 	p.skipWhitespace()
@@ -63,7 +63,7 @@ func (p *parser) parseParenList() ([]string, error) {
 		ret = append(ret, tok.value)
 		p.skipWhitespace()
 		if p.peek() != tokenComma && p.peek() != tokenRparen {
-			return nil, errors.New("unexpected token, expected ',' or ')' after string in parenthesis list")
+			return nil, p.errorf("unexpected token, expected ',' or ')' after string in parenthesis list")
 		}
 		if p.peek() == tokenRparen {
 			break
@@ -71,17 +71,33 @@ func (p *parser) parseParenList() ([]string, error) {
 		p.take()
 		p.skipWhitespace()
 		if p.peek() != tokenString && p.peek() != tokenQuotedString {
-			return nil, errors.New("unexpected token, expected string after comma in parenthesis list")
+			return nil, p.errorf("unexpected token, expected string after comma in parenthesis list")
 		}
 	}
 	p.skipWhitespace()
 	if p.peek() != tokenRparen {
-		return nil, errors.New("unexpected token, expected ')' at end of IN expression")
+		return nil, p.errorf("unexpected token, expected ')' at end of IN expression")
 	}
 	p.take()
 	return ret, nil
 }
 
+// nonWhitespaceIndex returns the index of the first token at or after from which is not whitespace.
+func (p *parser) nonWhitespaceIndex(from int) int {
+	for from < len(p.tokens) && p.tokens[from].typ == tokenWhitespace {
+		from++
+	}
+	return from
+}
+
+func (p *parser) isTypeAt(i int, typ tokenType) bool {
+	return i < len(p.tokens) && p.tokens[i].typ == typ
+}
+
+func (p *parser) isKeywordAt(i int, keyword string) bool {
+	return p.isTypeAt(i, tokenKeyword) && p.tokens[i].value == keyword
+}
+
 func (p *parser) skipWhitespace() {
 	for len(p.tokens) > 0 && p.tokens[0].typ == tokenWhitespace {
 		p.tokens = p.tokens[1:]
@@ -29,6 +29,12 @@ type PipelineParseResult struct {
 	Steps []ParsedPipelineStep
 }
 
+// rawValueSteps are the commands which parse their own input, such as eval whose "x=a*2" would otherwise be mistaken
+// for an option. They get everything up to the next pipe as their value, as it was written.
+var rawValueSteps = map[string]struct{}{
+	"eval": {},
+}
+
 func ParsePipeline(s string) (*PipelineParseResult, error) {
 	tokens, err := tokenize(s)
 	if err != nil {
@@ -36,7 +42,8 @@ func ParsePipeline(s string) (*PipelineParseResult, error) {
 	}
 
 	p := parser{
-		tokens: tokens,
+		tokens:   tokens,
+		inputLen: len(s),
 	}
 
 	steps := make([]ParsedPipelineStep, 0)
@@ -45,7 +52,7 @@ func ParsePipeline(s string) (*PipelineParseResult, error) {
 	if p.peek() != tokenPipe {
 		sb := strings.Builder{}
 		for len(p.tokens) > 0 && p.peek() != tokenPipe {
-			sb.WriteString(p.take().value)
+			sb.WriteString(p.take().source())
 		}
 		steps = append(steps, ParsedPipelineStep{
 			StepType: "search",
@@ -70,7 +77,16 @@ func ParsePipeline(s string) (*PipelineParseResult, error) {
 		}
 		step.StepType = tokStepType.value
 		p.skipWhitespace()
-		if p.peek() == tokenString {
+		if _, ok := rawValueSteps[step.StepType]; ok {
+			var sb strings.Builder
+			for len(p.tokens) > 0 && p.peek() != tokenPipe {
+				sb.WriteString(p.take().source())
+			}
+			step.Value = strings.TrimRight(sb.String(), whiteSpace)
+			steps = append(steps, step)
+			continue
+		}
+		for p.peek() == tokenString && p.isTypeAt(p.nonWhitespaceIndex(1), tokenEquals) {
 			key := p.take().value
 			p.skipWhitespace()
 			_, err := p.require(tokenEquals)
@@ -79,16 +95,35 @@ func ParsePipeline(s string) (*PipelineParseResult, error) {
 			}
 			p.skipWhitespace()
 			if p.peek() != tokenString && p.peek() != tokenQuotedString {
-				return nil, fmt.Errorf("failed to parse: expected string or quoted string in option list for command %v", step.StepType)
+				return nil, fmt.Errorf("failed to parse: %w", p.errorf("expected string or quoted string in option list for command %v", step.StepType))
 			}
 			tokFieldValue := p.take()
 			step.Args[key] = tokFieldValue.value
 			p.skipWhitespace()
 		}
-		if p.peek() == tokenQuotedString || p.peek() == tokenString {
-			step.Value = p.take().value
+		// Commands like dedup and stats take several values. A single value is passed on as is, otherwise the tokens up
+		// to the next pipe are passed on with quoted strings kept quoted and whitespace collapsed to a single space.
+		valueTokens := []*token{}
+		for len(p.tokens) > 0 && p.peek() != tokenPipe {
+			valueTokens = append(valueTokens, p.take())
+		}
+		for len(valueTokens) > 0 && valueTokens[len(valueTokens)-1].typ == tokenWhitespace {
+			valueTokens = valueTokens[:len(valueTokens)-1]
+		}
+		if len(valueTokens) == 1 && (valueTokens[0].typ == tokenString || valueTokens[0].typ == tokenQuotedString) {
+			step.Value = valueTokens[0].value
 		} else {
-			step.Value = ""
+			var sb strings.Builder
+			for i, tok := range valueTokens {
+				if tok.typ == tokenWhitespace {
+					if valueTokens[i-1].typ != tokenWhitespace {
+						sb.WriteRune(' ')
+					}
+				} else {
+					sb.WriteString(tok.source())
+				}
+			}
+			step.Value = sb.String()
 		}
 		steps = append(steps, step)
 	}
@@ -14,7 +14,10 @@
 
 package parser
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestImplicitSearch(t *testing.T) {
 	const input = "source=*my-log.txt* hello world"
@@ -120,3 +123,108 @@ func TestPipeWithOptions(t *testing.T) {
 		t.Fatalf("TestPipeWithOptions expected step 1 to have value='%v', got '%v'", step1exp, step1.Value)
 	}
 }
+
+func TestMultipleValues(t *testing.T) {
+	const input = "hello | dedup host  source | where userid=123 action=login"
+	res, err := ParsePipeline(input)
+	if err != nil {
+		t.Fatalf("TestMultipleValues parse returned error: %v", err)
+	}
+	if len(res.Steps) != 3 {
+		t.Fatalf("TestMultipleValues expected 3 steps, got %v", len(res.Steps))
+	}
+	step1 := res.Steps[1]
+	if step1.StepType != "dedup" {
+		t.Fatalf("TestMultipleValues expected step 1 to be dedup, got %v", step1.StepType)
+	}
+	const step1exp = "host source"
+	if step1.Value != step1exp {
+		t.Fatalf("TestMultipleValues expected step 1 to have value='%v', got '%v'", step1exp, step1.Value)
+	}
+	step2 := res.Steps[2]
+	if len(step2.Args) != 2 || step2.Args["userid"] != "123" || step2.Args["action"] != "login" {
+		t.Fatalf("TestMultipleValues expected step 2 to have args userid=123 and action=login, got %v", step2.Args)
+	}
+}
+
+func TestQuotedValuesSurvive(t *testing.T) {
+	const input = "\"connection refused\" x | search \"connection refused\" \"with \\\"escaped\\\" quotes\" x"
+	res, err := ParsePipeline(input)
+	if err != nil {
+		t.Fatalf("TestQuotedValuesSurvive parse returned error: %v", err)
+	}
+	if len(res.Steps) != 2 {
+		t.Fatalf("TestQuotedValuesSurvive expected 2 steps, got %v", len(res.Steps))
+	}
+	const step0exp = "\"connection refused\" x "
+	if res.Steps[0].Value != step0exp {
+		t.Fatalf("TestQuotedValuesSurvive expected step 0 to have value='%v', got '%v'", step0exp, res.Steps[0].Value)
+	}
+	const step1exp = "\"connection refused\" \"with \\\"escaped\\\" quotes\" x"
+	if res.Steps[1].Value != step1exp {
+		t.Fatalf("TestQuotedValuesSurvive expected step 1 to have value='%v', got '%v'", step1exp, res.Steps[1].Value)
+	}
+	for _, step := range res.Steps {
+		srch, err := ParseSearch(step.Value)
+		if err != nil {
+			t.Fatalf("TestQuotedValuesSurvive got error when parsing search '%v': %v", step.Value, err)
+		}
+		if _, ok := srch.Fragments["connection refused"]; !ok {
+			t.Fatalf("TestQuotedValuesSurvive expected '%v' to contain the fragment 'connection refused' but got %v", step.Value, srch.Fragments)
+		}
+	}
+}
+
+func TestValueWithParentheses(t *testing.T) {
+	const input = "hello | stats count, sum(bytes) by host"
+	res, err := ParsePipeline(input)
+	if err != nil {
+		t.Fatalf("TestValueWithParentheses parse returned error: %v", err)
+	}
+	if len(res.Steps) != 2 {
+		t.Fatalf("TestValueWithParentheses expected 2 steps, got %v", len(res.Steps))
+	}
+	const step1exp = "count, sum(bytes) by host"
+	if res.Steps[1].Value != step1exp {
+		t.Fatalf("TestValueWithParentheses expected step 1 to have value='%v', got '%v'", step1exp, res.Steps[1].Value)
+	}
+}
+
+func TestRawValueStep(t *testing.T) {
+	const input = "error | eval ms=latency*1000, msg=\"took \" . ms | sort ms"
+	res, err := ParsePipeline(input)
+	if err != nil {
+		t.Fatalf("TestRawValueStep parse returned error: %v", err)
+	}
+	if len(res.Steps) != 3 {
+		t.Fatalf("TestRawValueStep expected 3 steps, got %v", len(res.Steps))
+	}
+	const step1exp = "ms=latency*1000, msg=\"took \" . ms"
+	if res.Steps[1].Value != step1exp {
+		t.Fatalf("TestRawValueStep expected step 1 to have value='%v', got '%v'", step1exp, res.Steps[1].Value)
+	}
+	if len(res.Steps[1].Args) != 0 {
+		t.Fatalf("TestRawValueStep expected step 1 to have no options, got %v", res.Steps[1].Args)
+	}
+}
+
+func TestParsePipeline_ParseError(t *testing.T) {
+	for _, tt := range []struct {
+		input          string
+		expectedOffset int
+	}{
+		{"error | sort \"bytes", 13},
+		{"error | sort maxEvents=", 23},
+		{"error | ", 8},
+	} {
+		_, err := ParsePipeline(tt.input)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("ParsePipeline_ParseError expected a ParseError when parsing '%v' but got %v", tt.input, err)
+			continue
+		}
+		if parseErr.Offset != tt.expectedOffset {
+			t.Errorf("ParsePipeline_ParseError expected offset %v when parsing '%v' but got %v", tt.expectedOffset, tt.input, parseErr.Offset)
+		}
+	}
+}
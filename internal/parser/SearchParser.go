@@ -15,12 +15,103 @@
 package parser
 
 import (
-	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+type ComparisonOperator string
+
+const (
+	ComparisonGreater         ComparisonOperator = ">"
+	ComparisonGreaterOrEquals ComparisonOperator = ">="
+	ComparisonLess            ComparisonOperator = "<"
+	ComparisonLessOrEquals    ComparisonOperator = "<="
+)
+
+// FieldComparison is a numeric comparison against the value of a field, such as "status>=500".
+// = and != are not comparisons, they match the field value as a string so that wildcards like status=5* work.
+type FieldComparison struct {
+	Field    string
+	Operator ComparisonOperator
+	Value    float64
+}
+
+// Matches returns true if fieldValue is numeric and satisfies the comparison.
+func (c FieldComparison) Matches(fieldValue string) bool {
+	f, err := strconv.ParseFloat(strings.TrimSpace(fieldValue), 64)
+	if err != nil {
+		return false
+	}
+	switch c.Operator {
+	case ComparisonGreater:
+		return f > c.Value
+	case ComparisonGreaterOrEquals:
+		return f >= c.Value
+	case ComparisonLess:
+		return f < c.Value
+	case ComparisonLessOrEquals:
+		return f <= c.Value
+	}
+	return false
+}
+
+// FieldRegex matches the value of a field against a regular expression, such as `path=~"^/api/v[0-9]+"`.
+// The regular expression may match any part of the value unless it is anchored. Pattern is known to be a valid
+// regular expression, but it is compiled by the search since whether it is case sensitive depends on the
+// configuration.
+type FieldRegex struct {
+	Field   string
+	Pattern string
+}
+
+var comparisonTokens = map[tokenType]ComparisonOperator{
+	tokenGreater:         ComparisonGreater,
+	tokenGreaterOrEquals: ComparisonGreaterOrEquals,
+	tokenLess:            ComparisonLess,
+	tokenLessOrEquals:    ComparisonLessOrEquals,
+}
+
+// SearchExpressionType says which kind of node a SearchExpression is.
+type SearchExpressionType int
+
+const (
+	SearchExpressionAnd SearchExpressionType = iota
+	SearchExpressionOr
+	SearchExpressionFragment
+	SearchExpressionField
+	SearchExpressionComparison
+	SearchExpressionRegex
+	SearchExpressionExists
+)
+
+// SearchExpression is a node in the boolean expression tree produced by ParseSearch.
+// And and Or nodes have Children, all other node types are leaves.
+type SearchExpression struct {
+	Type    SearchExpressionType
+	Negated bool
+
+	Children []*SearchExpression
+
+	// Fragment is set if Type is SearchExpressionFragment.
+	Fragment string
+	// Field and Values are set if Type is SearchExpressionField. The node matches if the field matches any of the values.
+	// Only Field is set if Type is SearchExpressionExists, and the node matches if the event has the field at all.
+	Field  string
+	Values []string
+	// Comparison is set if Type is SearchExpressionComparison.
+	Comparison *FieldComparison
+	// Regex is set if Type is SearchExpressionRegex.
+	Regex *FieldRegex
+}
+
 type SearchParseResult struct {
+	// Expression is the whole search as a tree. The top level node is always a non-negated And node.
+	Expression *SearchExpression
+
+	// The maps below contain the leaves which are direct children of Expression, so they can be used to filter events
+	// without evaluating the tree.
 	Fragments    map[string]struct{}
 	NotFragments map[string]struct{}
 	Fields       map[string][]string
@@ -29,6 +120,12 @@ type SearchParseResult struct {
 	NotSources   map[string]struct{}
 	Hosts        map[string]struct{}
 	NotHosts     map[string]struct{}
+
+	FieldComparisons []FieldComparison
+
+	// Groups contains the direct children of Expression which could not be represented by the maps above, such as OR
+	// expressions and regular expressions. An event must match all of them to match the search.
+	Groups []*SearchExpression
 }
 
 func ParseSearch(input string) (*SearchParseResult, error) {
@@ -38,10 +135,26 @@ func ParseSearch(input string) (*SearchParseResult, error) {
 	}
 
 	p := parser{
-		tokens: tokens,
+		tokens:   tokens,
+		inputLen: len(input),
+	}
+
+	expr, err := p.parseOrExpression()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.tokens) > 0 {
+		return nil, p.errorf("unexpected ')' without matching '('")
+	}
+	if expr.Type != SearchExpressionAnd || expr.Negated {
+		expr = &SearchExpression{
+			Type:     SearchExpressionAnd,
+			Children: []*SearchExpression{expr},
+		}
 	}
 
 	ret := SearchParseResult{
+		Expression:   expr,
 		Fragments:    map[string]struct{}{},
 		NotFragments: map[string]struct{}{},
 		Fields:       map[string][]string{},
@@ -49,78 +162,8 @@ func ParseSearch(input string) (*SearchParseResult, error) {
 		Sources:      map[string]struct{}{},
 	}
 
-	for len(p.tokens) > 0 {
-		tok := p.take()
-		if tok == nil {
-			break
-		}
-		if tok.typ == tokenString {
-			lowered := strings.ToLower(tok.value)
-			if p.peek() == tokenEquals {
-				p.take()
-				if p.peek() != tokenString && p.peek() != tokenQuotedString {
-					return nil, errors.New("unexpected token, expected string or quoted string after =")
-				}
-				value := p.take()
-				ret.Fields[lowered] = []string{value.value}
-			} else if p.peek() == tokenNotEquals {
-				p.take()
-				if p.peek() != tokenString && p.peek() != tokenQuotedString {
-					return nil, errors.New("unexpected token, expected string or quoted string after =")
-				}
-				value := p.take()
-				if existingNots, ok := ret.NotFields[lowered]; ok {
-					ret.NotFields[lowered] = append(existingNots, value.value)
-				} else {
-					ret.NotFields[lowered] = []string{value.value}
-				}
-			} else if p.peek() == tokenWhitespace {
-				p.skipWhitespace()
-				if p.peek() == tokenKeyword && p.peekValue() == "IN" {
-					p.take()
-					p.skipWhitespace()
-					values, err := p.parseParenList()
-					if err != nil {
-						return nil, fmt.Errorf("error while parsing IN expression: %w", err)
-					}
-					ret.Fields[lowered] = values
-				} else if p.peek() == tokenKeyword && p.peekValue() == "NOT" {
-					p.take()
-					p.skipWhitespace()
-					if p.peek() != tokenKeyword || p.peekValue() != "IN" {
-						return nil, errors.New("unexpected token, expected 'IN' after 'NOT'")
-					}
-					p.take()
-					p.skipWhitespace()
-					values, err := p.parseParenList()
-					if err != nil {
-						return nil, fmt.Errorf("error while parsing NOT IN expression: %w", err)
-					}
-					if existingNots, ok := ret.NotFields[lowered]; ok {
-						ret.NotFields[lowered] = append(existingNots, values...)
-					} else {
-						ret.NotFields[lowered] = values
-					}
-				} else {
-					ret.Fragments[tok.value] = struct{}{}
-				}
-			} else {
-				ret.Fragments[tok.value] = struct{}{}
-			}
-		} else if tok.typ == tokenQuotedString {
-			ret.Fragments[tok.value] = struct{}{}
-		} else if tok.typ == tokenKeyword {
-			if tok.value == "NOT" {
-				if p.peek() == tokenWhitespace {
-					p.take()
-				}
-				if p.peek() != tokenString && p.peek() != tokenQuotedString {
-					return nil, errors.New("unexpected token, expected string or quoted string after =")
-				}
-				frag := p.take().value
-				ret.NotFragments[frag] = struct{}{}
-			}
-		}
+	for _, child := range expr.Children {
+		ret.addTopLevelTerm(child)
 	}
 
 	if sources, ok := ret.Fields["source"]; ok {
@@ -150,3 +193,207 @@ func ParseSearch(input string) (*SearchParseResult, error) {
 
 	return &ret, nil
 }
+
+func (ret *SearchParseResult) addTopLevelTerm(expr *SearchExpression) {
+	switch {
+	case expr.Type == SearchExpressionFragment && !expr.Negated:
+		ret.Fragments[expr.Fragment] = struct{}{}
+	case expr.Type == SearchExpressionFragment && expr.Negated:
+		ret.NotFragments[expr.Fragment] = struct{}{}
+	case expr.Type == SearchExpressionField && !expr.Negated:
+		// An event only has one value for a field, so repeating a field means any of the values should match, the same
+		// as status IN (500, 503)
+		ret.Fields[expr.Field] = append(ret.Fields[expr.Field], expr.Values...)
+	case expr.Type == SearchExpressionField && expr.Negated:
+		ret.NotFields[expr.Field] = append(ret.NotFields[expr.Field], expr.Values...)
+	case expr.Type == SearchExpressionComparison && !expr.Negated:
+		ret.FieldComparisons = append(ret.FieldComparisons, *expr.Comparison)
+	default:
+		ret.Groups = append(ret.Groups, expr)
+	}
+}
+
+// parseOrExpression parses terms separated by OR. AND binds tighter than OR, so each operand is an AND expression.
+func (p *parser) parseOrExpression() (*SearchExpression, error) {
+	first, err := p.parseAndExpression()
+	if err != nil {
+		return nil, err
+	}
+	children := []*SearchExpression{first}
+	ors := []*token{}
+	for p.peek() == tokenKeyword && p.peekValue() == "OR" {
+		ors = append(ors, p.take())
+		next, err := p.parseAndExpression()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, next)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	for i, child := range children {
+		if child.Type == SearchExpressionAnd && len(child.Children) == 0 {
+			// ors[i-1] is the OR before the empty term and ors[i] is the one after it
+			or := ors[0]
+			if i > 0 {
+				or = ors[i-1]
+			}
+			return nil, tokenErrorf(or, "expected search term on both sides of OR")
+		}
+	}
+	return &SearchExpression{
+		Type:     SearchExpressionOr,
+		Children: children,
+	}, nil
+}
+
+// parseAndExpression parses whitespace separated terms up to the next OR, ')' or the end of the input.
+func (p *parser) parseAndExpression() (*SearchExpression, error) {
+	children := []*SearchExpression{}
+	for {
+		p.skipWhitespace()
+		if len(p.tokens) == 0 || p.peek() == tokenRparen || (p.peek() == tokenKeyword && p.peekValue() == "OR") {
+			break
+		}
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if term != nil {
+			children = append(children, term)
+		}
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &SearchExpression{
+		Type:     SearchExpressionAnd,
+		Children: children,
+	}, nil
+}
+
+// parseTerm parses a single term. It returns nil if the token it consumed does not make up a term.
+func (p *parser) parseTerm() (*SearchExpression, error) {
+	tok := p.take()
+	switch tok.typ {
+	case tokenLparen:
+		expr, err := p.parseOrExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != tokenRparen {
+			return nil, p.errorf("unexpected end of search, expected ')'")
+		}
+		p.take()
+		if expr.Type == SearchExpressionAnd && len(expr.Children) == 0 {
+			return nil, tokenErrorf(tok, "unexpected empty parentheses")
+		}
+		return expr, nil
+	case tokenKeyword:
+		if tok.value != "NOT" {
+			return nil, nil
+		}
+		p.skipWhitespace()
+		if len(p.tokens) == 0 || p.peek() == tokenRparen || (p.peek() == tokenKeyword && p.peekValue() == "OR") {
+			return nil, tokenErrorf(tok, "unexpected token, expected search term after NOT")
+		}
+		expr, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if expr == nil {
+			return nil, tokenErrorf(tok, "unexpected token, expected search term after NOT")
+		}
+		expr.Negated = !expr.Negated
+		return expr, nil
+	case tokenQuotedString:
+		// A quoted string is a phrase, which is matched as a whole instead of being split into words
+		if tok.value == "" {
+			return nil, tokenErrorf(tok, "unexpected empty quoted string, expected a phrase to search for")
+		}
+		return &SearchExpression{Type: SearchExpressionFragment, Fragment: tok.value}, nil
+	case tokenString:
+		return p.parseStringTerm(tok)
+	}
+	return nil, nil
+}
+
+func (p *parser) parseStringTerm(tok *token) (*SearchExpression, error) {
+	lowered := strings.ToLower(tok.value)
+	if p.peek() == tokenEquals || p.peek() == tokenNotEquals {
+		negated := p.take().typ == tokenNotEquals
+		if p.peek() != tokenString && p.peek() != tokenQuotedString {
+			return nil, p.errorf("unexpected token, expected string or quoted string after =")
+		}
+		value := p.take()
+		if value.typ == tokenString && value.value == "*" {
+			// field=* matches any value, so it is the same as checking whether the event has the field
+			return &SearchExpression{Type: SearchExpressionExists, Negated: negated, Field: lowered}, nil
+		}
+		return &SearchExpression{Type: SearchExpressionField, Negated: negated, Field: lowered, Values: []string{value.value}}, nil
+	}
+	if p.peek() == tokenRegexEquals || p.peek() == tokenRegexNotEquals {
+		op := p.take()
+		if p.peek() != tokenString && p.peek() != tokenQuotedString {
+			return nil, p.errorf("unexpected token, expected regular expression after %v", op.value)
+		}
+		value := p.take()
+		_, err := regexp.Compile(value.value)
+		if err != nil {
+			return nil, tokenErrorf(value, "invalid regular expression for field %v: %v", lowered, err)
+		}
+		return &SearchExpression{
+			Type:    SearchExpressionRegex,
+			Negated: op.typ == tokenRegexNotEquals,
+			Regex: &FieldRegex{
+				Field:   lowered,
+				Pattern: value.value,
+			},
+		}, nil
+	}
+	if op, ok := comparisonTokens[p.peek()]; ok {
+		p.take()
+		if p.peek() != tokenString && p.peek() != tokenQuotedString {
+			return nil, p.errorf("unexpected token, expected number after %v", op)
+		}
+		value := p.take()
+		f, err := strconv.ParseFloat(value.value, 64)
+		if err != nil {
+			return nil, tokenErrorf(value, "expected number after %v but got '%v'", op, value.value)
+		}
+		return &SearchExpression{
+			Type: SearchExpressionComparison,
+			Comparison: &FieldComparison{
+				Field:    lowered,
+				Operator: op,
+				Value:    f,
+			},
+		}, nil
+	}
+	if p.peek() == tokenWhitespace {
+		next := p.nonWhitespaceIndex(0)
+		if p.isKeywordAt(next, "IN") {
+			p.skipWhitespace()
+			p.take()
+			p.skipWhitespace()
+			values, err := p.parseParenList()
+			if err != nil {
+				return nil, fmt.Errorf("error while parsing IN expression: %w", err)
+			}
+			return &SearchExpression{Type: SearchExpressionField, Field: lowered, Values: values}, nil
+		} else if p.isKeywordAt(next, "NOT") && p.isKeywordAt(p.nonWhitespaceIndex(next+1), "IN") {
+			p.skipWhitespace()
+			p.take()
+			p.skipWhitespace()
+			p.take()
+			p.skipWhitespace()
+			values, err := p.parseParenList()
+			if err != nil {
+				return nil, fmt.Errorf("error while parsing NOT IN expression: %w", err)
+			}
+			return &SearchExpression{Type: SearchExpressionField, Negated: true, Field: lowered, Values: values}, nil
+		}
+	}
+	return &SearchExpression{Type: SearchExpressionFragment, Fragment: tok.value}, nil
+}
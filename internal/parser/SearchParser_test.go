@@ -0,0 +1,302 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearch_FieldComparisons(t *testing.T) {
+	res, err := ParseSearch("Status>=500 responsetime<0.25 error")
+	if err != nil {
+		t.Fatalf("TestParseSearch_FieldComparisons got unexpected error: %v", err)
+	}
+	expected := []FieldComparison{
+		{Field: "status", Operator: ComparisonGreaterOrEquals, Value: 500},
+		{Field: "responsetime", Operator: ComparisonLess, Value: 0.25},
+	}
+	if !reflect.DeepEqual(res.FieldComparisons, expected) {
+		t.Fatalf("TestParseSearch_FieldComparisons expected comparisons=%v but got %v", expected, res.FieldComparisons)
+	}
+	if _, ok := res.Fragments["error"]; !ok || len(res.Fragments) != 1 {
+		t.Fatalf("TestParseSearch_FieldComparisons expected fragments to only contain 'error' but got %v", res.Fragments)
+	}
+}
+
+func TestParseSearch_FieldComparisonNotNumeric(t *testing.T) {
+	for _, input := range []string{"status>abc", "status<=", "status> 5"} {
+		_, err := ParseSearch(input)
+		if err == nil {
+			t.Errorf("TestParseSearch_FieldComparisonNotNumeric expected error when parsing '%v' but got nil", input)
+		}
+	}
+}
+
+func TestFieldComparison_Matches(t *testing.T) {
+	for _, tt := range []struct {
+		comparison FieldComparison
+		value      string
+		expected   bool
+	}{
+		{FieldComparison{"f", ComparisonGreater, 500}, "501", true},
+		{FieldComparison{"f", ComparisonGreater, 500}, "500", false},
+		{FieldComparison{"f", ComparisonGreaterOrEquals, 500}, "500", true},
+		{FieldComparison{"f", ComparisonGreaterOrEquals, 500}, "499.9", false},
+		{FieldComparison{"f", ComparisonLess, 0.5}, "0.4", true},
+		{FieldComparison{"f", ComparisonLess, 0.5}, "0.5", false},
+		{FieldComparison{"f", ComparisonLessOrEquals, 0.5}, "0.50", true},
+		{FieldComparison{"f", ComparisonGreater, 0}, "abc", false},
+	} {
+		if actual := tt.comparison.Matches(tt.value); actual != tt.expected {
+			t.Errorf("TestFieldComparison_Matches expected %v%v%v to be %v but got %v", tt.value, tt.comparison.Operator, tt.comparison.Value, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseSearch_Expression(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected string
+	}{
+		{"", "AND()"},
+		{"error", "AND(error)"},
+		{"error warning", "AND(error warning)"},
+		{"error OR warning", "AND(OR(error warning))"},
+		{"a b OR c", "AND(OR(AND(a b) c))"},
+		{"a OR b c", "AND(OR(a AND(b c)))"},
+		{"a (b OR c)", "AND(a OR(b c))"},
+		{"(status=500 OR status=503) path=/api", "AND(OR(status=500 status=503) path=/api)"},
+		{"(a OR (b (c OR d))) e", "AND(OR(a AND(b OR(c d))) e)"},
+		{"NOT (a OR b)", "AND(NOT OR(a b))"},
+		{"NOT (status=500 path=/health)", "AND(NOT AND(status=500 path=/health))"},
+		{"error NOT (status=500 \"health check\")", "AND(error NOT AND(status=500 health check))"},
+		{"NOT a OR b", "AND(OR(NOT a b))"},
+		{"a NOT b", "AND(a NOT b)"},
+		{"host NOT IN (x, y) OR status>=500", "AND(OR(host!=x|y status>=500))"},
+		{"\"hello world\" OR source IN (a, b)", "AND(OR(hello world source=a|b))"},
+		{"Path=~\"^/api/v[0-9]+\" user!~adm", "AND(path=~^/api/v[0-9]+ NOT user=~adm)"},
+		{"User=* trace_id!=* NOT session=* path=\"*\"", "AND(user=* NOT trace_id=* NOT session=* path=*)"},
+	} {
+		res, err := ParseSearch(tt.input)
+		if err != nil {
+			t.Errorf("TestParseSearch_Expression got unexpected error when parsing '%v': %v", tt.input, err)
+			continue
+		}
+		if actual := expressionString(res.Expression); actual != tt.expected {
+			t.Errorf("TestParseSearch_Expression expected '%v' to parse to %v but got %v", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseSearch_ExpressionErrors(t *testing.T) {
+	for _, input := range []string{"a OR", "OR a", "(a OR b", "a)", "()", "a (OR b)", "NOT", "(NOT)"} {
+		_, err := ParseSearch(input)
+		if err == nil {
+			t.Errorf("TestParseSearch_ExpressionErrors expected error when parsing '%v' but got nil", input)
+		}
+	}
+}
+
+func TestParseSearch_FlattensTopLevelTerms(t *testing.T) {
+	res, err := ParseSearch("error NOT debug host=web01 (status=500 OR status=503)")
+	if err != nil {
+		t.Fatalf("TestParseSearch_FlattensTopLevelTerms got unexpected error: %v", err)
+	}
+	if _, ok := res.Fragments["error"]; !ok || len(res.Fragments) != 1 {
+		t.Errorf("TestParseSearch_FlattensTopLevelTerms expected fragments to only contain 'error' but got %v", res.Fragments)
+	}
+	if _, ok := res.NotFragments["debug"]; !ok || len(res.NotFragments) != 1 {
+		t.Errorf("TestParseSearch_FlattensTopLevelTerms expected not fragments to only contain 'debug' but got %v", res.NotFragments)
+	}
+	if _, ok := res.Hosts["web01"]; !ok || len(res.Hosts) != 1 {
+		t.Errorf("TestParseSearch_FlattensTopLevelTerms expected hosts to only contain 'web01' but got %v", res.Hosts)
+	}
+	if _, ok := res.Fields["status"]; ok {
+		t.Errorf("TestParseSearch_FlattensTopLevelTerms expected status inside OR group to not be flattened into fields but got %v", res.Fields)
+	}
+	if len(res.Groups) != 1 || expressionString(res.Groups[0]) != "OR(status=500 status=503)" {
+		t.Errorf("TestParseSearch_FlattensTopLevelTerms expected a single OR group but got %v", res.Groups)
+	}
+}
+
+func TestParseSearch_Phrases(t *testing.T) {
+	for _, tt := range []struct {
+		input            string
+		expectedFrags    []string
+		expectedNotFrags []string
+	}{
+		{"\"connection refused\"", []string{"connection refused"}, nil},
+		{"error \"connection refused\"", []string{"error", "connection refused"}, nil},
+		{"NOT \"connection refused\"", nil, []string{"connection refused"}},
+		{"\"status=500 path=/api\"", []string{"status=500 path=/api"}, nil},
+		{"\"a OR b\"", []string{"a OR b"}, nil},
+		{"\"said \\\"hello world\\\" twice\"", []string{"said \"hello world\" twice"}, nil},
+	} {
+		res, err := ParseSearch(tt.input)
+		if err != nil {
+			t.Fatalf("TestParseSearch_Phrases got unexpected error when parsing '%v': %v", tt.input, err)
+		}
+		if len(res.Fragments) != len(tt.expectedFrags) || len(res.NotFragments) != len(tt.expectedNotFrags) {
+			t.Fatalf("TestParseSearch_Phrases expected fragments=%v and notFragments=%v when parsing '%v' but got %v and %v", tt.expectedFrags, tt.expectedNotFrags, tt.input, res.Fragments, res.NotFragments)
+		}
+		for _, f := range tt.expectedFrags {
+			if _, ok := res.Fragments[f]; !ok {
+				t.Fatalf("TestParseSearch_Phrases expected fragments=%v when parsing '%v' but got %v", tt.expectedFrags, tt.input, res.Fragments)
+			}
+		}
+		for _, f := range tt.expectedNotFrags {
+			if _, ok := res.NotFragments[f]; !ok {
+				t.Fatalf("TestParseSearch_Phrases expected notFragments=%v when parsing '%v' but got %v", tt.expectedNotFrags, tt.input, res.NotFragments)
+			}
+		}
+		if len(res.Fields) != 0 {
+			t.Fatalf("TestParseSearch_Phrases expected no fields when parsing '%v' but got %v", tt.input, res.Fields)
+		}
+	}
+
+	_, err := ParseSearch("error \"\"")
+	if err == nil {
+		t.Fatalf("TestParseSearch_Phrases expected error when parsing an empty phrase but got nil")
+	}
+}
+
+func expressionString(expr *SearchExpression) string {
+	prefix := ""
+	if expr.Negated && expr.Type != SearchExpressionField {
+		prefix = "NOT "
+	}
+	switch expr.Type {
+	case SearchExpressionAnd, SearchExpressionOr:
+		name := "AND"
+		if expr.Type == SearchExpressionOr {
+			name = "OR"
+		}
+		children := make([]string, len(expr.Children))
+		for i, child := range expr.Children {
+			children[i] = expressionString(child)
+		}
+		return prefix + name + "(" + strings.Join(children, " ") + ")"
+	case SearchExpressionFragment:
+		return prefix + expr.Fragment
+	case SearchExpressionField:
+		op := "="
+		if expr.Negated {
+			op = "!="
+		}
+		return expr.Field + op + strings.Join(expr.Values, "|")
+	case SearchExpressionComparison:
+		return prefix + fmt.Sprintf("%v%v%v", expr.Comparison.Field, expr.Comparison.Operator, expr.Comparison.Value)
+	case SearchExpressionRegex:
+		return prefix + expr.Regex.Field + "=~" + expr.Regex.Pattern
+	case SearchExpressionExists:
+		return prefix + expr.Field + "=*"
+	}
+	return "?"
+}
+
+func TestParseSearch_EqualsIsNotComparison(t *testing.T) {
+	res, err := ParseSearch("status=500 code!=404")
+	if err != nil {
+		t.Fatalf("TestParseSearch_EqualsIsNotComparison got unexpected error: %v", err)
+	}
+	if len(res.FieldComparisons) != 0 {
+		t.Fatalf("TestParseSearch_EqualsIsNotComparison expected no comparisons but got %v", res.FieldComparisons)
+	}
+	if !reflect.DeepEqual(res.Fields["status"], []string{"500"}) || !reflect.DeepEqual(res.NotFields["code"], []string{"404"}) {
+		t.Fatalf("TestParseSearch_EqualsIsNotComparison expected status=500 and code!=404 to be field matches but got fields=%v, notFields=%v", res.Fields, res.NotFields)
+	}
+}
+
+func TestParseSearch_RepeatedField(t *testing.T) {
+	res, err := ParseSearch("status=500 host=web1 status=503 source=a.log status IN (504, 505) source=b.log")
+	if err != nil {
+		t.Fatalf("TestParseSearch_RepeatedField got unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Fields["status"], []string{"500", "503", "504", "505"}) {
+		t.Fatalf("TestParseSearch_RepeatedField expected status to have every value but got %v", res.Fields["status"])
+	}
+	if !reflect.DeepEqual(res.Fields["host"], []string{"web1"}) {
+		t.Fatalf("TestParseSearch_RepeatedField expected host to have a single value but got %v", res.Fields["host"])
+	}
+	if !reflect.DeepEqual(res.Sources, map[string]struct{}{"a.log": {}, "b.log": {}}) {
+		t.Fatalf("TestParseSearch_RepeatedField expected both sources but got %v", res.Sources)
+	}
+}
+
+func TestParseSearch_Regex(t *testing.T) {
+	res, err := ParseSearch("path=~\"^/api/v[0-9]+$\" error")
+	if err != nil {
+		t.Fatalf("TestParseSearch_Regex got unexpected error: %v", err)
+	}
+	if len(res.Fields) != 0 {
+		t.Fatalf("TestParseSearch_Regex expected the regex to not be added to fields but got %v", res.Fields)
+	}
+	if len(res.Groups) != 1 || res.Groups[0].Type != SearchExpressionRegex {
+		t.Fatalf("TestParseSearch_Regex expected a single regex group but got %v", res.Groups)
+	}
+	expected := &FieldRegex{Field: "path", Pattern: "^/api/v[0-9]+$"}
+	if !reflect.DeepEqual(res.Groups[0].Regex, expected) {
+		t.Fatalf("TestParseSearch_Regex expected regex=%+v but got %+v", expected, res.Groups[0].Regex)
+	}
+}
+
+func TestParseSearch_InvalidRegex(t *testing.T) {
+	for _, input := range []string{"path=~\"[a-\"", "path=~\"(unclosed\"", "path!~\"*\"", "path=~", "path=~ x"} {
+		_, err := ParseSearch(input)
+		if err == nil {
+			t.Errorf("TestParseSearch_InvalidRegex expected error when parsing '%v' but got nil", input)
+		}
+	}
+	_, err := ParseSearch("path=~\"[a-\"")
+	if err == nil || !strings.Contains(err.Error(), "invalid regular expression for field path") {
+		t.Errorf("TestParseSearch_InvalidRegex expected error to say which field had an invalid regular expression but got %v", err)
+	}
+}
+
+func TestParseSearch_ParseError(t *testing.T) {
+	for _, tt := range []struct {
+		input          string
+		expectedToken  string
+		expectedOffset int
+	}{
+		{"status=\"500", "\"500", 7},
+		{"error \"", "\"", 6},
+		{"a ! b", "!", 2},
+		{"status! =500", "!", 6},
+		{"error OR", "OR", 6},
+		{"OR error", "OR", 0},
+		{"(a OR b", "", 7},
+		{"a) b", ")", 1},
+		{"a ()", "(", 2},
+		{"status>=abc", "abc", 8},
+		{"path=~\"[a-\"", "\"[a-\"", 6},
+		{"a NOT", "NOT", 2},
+	} {
+		_, err := ParseSearch(tt.input)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("TestParseSearch_ParseError expected a ParseError when parsing '%v' but got %v", tt.input, err)
+			continue
+		}
+		if parseErr.Token != tt.expectedToken || parseErr.Offset != tt.expectedOffset {
+			t.Errorf("TestParseSearch_ParseError expected token='%v' at offset %v when parsing '%v' but got token='%v' at offset %v",
+				tt.expectedToken, tt.expectedOffset, tt.input, parseErr.Token, parseErr.Offset)
+		}
+	}
+}
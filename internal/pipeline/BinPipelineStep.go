@@ -0,0 +1,126 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type binPipelineStep struct {
+	field string
+	span  float64
+	// decimals is the number of decimals in span, which the lower bounds are rounded to so that e.g. a span of 0.1
+	// gives 0.3 instead of 0.30000000000000004.
+	decimals       int
+	dropNonNumeric bool
+}
+
+func (s *binPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			for _, evt := range res.Events {
+				value, ok := evt.Fields[s.field]
+				if !ok {
+					continue
+				}
+				f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+					if s.dropNonNumeric {
+						delete(evt.Fields, s.field)
+					}
+					continue
+				}
+				evt.Fields[s.field] = s.bin(f)
+			}
+			select {
+			case pipe.output <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// bin returns the lower bound of the bucket f is in.
+func (s *binPipelineStep) bin(f float64) string {
+	q := f / s.span
+	// A value on a boundary can end up just below it because of rounding, such as 0.3/0.1 giving 2.9999999999999996,
+	// so a quotient which is that close to a whole number is treated as being that number.
+	if r := math.Round(q); math.Abs(q-r) <= 1e-9*math.Max(1, math.Abs(q)) {
+		q = r
+	}
+	lower := math.Floor(q) * s.span
+	if lower == 0 {
+		// Values between -span and 0 are floored to -0, which would be formatted as "-0"
+		lower = 0
+	}
+	return strconv.FormatFloat(lower, 'f', s.decimals, 64)
+}
+
+func compileBinStep(input string, options map[string]string) (pipelineStep, error) {
+	// The options usually come after the field, as in "bin bytes span=1000", in which case they are part of the input
+	var fields []string
+	for _, word := range strings.Fields(input) {
+		if i := strings.Index(word, "="); i > 0 {
+			options[word[:i]] = word[i+1:]
+		} else {
+			fields = append(fields, word)
+		}
+	}
+	if len(fields) != 1 {
+		return nil, errors.New("failed to compile bin: expected a single field to bin")
+	}
+	spanString, ok := options["span"]
+	if !ok {
+		return nil, errors.New("failed to compile bin: span must be given, as in span=1000")
+	}
+	span, err := strconv.ParseFloat(spanString, 64)
+	if err != nil || span <= 0 || math.IsInf(span, 0) {
+		return nil, fmt.Errorf("failed to compile bin: span must be a positive number, got '%v'", spanString)
+	}
+	decimals := 0
+	if strings.ContainsAny(spanString, "eE") {
+		// The number of decimals is not obvious from the exponent form, so the shortest exact representation is used
+		decimals = -1
+	} else if i := strings.Index(spanString, "."); i != -1 {
+		decimals = len(spanString) - i - 1
+	}
+	var dropNonNumeric bool
+	if s, ok := options["dropNonNumeric"]; ok {
+		dropNonNumeric, err = strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile bin: dropNonNumeric must be true or false, got '%v'", s)
+		}
+	}
+	return &binPipelineStep{
+		field:          strings.ToLower(fields[0]),
+		span:           span,
+		decimals:       decimals,
+		dropNonNumeric: dropNonNumeric,
+	}, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestBinPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		input    string
+		options  map[string]string
+		values   []string
+		expected []string
+	}{
+		{"positive", "bytes span=1000", map[string]string{}, []string{"0", "999", "1000", "1001", "2500.5"}, []string{"0", "0", "1000", "1000", "2000"}},
+		{"negative", "bytes span=1000", map[string]string{}, []string{"-1", "-999", "-1000", "-1001"}, []string{"-1000", "-1000", "-1000", "-2000"}},
+		{"negative zero", "bytes span=10", map[string]string{}, []string{"-0", "-0.5"}, []string{"0", "-10"}},
+		{"fractional span", "latency span=0.1", map[string]string{}, []string{"0.35", "0.3", "1.99"}, []string{"0.3", "0.3", "1.9"}},
+		{"option before field", "bytes", map[string]string{"span": "100"}, []string{"150"}, []string{"100"}},
+		{"non-numeric kept", "bytes span=1000", map[string]string{}, []string{"-", "1500", ""}, []string{"-", "1000", ""}},
+		{"non-numeric dropped", "bytes span=1000 dropNonNumeric=true", map[string]string{}, []string{"-", "1500", ""}, []string{"<missing>", "1000", "<missing>"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := compileBinStep(tt.input, tt.options)
+			if err != nil {
+				t.Fatalf("TestBinPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go step.Execute(context.Background(), pipe, params)
+
+			go func() {
+				evts := make([]events.EventWithExtractedFields, len(tt.values))
+				for i, v := range tt.values {
+					evts[i] = events.EventWithExtractedFields{Id: int64(i), Raw: "raw", Fields: map[string]string{"bytes": v, "latency": v}}
+				}
+				input <- PipelineStepResult{Events: evts}
+				close(input)
+			}()
+
+			field := step.(*binPipelineStep).field
+			actual := []string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					if v, ok := evt.Fields[field]; ok {
+						actual = append(actual, v)
+					} else {
+						actual = append(actual, "<missing>")
+					}
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestBinPipelineStep expected values=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestBinPipelineStep_CompileErrors(t *testing.T) {
+	for _, input := range []string{"", "bytes", "bytes span=0", "bytes span=-10", "bytes span=abc", "bytes status span=10", "bytes span=10 dropNonNumeric=maybe"} {
+		_, err := compileBinStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestBinPipelineStep_CompileErrors expected error for input=%v but got nil", input)
+		}
+	}
+}
+
+func TestBinPipelineStep_Pipeline(t *testing.T) {
+	p, err := CompilePipeline("error | bin Bytes span=1000 | stats count by bytes", nil, nil)
+	if err != nil {
+		t.Fatalf("TestBinPipelineStep_Pipeline got unexpected error: %v", err)
+	}
+	step := p.steps[1].(*binPipelineStep)
+	if step.field != "bytes" || step.span != 1000 {
+		t.Fatalf("TestBinPipelineStep_Pipeline expected field=bytes and span=1000 but got field=%v and span=%v", step.field, step.span)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// Count returns the number of events matching srch between startTime and endTime without returning the events.
+//
+// If srch only filters on hosts, sources and fragments the count is done by the repository, e.g. as a COUNT(*) in SQL.
+// The repository matches fragments using full text search while a search step also matches them as substrings in
+// the raw event. This means that the count can be slightly higher than the number of events returned by a search,
+// for example "log.txt" matches "log-txt" using full text search but not as a substring.
+// If srch contains any field predicates or fragments with wildcards that full text search can not express, or is
+// restricted to a set of ids, all matching events have to be streamed and have their fields extracted, and the count
+// is exact.
+func Count(ctx context.Context, repo events.Repository, cfg *config.Config, srch *search.Search, startTime, endTime *time.Time) (int64, error) {
+	startTime, endTime = searchTimeRange(srch, startTime, endTime)
+	logger := logging.OrDefault(cfg.Logger)
+	compiledFrags := compileWildcardFrags(srch.Fragments, cfg.CaseSensitive, logger)
+	compiledNotFrags := compileWildcardFrags(srch.NotFragments, cfg.CaseSensitive, logger)
+	if srch.Ids == nil && len(srch.Fields) == 0 && len(srch.NotFields) == 0 && len(srch.FieldComparisons) == 0 && len(srch.Groups) == 0 &&
+		len(compiledFrags) == 0 && len(compiledNotFrags) == 0 {
+		return repo.Count(ctx, srch, startTime, endTime)
+	}
+
+	var count int64
+	err := forEachMatchingEvent(ctx, repo, cfg, srch, startTime, endTime, func(evtFields map[string]string) {
+		count++
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// forEachMatchingEvent calls fn with the fields of every event matching srch between startTime and endTime, the same
+// way a search step filters them. startTime and endTime must already include the time range of srch.
+func forEachMatchingEvent(ctx context.Context, repo events.Repository, cfg *config.Config, srch *search.Search, startTime, endTime *time.Time, fn func(evtFields map[string]string)) error {
+	logger := logging.OrDefault(cfg.Logger)
+	compiledFrags := compileWildcardFrags(srch.Fragments, cfg.CaseSensitive, logger)
+	compiledNotFrags := compileWildcardFrags(srch.NotFragments, cfg.CaseSensitive, logger)
+	compiledFields := compileFieldValues(srch.Fields, cfg.CaseSensitive, logger)
+	compiledNotFields := compileFieldValues(srch.NotFields, cfg.CaseSensitive, logger)
+	compiledGroups := compileExpressions(srch.Groups, cfg.CaseSensitive, logger)
+	for page := range filterStream(ctx, repo, cfg, repositorySearch(srch, cfg.CaseSensitive), startTime, endTime) {
+		if page.Err != nil {
+			return fmt.Errorf("error searching events: %w", page.Err)
+		}
+		for _, evt := range page.Events {
+			if evtFields, include := shouldIncludeEvent(evt, cfg, compiledFrags, compiledNotFrags, nil, compiledFields, compiledNotFields, srch.FieldComparisons, compiledGroups); include {
+				fn(evtFields)
+			}
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestCount(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{
+		"ERROR status=500 path=/api",
+		"warning status=503 path=/api",
+		"info status=200 path=/api",
+		"error status=500 path=/health",
+		"info status=200 path=/health",
+	}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		source := "access.txt"
+		if i%2 == 1 {
+			source = "other.txt"
+		}
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    source,
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=([\\w./]+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected int64
+	}{
+		{"", 5},
+		{"error", 2},
+		{"NOT info", 3},
+		{"source=access.txt", 3},
+		{"source=access.txt NOT error", 2},
+		{"status=500", 2},
+		{"*rror", 2},
+		{"NOT *nfo", 3},
+		{"source=*.txt", 5},
+		{"status>=500 path=/api", 2},
+		{"error OR warning", 3},
+		{"source=other.txt status!=200", 2},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			srch, err := search.Parse(tt.search)
+			if err != nil {
+				t.Fatalf("TestCount got unexpected error when parsing search: %v", err)
+			}
+			count, err := Count(context.Background(), repo, params.Cfg, srch, nil, nil)
+			if err != nil {
+				t.Fatalf("TestCount got unexpected error: %v", err)
+			}
+			if count != tt.expected {
+				t.Fatalf("TestCount expected count=%v but got %v", tt.expected, count)
+			}
+
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestCount got unexpected error when compiling search step: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+			go sps.Execute(context.Background(), pipe, params)
+			var streamed int64
+			for res := range output {
+				streamed += int64(len(res.Events))
+			}
+			if count != streamed {
+				t.Fatalf("TestCount expected count to equal the number of streamed events=%v but got %v", streamed, count)
+			}
+		})
+	}
+}
+
+func TestCount_Ids(t *testing.T) {
+	repo := newInMemRepo(t)
+	evts := make([]events.Event, 10)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:       "log event",
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+
+	srch, err := search.Parse("log")
+	if err != nil {
+		t.Fatalf("TestCount_Ids got unexpected error when parsing search: %v", err)
+	}
+	srch.Ids = []int64{2, 4, 6, 42}
+	count, err := Count(context.Background(), repo, &config.Config{}, srch, nil, nil)
+	if err != nil {
+		t.Fatalf("TestCount_Ids got unexpected error: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("TestCount_Ids expected count=3 but got %v", count)
+	}
+}
+
+func TestCount_TimeRange(t *testing.T) {
+	repo := newInMemRepo(t)
+	evts := make([]events.Event, 10)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:       "log event",
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+
+	startTime := time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)
+	endTime := time.Date(2021, 1, 20, 20, 29, 5, 0, time.UTC)
+	count, err := Count(context.Background(), repo, &config.Config{}, &search.Search{}, &startTime, &endTime)
+	if err != nil {
+		t.Fatalf("TestCount_TimeRange got unexpected error: %v", err)
+	}
+	if count != 4 {
+		t.Fatalf("TestCount_TimeRange expected count=4 but got %v", count)
+	}
+}
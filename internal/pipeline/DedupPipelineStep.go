@@ -0,0 +1,73 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+type dedupPipelineStep struct {
+	fields []string
+}
+
+func (s *dedupPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	// Only the keys are kept rather than the events, but this still grows with the number of unique values
+	seen := map[string]struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			ret := make([]events.EventWithExtractedFields, 0, len(res.Events))
+			for _, evt := range res.Events {
+				key := s.key(evt)
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				ret = append(ret, evt)
+			}
+			res.Events = ret
+			pipe.output <- res
+		}
+	}
+}
+
+func (s *dedupPipelineStep) key(evt events.EventWithExtractedFields) string {
+	if len(s.fields) == 0 {
+		return evt.Raw
+	}
+	// A missing field is treated the same as an empty value
+	values := make([]string, len(s.fields))
+	for i, f := range s.fields {
+		values[i] = evt.Fields[f]
+	}
+	return strings.Join(values, "\x00")
+}
+
+func compileDedupStep(input string, options map[string]string) (pipelineStep, error) {
+	fields := strings.Fields(strings.ToLower(input))
+	return &dedupPipelineStep{
+		fields: fields,
+	}, nil
+}
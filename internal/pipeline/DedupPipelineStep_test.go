@@ -0,0 +1,90 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestDedupPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedIds []int64
+	}{
+		{"", []int64{1, 2, 4, 5}},
+		{"host", []int64{1, 3, 5}},
+		{"host UserId", []int64{1, 2, 3, 4, 5}},
+		{"missing", []int64{1}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			dps, err := compileDedupStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestDedupPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go dps.Execute(context.Background(), pipe, params)
+
+			// Split over two results to make sure duplicates are detected across batches
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 1, Raw: "user logged in", Fields: map[string]string{"host": "a", "userid": "1"}},
+						{Id: 2, Raw: "user logged out", Fields: map[string]string{"host": "a", "userid": "2"}},
+						{Id: 3, Raw: "user logged in", Fields: map[string]string{"host": "b", "userid": "1"}},
+					},
+				}
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 4, Raw: "user logged in again", Fields: map[string]string{"host": "a", "userid": "3"}},
+						{Id: 5, Raw: "user logged off", Fields: map[string]string{"host": "c", "userid": "1"}},
+					},
+				}
+				close(input)
+			}()
+
+			actualIds := []int64{}
+			for i := 0; i < 2; i++ {
+				result, ok := <-output
+				if !ok {
+					t.Fatal("TestDedupPipelineStep got unexpected !ok when receiving output")
+				}
+				for _, evt := range result.Events {
+					actualIds = append(actualIds, evt.Id)
+				}
+			}
+			_, ok := <-output
+			if ok {
+				t.Fatal("TestDedupPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+			if len(actualIds) != len(tt.expectedIds) {
+				t.Fatalf("TestDedupPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+			for i := range actualIds {
+				if actualIds[i] != tt.expectedIds[i] {
+					t.Fatalf("TestDedupPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+				}
+			}
+		})
+	}
+}
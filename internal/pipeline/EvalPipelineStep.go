@@ -0,0 +1,443 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+type evalAssignment struct {
+	field string
+	expr  evalExpr
+}
+
+type evalPipelineStep struct {
+	assignments []evalAssignment
+}
+
+func (s *evalPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			for i := range res.Events {
+				evt := &res.Events[i]
+				if evt.Fields == nil {
+					evt.Fields = map[string]string{}
+				}
+				for _, a := range s.assignments {
+					// Assignments are done in order, so a later one can use the field set by an earlier one
+					v, ok := a.expr.eval(evt)
+					if ok {
+						evt.Fields[a.field] = v.String()
+					} else {
+						delete(evt.Fields, a.field)
+					}
+				}
+			}
+			select {
+			case pipe.output <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// evalValue is the result of evaluating an expression. Field values are strings, which are only treated as numbers
+// by the arithmetic operators.
+type evalValue struct {
+	str   string
+	num   float64
+	isNum bool
+}
+
+func (v evalValue) String() string {
+	if v.isNum {
+		return strconv.FormatFloat(v.num, 'f', -1, 64)
+	}
+	return v.str
+}
+
+func (v evalValue) number() (float64, bool) {
+	if v.isNum {
+		return v.num, true
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v.str), 64)
+	return f, err == nil
+}
+
+// evalExpr is a compiled eval expression. eval returns false if the expression has no value for the event, because
+// a field it uses is missing or is not a number where a number is needed.
+type evalExpr interface {
+	eval(evt *events.EventWithExtractedFields) (evalValue, bool)
+}
+
+type evalField struct {
+	name string
+}
+
+func (e *evalField) eval(evt *events.EventWithExtractedFields) (evalValue, bool) {
+	if e.name == "_raw" {
+		return evalValue{str: evt.Raw}, true
+	}
+	v, ok := evt.Fields[e.name]
+	return evalValue{str: v}, ok
+}
+
+type evalLiteral struct {
+	value evalValue
+}
+
+func (e *evalLiteral) eval(evt *events.EventWithExtractedFields) (evalValue, bool) {
+	return e.value, true
+}
+
+type evalBinary struct {
+	op          string
+	left, right evalExpr
+}
+
+func (e *evalBinary) eval(evt *events.EventWithExtractedFields) (evalValue, bool) {
+	l, ok := e.left.eval(evt)
+	if !ok {
+		return evalValue{}, false
+	}
+	r, ok := e.right.eval(evt)
+	if !ok {
+		return evalValue{}, false
+	}
+	if e.op == "." {
+		return evalValue{str: l.String() + r.String()}, true
+	}
+	lf, ok := l.number()
+	if !ok {
+		return evalValue{}, false
+	}
+	rf, ok := r.number()
+	if !ok {
+		return evalValue{}, false
+	}
+	var f float64
+	switch e.op {
+	case "+":
+		f = lf + rf
+	case "-":
+		f = lf - rf
+	case "*":
+		f = lf * rf
+	case "/":
+		f = lf / rf
+	case "%":
+		f = math.Mod(lf, rf)
+	}
+	// Dividing by zero does not give a value, rather than one which can not be used by the rest of the pipeline
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return evalValue{}, false
+	}
+	return evalValue{num: f, isNum: true}, true
+}
+
+type evalNegate struct {
+	expr evalExpr
+}
+
+func (e *evalNegate) eval(evt *events.EventWithExtractedFields) (evalValue, bool) {
+	v, ok := e.expr.eval(evt)
+	if !ok {
+		return evalValue{}, false
+	}
+	f, ok := v.number()
+	if !ok {
+		return evalValue{}, false
+	}
+	return evalValue{num: -f, isNum: true}, true
+}
+
+var evalFunctions = map[string]func(v evalValue) evalValue{
+	"len": func(v evalValue) evalValue {
+		return evalValue{num: float64(utf8.RuneCountInString(v.String())), isNum: true}
+	},
+	"lower": func(v evalValue) evalValue {
+		return evalValue{str: strings.ToLower(v.String())}
+	},
+	"upper": func(v evalValue) evalValue {
+		return evalValue{str: strings.ToUpper(v.String())}
+	},
+}
+
+type evalCall struct {
+	fn  func(v evalValue) evalValue
+	arg evalExpr
+}
+
+func (e *evalCall) eval(evt *events.EventWithExtractedFields) (evalValue, bool) {
+	v, ok := e.arg.eval(evt)
+	if !ok {
+		return evalValue{}, false
+	}
+	return e.fn(v), true
+}
+
+type evalTokenType int
+
+const (
+	evalTokenNumber evalTokenType = iota
+	evalTokenString
+	evalTokenIdent
+	evalTokenOperator
+	evalTokenLparen
+	evalTokenRparen
+	evalTokenComma
+	evalTokenEquals
+	evalTokenEnd
+)
+
+type evalToken struct {
+	typ   evalTokenType
+	value string
+	// offset is the byte offset of the token in the input
+	offset int
+}
+
+func tokenizeEval(input string) ([]evalToken, error) {
+	var tokens []evalToken
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r >= '0' && r <= '9':
+			end := i
+			for end < len(input) && (input[end] >= '0' && input[end] <= '9' || input[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, evalToken{typ: evalTokenNumber, value: input[i:end], offset: i})
+			i = end
+		case r == '_' || unicode.IsLetter(r):
+			end := i
+			for end < len(input) {
+				r, size := utf8.DecodeRuneInString(input[end:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, evalToken{typ: evalTokenIdent, value: input[i:end], offset: i})
+			i = end
+		case r == '"':
+			var sb strings.Builder
+			end := i + 1
+			for ; end < len(input) && input[end] != '"'; end++ {
+				if input[end] == '\\' && end+1 < len(input) {
+					end++
+				}
+				sb.WriteByte(input[end])
+			}
+			if end == len(input) {
+				return nil, fmt.Errorf("unclosed quote at position %v", i)
+			}
+			tokens = append(tokens, evalToken{typ: evalTokenString, value: sb.String(), offset: i})
+			i = end + 1
+		case strings.ContainsRune("+-*/%.", r):
+			tokens = append(tokens, evalToken{typ: evalTokenOperator, value: string(r), offset: i})
+			i++
+		case r == '(':
+			tokens = append(tokens, evalToken{typ: evalTokenLparen, value: "(", offset: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, evalToken{typ: evalTokenRparen, value: ")", offset: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, evalToken{typ: evalTokenComma, value: ",", offset: i})
+			i++
+		case r == '=':
+			tokens = append(tokens, evalToken{typ: evalTokenEquals, value: "=", offset: i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %v", r, i)
+		}
+	}
+	return append(tokens, evalToken{typ: evalTokenEnd, offset: len(input)}), nil
+}
+
+type evalParser struct {
+	tokens []evalToken
+}
+
+func (p *evalParser) peek() evalToken {
+	return p.tokens[0]
+}
+
+func (p *evalParser) take() evalToken {
+	tok := p.tokens[0]
+	if tok.typ != evalTokenEnd {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *evalParser) errorf(format string, args ...interface{}) error {
+	tok := p.peek()
+	found := "end of input"
+	if tok.typ != evalTokenEnd {
+		found = "'" + tok.value + "'"
+	}
+	return fmt.Errorf("%v but found %v at position %v", fmt.Sprintf(format, args...), found, tok.offset)
+}
+
+func (p *evalParser) isOperator(ops ...string) bool {
+	tok := p.peek()
+	if tok.typ != evalTokenOperator {
+		return false
+	}
+	for _, op := range ops {
+		if tok.value == op {
+			return true
+		}
+	}
+	return false
+}
+
+// The operators from lowest to highest precedence are ".", which concatenates strings, "+" and "-", and "*", "/" and
+// "%". They are all left associative.
+func (p *evalParser) parseExpr() (evalExpr, error) {
+	return p.parseBinary([][]string{{"."}, {"+", "-"}, {"*", "/", "%"}})
+}
+
+func (p *evalParser) parseBinary(levels [][]string) (evalExpr, error) {
+	if len(levels) == 0 {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(levels[1:])
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(levels[0]...) {
+		op := p.take().value
+		right, err := p.parseBinary(levels[1:])
+		if err != nil {
+			return nil, err
+		}
+		left = &evalBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *evalParser) parseUnary() (evalExpr, error) {
+	if p.isOperator("-") {
+		p.take()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &evalNegate{expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *evalParser) parsePrimary() (evalExpr, error) {
+	switch p.peek().typ {
+	case evalTokenNumber:
+		tok := p.take()
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%v' at position %v", tok.value, tok.offset)
+		}
+		return &evalLiteral{value: evalValue{num: f, isNum: true}}, nil
+	case evalTokenString:
+		return &evalLiteral{value: evalValue{str: p.take().value}}, nil
+	case evalTokenIdent:
+		tok := p.take()
+		name := strings.ToLower(tok.value)
+		if p.peek().typ != evalTokenLparen {
+			return &evalField{name: name}, nil
+		}
+		fn, ok := evalFunctions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function '%v' at position %v, expected one of len, lower or upper", tok.value, tok.offset)
+		}
+		p.take()
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().typ != evalTokenRparen {
+			return nil, p.errorf("expected ')' after the argument to %v", name)
+		}
+		p.take()
+		return &evalCall{fn: fn, arg: arg}, nil
+	case evalTokenLparen:
+		p.take()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().typ != evalTokenRparen {
+			return nil, p.errorf("expected ')'")
+		}
+		p.take()
+		return expr, nil
+	}
+	return nil, p.errorf("expected a field, number, string or '('")
+}
+
+func compileEvalStep(input string, options map[string]string) (pipelineStep, error) {
+	tokens, err := tokenizeEval(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile eval: %w", err)
+	}
+	p := evalParser{tokens: tokens}
+	ret := evalPipelineStep{}
+	for {
+		if p.peek().typ != evalTokenIdent {
+			return nil, fmt.Errorf("failed to compile eval: %w", p.errorf("expected the name of a field"))
+		}
+		field := strings.ToLower(p.take().value)
+		if isBuiltinField(field) || field == "_raw" {
+			return nil, fmt.Errorf("failed to compile eval: the field %v can not be assigned to", field)
+		}
+		if p.peek().typ != evalTokenEquals {
+			return nil, fmt.Errorf("failed to compile eval: %w", p.errorf("expected '=' after %v", field))
+		}
+		p.take()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile eval: %w", err)
+		}
+		ret.assignments = append(ret.assignments, evalAssignment{field: field, expr: expr})
+		if p.peek().typ == evalTokenEnd {
+			return &ret, nil
+		}
+		if p.peek().typ != evalTokenComma {
+			return nil, fmt.Errorf("failed to compile eval: %w", p.errorf("expected ',' or the end of the expression"))
+		}
+		p.take()
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func executeEval(t *testing.T, input string, fields map[string]string) map[string]string {
+	step, err := compileEvalStep(input, map[string]string{})
+	if err != nil {
+		t.Fatalf("TestEvalPipelineStep got unexpected error when compiling '%v': %v", input, err)
+	}
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: newInMemRepo(t),
+	}
+	pipe, in, output := newPipe()
+
+	go step.Execute(context.Background(), pipe, params)
+
+	in <- PipelineStepResult{Events: []events.EventWithExtractedFields{{Id: 1, Raw: "raw event", Fields: fields}}}
+	close(in)
+	res, ok := <-output
+	if !ok {
+		t.Fatal("TestEvalPipelineStep got unexpected !ok when receiving output")
+	}
+	if len(res.Events) != 1 {
+		t.Fatalf("TestEvalPipelineStep expected 1 event but got %v", len(res.Events))
+	}
+	return res.Events[0].Fields
+}
+
+func TestEvalPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		fields   map[string]string
+		field    string
+		expected string
+	}{
+		{"ms=latency*1000", map[string]string{"latency": "1.5"}, "ms", "1500"},
+		{"x=1 + 2 * 3 - 4 / 2", nil, "x", "5"},
+		{"x=(1 + 2) * 3", nil, "x", "9"},
+		{"x=-latency % 3", map[string]string{"latency": "7"}, "x", "-1"},
+		{"x=a - -b", map[string]string{"a": "1", "b": "2"}, "x", "3"},
+		{"x=0.1 + 0.2", nil, "x", "0.30000000000000004"},
+		{"url=host . \"/\" . path", map[string]string{"host": "example.com", "path": "index.html"}, "url", "example.com/index.html"},
+		{"x=a . b + 1", map[string]string{"a": "1", "b": "2"}, "x", "13"},
+		{"x=\"say \\\"hi\\\"\"", nil, "x", "say \"hi\""},
+		{"n=len(user)", map[string]string{"user": "Åsa"}, "n", "3"},
+		{"u=upper(user), l=LOWER(u)", map[string]string{"user": "Alice"}, "l", "alice"},
+		{"u=upper(user), l=LOWER(u)", map[string]string{"user": "Alice"}, "u", "ALICE"},
+		{"size=len(_raw)", nil, "size", "9"},
+		{"Total=Bytes*2", map[string]string{"bytes": "21"}, "total", "42"},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			fields := executeEval(t, tt.input, tt.fields)
+			if v, ok := fields[tt.field]; !ok || v != tt.expected {
+				t.Fatalf("TestEvalPipelineStep expected %v='%v' but got fields %v", tt.field, tt.expected, fields)
+			}
+		})
+	}
+}
+
+func TestEvalPipelineStep_NoValue(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		field string
+	}{
+		{"x=missing + 1", "x"},
+		{"x=user * 2", "x"},
+		{"x=len(missing)", "x"},
+		{"x=status / 0", "x"},
+		{"x=-user", "x"},
+		// A field which already exists is removed rather than keeping its old value
+		{"status=missing", "status"},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			fields := executeEval(t, tt.input, map[string]string{"user": "alice", "status": "500"})
+			if v, ok := fields[tt.field]; ok {
+				t.Fatalf("TestEvalPipelineStep_NoValue expected %v to not be set but got '%v'", tt.field, v)
+			}
+		})
+	}
+}
+
+func TestCompileEvalStep_Errors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"x",
+		"x=",
+		"x=1 +",
+		"x=(1 + 2",
+		"x=foo(bar)",
+		"x=len(bar",
+		"x=1 y=2",
+		"x=\"unclosed",
+		"x=1 $ 2",
+		"host=1",
+		"_raw=1",
+		"1=2",
+	} {
+		_, err := compileEvalStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestCompileEvalStep_Errors expected an error when compiling '%v' but got nil", input)
+		}
+	}
+}
+
+func TestEvalPipelineStep_Pipeline(t *testing.T) {
+	p, err := CompilePipeline("error | eval ms=latency*1000, msg=\"took \" . ms", nil, nil)
+	if err != nil {
+		t.Fatalf("TestEvalPipelineStep_Pipeline got unexpected error: %v", err)
+	}
+	step := p.steps[1].(*evalPipelineStep)
+	if len(step.assignments) != 2 || step.assignments[0].field != "ms" || step.assignments[1].field != "msg" {
+		t.Fatalf("TestEvalPipelineStep_Pipeline got unexpected assignments %v", step.assignments)
+	}
+}
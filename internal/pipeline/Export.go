@@ -0,0 +1,198 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+const (
+	ExportFormatCSV       = "csv"
+	ExportFormatJSONLines = "jsonl"
+)
+
+// DefaultExportColumns are the columns which are exported if no columns are given.
+var DefaultExportColumns = []string{"_time", "host", "source", "_raw"}
+
+// Export writes the events in results to w, one row or JSON object per event, and returns the number of events
+// written. The columns are written in the given order and are either one of the fields of the events, or _time or
+// _raw for the timestamp and raw string of the event. An event which is missing a column gets an empty cell in CSV
+// and leaves the key out in JSON lines.
+//
+// The events are written as they are received instead of being collected first, so the export of a large search
+// uses no more memory than the search itself. Aggregated results, such as the table from stats, can not be exported.
+func Export(ctx context.Context, w io.Writer, format string, columns []string, results <-chan PipelineStepResult) (int, error) {
+	if len(columns) == 0 {
+		columns = DefaultExportColumns
+	}
+	var ew exportWriter
+	switch format {
+	case ExportFormatCSV:
+		ew = &csvExportWriter{w: csv.NewWriter(w)}
+	case ExportFormatJSONLines:
+		ew = &jsonLinesExportWriter{w: bufio.NewWriter(w)}
+	default:
+		return 0, fmt.Errorf("unknown export format=%v, expected %v or %v", format, ExportFormatCSV, ExportFormatJSONLines)
+	}
+	err := ew.writeHeader(columns)
+	if err != nil {
+		return 0, fmt.Errorf("error writing export header: %w", err)
+	}
+
+	// The fields are projected the same way the fields command does it
+	projection := fieldsPipelineStep{fields: columns}
+	values := make([]*string, len(columns))
+	n := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case res, ok := <-results:
+			if !ok {
+				err = ew.flush()
+				if err != nil {
+					return n, fmt.Errorf("error writing export: %w", err)
+				}
+				return n, nil
+			}
+			if res.Err != nil {
+				// Flushing what has been written so far lets the reader see how far the export got
+				ew.flush()
+				return n, fmt.Errorf("error exporting search: %w", res.Err)
+			}
+			if res.Aggregate != nil {
+				return n, errors.New("aggregated results can not be exported, only events")
+			}
+			for _, evt := range res.Events {
+				fields := projection.project(evt.Fields)
+				for i, c := range columns {
+					values[i] = exportValue(evt, fields, c)
+				}
+				err = ew.writeRow(columns, values)
+				if err != nil {
+					return n, fmt.Errorf("error writing export: %w", err)
+				}
+				n++
+			}
+		}
+	}
+}
+
+// exportValue returns the value of column for evt, or nil if the event does not have it. host and source are taken
+// from the event itself if they are not among the fields, as is the case for the events returned by GetByIds.
+func exportValue(evt events.EventWithExtractedFields, fields map[string]string, column string) *string {
+	var v string
+	switch column {
+	case "_time":
+		v = evt.Timestamp.Format(time.RFC3339Nano)
+	case "_raw":
+		v = evt.Raw
+	default:
+		var ok bool
+		v, ok = fields[column]
+		if !ok && column == "host" {
+			v, ok = evt.Host, true
+		} else if !ok && column == "source" {
+			v, ok = evt.Source, true
+		}
+		if !ok {
+			return nil
+		}
+	}
+	return &v
+}
+
+type exportWriter interface {
+	writeHeader(columns []string) error
+	writeRow(columns []string, values []*string) error
+	flush() error
+}
+
+type csvExportWriter struct {
+	w   *csv.Writer
+	row []string
+}
+
+// writeHeader writes the columns as the first row, so that the header is the same even if there are no events or
+// no event has all columns.
+func (cw *csvExportWriter) writeHeader(columns []string) error {
+	cw.row = make([]string, len(columns))
+	return cw.w.Write(columns)
+}
+
+func (cw *csvExportWriter) writeRow(columns []string, values []*string) error {
+	for i, v := range values {
+		cw.row[i] = ""
+		if v != nil {
+			cw.row[i] = *v
+		}
+	}
+	return cw.w.Write(cw.row)
+}
+
+func (cw *csvExportWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type jsonLinesExportWriter struct {
+	w *bufio.Writer
+}
+
+func (jw *jsonLinesExportWriter) writeHeader(columns []string) error {
+	return nil
+}
+
+// writeRow writes one JSON object per line. encoding/json sorts the keys of a map, but the objects are written by
+// hand to keep the keys in the order of the columns.
+func (jw *jsonLinesExportWriter) writeRow(columns []string, values []*string) error {
+	jw.w.WriteByte('{')
+	first := true
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if !first {
+			jw.w.WriteByte(',')
+		}
+		first = false
+		key, err := json.Marshal(columns[i])
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(*v)
+		if err != nil {
+			return err
+		}
+		jw.w.Write(key)
+		jw.w.WriteByte(':')
+		jw.w.Write(value)
+	}
+	_, err := jw.w.WriteString("}\n")
+	return err
+}
+
+func (jw *jsonLinesExportWriter) flush() error {
+	return jw.w.Flush()
+}
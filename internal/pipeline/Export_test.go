@@ -0,0 +1,145 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+var exportTestEvents = []events.EventWithExtractedFields{
+	{
+		Id: 1, Raw: "status=200 path=/api", Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 123000000, time.UTC),
+		Host: "web01", Source: "access.log", Fields: map[string]string{"host": "web01", "source": "access.log", "status": "200", "path": "/api"},
+	},
+	{
+		Id: 2, Raw: "level=error message=\"a, \\\"quoted\\\" message\"", Timestamp: time.Date(2021, 1, 20, 20, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60)),
+		Host: "web02", Source: "error.log", Fields: map[string]string{"level": "error", "message": "a, \"quoted\" message\non two lines"},
+	},
+}
+
+func exportResults(evts ...[]events.EventWithExtractedFields) <-chan PipelineStepResult {
+	ret := make(chan PipelineStepResult, len(evts))
+	for _, e := range evts {
+		ret <- PipelineStepResult{Events: e}
+	}
+	close(ret)
+	return ret
+}
+
+func TestExport_CSV(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Export(context.Background(), &buf, ExportFormatCSV, []string{"_time", "host", "status", "message"}, exportResults(exportTestEvents[:1], exportTestEvents[1:]))
+	if err != nil {
+		t.Fatalf("TestExport_CSV got unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("TestExport_CSV expected 2 events to be written but got %v", n)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("TestExport_CSV got unexpected error when reading CSV: %v", err)
+	}
+	expected := [][]string{
+		{"_time", "host", "status", "message"},
+		{"2021-01-20T20:29:00.123Z", "web01", "200", ""},
+		{"2021-01-20T20:30:00+02:00", "web02", "", "a, \"quoted\" message\non two lines"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("TestExport_CSV expected records=%q but got %q", expected, records)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, records[2][0])
+	if err != nil || !ts.Equal(exportTestEvents[1].Timestamp) {
+		t.Fatalf("TestExport_CSV expected _time to parse to %v but got %v (err=%v)", exportTestEvents[1].Timestamp, ts, err)
+	}
+}
+
+func TestExport_CSVHeaderWithoutEvents(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Export(context.Background(), &buf, ExportFormatCSV, nil, exportResults())
+	if err != nil {
+		t.Fatalf("TestExport_CSVHeaderWithoutEvents got unexpected error: %v", err)
+	}
+	if buf.String() != "_time,host,source,_raw\n" {
+		t.Fatalf("TestExport_CSVHeaderWithoutEvents expected only the default header but got %q", buf.String())
+	}
+}
+
+func TestExport_JSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := Export(context.Background(), &buf, ExportFormatJSONLines, ParseFieldList("_raw, Source level"), exportResults(exportTestEvents))
+	if err != nil {
+		t.Fatalf("TestExport_JSONLines got unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("TestExport_JSONLines expected 2 events to be written but got %v", n)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("TestExport_JSONLines expected 2 lines but got %q", buf.String())
+	}
+	// The keys are in the order of the columns
+	if !strings.HasPrefix(lines[0], `{"_raw":`) || !strings.Contains(lines[1], `"source":"error.log","level":"error"}`) {
+		t.Fatalf("TestExport_JSONLines expected the keys in column order but got %q", buf.String())
+	}
+
+	expected := []map[string]string{
+		{"_raw": exportTestEvents[0].Raw, "source": "access.log"},
+		{"_raw": exportTestEvents[1].Raw, "source": "error.log", "level": "error"},
+	}
+	scanner := bufio.NewScanner(&buf)
+	for i := 0; scanner.Scan(); i++ {
+		var actual map[string]string
+		err = json.Unmarshal(scanner.Bytes(), &actual)
+		if err != nil {
+			t.Fatalf("TestExport_JSONLines got unexpected error when parsing line %v: %v", i, err)
+		}
+		if !reflect.DeepEqual(actual, expected[i]) {
+			t.Fatalf("TestExport_JSONLines expected line %v to be %v but got %v", i, expected[i], actual)
+		}
+	}
+}
+
+func TestExport_Errors(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Export(context.Background(), &buf, "xml", nil, exportResults())
+	if err == nil {
+		t.Fatal("TestExport_Errors expected an error for an unknown format but got nil")
+	}
+
+	results := make(chan PipelineStepResult, 1)
+	results <- PipelineStepResult{Events: []events.EventWithExtractedFields{}, Aggregate: &AggregateResult{}}
+	close(results)
+	_, err = Export(context.Background(), &buf, ExportFormatCSV, nil, results)
+	if err == nil {
+		t.Fatal("TestExport_Errors expected an error for an aggregated result but got nil")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Export(ctx, &buf, ExportFormatCSV, nil, make(chan PipelineStepResult))
+	if err != context.Canceled {
+		t.Fatalf("TestExport_Errors expected context.Canceled after cancelling but got %v", err)
+	}
+}
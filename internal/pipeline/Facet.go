@@ -0,0 +1,66 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// FacetValue is one of the distinct values of a field and the number of events which have it.
+type FacetValue struct {
+	Value string
+	Count int64
+}
+
+// Facet returns the limit most common values of field among the events matching srch between startTime and endTime,
+// most common first and in alphabetical order when the counts are equal. Events which do not have the field are not
+// counted. If limit is 0 or less every value is returned.
+//
+// This gives the same counts as "| stats count by <field>", but only the values are kept in memory and not the events.
+func Facet(ctx context.Context, repo events.Repository, cfg *config.Config, srch *search.Search, startTime, endTime *time.Time, field string, limit int) ([]FacetValue, error) {
+	startTime, endTime = searchTimeRange(srch, startTime, endTime)
+	field = strings.ToLower(field)
+	counts := map[string]int64{}
+	err := forEachMatchingEvent(ctx, repo, cfg, srch, startTime, endTime, func(evtFields map[string]string) {
+		if v, ok := evtFields[field]; ok {
+			counts[v]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]FacetValue, 0, len(counts))
+	for v, c := range counts {
+		ret = append(ret, FacetValue{Value: v, Count: c})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Value < ret[j].Value
+	})
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
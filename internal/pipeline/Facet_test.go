@@ -0,0 +1,109 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestFacet(t *testing.T) {
+	repo := newInMemRepo(t)
+	// status=200 appears 5 times, 500 3 times, 404 and 503 twice each and 302 once. Two events have no status.
+	statuses := []string{"200", "500", "200", "404", "200", "503", "500", "200", "302", "404", "", "503", "500", "200", ""}
+	evts := make([]events.Event, len(statuses))
+	for i, status := range statuses {
+		raw := fmt.Sprintf("request %v", i)
+		if status != "" {
+			raw += " status=" + status
+		}
+		host := "web01"
+		if i%3 == 0 {
+			host = "web02"
+		}
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      host,
+			Source:    "access.log",
+			Offset:    int64(i),
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+	}
+
+	for _, tt := range []struct {
+		search   string
+		field    string
+		limit    int
+		expected []FacetValue
+	}{
+		{"", "status", 0, []FacetValue{{"200", 5}, {"500", 3}, {"404", 2}, {"503", 2}, {"302", 1}}},
+		{"", "Status", 3, []FacetValue{{"200", 5}, {"500", 3}, {"404", 2}}},
+		{"", "status", 1, []FacetValue{{"200", 5}}},
+		{"", "host", 10, []FacetValue{{"web01", 10}, {"web02", 5}}},
+		{"host=web02", "status", 0, []FacetValue{{"404", 2}, {"500", 2}, {"200", 1}}},
+		{"status>=500", "status", 0, []FacetValue{{"500", 3}, {"503", 2}}},
+		{"", "missing", 0, []FacetValue{}},
+	} {
+		t.Run(fmt.Sprintf("%v_%v_%v", tt.search, tt.field, tt.limit), func(t *testing.T) {
+			srch, err := search.Parse(tt.search)
+			if err != nil {
+				t.Fatalf("TestFacet got unexpected error when parsing search: %v", err)
+			}
+			actual, err := Facet(context.Background(), repo, cfg, srch, nil, nil, tt.field, tt.limit)
+			if err != nil {
+				t.Fatalf("TestFacet got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestFacet expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFacet_TimeRange(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "status=200", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 0, 0, 0, time.UTC)},
+		{Raw: "status=500", Host: "web01", Source: "access.log", Offset: 1, Timestamp: time.Date(2021, 1, 20, 21, 0, 0, 0, time.UTC)},
+	})
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+	}
+	srch, err := search.Parse("")
+	if err != nil {
+		t.Fatalf("TestFacet_TimeRange got unexpected error when parsing search: %v", err)
+	}
+	startTime := time.Date(2021, 1, 20, 20, 30, 0, 0, time.UTC)
+	actual, err := Facet(context.Background(), repo, cfg, srch, &startTime, nil, "status", 0)
+	if err != nil {
+		t.Fatalf("TestFacet_TimeRange got unexpected error: %v", err)
+	}
+	expected := []FacetValue{{"500", 1}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestFacet_TimeRange expected %v but got %v", expected, actual)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+type fieldsPipelineStep struct {
+	fields []string
+}
+
+func (s *fieldsPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			if len(s.fields) > 0 {
+				ret := make([]events.EventWithExtractedFields, len(res.Events))
+				for i, evt := range res.Events {
+					evt.Fields = s.project(evt.Fields)
+					ret[i] = evt
+				}
+				res.Events = ret
+			}
+			pipe.output <- res
+		}
+	}
+}
+
+// project returns a new map with only the selected fields. Fields the event does not have are left out.
+func (s *fieldsPipelineStep) project(fields map[string]string) map[string]string {
+	ret := make(map[string]string, len(s.fields))
+	for _, f := range s.fields {
+		if v, ok := fields[f]; ok {
+			ret[f] = v
+		}
+	}
+	return ret
+}
+
+// ParseFieldList returns the lower case field names in a list separated by commas or whitespace, as given to the
+// fields command.
+func ParseFieldList(input string) []string {
+	return strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func compileFieldsStep(input string, options map[string]string) (pipelineStep, error) {
+	return &fieldsPipelineStep{
+		fields: ParseFieldList(input),
+	}, nil
+}
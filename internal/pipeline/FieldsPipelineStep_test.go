@@ -0,0 +1,108 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestFieldsPipelineStep(t *testing.T) {
+	timestamp := time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		input    string
+		expected []map[string]string
+	}{
+		{"", []map[string]string{
+			{"source": "access.log", "status": "200", "path": "/api"},
+			{"source": "error.log", "level": "error"},
+		}},
+		{"source status", []map[string]string{
+			{"source": "access.log", "status": "200"},
+			{"source": "error.log"},
+		}},
+		{"Path, missing", []map[string]string{
+			{"path": "/api"},
+			{},
+		}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			fps, err := compileFieldsStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestFieldsPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go fps.Execute(context.Background(), pipe, params)
+
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 1, Raw: "status=200 path=/api", Timestamp: timestamp, Fields: map[string]string{"source": "access.log", "status": "200", "path": "/api"}},
+						{Id: 2, Raw: "level=error", Timestamp: timestamp, Fields: map[string]string{"source": "error.log", "level": "error"}},
+					},
+				}
+				close(input)
+			}()
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestFieldsPipelineStep got unexpected !ok when receiving output")
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestFieldsPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+			if len(result.Events) != len(tt.expected) {
+				t.Fatalf("TestFieldsPipelineStep expected %v events but got %v", len(tt.expected), len(result.Events))
+			}
+			for i, evt := range result.Events {
+				if evt.Id != int64(i+1) || !evt.Timestamp.Equal(timestamp) {
+					t.Fatalf("TestFieldsPipelineStep expected the id and timestamp to be kept but got id=%v, timestamp=%v", evt.Id, evt.Timestamp)
+				}
+				if len(evt.Fields) != len(tt.expected[i]) {
+					t.Fatalf("TestFieldsPipelineStep expected fields=%v but got %v", tt.expected[i], evt.Fields)
+				}
+				for k, v := range tt.expected[i] {
+					if evt.Fields[k] != v {
+						t.Fatalf("TestFieldsPipelineStep expected fields=%v but got %v", tt.expected[i], evt.Fields)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCompilePipeline_Table(t *testing.T) {
+	p, err := CompilePipeline("error | table source status", nil, nil)
+	if err != nil {
+		t.Fatalf("TestCompilePipeline_Table got unexpected error: %v", err)
+	}
+	fps, ok := p.steps[1].(*fieldsPipelineStep)
+	if !ok {
+		t.Fatalf("TestCompilePipeline_Table expected the second step to be a fields step but got %T", p.steps[1])
+	}
+	if len(fps.fields) != 2 || fps.fields[0] != "source" || fps.fields[1] != "status" {
+		t.Fatalf("TestCompilePipeline_Table expected fields=[source status] but got %v", fps.fields)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+)
+
+// DefaultFillnullValue is the value fillnull gives missing fields if no value is given.
+const DefaultFillnullValue = "0"
+
+type fillnullPipelineStep struct {
+	value  string
+	fields []string
+}
+
+func (s *fillnullPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	// seen is the fields of all events so far, which are filled in when no fields were given. Results are streamed
+	// so fields can not be known before they are seen, which means an event is only given the fields of itself and
+	// the events before it.
+	seen := map[string]struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			for i := range res.Events {
+				evt := &res.Events[i]
+				if evt.Fields == nil {
+					evt.Fields = map[string]string{}
+				}
+				if len(s.fields) > 0 {
+					s.fill(evt.Fields, s.fields...)
+					continue
+				}
+				for k := range evt.Fields {
+					seen[k] = struct{}{}
+				}
+				for k := range seen {
+					s.fill(evt.Fields, k)
+				}
+			}
+			select {
+			case pipe.output <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// fill sets each of names which the event does not have to the value. Fields which are present are left alone, even
+// if their value is empty.
+func (s *fillnullPipelineStep) fill(fields map[string]string, names ...string) {
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			fields[name] = s.value
+		}
+	}
+}
+
+func compileFillnullStep(input string, options map[string]string) (pipelineStep, error) {
+	value, ok := options["value"]
+	if !ok {
+		value = DefaultFillnullValue
+	}
+	return &fillnullPipelineStep{
+		value:  value,
+		fields: ParseFieldList(input),
+	}, nil
+}
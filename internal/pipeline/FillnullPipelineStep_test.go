@@ -0,0 +1,104 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestFillnullPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		input    string
+		options  map[string]string
+		fields   []map[string]string
+		expected []map[string]string
+	}{
+		{
+			"default value",
+			"bytes",
+			map[string]string{},
+			[]map[string]string{{"bytes": "100"}, {"status": "200"}},
+			[]map[string]string{{"bytes": "100"}, {"status": "200", "bytes": "0"}},
+		},
+		{
+			"given value",
+			"bytes, user",
+			map[string]string{"value": "n/a"},
+			[]map[string]string{{"bytes": "100", "user": ""}, {}, nil},
+			[]map[string]string{{"bytes": "100", "user": ""}, {"bytes": "n/a", "user": "n/a"}, {"bytes": "n/a", "user": "n/a"}},
+		},
+		{
+			"fields seen so far",
+			"",
+			map[string]string{},
+			[]map[string]string{{"status": "200"}, {"bytes": "100"}, {}},
+			[]map[string]string{{"status": "200"}, {"status": "0", "bytes": "100"}, {"status": "0", "bytes": "0"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := compileFillnullStep(tt.input, tt.options)
+			if err != nil {
+				t.Fatalf("TestFillnullPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go step.Execute(context.Background(), pipe, params)
+
+			go func() {
+				// Each event is sent in its own result to check that the fields seen are remembered between results
+				for i, fields := range tt.fields {
+					input <- PipelineStepResult{
+						Events: []events.EventWithExtractedFields{{Id: int64(i), Raw: "raw", Fields: fields}},
+					}
+				}
+				close(input)
+			}()
+
+			actual := []map[string]string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Fields)
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestFillnullPipelineStep expected fields=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFillnullPipelineStep_Pipeline(t *testing.T) {
+	p, err := CompilePipeline(`error | fillnull value="-" Bytes user`, nil, nil)
+	if err != nil {
+		t.Fatalf("TestFillnullPipelineStep_Pipeline got unexpected error: %v", err)
+	}
+	step := p.steps[1].(*fillnullPipelineStep)
+	if step.value != "-" {
+		t.Fatalf("TestFillnullPipelineStep_Pipeline expected value=- but got %v", step.value)
+	}
+	if expected := []string{"bytes", "user"}; !reflect.DeepEqual(step.fields, expected) {
+		t.Fatalf("TestFillnullPipelineStep_Pipeline expected fields=%v but got %v", expected, step.fields)
+	}
+}
@@ -16,21 +16,25 @@ package pipeline
 
 import (
 	"fmt"
-	"log"
 	"regexp"
 	"strings"
+	"unicode"
 
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/parser"
+	"github.com/jackbister/logsuck/internal/search"
 )
 
-func compileMultipleFrags(frags []string) []*regexp.Regexp {
+// compileMultipleFrags compiles frags, leaving out and logging a warning to logger for any fragment which can not be
+// compiled.
+func compileMultipleFrags(frags []string, caseSensitive bool, logger logging.Logger) []*regexp.Regexp {
 	ret := make([]*regexp.Regexp, 0, len(frags))
 	for _, frag := range frags {
-		compiled, err := compileFrag(frag)
+		compiled, err := compileFrag(frag, caseSensitive)
 		if err != nil {
-			log.Println("Failed to compile fragment=" + frag + ", err=" + err.Error() + ", fragment will not be included")
+			logger.Warnf("failed to compile fragment=%v, fragment will not be included: %v", frag, err)
 		} else {
 			ret = append(ret, compiled)
 		}
@@ -38,8 +42,158 @@ func compileMultipleFrags(frags []string) []*regexp.Regexp {
 	return ret
 }
 
-func compileKeys(m map[string]struct{}) []*regexp.Regexp {
-	return compileMultipleFrags(getKeys(m))
+// compileWildcardFrags compiles the fragments which have a wildcard somewhere other than at the end.
+// The repositories match the other fragments using full text search, but these can not be expressed that way so they
+// have to be matched against the events returned by the repository.
+// If caseSensitive is set every fragment is compiled, since full text search is always case insensitive.
+func compileWildcardFrags(fragments map[string]struct{}, caseSensitive bool, logger logging.Logger) []*regexp.Regexp {
+	frags := make([]string, 0)
+	for frag := range fragments {
+		i := strings.Index(frag, "*")
+		if caseSensitive || (i != -1 && (i == 0 || i != len(frag)-1)) {
+			frags = append(frags, frag)
+		}
+	}
+	return compileMultipleFrags(frags, caseSensitive, logger)
+}
+
+// repositorySearch returns the search which should be passed to the repository for srch.
+// The repositories may return more events than srch matches, since the events are filtered again afterwards, but
+// they must not leave any out. A case insensitive NOT would exclude events which only match it with another case,
+// so the negated hosts, sources and fragments are left to the case sensitive filtering if caseSensitive is set.
+func repositorySearch(srch *search.Search, caseSensitive bool) *search.Search {
+	if !caseSensitive {
+		return srch
+	}
+	ret := *srch
+	ret.NotFragments = map[string]struct{}{}
+	ret.NotHosts = nil
+	ret.NotSources = nil
+	return &ret
+}
+
+// repositoryMatcher returns a function which matches an event against the parts of srch which are otherwise matched
+// by the repository: the hosts, sources and fragments.
+func repositoryMatcher(srch *search.Search, caseSensitive bool, logger logging.Logger) func(evt events.EventWithId) bool {
+	compiledFrags := compileMultipleFrags(getKeys(srch.Fragments), caseSensitive, logger)
+	compiledNotFrags := compileMultipleFrags(getKeys(srch.NotFragments), caseSensitive, logger)
+	compiledHosts := compileMultipleFrags(getKeys(srch.Hosts), caseSensitive, logger)
+	compiledNotHosts := compileMultipleFrags(getKeys(srch.NotHosts), caseSensitive, logger)
+	compiledSources := compileMultipleFrags(getKeys(srch.Sources), caseSensitive, logger)
+	compiledNotSources := compileMultipleFrags(getKeys(srch.NotSources), caseSensitive, logger)
+	return func(evt events.EventWithId) bool {
+		// An event can only have one host and source, so multiple values mean any of them should match
+		if (len(compiledHosts) > 0 && !anyMatch(compiledHosts, evt.Host)) || anyMatch(compiledNotHosts, evt.Host) {
+			return false
+		}
+		if (len(compiledSources) > 0 && !anyMatch(compiledSources, evt.Source)) || anyMatch(compiledNotSources, evt.Source) {
+			return false
+		}
+		for _, frag := range compiledFrags {
+			if !frag.MatchString(evt.Raw) {
+				return false
+			}
+		}
+		return !anyMatch(compiledNotFrags, evt.Raw)
+	}
+}
+
+// MaxFuzzyDistance is the largest edit distance a fuzzy search can use. Larger distances make short words match
+// almost anything while making every event more expensive to check.
+const MaxFuzzyDistance = 3
+
+// fuzzyFragment matches any word in the event which can be turned into the fragment using at most maxDistance single
+// character insertions, deletions or substitutions.
+type fuzzyFragment struct {
+	frag          []rune
+	maxDistance   int
+	caseSensitive bool
+}
+
+// isFuzzyFragment returns true if frag is a single word without wildcards, which is the only kind of fragment a fuzzy
+// search matches approximately. A fragment with punctuation, such as an IP address, spans several words and is still
+// matched exactly.
+func isFuzzyFragment(frag string) bool {
+	if frag == "" {
+		return false
+	}
+	for _, r := range frag {
+		if !isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// compileFuzzyFrags splits fragments into the ones which are matched approximately and the rest, which are returned
+// in a new map so that they can still be matched exactly.
+func compileFuzzyFrags(fragments map[string]struct{}, maxDistance int, caseSensitive bool) ([]*fuzzyFragment, map[string]struct{}) {
+	ret := make([]*fuzzyFragment, 0)
+	rest := make(map[string]struct{}, len(fragments))
+	for frag := range fragments {
+		if !isFuzzyFragment(frag) {
+			rest[frag] = struct{}{}
+			continue
+		}
+		if !caseSensitive {
+			frag = strings.ToLower(frag)
+		}
+		ret = append(ret, &fuzzyFragment{frag: []rune(frag), maxDistance: maxDistance, caseSensitive: caseSensitive})
+	}
+	return ret, rest
+}
+
+func (f *fuzzyFragment) matches(raw string) bool {
+	if !f.caseSensitive {
+		raw = strings.ToLower(raw)
+	}
+	for _, word := range strings.FieldsFunc(raw, func(r rune) bool { return !isWordRune(r) }) {
+		if withinEditDistance([]rune(word), f.frag, f.maxDistance) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinEditDistance returns true if the Levenshtein distance between a and b is at most max. Words in log lines are
+// short, so the whole table is computed, but it gives up as soon as a row shows that the distance will be too large.
+func withinEditDistance(a, b []rune, max int) bool {
+	if len(a)-len(b) > max || len(b)-len(a) > max {
+		return false
+	}
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j-1]+cost, minInt(prev[j]+1, curr[j-1]+1))
+			rowMin = minInt(rowMin, curr[j])
+		}
+		if rowMin > max {
+			return false
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)] <= max
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 func getKeys(fragments map[string]struct{}) []string {
@@ -50,24 +204,57 @@ func getKeys(fragments map[string]struct{}) []string {
 	return ret
 }
 
-func compileFieldValues(m map[string][]string) map[string][]*regexp.Regexp {
+func compileFieldValues(m map[string][]string, caseSensitive bool, logger logging.Logger) map[string][]*regexp.Regexp {
 	ret := make(map[string][]*regexp.Regexp, len(m))
 	for key, values := range m {
-		compiledValues := make([]*regexp.Regexp, len(values))
-		for i, value := range values {
-			compiled, err := compileFrag(value)
-			if err != nil {
-				log.Println("Failed to compile fieldValue=" + value + ", err=" + err.Error() + ", fieldValue will not be included")
-			} else {
-				compiledValues[i] = compiled
-			}
+		ret[key] = compileMultipleFieldValues(values, caseSensitive, logger)
+	}
+	return ret
+}
+
+func compileMultipleFieldValues(values []string, caseSensitive bool, logger logging.Logger) []*regexp.Regexp {
+	ret := make([]*regexp.Regexp, 0, len(values))
+	for _, value := range values {
+		compiled, err := compileFieldValue(value, caseSensitive)
+		if err != nil {
+			logger.Warnf("failed to compile fieldValue=%v, fieldValue will not be included: %v", value, err)
+		} else {
+			ret = append(ret, compiled)
 		}
-		ret[key] = compiledValues
 	}
 	return ret
 }
 
-func compileFrag(frag string) (*regexp.Regexp, error) {
+// compileFieldValue compiles a value a field is compared to using = or !=. Unlike a fragment, which can match any
+// word in the event, the value has to match the whole field value, so status=200 does not match a status of 2004 or
+// "200 OK". Wildcards can be used to match part of the value, as in path=/api/*.
+func compileFieldValue(value string, caseSensitive bool) (*regexp.Regexp, error) {
+	rexString := caseFlag(caseSensitive) + "^" + wildcardPattern(value) + "$"
+	rex, err := regexp.Compile(rexString)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compile rexString="+rexString+": %w", err)
+	}
+	return rex, nil
+}
+
+// wildcardPattern returns a regular expression which matches s literally, except for * which matches anything.
+func wildcardPattern(s string) string {
+	parts := strings.Split(s, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return strings.Join(parts, ".*")
+}
+
+// caseFlag returns the flag which makes a regular expression case insensitive, unless caseSensitive is set.
+func caseFlag(caseSensitive bool) string {
+	if caseSensitive {
+		return ""
+	}
+	return "(?i)"
+}
+
+func compileFrag(frag string, caseSensitive bool) (*regexp.Regexp, error) {
 	pre := "(^|\\W)"
 	if strings.HasPrefix(frag, "*") {
 		pre = ""
@@ -76,7 +263,9 @@ func compileFrag(frag string) (*regexp.Regexp, error) {
 	if strings.HasSuffix(frag, "*") {
 		post = ""
 	}
-	rexString := pre + strings.Replace(frag, "*", ".*", -1) + post
+	// Everything but the wildcard is matched literally and, unless caseSensitive is set, case insensitively, the same
+	// way the repository matches. The fragment is grouped so that search.Highlight can leave the boundaries out.
+	rexString := caseFlag(caseSensitive) + pre + "(?P<" + search.MatchGroupName + ">" + wildcardPattern(frag) + ")" + post
 	rex, err := regexp.Compile(rexString)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to compile rexString="+rexString+": %w", err)
@@ -84,15 +273,128 @@ func compileFrag(frag string) (*regexp.Regexp, error) {
 	return rex, nil
 }
 
+type compiledExpression struct {
+	expr     *parser.SearchExpression
+	children []*compiledExpression
+	values   []*regexp.Regexp
+}
+
+func compileExpressions(exprs []*parser.SearchExpression, caseSensitive bool, logger logging.Logger) []*compiledExpression {
+	ret := make([]*compiledExpression, len(exprs))
+	for i, expr := range exprs {
+		ret[i] = compileExpression(expr, caseSensitive, logger)
+	}
+	return ret
+}
+
+func compileExpression(expr *parser.SearchExpression, caseSensitive bool, logger logging.Logger) *compiledExpression {
+	ret := &compiledExpression{
+		expr:     expr,
+		children: compileExpressions(expr.Children, caseSensitive, logger),
+	}
+	switch expr.Type {
+	case parser.SearchExpressionFragment:
+		ret.values = compileMultipleFrags([]string{expr.Fragment}, caseSensitive, logger)
+	case parser.SearchExpressionField:
+		ret.values = compileMultipleFieldValues(expr.Values, caseSensitive, logger)
+	case parser.SearchExpressionRegex:
+		rex, err := regexp.Compile(caseFlag(caseSensitive) + expr.Regex.Pattern)
+		if err != nil {
+			logger.Warnf("failed to compile regex=%v, it will not match any value: %v", expr.Regex.Pattern, err)
+		} else {
+			ret.values = []*regexp.Regexp{rex}
+		}
+	}
+	return ret
+}
+
+func (c *compiledExpression) matches(raw string, evtFields map[string]string) bool {
+	var ret bool
+	switch c.expr.Type {
+	case parser.SearchExpressionAnd:
+		ret = true
+		for _, child := range c.children {
+			if !child.matches(raw, evtFields) {
+				ret = false
+				break
+			}
+		}
+	case parser.SearchExpressionOr:
+		for _, child := range c.children {
+			if child.matches(raw, evtFields) {
+				ret = true
+				break
+			}
+		}
+	case parser.SearchExpressionFragment:
+		ret = anyMatch(c.values, raw)
+	case parser.SearchExpressionField:
+		evtValue, ok := evtFields[c.expr.Field]
+		ret = ok && anyMatch(c.values, evtValue)
+	case parser.SearchExpressionComparison:
+		evtValue, ok := evtFields[c.expr.Comparison.Field]
+		ret = ok && c.expr.Comparison.Matches(evtValue)
+	case parser.SearchExpressionRegex:
+		evtValue, ok := evtFields[c.expr.Regex.Field]
+		ret = ok && anyMatch(c.values, evtValue)
+	case parser.SearchExpressionExists:
+		_, ret = evtFields[c.expr.Field]
+	}
+	if c.expr.Negated {
+		return !ret
+	}
+	return ret
+}
+
+// isBuiltinField returns true if name is one of the fields which are set from the event itself rather than extracted.
+func isBuiltinField(name string) bool {
+	return name == "host" || name == "source"
+}
+
+func anyMatch(rexes []*regexp.Regexp, s string) bool {
+	for _, rex := range rexes {
+		if rex.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
 func shouldIncludeEvent(evt events.EventWithId,
 	cfg *config.Config,
-	compiledFrags []*regexp.Regexp, compiledNotFrags []*regexp.Regexp,
-	compiledFields map[string][]*regexp.Regexp, compiledNotFields map[string][]*regexp.Regexp) (map[string]string, bool) {
-	evtFields := parser.ExtractFields(strings.ToLower(evt.Raw), cfg.FieldExtractors)
-	// TODO: This could produce unexpected results
+	compiledFrags []*regexp.Regexp, compiledNotFrags []*regexp.Regexp, fuzzyFrags []*fuzzyFragment,
+	compiledFields map[string][]*regexp.Regexp, compiledNotFields map[string][]*regexp.Regexp,
+	comparisons []parser.FieldComparison, groups []*compiledExpression) (map[string]string, bool) {
+	raw := events.NormalizeCase(cfg, evt.Raw)
+	evtFields := events.ExtractFields(cfg, raw, evt.Source)
+	// The built in fields take precedence over extracted fields with the same name. The repository filters on the
+	// real host and source, so letting an extracted field override them would make searches inconsistent.
 	evtFields["host"] = evt.Host
 	evtFields["source"] = evt.Source
 
+	for _, frag := range compiledFrags {
+		if !frag.MatchString(raw) {
+			return evtFields, false
+		}
+	}
+	for _, frag := range compiledNotFrags {
+		if frag.MatchString(raw) {
+			return evtFields, false
+		}
+	}
+	for _, frag := range fuzzyFrags {
+		if !frag.matches(evt.Raw) {
+			return evtFields, false
+		}
+	}
+	return evtFields, matchesFields(raw, evtFields, compiledFields, compiledNotFields, comparisons, groups)
+}
+
+// matchesFields returns true if evtFields matches the fields, comparisons and groups of a search. raw is what the
+// fragments in the groups are matched against.
+func matchesFields(raw string, evtFields map[string]string,
+	compiledFields map[string][]*regexp.Regexp, compiledNotFields map[string][]*regexp.Regexp,
+	comparisons []parser.FieldComparison, groups []*compiledExpression) bool {
 	include := true
 	for key, values := range compiledFields {
 		evtValue, ok := evtFields[key]
@@ -114,7 +416,8 @@ func shouldIncludeEvent(evt events.EventWithId,
 	for key, values := range compiledNotFields {
 		evtValue, ok := evtFields[key]
 		if !ok {
-			break
+			// An event without the field does not have the value, so it is not excluded by a negated field
+			continue
 		}
 		anyMatch := false
 		for _, value := range values {
@@ -127,5 +430,19 @@ func shouldIncludeEvent(evt events.EventWithId,
 			break
 		}
 	}
-	return evtFields, include
+	for _, c := range comparisons {
+		evtValue, ok := evtFields[c.Field]
+		if !ok || !c.Matches(evtValue) {
+			include = false
+			break
+		}
+	}
+	// The fragments and fields above are the flattened top level terms, groups are the rest of the search tree
+	for _, g := range groups {
+		if !include {
+			break
+		}
+		include = g.matches(raw, evtFields)
+	}
+	return include
 }
@@ -0,0 +1,137 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestCompileFrag(t *testing.T) {
+	for _, tt := range []struct {
+		frag     string
+		value    string
+		expected bool
+	}{
+		{"/api/*", "/api/v1/users", true},
+		{"/api/*", "/apiv1", false},
+		{"*.log", "access.log", true},
+		{"*.log", "access.txt", false},
+		{"web*3", "web03", true},
+		{"web*3", "web04", false},
+		{"*", "anything", true},
+		{"WEB*", "web01", true},
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3", "1x2x3", false},
+		{"access.log", "accessxlog", false},
+		{"a+b", "aab", false},
+		{"a+b", "a+b", true},
+		{"(x)", "(x)", true},
+		{"[a-z]", "b", false},
+	} {
+		t.Run(tt.frag+"_"+tt.value, func(t *testing.T) {
+			rex, err := compileFrag(tt.frag, false)
+			if err != nil {
+				t.Fatalf("TestCompileFrag got unexpected error: %v", err)
+			}
+			if rex.MatchString(tt.value) != tt.expected {
+				t.Fatalf("TestCompileFrag expected frag=%v to match value=%v to be %v but got %v", tt.frag, tt.value, tt.expected, !tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompileFrag_Highlight(t *testing.T) {
+	raw := "GET /api/users failed, retrying GET /api/users"
+	rexes := compileMultipleFrags([]string{"get", "/api/users", "failed"}, false, logging.Nop())
+	expected := []search.MatchRange{{Start: 0, End: 3}, {Start: 4, End: 14}, {Start: 15, End: 21}, {Start: 32, End: 35}, {Start: 36, End: 46}}
+	if actual := search.Highlight(rexes, raw); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestCompileFrag_Highlight expected %v but got %v", expected, actual)
+	}
+	// Case sensitive fragments only highlight matches with the same case
+	expected = []search.MatchRange{{Start: 15, End: 21}}
+	if actual := search.Highlight(compileMultipleFrags([]string{"get", "failed"}, true, logging.Nop()), raw); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestCompileFrag_Highlight expected %v when case sensitive but got %v", expected, actual)
+	}
+}
+
+func TestCompileFieldValue(t *testing.T) {
+	for _, tt := range []struct {
+		value      string
+		fieldValue string
+		expected   bool
+	}{
+		{"200", "200", true},
+		{"200", "2004", false},
+		{"200", "10200", false},
+		{"200", "200 ok", false},
+		{"/api/v1", "/api/v1", true},
+		{"/api/v1", "/API/V1", true},
+		{"/api/v1", "/api/v1/users", false},
+		{"/api/*", "/api/v1/users", true},
+		{"/api/*", "/static/api/v1", false},
+		{"*.log", "/var/log/access.log", true},
+		{"web*3", "web03", true},
+		{"web*3", "web03b", false},
+		{"1.2.3", "1x2x3", false},
+		{"", "", true},
+		{"", "x", false},
+	} {
+		t.Run(tt.value+"_"+tt.fieldValue, func(t *testing.T) {
+			rex, err := compileFieldValue(tt.value, false)
+			if err != nil {
+				t.Fatalf("TestCompileFieldValue got unexpected error: %v", err)
+			}
+			if rex.MatchString(tt.fieldValue) != tt.expected {
+				t.Fatalf("TestCompileFieldValue expected value=%v to match fieldValue=%v to be %v but got %v", tt.value, tt.fieldValue, tt.expected, !tt.expected)
+			}
+		})
+	}
+}
+
+func TestWithinEditDistance(t *testing.T) {
+	for _, tt := range []struct {
+		a, b     string
+		max      int
+		expected bool
+	}{
+		{"receive", "receive", 0, true},
+		{"recieve", "receive", 1, false},
+		{"recieve", "receive", 2, true},
+		{"receve", "receive", 1, true},
+		{"receivee", "receive", 1, true},
+		{"deceive", "receive", 1, true},
+		{"recipe", "receive", 1, false},
+		{"recipe", "receive", 2, true},
+		{"", "ab", 2, true},
+		{"", "abc", 2, false},
+		{"kitten", "sitting", 3, true},
+		{"kitten", "sitting", 2, false},
+		{"timeout", "connection", 3, false},
+	} {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			actual := withinEditDistance([]rune(tt.a), []rune(tt.b), tt.max)
+			if actual != tt.expected {
+				t.Fatalf("TestWithinEditDistance expected %v for a=%v b=%v max=%v but got %v", tt.expected, tt.a, tt.b, tt.max, actual)
+			}
+			if withinEditDistance([]rune(tt.b), []rune(tt.a), tt.max) != actual {
+				t.Fatalf("TestWithinEditDistance expected the distance between a=%v and b=%v to be symmetric", tt.a, tt.b)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultHeadCount is the number of events head lets through when no number is given.
+const defaultHeadCount = 10
+
+type headPipelineStep struct {
+	count int
+}
+
+func (s *headPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	s.emit(ctx, pipe)
+	close(pipe.output)
+
+	// Enough events have been emitted, so the earlier steps can stop searching. The input is drained so that they
+	// are not stuck trying to send their last results before noticing that they have been cancelled.
+	if pipe.cancelInput != nil {
+		pipe.cancelInput()
+	}
+	for range pipe.input {
+	}
+}
+
+func (s *headPipelineStep) emit(ctx context.Context, pipe pipelinePipe) {
+	remaining := s.count
+	for remaining > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			if res.Aggregate != nil {
+				if len(res.Aggregate.Rows) > remaining {
+					agg := *res.Aggregate
+					agg.Rows = agg.Rows[:remaining]
+					res.Aggregate = &agg
+				}
+				remaining -= len(res.Aggregate.Rows)
+			} else {
+				if len(res.Events) > remaining {
+					res.Events = res.Events[:remaining]
+				}
+				remaining -= len(res.Events)
+			}
+			pipe.output <- res
+		}
+	}
+}
+
+func compileHeadStep(input string, options map[string]string) (pipelineStep, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return &headPipelineStep{count: defaultHeadCount}, nil
+	}
+	count, err := strconv.Atoi(input)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("failed to compile head: expected a positive integer, got '%v'", input)
+	}
+	return &headPipelineStep{count: count}, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestHeadPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedIds []int64
+	}{
+		{"2", []int64{1, 2}},
+		{"4", []int64{1, 2, 3, 4}},
+		{"", []int64{1, 2, 3, 4, 5}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			hps, err := compileHeadStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestHeadPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go hps.Execute(context.Background(), pipe, params)
+
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{{Id: 1}, {Id: 2}, {Id: 3}},
+				}
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{{Id: 4}, {Id: 5}},
+				}
+				close(input)
+			}()
+
+			actualIds := []int64{}
+			for result := range output {
+				for _, evt := range result.Events {
+					actualIds = append(actualIds, evt.Id)
+				}
+			}
+			if len(actualIds) != len(tt.expectedIds) {
+				t.Fatalf("TestHeadPipelineStep expected ids %v but got %v", tt.expectedIds, actualIds)
+			}
+			for i := range actualIds {
+				if actualIds[i] != tt.expectedIds[i] {
+					t.Fatalf("TestHeadPipelineStep expected ids %v but got %v", tt.expectedIds, actualIds)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadPipelineStep_CancelsInput(t *testing.T) {
+	hps, err := compileHeadStep("3", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestHeadPipelineStep_CancelsInput got unexpected error: %v", err)
+	}
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: newInMemRepo(t),
+	}
+	pipe, input, output := newPipe()
+	inputCtx, cancel := context.WithCancel(context.Background())
+	pipe.cancelInput = cancel
+
+	go hps.Execute(context.Background(), pipe, params)
+
+	// The input never runs out of events, so the step before head only stops if it is cancelled
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		defer close(input)
+		for i := int64(0); ; i++ {
+			select {
+			case <-inputCtx.Done():
+				return
+			case input <- PipelineStepResult{Events: []events.EventWithExtractedFields{{Id: i}}}:
+			}
+		}
+	}()
+
+	count := 0
+	for result := range output {
+		count += len(result.Events)
+	}
+	if count != 3 {
+		t.Fatalf("TestHeadPipelineStep_CancelsInput expected 3 events but got %v", count)
+	}
+	select {
+	case <-inputDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestHeadPipelineStep_CancelsInput expected the input to be cancelled")
+	}
+}
+
+func TestHeadPipelineStep_Aggregate(t *testing.T) {
+	hps, err := compileHeadStep("1", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestHeadPipelineStep_Aggregate got unexpected error: %v", err)
+	}
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: newInMemRepo(t),
+	}
+	pipe, input, output := newPipe()
+
+	go hps.Execute(context.Background(), pipe, params)
+
+	go func() {
+		input <- PipelineStepResult{
+			Aggregate: &AggregateResult{
+				GroupBy: []string{"host"},
+				Columns: []string{"count"},
+				Rows:    []AggregateRow{{Group: []string{"a"}}, {Group: []string{"b"}}},
+			},
+		}
+		close(input)
+	}()
+
+	result, ok := <-output
+	if !ok {
+		t.Fatal("TestHeadPipelineStep_Aggregate got unexpected !ok when receiving output")
+	}
+	if len(result.Aggregate.Rows) != 1 || result.Aggregate.Rows[0].Group[0] != "a" {
+		t.Fatalf("TestHeadPipelineStep_Aggregate expected only the row for host a but got %v", result.Aggregate.Rows)
+	}
+}
+
+func TestCompileHeadStep_Invalid(t *testing.T) {
+	for _, input := range []string{"0", "-1", "ten", "1 2"} {
+		_, err := compileHeadStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestCompileHeadStep_Invalid expected an error for input '%v'", input)
+		}
+	}
+}
+
+func TestPipeline_Head(t *testing.T) {
+	repo := newInMemRepo(t)
+	evts := make([]events.Event, 50)
+	for i := range evts {
+		evts[i] = events.Event{
+			Raw:       fmt.Sprintf("message %v", i),
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	for _, command := range []string{"head", "limit"} {
+		t.Run(command, func(t *testing.T) {
+			p, err := CompilePipeline("message | "+command+" 5", nil, nil)
+			if err != nil {
+				t.Fatalf("TestPipeline_Head got unexpected error: %v", err)
+			}
+			count := 0
+			for result := range p.Execute(context.Background(), params) {
+				count += len(result.Events)
+			}
+			if count != 5 {
+				t.Fatalf("TestPipeline_Head expected 5 events but got %v", count)
+			}
+		})
+	}
+}
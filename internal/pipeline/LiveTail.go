@@ -0,0 +1,40 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// LiveTailFilter returns a filter for subscribing to an events.LiveTail which includes the events matching srch.
+// Nothing has filtered the events before they reach the filter, so unlike a search step it matches the hosts, sources
+// and every fragment itself instead of leaving them to the repository.
+// The time range of srch is ignored, since the events of a live tail are always the latest ones.
+func LiveTailFilter(cfg *config.Config, srch *search.Search) events.LiveTailFilter {
+	logger := logging.OrDefault(cfg.Logger)
+	matches := repositoryMatcher(srch, cfg.CaseSensitive, logger)
+	compiledFields := compileFieldValues(srch.Fields, cfg.CaseSensitive, logger)
+	compiledNotFields := compileFieldValues(srch.NotFields, cfg.CaseSensitive, logger)
+	compiledGroups := compileExpressions(srch.Groups, cfg.CaseSensitive, logger)
+	return func(evt events.EventWithId) (map[string]string, bool) {
+		if !matches(evt) {
+			return nil, false
+		}
+		return shouldIncludeEvent(evt, cfg, nil, nil, nil, compiledFields, compiledNotFields, srch.FieldComparisons, compiledGroups)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+func TestLiveTailFilter(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=([\\w./]+)")},
+	}
+	evt := events.EventWithId{Raw: "ERROR status=500 path=/api", Host: "web01", Source: "access.txt"}
+
+	for _, tt := range []struct {
+		search   string
+		expected bool
+	}{
+		{"", true},
+		{"error", true},
+		{"warning", false},
+		{"NOT error", false},
+		{"err*", true},
+		{"status=500", true},
+		{"status!=500", false},
+		{"status>=500", true},
+		{"status<500", false},
+		{"host=web01", true},
+		{"host=web02", false},
+		{"host!=web01", false},
+		{"source=access.txt", true},
+		{"source=other.txt", false},
+		{"(path=/health OR status=500)", true},
+		{"earliest=-1h error", true},
+	} {
+		srch, err := search.Parse(tt.search)
+		if err != nil {
+			t.Fatalf("TestLiveTailFilter got error when parsing search=%v: %v", tt.search, err)
+		}
+		fields, include := LiveTailFilter(cfg, srch)(evt)
+		if include != tt.expected {
+			t.Fatalf("TestLiveTailFilter expected include=%v for search=%v but got %v", tt.expected, tt.search, include)
+		}
+		if include && fields["status"] != "500" {
+			t.Fatalf("TestLiveTailFilter expected the extracted fields for search=%v but got %v", tt.search, fields)
+		}
+	}
+}
@@ -17,11 +17,11 @@ package pipeline
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/parser"
 )
 
@@ -38,6 +38,24 @@ type PipelineParameters struct {
 
 type PipelineStepResult struct {
 	Events []events.EventWithExtractedFields
+	// Aggregate is set by steps which produce a table of aggregated values instead of events, such as stats.
+	Aggregate *AggregateResult
+	// Truncated is set by steps which had to drop events because they can only hold a limited number of them in
+	// memory, such as sort. Steps later in the pipeline pass it on.
+	Truncated bool
+	// Err is set if the search failed, in which case this is the last result and it has no events. A pipeline which
+	// is done without sending a result with Err set searched every event, even if it did not send any.
+	Err error
+}
+
+// forwardErr sends res, which has Err set, to the next step. Steps which collect their input before sending anything,
+// such as sort and stats, stop when they receive an error instead of sending a result missing the events of the
+// failed search.
+func forwardErr(ctx context.Context, pipe pipelinePipe, res PipelineStepResult) {
+	select {
+	case pipe.output <- PipelineStepResult{Err: res.Err}:
+	case <-ctx.Done():
+	}
 }
 
 // TODO: What is a reasonable value? Configurable? Dynamic?
@@ -51,6 +69,9 @@ const pipeBufferSize = 100
 type pipelinePipe struct {
 	input  <-chan PipelineStepResult
 	output chan<- PipelineStepResult
+	// cancelInput cancels the context of the steps before this one, for steps such as head which can finish
+	// before their input is exhausted. It is nil for the first step.
+	cancelInput context.CancelFunc
 }
 
 type pipelineStep interface {
@@ -58,9 +79,26 @@ type pipelineStep interface {
 }
 
 var compilers = map[string]func(input string, options map[string]string) (pipelineStep, error){
-	"rex":    compileRexStep,
-	"search": compileSearchStep,
-	"where":  compileWhereStep,
+	"bin":         compileBinStep,
+	"dedup":       compileDedupStep,
+	"eval":        compileEvalStep,
+	"fields":      compileFieldsStep,
+	"fillnull":    compileFillnullStep,
+	"head":        compileHeadStep,
+	"limit":       compileHeadStep,
+	"rare":        compileRareStep,
+	"rename":      compileRenameStep,
+	"reverse":     compileReverseStep,
+	"rex":         compileRexStep,
+	"search":      compileSearchStep,
+	"sort":        compileSortStep,
+	"stats":       compileStatsStep,
+	"table":       compileFieldsStep,
+	"timechart":   compileTimechartStep,
+	"top":         compileTopStep,
+	"transaction": compileTransactionStep,
+	"uniq":        compileUniqStep,
+	"where":       compileWhereStep,
 }
 
 func CompilePipeline(input string, startTime, endTime *time.Time) (*Pipeline, error) {
@@ -75,6 +113,10 @@ func CompilePipeline(input string, startTime, endTime *time.Time) (*Pipeline, er
 		if !ok {
 			return nil, fmt.Errorf("failed to compile pipeline: no compiler found for StepType=%v", step.StepType)
 		}
+		// Only the first search gets its events from the repository, the others filter the results before them
+		if i > 0 && step.StepType == "search" {
+			compiler = compileSearchFilterStep
+		}
 		// This feels pretty dumb
 		if i == 0 && step.StepType == "search" {
 			if startTime != nil {
@@ -90,11 +132,32 @@ func CompilePipeline(input string, startTime, endTime *time.Time) (*Pipeline, er
 		}
 		compiledSteps[i] = res
 	}
+	// Sorting the events of the search oldest first does not need to buffer them, since the repository can return them
+	// in that order instead. This only works when the sort directly follows the search, since the steps in between
+	// may depend on the events arriving newest first.
+	if len(compiledSteps) > 1 {
+		first, isSearch := compiledSteps[0].(*searchPipelineStep)
+		second, isSort := compiledSteps[1].(*sortPipelineStep)
+		if isSearch && isSort && second.isOldestFirst() {
+			first.srch.OldestFirst = true
+			compiledSteps = append(compiledSteps[:1], compiledSteps[2:]...)
+		}
+	}
+	// Steps such as timechart fill in the whole time range of the search, so they need to know what it is
+	if len(compiledSteps) > 0 {
+		if first, ok := compiledSteps[0].(*searchPipelineStep); ok {
+			for _, step := range compiledSteps[1:] {
+				if trs, ok := step.(timeRangeStep); ok {
+					trs.setTimeRange(first.startTime, first.endTime)
+				}
+			}
+		}
+	}
 
 	lastOutput := make(chan PipelineStepResult, pipeBufferSize)
 	close(lastOutput)
 	pipes := make([]pipelinePipe, len(compiledSteps))
-	for i := 0; i < len(pr.Steps); i++ {
+	for i := 0; i < len(compiledSteps); i++ {
 		outputEvents := make(chan PipelineStepResult, pipeBufferSize)
 		pipes[i] = pipelinePipe{
 			input:  lastOutput,
@@ -103,7 +166,6 @@ func CompilePipeline(input string, startTime, endTime *time.Time) (*Pipeline, er
 		lastOutput = outputEvents
 	}
 
-	log.Println("outchan", lastOutput)
 	return &Pipeline{
 		steps:   compiledSteps,
 		pipes:   pipes,
@@ -112,9 +174,24 @@ func CompilePipeline(input string, startTime, endTime *time.Time) (*Pipeline, er
 }
 
 func (p *Pipeline) Execute(ctx context.Context, params PipelineParameters) <-chan PipelineStepResult {
+	// Each step gets a context derived from the context of the step after it, so that cancelling one step's context
+	// also cancels every step before it.
+	ctxs := make([]context.Context, len(p.steps))
+	cancels := make([]context.CancelFunc, len(p.steps))
+	for i := len(p.steps) - 1; i >= 0; i-- {
+		ctxs[i], cancels[i] = context.WithCancel(ctx)
+		ctx = ctxs[i]
+	}
+	logger := logging.OrDefault(params.Cfg.Logger)
 	for i, step := range p.steps {
-		log.Printf("pipe %v %v", i, p.pipes[i])
-		go step.Execute(ctx, p.pipes[i], params)
+		if i > 0 {
+			p.pipes[i].cancelInput = cancels[i-1]
+		}
+		logger.Debugf("starting pipeline step=%v of type=%T", i, step)
+		go func(i int, step pipelineStep) {
+			defer cancels[i]()
+			step.Execute(ctxs[i], p.pipes[i], params)
+		}(i, step)
 	}
 	return p.outChan
 }
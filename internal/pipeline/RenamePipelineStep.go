@@ -0,0 +1,82 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+type renamePipelineStep struct {
+	renames []fieldRename
+}
+
+type fieldRename struct {
+	from, to string
+}
+
+func (s *renamePipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			for i := range res.Events {
+				s.rename(&res.Events[i])
+			}
+			select {
+			case pipe.output <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// rename applies the renames in order. If the new name is already in use its value is overwritten, and if the event
+// does not have the old field nothing happens, so the value of an existing field is never lost to a missing one.
+func (s *renamePipelineStep) rename(evt *events.EventWithExtractedFields) {
+	for _, r := range s.renames {
+		v, ok := evt.Fields[r.from]
+		if !ok {
+			continue
+		}
+		delete(evt.Fields, r.from)
+		evt.Fields[r.to] = v
+	}
+}
+
+func compileRenameStep(input string, options map[string]string) (pipelineStep, error) {
+	ret := renamePipelineStep{}
+	for _, part := range strings.Split(strings.ToLower(input), ",") {
+		words := strings.Fields(part)
+		if len(words) != 3 || words[1] != "as" {
+			return nil, fmt.Errorf("failed to compile rename: expected '<field> as <new name>' but got '%v'", strings.TrimSpace(part))
+		}
+		if isBuiltinField(words[2]) || words[2] == "_raw" {
+			return nil, fmt.Errorf("failed to compile rename: the field %v can not be assigned to", words[2])
+		}
+		ret.renames = append(ret.renames, fieldRename{from: words[0], to: words[2]})
+	}
+	return &ret, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestRenamePipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		fields   map[string]string
+		expected map[string]string
+	}{
+		{"src_ip as ip", map[string]string{"src_ip": "10.0.0.1", "status": "200"}, map[string]string{"ip": "10.0.0.1", "status": "200"}},
+		{"SRC_IP AS Ip", map[string]string{"src_ip": "10.0.0.1"}, map[string]string{"ip": "10.0.0.1"}},
+		{"src_ip as ip", map[string]string{"src_ip": "10.0.0.1", "ip": "10.0.0.2"}, map[string]string{"ip": "10.0.0.1"}},
+		{"src_ip as ip", map[string]string{"ip": "10.0.0.2"}, map[string]string{"ip": "10.0.0.2"}},
+		{"src_ip as ip", map[string]string{}, map[string]string{}},
+		{"src_ip as ip, client_ip as ip", map[string]string{"client_ip": "10.0.0.3"}, map[string]string{"ip": "10.0.0.3"}},
+		{"a as b, b as c", map[string]string{"a": "1"}, map[string]string{"c": "1"}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			step, err := compileRenameStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestRenamePipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go step.Execute(context.Background(), pipe, params)
+
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{{Id: 1, Raw: "raw", Fields: tt.fields}},
+				}
+				close(input)
+			}()
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestRenamePipelineStep got unexpected !ok when receiving output")
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestRenamePipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+			if len(result.Events) != 1 {
+				t.Fatalf("TestRenamePipelineStep expected 1 event but got %v", len(result.Events))
+			}
+			if !reflect.DeepEqual(result.Events[0].Fields, tt.expected) {
+				t.Fatalf("TestRenamePipelineStep expected fields=%v but got %v", tt.expected, result.Events[0].Fields)
+			}
+		})
+	}
+}
+
+func TestRenamePipelineStep_Pipeline(t *testing.T) {
+	p, err := CompilePipeline("error | rename src_ip as ip, client_ip as ip", nil, nil)
+	if err != nil {
+		t.Fatalf("TestRenamePipelineStep_Pipeline got unexpected error: %v", err)
+	}
+	step := p.steps[1].(*renamePipelineStep)
+	expected := []fieldRename{{from: "src_ip", to: "ip"}, {from: "client_ip", to: "ip"}}
+	if !reflect.DeepEqual(step.renames, expected) {
+		t.Fatalf("TestRenamePipelineStep_Pipeline expected renames=%v but got %v", expected, step.renames)
+	}
+}
+
+func TestCompileRenameStep_Errors(t *testing.T) {
+	for _, input := range []string{"", "a", "a b", "a to b", "a as", "a as b,", "a as b c", "a as host", "a as _raw"} {
+		_, err := compileRenameStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestCompileRenameStep_Errors expected an error for input='%v' but got nil", input)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// DefaultReverseMaxEvents is the number of events the reverse command buffers unless the maxEvents option is given.
+const DefaultReverseMaxEvents = 100000
+
+type reversePipelineStep struct {
+	maxEvents int
+}
+
+func (s *reversePipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	// The last event has to be received before the first one can be sent, so only the first maxEvents events are kept
+	buffered := []events.EventWithExtractedFields{}
+	truncated := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				for i, j := 0, len(buffered)-1; i < j; i, j = i+1, j-1 {
+					buffered[i], buffered[j] = buffered[j], buffered[i]
+				}
+				select {
+				case pipe.output <- PipelineStepResult{Events: buffered, Truncated: truncated}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			if res.Aggregate != nil {
+				// The rows of a table are already all in one result, so they can be reversed right away
+				agg := *res.Aggregate
+				agg.Rows = make([]AggregateRow, len(res.Aggregate.Rows))
+				for i, row := range res.Aggregate.Rows {
+					agg.Rows[len(agg.Rows)-1-i] = row
+				}
+				res.Aggregate = &agg
+				select {
+				case pipe.output <- res:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			truncated = truncated || res.Truncated
+			for _, evt := range res.Events {
+				if len(buffered) >= s.maxEvents {
+					truncated = true
+					break
+				}
+				buffered = append(buffered, evt)
+			}
+		}
+	}
+}
+
+func compileReverseStep(input string, options map[string]string) (pipelineStep, error) {
+	if strings.TrimSpace(input) != "" {
+		return nil, fmt.Errorf("failed to compile reverse: expected no arguments, got '%v'", input)
+	}
+	maxEvents := DefaultReverseMaxEvents
+	if s, ok := options["maxEvents"]; ok {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			return nil, fmt.Errorf("failed to compile reverse: maxEvents must be a positive integer, got '%v'", s)
+		}
+		maxEvents = i
+	}
+	return &reversePipelineStep{maxEvents: maxEvents}, nil
+}
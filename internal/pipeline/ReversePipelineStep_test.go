@@ -0,0 +1,120 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestReversePipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		name              string
+		options           map[string]string
+		expectedIds       []int64
+		expectedTruncated bool
+	}{
+		{"all events", map[string]string{}, []int64{5, 4, 3, 2, 1}, false},
+		// The events after the first maxEvents are dropped, since the events arrive newest first
+		{"maxEvents", map[string]string{"maxEvents": "4"}, []int64{4, 3, 2, 1}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rps, err := compileReverseStep("", tt.options)
+			if err != nil {
+				t.Fatalf("TestReversePipelineStep got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			go rps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+
+			// Split over two results to make sure events are reversed across batches
+			go func() {
+				input <- PipelineStepResult{Events: []events.EventWithExtractedFields{{Id: 1}, {Id: 2}, {Id: 3}}}
+				input <- PipelineStepResult{Events: []events.EventWithExtractedFields{{Id: 4}, {Id: 5}}}
+				close(input)
+			}()
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestReversePipelineStep got unexpected !ok when receiving output")
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestReversePipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+			if result.Truncated != tt.expectedTruncated {
+				t.Fatalf("TestReversePipelineStep expected truncated=%v but got %v", tt.expectedTruncated, result.Truncated)
+			}
+			actualIds := make([]int64, len(result.Events))
+			for i, evt := range result.Events {
+				actualIds[i] = evt.Id
+			}
+			if !reflect.DeepEqual(actualIds, tt.expectedIds) {
+				t.Fatalf("TestReversePipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+		})
+	}
+}
+
+func TestReversePipelineStep_Aggregate(t *testing.T) {
+	rps, err := compileReverseStep("", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestReversePipelineStep_Aggregate got unexpected error: %v", err)
+	}
+	pipe, input, output := newPipe()
+	go rps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+	agg := &AggregateResult{
+		GroupBy: []string{"user"},
+		Rows:    []AggregateRow{{Group: []string{"alice"}}, {Group: []string{"bob"}}, {Group: []string{"carol"}}},
+	}
+	go func() {
+		input <- PipelineStepResult{Aggregate: agg}
+		close(input)
+	}()
+
+	actual := []string{}
+	for res := range output {
+		if res.Aggregate != nil {
+			for _, row := range res.Aggregate.Rows {
+				actual = append(actual, row.Group[0])
+			}
+		}
+	}
+	if expected := []string{"carol", "bob", "alice"}; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestReversePipelineStep_Aggregate expected rows=%v but got %v", expected, actual)
+	}
+	if agg.Rows[0].Group[0] != "alice" {
+		t.Fatalf("TestReversePipelineStep_Aggregate expected the input to be left as it was but got %v", agg.Rows)
+	}
+}
+
+func TestCompileReverseStep_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		options map[string]string
+	}{
+		{"user", map[string]string{}},
+		{"", map[string]string{"maxEvents": "0"}},
+		{"", map[string]string{"maxEvents": "many"}},
+	} {
+		_, err := compileReverseStep(tt.input, tt.options)
+		if err == nil {
+			t.Fatalf("TestCompileReverseStep_Errors expected an error for input=%v, options=%v but got nil", tt.input, tt.options)
+		}
+	}
+}
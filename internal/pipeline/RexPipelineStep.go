@@ -17,19 +17,23 @@ package pipeline
 import (
 	"context"
 	"fmt"
-	"log"
 	"regexp"
+	"strings"
 
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/parser"
 )
 
 type rexPipelineStep struct {
-	extractor regexp.Regexp
-	field     string
+	// extractors only contains the regex the step was compiled with, but is kept as a slice so that a new one does
+	// not have to be allocated for every event passed to parser.ExtractFields
+	extractors []*regexp.Regexp
+	field      string
 }
 
 func (r *rexPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
 	defer close(pipe.output)
+	logger := logging.OrDefault(params.Cfg.Logger)
 
 	for {
 		select {
@@ -48,13 +52,18 @@ func (r *rexPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params
 				} else if r.field == "host" {
 					fieldValue = evt.Host
 				} else if !ok {
-					log.Println("skip")
-					continue // Maybe this should be logged or put in some kind of metrics
+					// Maybe this should be put in some kind of metrics
+					logger.Debugf("skipping eventId=%v in rex since it does not have field=%v", evt.Id, r.field)
+					continue
 				}
-				newFields := parser.ExtractFields(fieldValue, []*regexp.Regexp{
-					&r.extractor,
-				})
+				newFields := parser.ExtractFields(fieldValue, r.extractors)
 				for k, v := range newFields {
+					// Field names are lowercased everywhere else in the pipeline, so (?P<userId>...) has to be
+					// stored as userid for "| where userId=123" to find it
+					k = strings.ToLower(k)
+					if isBuiltinField(k) {
+						continue
+					}
 					// Is mutating the event in place like this dangerous?
 					// I don't think so since the events are paid forward through channels so only one step should touch them at a time,
 					// and this avoids an extra allocation for each batch+step combo
@@ -72,14 +81,30 @@ func compileRexStep(input string, options map[string]string) (pipelineStep, erro
 		field = "_raw"
 	}
 
-	log.Printf("Compiling rex with extractor='%v'", input)
 	regex, err := regexp.Compile(input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile rex: %w", err)
 	}
+	if !isValidExtractor(regex) {
+		return nil, fmt.Errorf("failed to compile rex: the regular expression '%v' must either contain only named capture groups or exactly two unnamed capture groups", input)
+	}
 
 	return &rexPipelineStep{
-		extractor: *regex,
-		field:     field,
+		extractors: []*regexp.Regexp{regex},
+		field:      field,
 	}, nil
 }
+
+// isValidExtractor returns true if parser.ExtractFields can extract fields using regex, meaning that it either has
+// only named capture groups or two unnamed capture groups for the field name and value.
+func isValidExtractor(regex *regexp.Regexp) bool {
+	if regex.NumSubexp() == 0 {
+		return false
+	}
+	for _, name := range regex.SubexpNames()[1:] {
+		if name == "" {
+			return regex.NumSubexp() == 2
+		}
+	}
+	return true
+}
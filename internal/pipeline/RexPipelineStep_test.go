@@ -192,6 +192,77 @@ func TestRexPipelineStep_Host(t *testing.T) {
 	verifyField(t, evt, "hostid", "123")
 }
 
+func TestRexPipelineStep_LowercasesFieldNames(t *testing.T) {
+	rps, err := compileRexStep("userId=(?P<userId>\\d+)", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestRexPipelineStep got unexpected error: %v", err)
+	}
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: newInMemRepo(t),
+	}
+	pipe, input, output := newPipe()
+
+	go rps.Execute(context.Background(), pipe, params)
+
+	input <- PipelineStepResult{
+		Events: []events.EventWithExtractedFields{
+			{
+				Id:     1,
+				Fields: map[string]string{},
+				Raw:    "2021-01-20 19:37:00 userId=123",
+			},
+		},
+	}
+	close(input)
+
+	evt := verifyEvt(t, output)
+	verifyField(t, evt, "userid", "123")
+}
+
+func TestCompileRexStep_Invalid(t *testing.T) {
+	for _, input := range []string{
+		"userid=(?P<userid>\\d+",
+		"userid=\\d+",
+		"(\\w+)=(\\w+) (\\w+)",
+	} {
+		_, err := compileRexStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestCompileRexStep_Invalid expected an error for input '%v'", input)
+		}
+	}
+}
+
+func TestPipeline_RexThenFilter(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "request user=alice", Host: "MYHOST", Source: "log.txt", Offset: 0, Timestamp: time.Date(2021, 1, 20, 19, 37, 0, 0, time.UTC)},
+		{Raw: "request user=bob", Host: "MYHOST", Source: "log.txt", Offset: 1, Timestamp: time.Date(2021, 1, 20, 19, 37, 1, 0, time.UTC)},
+		{Raw: "request user=alice", Host: "MYHOST", Source: "log.txt", Offset: 2, Timestamp: time.Date(2021, 1, 20, 19, 37, 2, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	p, err := CompilePipeline("request | rex \"user=(?P<User>\\w+)\" | where User=alice", nil, nil)
+	if err != nil {
+		t.Fatalf("TestPipeline_RexThenFilter got unexpected error: %v", err)
+	}
+	count := 0
+	for result := range p.Execute(context.Background(), params) {
+		for _, evt := range result.Events {
+			if evt.Fields["user"] != "alice" {
+				t.Fatalf("TestPipeline_RexThenFilter expected user=alice but got event %v", evt)
+			}
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("TestPipeline_RexThenFilter expected 2 events but got %v", count)
+	}
+}
+
 func verifyEvt(t *testing.T, output chan PipelineStepResult) events.EventWithExtractedFields {
 	result, ok := <-output
 	if !ok {
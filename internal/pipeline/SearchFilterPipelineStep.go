@@ -0,0 +1,182 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+// searchFilterPipelineStep is a search anywhere but first in the pipeline. Instead of searching the repository it
+// filters the results of the steps before it, which can be events or the rows of a table such as the one from stats.
+// The time range only applies to events, since the rows of a table do not have a timestamp.
+type searchFilterPipelineStep struct {
+	srch               *search.Search
+	startTime, endTime *time.Time
+	fuzzy              int
+}
+
+// compiledSearchFilter is the search of a searchFilterPipelineStep compiled for the configured case sensitivity.
+type compiledSearchFilter struct {
+	frags, notFrags    []*regexp.Regexp
+	fuzzyFrags         []*fuzzyFragment
+	fields, notFields  map[string][]*regexp.Regexp
+	groups             []*compiledExpression
+	srch               *search.Search
+	startTime, endTime *time.Time
+}
+
+func (s *searchFilterPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+	caseSensitive := params.Cfg.CaseSensitive
+	logger := logging.OrDefault(params.Cfg.Logger)
+	frags := s.srch.Fragments
+	var fuzzyFrags []*fuzzyFragment
+	if s.fuzzy > 0 {
+		fuzzyFrags, frags = compileFuzzyFrags(s.srch.Fragments, s.fuzzy, caseSensitive)
+	}
+	// There is no repository to match the fragments here, so every fragment has to be compiled
+	filter := &compiledSearchFilter{
+		frags:      compileMultipleFrags(getKeys(frags), caseSensitive, logger),
+		notFrags:   compileMultipleFrags(getKeys(s.srch.NotFragments), caseSensitive, logger),
+		fuzzyFrags: fuzzyFrags,
+		fields:     compileFieldValues(s.srch.Fields, caseSensitive, logger),
+		notFields:  compileFieldValues(s.srch.NotFields, caseSensitive, logger),
+		groups:     compileExpressions(s.srch.Groups, caseSensitive, logger),
+		srch:       s.srch,
+		startTime:  s.startTime,
+		endTime:    s.endTime,
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			if res.Aggregate != nil {
+				agg := *res.Aggregate
+				agg.Rows = make([]AggregateRow, 0, len(res.Aggregate.Rows))
+				for _, row := range res.Aggregate.Rows {
+					if filter.matchesRow(res.Aggregate, row) {
+						agg.Rows = append(agg.Rows, row)
+					}
+				}
+				res.Aggregate = &agg
+			} else {
+				ret := make([]events.EventWithExtractedFields, 0, len(res.Events))
+				for _, evt := range res.Events {
+					if filter.matchesEvent(evt) {
+						ret = append(ret, evt)
+					}
+				}
+				res.Events = ret
+			}
+			select {
+			case pipe.output <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// matchesEvent matches evt using the fields it has at this point in the pipeline, which may have been changed by
+// steps such as eval and rename, rather than extracting them again.
+func (f *compiledSearchFilter) matchesEvent(evt events.EventWithExtractedFields) bool {
+	if (f.startTime != nil && evt.Timestamp.Before(*f.startTime)) || (f.endTime != nil && evt.Timestamp.After(*f.endTime)) {
+		return false
+	}
+	fields := make(map[string]string, len(evt.Fields)+2)
+	for k, v := range evt.Fields {
+		fields[k] = v
+	}
+	// Steps such as fields may have removed host and source, but they are still known
+	fields["host"] = evt.Host
+	fields["source"] = evt.Source
+	return f.matches(evt.Raw, fields)
+}
+
+// matchesRow matches row using its group and column values as fields. A table has no raw, so fragments are matched
+// against all of the values of the row instead. Columns without a value, such as the sum of a field which was never
+// numeric, are missing from the fields.
+func (f *compiledSearchFilter) matchesRow(agg *AggregateResult, row AggregateRow) bool {
+	fields := make(map[string]string, len(agg.GroupBy)+len(agg.Columns))
+	values := make([]string, 0, len(agg.GroupBy)+len(agg.Columns))
+	for i, name := range agg.GroupBy {
+		if i < len(row.Group) {
+			fields[name] = row.Group[i]
+			values = append(values, row.Group[i])
+		}
+	}
+	for i, name := range agg.Columns {
+		if i < len(row.Values) && row.Values[i] != nil {
+			v := strconv.FormatFloat(*row.Values[i], 'f', -1, 64)
+			fields[name] = v
+			values = append(values, v)
+		}
+	}
+	return f.matches(strings.Join(values, " "), fields)
+}
+
+func (f *compiledSearchFilter) matches(raw string, fields map[string]string) bool {
+	for _, frag := range f.frags {
+		if !frag.MatchString(raw) {
+			return false
+		}
+	}
+	if anyMatch(f.notFrags, raw) {
+		return false
+	}
+	for _, frag := range f.fuzzyFrags {
+		if !frag.matches(raw) {
+			return false
+		}
+	}
+	return matchesFields(raw, fields, f.fields, f.notFields, f.srch.FieldComparisons, f.groups)
+}
+
+// compileSearchFilterStep compiles a search which is not the first step of the pipeline. It takes the same options as
+// the first search, except ids since there is no repository to get the events from.
+func compileSearchFilterStep(input string, options map[string]string) (pipelineStep, error) {
+	if _, ok := options["ids"]; ok {
+		return nil, errors.New("failed to create search: ids can only be given to the first search in the pipeline")
+	}
+	compiled, err := compileSearchStep(input, options)
+	if err != nil {
+		return nil, err
+	}
+	step := compiled.(*searchPipelineStep)
+	return &searchFilterPipelineStep{
+		srch:      step.srch,
+		startTime: step.startTime,
+		endTime:   step.endTime,
+		fuzzy:     step.fuzzy,
+	}, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+var searchFilterTestEvents = []events.EventWithExtractedFields{
+	{Id: 1, Raw: "GET /index.html status=200", Host: "a", Source: "access.log", Fields: map[string]string{"status": "200", "ms": "12"}},
+	{Id: 2, Raw: "GET /missing status=404", Host: "a", Source: "access.log", Fields: map[string]string{"status": "404", "ms": "3"}},
+	{Id: 3, Raw: "POST /login status=500 error", Host: "b", Source: "access.log", Fields: map[string]string{"status": "500", "ms": "250"}},
+	{Id: 4, Raw: "Error connecting to database", Host: "b", Source: "error.log", Fields: map[string]string{}},
+}
+
+func TestSearchFilterPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input       string
+		expectedIds []int64
+	}{
+		{"error", []int64{3, 4}},
+		{"NOT error", []int64{1, 2}},
+		{"status=404", []int64{2}},
+		{"status!=404", []int64{1, 3, 4}},
+		{"ms>10", []int64{1, 3}},
+		{"host=b source=error.log", []int64{4}},
+		{"status=200 OR status=500", []int64{1, 3}},
+		{"get* ms<5", []int64{2}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			sfs, err := compileSearchFilterStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchFilterPipelineStep got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			go sfs.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+
+			go func() {
+				input <- PipelineStepResult{Events: searchFilterTestEvents[:2]}
+				input <- PipelineStepResult{Events: searchFilterTestEvents[2:]}
+				close(input)
+			}()
+
+			actualIds := []int64{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actualIds = append(actualIds, evt.Id)
+				}
+			}
+			if !reflect.DeepEqual(actualIds, tt.expectedIds) {
+				t.Fatalf("TestSearchFilterPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+		})
+	}
+}
+
+func TestSearchFilterPipelineStep_Aggregate(t *testing.T) {
+	agg := &AggregateResult{
+		GroupBy: []string{"status"},
+		Columns: []string{"count", "ms"},
+		Rows: []AggregateRow{
+			{Group: []string{"200"}, Values: floats(150, 12.5)},
+			{Group: []string{"404"}, Values: floats(20, 3)},
+			{Group: []string{"500"}, Values: []*float64{floats(101)[0], nil}},
+		},
+	}
+	for _, tt := range []struct {
+		input    string
+		expected []string
+	}{
+		{"count>100", []string{"200", "500"}},
+		{"status=404", []string{"404"}},
+		{"NOT status=200", []string{"404", "500"}},
+		// The column is missing for the row where it has no value
+		{"ms<=12.5", []string{"200", "404"}},
+		// Fragments match any of the values in the row
+		{"12.5", []string{"200"}},
+		{"count>1000", []string{}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			sfs, err := compileSearchFilterStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchFilterPipelineStep_Aggregate got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			go sfs.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+			go func() {
+				input <- PipelineStepResult{Aggregate: agg}
+				close(input)
+			}()
+
+			actual := []string{}
+			for res := range output {
+				if res.Aggregate == nil {
+					t.Fatalf("TestSearchFilterPipelineStep_Aggregate expected an aggregate result but got %v", res)
+				}
+				if !reflect.DeepEqual(res.Aggregate.Columns, agg.Columns) {
+					t.Fatalf("TestSearchFilterPipelineStep_Aggregate expected columns=%v but got %v", agg.Columns, res.Aggregate.Columns)
+				}
+				for _, row := range res.Aggregate.Rows {
+					actual = append(actual, row.Group[0])
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestSearchFilterPipelineStep_Aggregate expected rows=%v but got %v", tt.expected, actual)
+			}
+			if len(agg.Rows) != 3 {
+				t.Fatalf("TestSearchFilterPipelineStep_Aggregate expected the input to be left as it was but got %v", agg.Rows)
+			}
+		})
+	}
+}
+
+func TestCompilePipeline_NestedSearch(t *testing.T) {
+	repo := events.InMemoryRepository()
+	now := time.Now()
+	evts := []events.Event{}
+	for i, status := range []string{"200", "200", "200", "404", "500", "500"} {
+		evts = append(evts, events.Event{Raw: "request status=" + status, Host: "a", Source: "access.log", Timestamp: now.Add(-time.Duration(i) * time.Second), Offset: int64(i)})
+	}
+	if _, err := repo.AddBatch(evts); err != nil {
+		t.Fatalf("TestCompilePipeline_NestedSearch got unexpected error when adding events: %v", err)
+	}
+
+	p, err := CompilePipeline("request | stats count by status | search count>1", nil, nil)
+	if err != nil {
+		t.Fatalf("TestCompilePipeline_NestedSearch got unexpected error: %v", err)
+	}
+	if _, ok := p.steps[2].(*searchFilterPipelineStep); !ok {
+		t.Fatalf("TestCompilePipeline_NestedSearch expected the last step to filter its input but got %T", p.steps[2])
+	}
+	actual := []string{}
+	for res := range p.Execute(context.Background(), PipelineParameters{Cfg: &config.Config{KeyValueExtraction: true}, EventsRepo: repo}) {
+		if res.Err != nil {
+			t.Fatalf("TestCompilePipeline_NestedSearch got unexpected error when executing: %v", res.Err)
+		}
+		if res.Aggregate != nil {
+			for _, row := range res.Aggregate.Rows {
+				actual = append(actual, row.Group[0])
+			}
+		}
+	}
+	if expected := []string{"200", "500"}; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestCompilePipeline_NestedSearch expected rows=%v but got %v", expected, actual)
+	}
+}
+
+func TestCompileSearchFilterStep_Errors(t *testing.T) {
+	_, err := CompilePipeline("request | search status=200 ids=1,2", nil, nil)
+	if err == nil {
+		t.Fatal("TestCompileSearchFilterStep_Errors expected an error when giving ids to a search after the first step but got nil")
+	}
+}
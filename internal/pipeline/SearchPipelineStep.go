@@ -17,47 +17,87 @@ package pipeline
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/araddon/dateparse"
+	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
 	"github.com/jackbister/logsuck/internal/search"
 )
 
 type searchPipelineStep struct {
 	srch               *search.Search
 	startTime, endTime *time.Time
+
+	// fuzzy is the edit distance words may be from the fragments of the search and still match, or 0 if they have to
+	// match exactly.
+	fuzzy int
 }
 
 func (s *searchPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
 	defer close(pipe.output)
-	inputEvents := params.EventsRepo.FilterStream(s.srch, s.startTime, s.endTime)
-	compiledFrags := compileKeys(s.srch.Fragments)
-	compiledNotFrags := compileKeys(s.srch.NotFragments)
-	compiledFields := compileFieldValues(s.srch.Fields)
-	compiledNotFields := compileFieldValues(s.srch.NotFields)
+	repoSrch := repositorySearch(s.srch, params.Cfg.CaseSensitive)
+	logger := logging.OrDefault(params.Cfg.Logger)
+	frags := s.srch.Fragments
+	var fuzzyFrags []*fuzzyFragment
+	if s.fuzzy > 0 {
+		// Full text search can not match words approximately, so the repository is not given the fuzzy fragments and
+		// returns every event matching the rest of the search, which are then checked here
+		fuzzyFrags, frags = compileFuzzyFrags(s.srch.Fragments, s.fuzzy, params.Cfg.CaseSensitive)
+		exact := *repoSrch
+		exact.Fragments = frags
+		repoSrch = &exact
+	}
+	inputEvents := filterStream(ctx, params.EventsRepo, params.Cfg, repoSrch, s.startTime, s.endTime)
+	compiledFrags := compileWildcardFrags(frags, params.Cfg.CaseSensitive, logger)
+	compiledNotFrags := compileWildcardFrags(s.srch.NotFragments, params.Cfg.CaseSensitive, logger)
+	compiledFields := compileFieldValues(s.srch.Fields, params.Cfg.CaseSensitive, logger)
+	compiledNotFields := compileFieldValues(s.srch.NotFields, params.Cfg.CaseSensitive, logger)
+	compiledGroups := compileExpressions(s.srch.Groups, params.Cfg.CaseSensitive, logger)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case evts, ok := <-inputEvents:
+		case page, ok := <-inputEvents:
 			if !ok {
 				return
 			}
+			if page.Err != nil {
+				pipe.output <- PipelineStepResult{Err: fmt.Errorf("error searching events: %w", page.Err)}
+				return
+			}
 			retEvts := make([]events.EventWithExtractedFields, 0)
-			for _, evt := range evts {
-				evtFields, include := shouldIncludeEvent(evt, params.Cfg, compiledFrags, compiledNotFrags, compiledFields, compiledNotFields)
-				if include {
-					retEvts = append(retEvts, events.EventWithExtractedFields{
-						Id:        evt.Id,
-						Raw:       evt.Raw,
-						Timestamp: evt.Timestamp,
-						Host:      evt.Host,
-						Source:    evt.Source,
-						Fields:    evtFields,
-					})
+			retBytes := 0
+			for _, evt := range page.Events {
+				evtFields, include := shouldIncludeEvent(evt, params.Cfg, compiledFrags, compiledNotFrags, fuzzyFrags, compiledFields, compiledNotFields, s.srch.FieldComparisons, compiledGroups)
+				if !include {
+					continue
+				}
+				retEvt := events.EventWithExtractedFields{
+					Id:        evt.Id,
+					Raw:       evt.Raw,
+					Timestamp: evt.Timestamp,
+					Host:      evt.Host,
+					Source:    evt.Source,
+					Fields:    evtFields,
 				}
+				// The events matched so far are sent before the one which would make the result too large, which
+				// keeps them in order
+				size := eventSize(retEvt)
+				if len(retEvts) > 0 && resultFull(params.Cfg.Search, len(retEvts)+1, retBytes+size) {
+					select {
+					case pipe.output <- PipelineStepResult{Events: retEvts}:
+					case <-ctx.Done():
+						return
+					}
+					retEvts = make([]events.EventWithExtractedFields, 0)
+					retBytes = 0
+				}
+				retEvts = append(retEvts, retEvt)
+				retBytes += size
 			}
 			pipe.output <- PipelineStepResult{
 				Events: retEvts,
@@ -66,6 +106,23 @@ func (s *searchPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, par
 	}
 }
 
+// resultFull returns true if a result with numEvents events of numBytes bytes in total would be larger than cfg allows.
+func resultFull(cfg *config.SearchConfig, numEvents, numBytes int) bool {
+	if cfg == nil {
+		return false
+	}
+	return (cfg.MaxResultEvents > 0 && numEvents > cfg.MaxResultEvents) || (cfg.MaxResultBytes > 0 && numBytes > cfg.MaxResultBytes)
+}
+
+// eventSize returns the number of bytes in the raw and fields of evt, which is most of the memory it uses.
+func eventSize(evt events.EventWithExtractedFields) int {
+	n := len(evt.Raw)
+	for k, v := range evt.Fields {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
 func compileSearchStep(input string, options map[string]string) (pipelineStep, error) {
 	var startTime, endTime *time.Time
 	if t, ok := options["startTime"]; ok {
@@ -82,14 +139,97 @@ func compileSearchStep(input string, options map[string]string) (pipelineStep, e
 		}
 		endTime = &endTimeParsed
 	}
+	var fuzzy int
+	if f, ok := options["fuzzy"]; ok {
+		parsed, err := strconv.Atoi(f)
+		if err != nil || parsed < 0 || parsed > MaxFuzzyDistance {
+			return nil, fmt.Errorf("failed to create search: fuzzy must be a number between 0 and %v but got '%v'", MaxFuzzyDistance, f)
+		}
+		fuzzy = parsed
+	}
+	var ids []int64
+	if s, ok := options["ids"]; ok {
+		ids = []int64{}
+		for _, idString := range ParseFieldList(s) {
+			id, err := strconv.ParseInt(idString, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create search: ids must be a list of event ids but got '%v'", s)
+			}
+			ids = append(ids, id)
+		}
+	}
 
 	srch, err := search.Parse(input)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create search: %w", err)
 	}
+	srch.Ids = ids
+	startTime, endTime = searchTimeRange(srch, startTime, endTime)
 	return &searchPipelineStep{
 		srch:      srch,
 		startTime: startTime,
 		endTime:   endTime,
+		fuzzy:     fuzzy,
 	}, nil
 }
+
+// searchTimeRange returns the intersection of the earliest/latest range in srch and the given range,
+// since both ranges have to be satisfied.
+func searchTimeRange(srch *search.Search, startTime, endTime *time.Time) (*time.Time, *time.Time) {
+	if srch.StartTime != nil && (startTime == nil || srch.StartTime.After(*startTime)) {
+		startTime = srch.StartTime
+	}
+	if srch.EndTime != nil && (endTime == nil || srch.EndTime.Before(*endTime)) {
+		endTime = srch.EndTime
+	}
+	return startTime, endTime
+}
+
+// idsPageSize is the number of events filterStream sends at a time when searching within a set of ids.
+const idsPageSize = 1000
+
+// filterStream returns the events matching srch between startTime and endTime from repo, which the search step and
+// the other ways of searching then filter further. srch should be the result of repositorySearch.
+// If srch has Ids the repository is not searched. Only the events with those ids are fetched, and they are matched
+// against the parts of srch which the repository would have matched here, so every way of searching behaves the same.
+func filterStream(ctx context.Context, repo events.Repository, cfg *config.Config, srch *search.Search, startTime, endTime *time.Time) <-chan events.FilterStreamPage {
+	if srch.Ids == nil {
+		return repo.FilterStream(ctx, srch, startTime, endTime)
+	}
+	ret := make(chan events.FilterStreamPage)
+	go func() {
+		defer close(ret)
+		evts, err := events.GetByIdsContext(ctx, repo, srch.Ids, events.SortModeTimestampDesc)
+		if ctx.Err() != nil {
+			return
+		}
+		if srch.OldestFirst {
+			for i, j := 0, len(evts)-1; i < j; i, j = i+1, j-1 {
+				evts[i], evts[j] = evts[j], evts[i]
+			}
+		}
+		if err != nil {
+			select {
+			case ret <- events.FilterStreamPage{Err: fmt.Errorf("error getting events by id: %w", err)}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		matches := repositoryMatcher(srch, cfg.CaseSensitive, logging.OrDefault(cfg.Logger))
+		page := make([]events.EventWithId, 0, idsPageSize)
+		for i, evt := range evts {
+			if (startTime == nil || !evt.Timestamp.Before(*startTime)) && (endTime == nil || !evt.Timestamp.After(*endTime)) && matches(evt) {
+				page = append(page, evt)
+			}
+			if len(page) == idsPageSize || (i == len(evts)-1 && len(page) > 0) {
+				select {
+				case ret <- events.FilterStreamPage{Events: page}:
+				case <-ctx.Done():
+					return
+				}
+				page = make([]events.EventWithId, 0, idsPageSize)
+			}
+		}
+	}()
+	return ret
+}
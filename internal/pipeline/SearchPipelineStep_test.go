@@ -16,11 +16,17 @@ package pipeline
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/search"
 )
 
 func TestSearchPipelineStep(t *testing.T) {
@@ -59,3 +65,1208 @@ func TestSearchPipelineStep(t *testing.T) {
 		t.Fatal("TestSearchPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
 	}
 }
+
+func TestSearchPipelineStep_HostFilter(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{
+			Raw:       "2021-01-20 20:29:00 error when handling request",
+			Host:      "web01",
+			Offset:    0,
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC),
+		},
+		{
+			Raw:       "2021-01-20 20:29:01 error when handling request",
+			Host:      "web02",
+			Offset:    0,
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC),
+		},
+	})
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search       string
+		expectedHost string
+	}{
+		{"host=web01 error", "web01"},
+		{"host!=web01", "web02"},
+		{"error host!=web01", "web02"},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_HostFilter got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			evts := []events.EventWithExtractedFields{}
+			for res := range output {
+				evts = append(evts, res.Events...)
+			}
+			if len(evts) != 1 {
+				t.Fatalf("TestSearchPipelineStep_HostFilter got unexpected number of events, expected 1 but got %v", len(evts))
+			}
+			if evts[0].Host != tt.expectedHost {
+				t.Fatalf("TestSearchPipelineStep_HostFilter got unexpected host, expected '%v' but got '%v'", tt.expectedHost, evts[0].Host)
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_SourcePatterns(t *testing.T) {
+	sources := []string{"app-1.log", "app-2.log", "db.log", "app-admin.txt"}
+	evts := make([]events.Event, len(sources))
+	raws := make([]string, len(sources))
+	for i, source := range sources {
+		raws[i] = fmt.Sprintf("2021-01-20 20:29:0%v request handled", i)
+		evts[i] = events.Event{
+			Raw:       raws[i],
+			Host:      "MYHOST",
+			Offset:    0,
+			Source:    source,
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+
+	for name, repo := range map[string]events.Repository{"sqlite": newInMemRepo(t), "inMemory": events.InMemoryRepository()} {
+		_, err := repo.AddBatch(evts)
+		if err != nil {
+			t.Fatalf("TestSearchPipelineStep_SourcePatterns got error when adding events: %v", err)
+		}
+		params := PipelineParameters{Cfg: &config.Config{}, EventsRepo: repo}
+		for _, tt := range []struct {
+			search   string
+			expected []string
+		}{
+			{"source=app-*", []string{raws[3], raws[1], raws[0]}},
+			{"source=*.log", []string{raws[2], raws[1], raws[0]}},
+			{"source=app-*.log", []string{raws[1], raws[0]}},
+			{"source=app-1.log", []string{raws[0]}},
+			{"source=APP-1.LOG", []string{raws[0]}},
+			{"source!=app-*", []string{raws[2]}},
+			{"source!=*.log", []string{raws[3]}},
+			{"source!=app-*.log", []string{raws[3], raws[2]}},
+			{"source!=db.log request", []string{raws[3], raws[1], raws[0]}},
+			{"source IN (db*, *.txt)", []string{raws[3], raws[2]}},
+			{"source NOT IN (*-1.log, *.txt)", []string{raws[2], raws[1]}},
+		} {
+			t.Run(name+"_"+tt.search, func(t *testing.T) {
+				actual := executeSearch(t, tt.search, params)
+				if !reflect.DeepEqual(actual, tt.expected) {
+					t.Fatalf("TestSearchPipelineStep_SourcePatterns expected events=%v but got %v", tt.expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestSearchPipelineStep_FieldComparisons(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{
+		"status=200 time=0.1",
+		"status=404 time=0.5",
+		"status=500 time=1.25",
+		"status=503 time=slow",
+		"status=unknown time=0.2",
+		"no fields here",
+	}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=([\\w.]+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []string
+	}{
+		{"status>=500", []string{"status=503 time=slow", "status=500 time=1.25"}},
+		{"status>500", []string{"status=503 time=slow"}},
+		{"status<=404", []string{"status=404 time=0.5", "status=200 time=0.1"}},
+		{"time<0.5", []string{"status=unknown time=0.2", "status=200 time=0.1"}},
+		{"time>=0.5 status<503", []string{"status=500 time=1.25", "status=404 time=0.5"}},
+		{"missing>0", []string{}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_FieldComparisons got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			actual := []string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Raw)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_FieldComparisons expected events=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_FieldComparisons expected events=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_OrGroups(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{
+		"ERROR status=500 path=/api",
+		"warning status=503 path=/api",
+		"info status=200 path=/api",
+		"error status=500 path=/health",
+	}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=([\\w/]+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []string
+	}{
+		{"error OR warning", []string{raws[3], raws[1], raws[0]}},
+		{"(status=500 OR status=503) path=/api", []string{raws[1], raws[0]}},
+		{"status=500 OR status=503 path=/api", []string{raws[3], raws[1], raws[0]}},
+		{"NOT (error OR warning)", []string{raws[2]}},
+		// Only events matching every term of the group are excluded, so raws[0] which has status=500 but another path
+		// and raws[1] which has neither are kept
+		{"NOT (status=500 path=/health)", []string{raws[2], raws[1], raws[0]}},
+		{"NOT (error path=/health)", []string{raws[2], raws[1], raws[0]}},
+		{"NOT (status=500 path=/api) NOT (error path=/health)", []string{raws[2], raws[1]}},
+		{"path=/api NOT (status>=500 info)", []string{raws[2], raws[1], raws[0]}},
+		{"NOT (status>=500 path=/api)", []string{raws[3], raws[2]}},
+		{"path=/api (info OR (warning status>500))", []string{raws[2], raws[1]}},
+		{"status=500 status=503", []string{raws[3], raws[1], raws[0]}},
+		{"status=500 status=503 path=/api", []string{raws[1], raws[0]}},
+		{"status=500 status IN (503, 200) path=/api", []string{raws[2], raws[1], raws[0]}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_OrGroups got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			actual := []string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Raw)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_OrGroups expected events=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_OrGroups expected events=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_SameMatchingInsideGroups(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "compiled c++ code", Host: "web01", Source: "my-log.txt", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "matched a.b here", Host: "web02", Source: "my-log.txt", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "matched axb here", Host: "web03", Source: "my-log.txt", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	run := func(search string) []string {
+		sps, err := compileSearchStep(search, map[string]string{})
+		if err != nil {
+			t.Fatalf("TestSearchPipelineStep_SameMatchingInsideGroups got unexpected error when compiling '%v': %v", search, err)
+		}
+		pipe, input, output := newPipe()
+		close(input)
+		go sps.Execute(context.Background(), pipe, params)
+		raws := []string{}
+		for res := range output {
+			for _, evt := range res.Events {
+				raws = append(raws, evt.Raw)
+			}
+		}
+		return raws
+	}
+
+	for _, tt := range []struct {
+		term     string
+		expected string
+	}{
+		{"c++", "compiled c++ code"},
+		{"a.b", "matched a.b here"},
+		{"COMPILED", "compiled c++ code"},
+		{"host=WEB01", "compiled c++ code"},
+		{"source=MY-LOG.txt c++", "compiled c++ code"},
+	} {
+		t.Run(tt.term, func(t *testing.T) {
+			outside := run(tt.term)
+			inside := run("(" + tt.term + " OR nonexistent)")
+			if len(outside) != 1 || outside[0] != tt.expected {
+				t.Fatalf("TestSearchPipelineStep_SameMatchingInsideGroups expected '%v' to match ['%v'] but got %v", tt.term, tt.expected, outside)
+			}
+			if len(inside) != 1 || inside[0] != tt.expected {
+				t.Fatalf("TestSearchPipelineStep_SameMatchingInsideGroups expected '%v' inside a group to match ['%v'] but got %v", tt.term, tt.expected, inside)
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_Phrases(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "connection refused by peer", Host: "web01", Source: "my-log.txt", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "refused connection", Host: "web01", Source: "my-log.txt", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "user said \"hello world\" twice", Host: "web01", Source: "my-log.txt", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []string
+	}{
+		{"\"connection refused\"", []string{"connection refused by peer"}},
+		{"connection refused", []string{"refused connection", "connection refused by peer"}},
+		{"NOT \"connection refused\"", []string{"user said \"hello world\" twice", "refused connection"}},
+		{"(\"connection refused\" OR nonexistent)", []string{"connection refused by peer"}},
+		{"\"said \\\"hello world\\\"\"", []string{"user said \"hello world\" twice"}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_Phrases got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+			go sps.Execute(context.Background(), pipe, params)
+			actual := []string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Raw)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_Phrases expected events=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_Phrases expected events=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_Wildcards(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "GET /api/v1/users version=1.2.3", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "GET /static/app.js version=1x2x3", Host: "web01", Source: "accessxlog", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "connection refused", Host: "db01", Source: "db.log", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+		{Raw: "connection timed out", Host: "web03", Source: "access.log", Offset: 3, Timestamp: time.Date(2021, 1, 20, 20, 29, 3, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{
+				regexp.MustCompile("(\\w+)=(\\S+)"),
+				regexp.MustCompile("(?i)GET (?P<path>\\S+)"),
+			},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []int64
+	}{
+		{"path=/api/*", []int64{1}},
+		{"path=/api", []int64{}},
+		{"path=/api/v1/users", []int64{1}},
+		{"host=web*", []int64{4, 2, 1}},
+		{"host=*01", []int64{3, 2, 1}},
+		{"host=w*3", []int64{4}},
+		{"host=w*3 OR host=db*", []int64{4, 3}},
+		{"NOT host=*01", []int64{4}},
+		{"source=*.log", []int64{4, 3, 1}},
+		{"source=access.log", []int64{4, 1}},
+		{"version=1.2.3", []int64{1}},
+		{"conn*", []int64{4, 3}},
+		{"*fused", []int64{3}},
+		{"con*out", []int64{4}},
+		{"NOT *fused", []int64{4, 2, 1}},
+		{"\"connection *\"", []int64{4, 3}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_Wildcards got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+			go sps.Execute(context.Background(), pipe, params)
+			actual := []int64{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Id)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_Wildcards expected ids=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_Wildcards expected ids=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_FieldExtractorsForSource(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "status=500", Host: "web01", Source: "app.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "GET / 500", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			IndexedFiles: []config.IndexedFileConfig{
+				{Filename: "access.*", FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(?i)get \\S+ (?P<status>\\d+)")}},
+			},
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	sps, err := compileSearchStep("status=500", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestSearchPipelineStep_FieldExtractorsForSource got unexpected error: %v", err)
+	}
+	pipe, input, output := newPipe()
+	close(input)
+	go sps.Execute(context.Background(), pipe, params)
+	actual := []string{}
+	for res := range output {
+		for _, evt := range res.Events {
+			actual = append(actual, evt.Source)
+		}
+	}
+	if len(actual) != 2 || actual[0] != "access.log" || actual[1] != "app.log" {
+		t.Fatalf("TestSearchPipelineStep_FieldExtractorsForSource expected sources=[access.log app.log] but got %v", actual)
+	}
+}
+
+func TestShouldIncludeEvent_NotFieldsWithMissingFields(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\S+)")},
+	}
+	for _, tt := range []struct {
+		search   string
+		raw      string
+		expected bool
+	}{
+		{"status!=500 path!=/health", "path=/health", false},
+		{"status!=500 path!=/health", "status=500", false},
+		{"status!=500 path!=/health", "path=/api", true},
+		{"a!=1 b!=2 c!=3 d!=4", "d=4", false},
+		{"a!=1 b!=2 c!=3 d!=4", "a=1", false},
+		{"a!=1 b!=2 c!=3 d!=4", "other=1", true},
+		{"status NOT IN (500, 503) path!=/health", "status=503", false},
+	} {
+		t.Run(tt.search+"_"+tt.raw, func(t *testing.T) {
+			srch, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestShouldIncludeEvent_NotFieldsWithMissingFields got unexpected error: %v", err)
+			}
+			s := srch.(*searchPipelineStep).srch
+			compiledNotFields := compileFieldValues(s.NotFields, false, logging.Nop())
+			// The fields are iterated in random order, so evaluate several times to try different orders
+			for i := 0; i < 20; i++ {
+				_, include := shouldIncludeEvent(events.EventWithId{Id: 1, Raw: tt.raw, Host: "host", Source: "log.txt"}, cfg,
+					nil, nil, nil, nil, compiledNotFields, nil, nil)
+				if include != tt.expected {
+					t.Fatalf("TestShouldIncludeEvent_NotFieldsWithMissingFields expected include=%v but got %v", tt.expected, include)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_BuiltinFieldsTakePrecedence(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "source=upstream.log host=other message", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\S+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected int
+	}{
+		{"source=access.log", 1},
+		{"source=upstream.log", 0},
+		{"host=web01", 1},
+		{"host=other", 0},
+		{"message | rex \"(?P<source>upstream\\.log)\" | where source=access.log", 1},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			p, err := CompilePipeline(tt.search, nil, nil)
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_BuiltinFieldsTakePrecedence got unexpected error: %v", err)
+			}
+			actual := 0
+			for res := range p.Execute(context.Background(), params) {
+				for _, evt := range res.Events {
+					if evt.Fields["source"] != "access.log" || evt.Fields["host"] != "web01" {
+						t.Fatalf("TestSearchPipelineStep_BuiltinFieldsTakePrecedence expected source=access.log, host=web01 but got %v", evt.Fields)
+					}
+					actual++
+				}
+			}
+			if actual != tt.expected {
+				t.Fatalf("TestSearchPipelineStep_BuiltinFieldsTakePrecedence expected %v events but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_FtsSyntax(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{`opened c:\path\file.txt`, `opened c path file`, `range a-b done`, `range a b done`, `say "hi" now`, `say hi now`, `call f(x) ok`, `call f x ok`}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{Raw: raw, Host: "localhost", Source: "log.txt", Offset: int64(i), Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC)}
+	}
+	_, err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	params := PipelineParameters{Cfg: &config.Config{}, EventsRepo: repo}
+	// These used to cause a syntax error in the MATCH expression or match the wrong events
+	for _, tt := range []struct {
+		search   string
+		expected []string
+	}{
+		{`"c:\path"`, []string{`opened c:\path\file.txt`}},
+		{`opened NOT "c:\path"`, []string{`opened c path file`}},
+		{`range NOT "a-b"`, []string{`range a b done`}},
+		{`"\"hi\""`, []string{`say "hi" now`}},
+		{`say NOT "\"hi\""`, []string{`say hi now`}},
+		{`"f(x)"`, []string{`call f(x) ok`}},
+		{`call NOT "f(x)"`, []string{`call f x ok`}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			actual := executeSearch(t, tt.search, params)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_FtsSyntax expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_Regex(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "path=/api/v1/users", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "path=/api/vx/users", Host: "web01", Source: "access.log", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "path=/static/api/v2", Host: "web01", Source: "access.log", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+		{Raw: "no path here", Host: "web02", Source: "access.log", Offset: 3, Timestamp: time.Date(2021, 1, 20, 20, 29, 3, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\S+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []int64
+	}{
+		{"path=~\"^/api/v[0-9]+\"", []int64{1}},
+		{"path=~\"api/v[0-9]\"", []int64{3, 1}},
+		{"path!~\"^/api/\"", []int64{4, 3}},
+		// Without the regex operator the value is matched literally, so the brackets are not a character class
+		{"path=\"/api/v[0-9]*\"", []int64{}},
+		{"(path=~\"^/static\" OR host=~\"02$\")", []int64{4, 3}},
+		{"host=~\"^WEB\"", []int64{4, 3, 2, 1}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_Regex got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+			go sps.Execute(context.Background(), pipe, params)
+			actual := []int64{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Id)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_Regex expected ids=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_Regex expected ids=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_Fuzzy(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "failed to receive message", Host: "web01", Source: "app.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "Failed to recieve message", Host: "web01", Source: "app.log", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "failed to send message", Host: "web01", Source: "app.log", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+		{Raw: "received a recipe from 10.0.0.1", Host: "web02", Source: "app.log", Offset: 3, Timestamp: time.Date(2021, 1, 20, 20, 29, 3, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg:        &config.Config{},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []int64
+	}{
+		{"receive", []int64{1}},
+		{"| search fuzzy=0 receive", []int64{1}},
+		{"| search fuzzy=1 receive", []int64{4, 1}},
+		{"| search fuzzy=2 receive", []int64{4, 2, 1}},
+		{"| search fuzzy=2 RECEIVE", []int64{4, 2, 1}},
+		{"| search fuzzy=2 receive failed", []int64{2, 1}},
+		{"| search fuzzy=2 receive NOT failed", []int64{4}},
+		{"| search fuzzy=2 receive host=web01", []int64{2, 1}},
+		{"| search fuzzy=1 timeout", []int64{}},
+		// Fragments which are not a single word are still matched exactly
+		{"| search fuzzy=1 10.0.0.2", []int64{}},
+		{"| search fuzzy=1 10.0.0.1", []int64{4}},
+		{"| search fuzzy=1 rec*", []int64{4, 2, 1}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			p, err := CompilePipeline(tt.search, nil, nil)
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_Fuzzy got unexpected error: %v", err)
+			}
+			actual := []int64{}
+			for res := range p.Execute(context.Background(), params) {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Id)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_Fuzzy expected ids=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_Fuzzy expected ids=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSearchStep_FuzzyErrors(t *testing.T) {
+	for _, fuzzy := range []string{"-1", "4", "one", "1.5"} {
+		_, err := compileSearchStep("receive", map[string]string{"fuzzy": fuzzy})
+		if err == nil {
+			t.Fatalf("TestCompileSearchStep_FuzzyErrors expected an error for fuzzy=%v but got nil", fuzzy)
+		}
+	}
+}
+
+func TestSearchPipelineStep_Ids(t *testing.T) {
+	repo := newInMemRepo(t)
+	repo.AddBatch([]events.Event{
+		{Raw: "error status=500", Host: "web01", Source: "access.log", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "error status=503", Host: "web02", Source: "access.log", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "info status=200", Host: "web01", Source: "access.log", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+		{Raw: "error status=500", Host: "web01", Source: "other.log", Offset: 3, Timestamp: time.Date(2021, 1, 20, 20, 29, 3, 0, time.UTC)},
+		{Raw: "error status=502", Host: "web02", Source: "access.log", Offset: 4, Timestamp: time.Date(2021, 1, 20, 20, 29, 4, 0, time.UTC)},
+	})
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+		},
+		EventsRepo: repo,
+	}
+	startTime := time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)
+
+	for _, tt := range []struct {
+		search    string
+		startTime *time.Time
+		expected  []int64
+	}{
+		{`| search ids="1,2,3"`, nil, []int64{3, 2, 1}},
+		{`| search ids="1,2,3" error`, nil, []int64{2, 1}},
+		{`| search ids="1 4 5" NOT host=web02`, nil, []int64{4, 1}},
+		{`| search ids="1,2,4,5" error status=500`, nil, []int64{4, 1}},
+		{`| search ids="1,2,3,4,5" error source=access.log status!=500`, nil, []int64{5, 2}},
+		{`| search ids="1,2,3,4"`, &startTime, []int64{4, 3, 2}},
+		{`| search ids="2,99"`, nil, []int64{2}},
+		{`| search ids="" error`, nil, []int64{}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			p, err := CompilePipeline(tt.search, tt.startTime, nil)
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_Ids got unexpected error: %v", err)
+			}
+			actual := []int64{}
+			for res := range p.Execute(context.Background(), params) {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Id)
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_Ids expected ids=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+
+	_, err := compileSearchStep("error", map[string]string{"ids": "1,two"})
+	if err == nil {
+		t.Fatal("TestSearchPipelineStep_Ids expected an error for ids which are not numbers but got nil")
+	}
+}
+
+func TestSearchPipelineStep_ResultLimits(t *testing.T) {
+	repo := newInMemRepo(t)
+	evts := []events.Event{}
+	for i := 0; i < 10; i++ {
+		raw := fmt.Sprintf("event number %v", i)
+		if i == 4 {
+			raw += " with a raw which is longer than the byte limit on its own"
+		}
+		evts = append(evts, events.Event{Raw: raw, Host: "web01", Source: "app.log", Offset: int64(i), Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC)})
+	}
+	repo.AddBatch(evts)
+
+	run := func(srchCfg *config.SearchConfig) ([][]events.EventWithExtractedFields, []int64) {
+		sps, err := compileSearchStep("event", map[string]string{})
+		if err != nil {
+			t.Fatalf("TestSearchPipelineStep_ResultLimits got unexpected error: %v", err)
+		}
+		pipe, input, output := newPipe()
+		close(input)
+		go sps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{Search: srchCfg}, EventsRepo: repo})
+		results := [][]events.EventWithExtractedFields{}
+		ids := []int64{}
+		for res := range output {
+			results = append(results, res.Events)
+			for _, evt := range res.Events {
+				ids = append(ids, evt.Id)
+			}
+		}
+		return results, ids
+	}
+
+	_, expectedIds := run(nil)
+	if len(expectedIds) != 10 {
+		t.Fatalf("TestSearchPipelineStep_ResultLimits expected 10 events without limits but got %v", expectedIds)
+	}
+	for _, tt := range []struct {
+		name      string
+		cfg       *config.SearchConfig
+		maxEvents int
+		maxBytes  int
+	}{
+		{"maxResultEvents", &config.SearchConfig{MaxResultEvents: 3}, 3, 0},
+		{"maxResultBytes", &config.SearchConfig{MaxResultBytes: 40}, 0, 40},
+		{"both", &config.SearchConfig{MaxResultEvents: 2, MaxResultBytes: 20}, 2, 20},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			results, ids := run(tt.cfg)
+			if !reflect.DeepEqual(ids, expectedIds) {
+				t.Fatalf("TestSearchPipelineStep_ResultLimits expected the events in the same order as without limits, ids=%v, but got %v", expectedIds, ids)
+			}
+			if len(results) < 2 {
+				t.Fatalf("TestSearchPipelineStep_ResultLimits expected the page to be split into several results but got %v", len(results))
+			}
+			for _, res := range results {
+				if tt.maxEvents > 0 && len(res) > tt.maxEvents {
+					t.Fatalf("TestSearchPipelineStep_ResultLimits got a result with numEvents=%v, expected at most %v", len(res), tt.maxEvents)
+				}
+				size := 0
+				for _, evt := range res {
+					size += eventSize(evt)
+				}
+				// An event larger than the limit is sent on its own
+				if tt.maxBytes > 0 && size > tt.maxBytes && len(res) > 1 {
+					t.Fatalf("TestSearchPipelineStep_ResultLimits got a result with numBytes=%v, expected at most %v", size, tt.maxBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSearchStep_EarliestLatest(t *testing.T) {
+	sps, err := compileSearchStep("error earliest=-1h", map[string]string{
+		"startTime": time.Now().Add(-24 * time.Hour).Format(time.RFC3339Nano),
+		"endTime":   time.Now().Add(-30 * time.Minute).Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		t.Fatalf("TestCompileSearchStep_EarliestLatest got unexpected error: %v", err)
+	}
+	step := sps.(*searchPipelineStep)
+	// earliest=-1h is later than the startTime option, while the endTime option is earlier than the implied latest=now
+	if step.startTime == nil || time.Since(*step.startTime) > 61*time.Minute {
+		t.Fatalf("TestCompileSearchStep_EarliestLatest expected startTime to be about an hour ago but got %v", step.startTime)
+	}
+	if step.endTime == nil || time.Since(*step.endTime) < 29*time.Minute {
+		t.Fatalf("TestCompileSearchStep_EarliestLatest expected endTime to be about 30 minutes ago but got %v", step.endTime)
+	}
+}
+
+func TestSearchPipelineStep_FieldExists(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{
+		"login user=alice status=200",
+		"login user=bob status=500 trace_id=abc",
+		"healthcheck status=200",
+		"request status=500 trace_id=def",
+	}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	for _, tt := range []struct {
+		search   string
+		expected []string
+	}{
+		{"user=*", []string{raws[1], raws[0]}},
+		{"user!=*", []string{raws[3], raws[2]}},
+		{"NOT user=*", []string{raws[3], raws[2]}},
+		{"user=* status=500", []string{raws[1]}},
+		{"user=* NOT trace_id=*", []string{raws[0]}},
+		{"user=* OR trace_id=*", []string{raws[3], raws[1], raws[0]}},
+		{"status!=200 NOT user=*", []string{raws[3]}},
+		{"host=* missing=*", []string{}},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			sps, err := compileSearchStep(tt.search, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSearchPipelineStep_FieldExists got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			close(input)
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			actual := []string{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Raw)
+				}
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("TestSearchPipelineStep_FieldExists expected events=%v but got %v", tt.expected, actual)
+			}
+			for i := range actual {
+				if actual[i] != tt.expected[i] {
+					t.Fatalf("TestSearchPipelineStep_FieldExists expected events=%v but got %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPipelineStep_CaseSensitive(t *testing.T) {
+	repo := newInMemRepo(t)
+	raws := []string{
+		"ERROR user=Alice failed",
+		"error user=alice failed",
+		"info User=BOB ok",
+	}
+	evts := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		evts[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, i, 0, time.UTC),
+		}
+	}
+	repo.AddBatch(evts)
+
+	for _, tt := range []struct {
+		search      string
+		insensitive []string
+		sensitive   []string
+	}{
+		{"error", []string{raws[1], raws[0]}, []string{raws[1]}},
+		{"ERROR", []string{raws[1], raws[0]}, []string{raws[0]}},
+		{"NOT ERROR", []string{raws[2]}, []string{raws[2], raws[1]}},
+		{"err*", []string{raws[1], raws[0]}, []string{raws[1]}},
+		{"user=Alice", []string{raws[1], raws[0]}, []string{raws[0]}},
+		{"user!=Alice", []string{raws[2]}, []string{raws[2], raws[1]}},
+		{"user=bob", []string{raws[2]}, []string{}},
+		{"user=BOB", []string{raws[2]}, []string{raws[2]}},
+		{"host=myhost", []string{raws[2], raws[1], raws[0]}, []string{}},
+		{"host!=myhost", []string{}, []string{raws[2], raws[1], raws[0]}},
+		{"(ERROR OR info) failed", []string{raws[1], raws[0]}, []string{raws[0]}},
+		{`user=~"^Alice$"`, []string{raws[1], raws[0]}, []string{raws[0]}},
+		{`user!~"^alice$"`, []string{raws[2]}, []string{raws[2], raws[0]}},
+		{`user=~"^[A-Z]+$"`, []string{raws[2], raws[1], raws[0]}, []string{raws[2]}},
+	} {
+		for _, caseSensitive := range []bool{false, true} {
+			expected := tt.insensitive
+			if caseSensitive {
+				expected = tt.sensitive
+			}
+			t.Run(fmt.Sprintf("%v_%v", tt.search, caseSensitive), func(t *testing.T) {
+				cfg := &config.Config{
+					FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+					CaseSensitive:   caseSensitive,
+				}
+				sps, err := compileSearchStep(tt.search, map[string]string{})
+				if err != nil {
+					t.Fatalf("TestSearchPipelineStep_CaseSensitive got unexpected error: %v", err)
+				}
+				pipe, input, output := newPipe()
+				close(input)
+
+				go sps.Execute(context.Background(), pipe, PipelineParameters{Cfg: cfg, EventsRepo: repo})
+
+				actual := []string{}
+				for res := range output {
+					for _, evt := range res.Events {
+						actual = append(actual, evt.Raw)
+					}
+				}
+				if !reflect.DeepEqual(actual, expected) {
+					t.Fatalf("TestSearchPipelineStep_CaseSensitive expected events=%v but got %v", expected, actual)
+				}
+
+				count, err := Count(context.Background(), repo, cfg, sps.(*searchPipelineStep).srch, nil, nil)
+				if err != nil {
+					t.Fatalf("TestSearchPipelineStep_CaseSensitive got unexpected error from Count: %v", err)
+				}
+				if count != int64(len(expected)) {
+					t.Fatalf("TestSearchPipelineStep_CaseSensitive expected count=%v but got %v", len(expected), count)
+				}
+			})
+		}
+	}
+}
+
+func TestSearchPipelineStep_PreserveFieldCase(t *testing.T) {
+	cfg := &config.Config{
+		FieldExtractors:   []*regexp.Regexp{regexp.MustCompile("^(?P<Level>[A-Z]+) "), regexp.MustCompile("(\\w+)=(\\w+)")},
+		PreserveFieldCase: true,
+	}
+	raws := []string{
+		"ERROR User=Alice failed",
+		"INFO User=BOB ok",
+	}
+	stored, extracted := newStoredFieldsRepos(t, &config.Config{
+		FieldExtractors:   cfg.FieldExtractors,
+		PreserveFieldCase: true,
+		StoreFields:       true,
+	}, raws)
+
+	for _, tt := range []struct {
+		search         string
+		expectedRaws   []string
+		expectedFields []map[string]string
+	}{
+		{"error", []string{raws[0]}, []map[string]string{{"level": "ERROR", "user": "Alice"}}},
+		{"Failed", []string{raws[0]}, []map[string]string{{"level": "ERROR", "user": "Alice"}}},
+		{"user=alice", []string{raws[0]}, []map[string]string{{"level": "ERROR", "user": "Alice"}}},
+		{"level=info", []string{raws[1]}, []map[string]string{{"level": "INFO", "user": "BOB"}}},
+		{"user!=ALICE", []string{raws[1]}, []map[string]string{{"level": "INFO", "user": "BOB"}}},
+	} {
+		for name, repo := range map[string]events.Repository{"stored": stored, "extracted": extracted} {
+			t.Run(tt.search+"_"+name, func(t *testing.T) {
+				sps, err := compileSearchStep(tt.search, map[string]string{})
+				if err != nil {
+					t.Fatalf("TestSearchPipelineStep_PreserveFieldCase got unexpected error: %v", err)
+				}
+				pipe, input, output := newPipe()
+				close(input)
+
+				go sps.Execute(context.Background(), pipe, PipelineParameters{Cfg: cfg, EventsRepo: repo})
+
+				actualRaws := []string{}
+				actualFields := []map[string]string{}
+				for res := range output {
+					for _, evt := range res.Events {
+						actualRaws = append(actualRaws, evt.Raw)
+						delete(evt.Fields, "host")
+						delete(evt.Fields, "source")
+						actualFields = append(actualFields, evt.Fields)
+					}
+				}
+				if !reflect.DeepEqual(actualRaws, tt.expectedRaws) {
+					t.Fatalf("TestSearchPipelineStep_PreserveFieldCase expected events=%v but got %v", tt.expectedRaws, actualRaws)
+				}
+				if !reflect.DeepEqual(actualFields, tt.expectedFields) {
+					t.Fatalf("TestSearchPipelineStep_PreserveFieldCase expected fields=%v but got %v", tt.expectedFields, actualFields)
+				}
+			})
+		}
+	}
+}
+
+// newStoredFieldsRepos returns a repository where the fields of the events are stored and one where they are not,
+// with the same events added to both.
+func newStoredFieldsRepos(t testing.TB, cfg *config.Config, raws []string) (stored, extracted events.Repository) {
+	stored, extracted = newInMemRepo(t), newInMemRepo(t)
+	withFields := make([]events.Event, len(raws))
+	withoutFields := make([]events.Event, len(raws))
+	for i, raw := range raws {
+		withoutFields[i] = events.Event{
+			Raw:       raw,
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "my-log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+		}
+		withFields[i] = withoutFields[i]
+		withFields[i].Fields = events.ExtractFields(cfg, events.NormalizeCase(cfg, raw), withFields[i].Source)
+	}
+	for _, r := range []struct {
+		repo events.Repository
+		evts []events.Event
+	}{{stored, withFields}, {extracted, withoutFields}} {
+		// Added in chunks of the publisher's default batch size to stay below SQLite's limit on the number of variables
+		for start := 0; start < len(r.evts); start += config.DefaultPublisherBatchSize {
+			end := start + config.DefaultPublisherBatchSize
+			if end > len(r.evts) {
+				end = len(r.evts)
+			}
+			_, err := r.repo.AddBatch(r.evts[start:end])
+			if err != nil {
+				t.Fatalf("got error when adding events: %v", err)
+			}
+		}
+	}
+	return stored, extracted
+}
+
+func executeSearch(t testing.TB, search string, params PipelineParameters) []string {
+	sps, err := compileSearchStep(search, map[string]string{})
+	if err != nil {
+		t.Fatalf("got unexpected error when compiling search: %v", err)
+	}
+	pipe, input, output := newPipe()
+	close(input)
+
+	go sps.Execute(context.Background(), pipe, params)
+
+	actual := []string{}
+	for res := range output {
+		for _, evt := range res.Events {
+			actual = append(actual, evt.Raw)
+		}
+	}
+	return actual
+}
+
+func TestSearchPipelineStep_StoredFields(t *testing.T) {
+	for _, caseSensitive := range []bool{false, true} {
+		cfg := &config.Config{
+			FieldExtractors:    []*regexp.Regexp{regexp.MustCompile("^(?P<level>\\w+):")},
+			KeyValueExtraction: true,
+			JSONExtraction:     true,
+			CaseSensitive:      caseSensitive,
+			StoreFields:        true,
+		}
+		stored, extracted := newStoredFieldsRepos(t, cfg, []string{
+			"INFO: status=200 user=Alice path=/api",
+			"ERROR: status=500 user=bob path=/api/users",
+			"WARN: status=404 user=\"Carol Smith\"",
+			`{"status": 500, "user": {"name": "bob"}}`,
+			"no fields at all",
+		})
+
+		for _, search := range []string{
+			"status=500",
+			"status=500 user=bob",
+			"status=200 OR status=500",
+			"status IN (200, 404)",
+			"user=alice",
+			"user=Alice",
+			"user=\"carol smith\"",
+			"user.name=bob",
+			"level=error",
+			"level=ERROR status!=404",
+			"path=/api*",
+			"status=5* user=bob",
+			"status>=404",
+			"missing=1",
+		} {
+			t.Run(fmt.Sprintf("%v_%v", search, caseSensitive), func(t *testing.T) {
+				expected := executeSearch(t, search, PipelineParameters{Cfg: cfg, EventsRepo: extracted})
+				actual := executeSearch(t, search, PipelineParameters{Cfg: cfg, EventsRepo: stored})
+				if !reflect.DeepEqual(actual, expected) {
+					t.Fatalf("TestSearchPipelineStep_StoredFields expected events=%v but got %v", expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSearchPipelineStep_StoredFields(b *testing.B) {
+	cfg := &config.Config{
+		KeyValueExtraction: true,
+		StoreFields:        true,
+	}
+	raws := make([]string, 20000)
+	for i := range raws {
+		raws[i] = fmt.Sprintf("request status=%v user=user%v path=/api/%v", 200+i%5*100, i%100, i%7)
+	}
+	stored, extracted := newStoredFieldsRepos(b, cfg, raws)
+	for name, repo := range map[string]events.Repository{"stored": stored, "extracted": extracted} {
+		b.Run(name, func(b *testing.B) {
+			params := PipelineParameters{Cfg: cfg, EventsRepo: repo}
+			for i := 0; i < b.N; i++ {
+				actual := executeSearch(b, "status=500 user=user43", params)
+				if len(actual) != 200 {
+					b.Fatalf("got unexpected number of events, expected 200 but got %v", len(actual))
+				}
+			}
+		})
+	}
+}
+
+// failingRepo is a repository whose searches always fail. Every other method panics since the embedded Repository is
+// nil.
+type failingRepo struct {
+	events.Repository
+}
+
+func (repo *failingRepo) FilterStream(ctx context.Context, srch *search.Search, searchStartTime, searchEndTime *time.Time) <-chan events.FilterStreamPage {
+	ret := make(chan events.FilterStreamPage, 1)
+	ret <- events.FilterStreamPage{Err: errors.New("search failed")}
+	close(ret)
+	return ret
+}
+
+func TestPipeline_ResultStatus(t *testing.T) {
+	populated := newInMemRepo(t)
+	_, err := populated.AddBatch([]events.Event{
+		{Raw: "event 1", Host: "localhost", Source: "log.txt", Offset: 0, Timestamp: time.Date(2021, 1, 20, 20, 29, 0, 0, time.UTC)},
+		{Raw: "event 2", Host: "localhost", Source: "log.txt", Offset: 1, Timestamp: time.Date(2021, 1, 20, 20, 29, 1, 0, time.UTC)},
+		{Raw: "event 3", Host: "localhost", Source: "log.txt", Offset: 2, Timestamp: time.Date(2021, 1, 20, 20, 29, 2, 0, time.UTC)},
+	})
+	if err != nil {
+		t.Fatalf("got error when adding events: %v", err)
+	}
+	for _, tt := range []struct {
+		name              string
+		repo              events.Repository
+		query             string
+		expectedEvents    int
+		expectedErr       bool
+		expectedTruncated bool
+	}{
+		{"clean empty", newInMemRepo(t), "event", 0, false, false},
+		{"error", &failingRepo{}, "event", 0, true, false},
+		{"error through sort", &failingRepo{}, "event | sort _time desc", 0, true, false},
+		{"error through stats", &failingRepo{}, "event | stats count", 0, true, false},
+		{"truncated", populated, "event | sort maxEvents=2 _time desc", 2, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pl, err := CompilePipeline(tt.query, nil, nil)
+			if err != nil {
+				t.Fatalf("got unexpected error when compiling pipeline: %v", err)
+			}
+			numEvents := 0
+			var resErr error
+			truncated := false
+			for res := range pl.Execute(context.Background(), PipelineParameters{Cfg: &config.Config{}, EventsRepo: tt.repo}) {
+				numEvents += len(res.Events)
+				if res.Err != nil {
+					resErr = res.Err
+				}
+				truncated = truncated || res.Truncated
+			}
+			if numEvents != tt.expectedEvents {
+				t.Fatalf("got unexpected number of events, expected %v but got %v", tt.expectedEvents, numEvents)
+			}
+			if (resErr != nil) != tt.expectedErr {
+				t.Fatalf("got unexpected error, expected error=%v but got %v", tt.expectedErr, resErr)
+			}
+			if truncated != tt.expectedTruncated {
+				t.Fatalf("got unexpected truncated, expected %v but got %v", tt.expectedTruncated, truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// DefaultSortMaxEvents is the number of events the sort command buffers unless the maxEvents option is given.
+const DefaultSortMaxEvents = 100000
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+type sortPipelineStep struct {
+	keys      []sortKey
+	maxEvents int
+}
+
+// sortValue is the value of a sort field for an event. Numbers sort before strings and missing fields sort last,
+// regardless of the direction.
+type sortValue struct {
+	missing  bool
+	isNumber bool
+	number   float64
+	str      string
+}
+
+type sortableEvent struct {
+	evt    events.EventWithExtractedFields
+	values []sortValue
+}
+
+func (s *sortPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	// Sorting needs all events before anything can be sent on, so only the first maxEvents events are kept
+	buffered := []sortableEvent{}
+	truncated := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				s.sort(buffered)
+				ret := make([]events.EventWithExtractedFields, len(buffered))
+				for i, se := range buffered {
+					ret[i] = se.evt
+				}
+				select {
+				case pipe.output <- PipelineStepResult{Events: ret, Truncated: truncated}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			if res.Aggregate != nil {
+				// The rows of a table are already all in one result, so they can be sorted right away
+				res.Aggregate = s.sortAggregate(res.Aggregate)
+				select {
+				case pipe.output <- res:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			truncated = truncated || res.Truncated
+			for _, evt := range res.Events {
+				if len(buffered) >= s.maxEvents {
+					truncated = true
+					break
+				}
+				buffered = append(buffered, sortableEvent{evt: evt, values: s.values(evt)})
+			}
+		}
+	}
+}
+
+// timeField is the name of the sort field which sorts the events by their timestamp.
+const timeField = "_time"
+
+func (s *sortPipelineStep) values(evt events.EventWithExtractedFields) []sortValue {
+	ret := make([]sortValue, len(s.keys))
+	for i, k := range s.keys {
+		if k.field == timeField {
+			ret[i] = sortValue{isNumber: true, number: float64(evt.Timestamp.UnixNano())}
+			continue
+		}
+		v, ok := evt.Fields[k.field]
+		if !ok {
+			ret[i] = sortValue{missing: true}
+			continue
+		}
+		ret[i] = stringSortValue(v)
+	}
+	return ret
+}
+
+// rowValues returns the values of the sort fields for a row of agg. A field can be either one of the fields the
+// table is grouped by or one of its columns, and a column without a value is missing.
+func (s *sortPipelineStep) rowValues(agg *AggregateResult, row AggregateRow) []sortValue {
+	ret := make([]sortValue, len(s.keys))
+	for i, k := range s.keys {
+		ret[i] = sortValue{missing: true}
+		for j, name := range agg.GroupBy {
+			if strings.ToLower(name) == k.field && j < len(row.Group) {
+				ret[i] = stringSortValue(row.Group[j])
+			}
+		}
+		for j, name := range agg.Columns {
+			if strings.ToLower(name) == k.field && j < len(row.Values) && row.Values[j] != nil {
+				ret[i] = sortValue{isNumber: true, number: *row.Values[j]}
+			}
+		}
+	}
+	return ret
+}
+
+func stringSortValue(v string) sortValue {
+	f, err := strconv.ParseFloat(v, 64)
+	return sortValue{isNumber: err == nil, number: f, str: v}
+}
+
+// sort sorts the events by the keys. The sort is stable, so events with equal keys keep the order they were received
+// in, which is usually latest first.
+func (s *sortPipelineStep) sort(evts []sortableEvent) {
+	sort.SliceStable(evts, func(i, j int) bool {
+		return s.less(evts[i].values, evts[j].values)
+	})
+}
+
+// sortAggregate returns a copy of agg with its rows sorted by the keys, leaving agg as it was.
+func (s *sortPipelineStep) sortAggregate(agg *AggregateResult) *AggregateResult {
+	values := make([][]sortValue, len(agg.Rows))
+	order := make([]int, len(agg.Rows))
+	for i, row := range agg.Rows {
+		values[i] = s.rowValues(agg, row)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return s.less(values[order[i]], values[order[j]])
+	})
+	ret := *agg
+	ret.Rows = make([]AggregateRow, len(agg.Rows))
+	for i, idx := range order {
+		ret.Rows[i] = agg.Rows[idx]
+	}
+	return &ret
+}
+
+func (s *sortPipelineStep) less(a, b []sortValue) bool {
+	for k, key := range s.keys {
+		c := compareSortValues(a[k], b[k])
+		if c == 0 {
+			continue
+		}
+		if key.desc && !a[k].missing && !b[k].missing {
+			return c > 0
+		}
+		return c < 0
+	}
+	return false
+}
+
+// isOldestFirst returns true if the step only sorts the events by their timestamp in ascending order.
+func (s *sortPipelineStep) isOldestFirst() bool {
+	return len(s.keys) == 1 && s.keys[0].field == timeField && !s.keys[0].desc
+}
+
+func compareSortValues(a, b sortValue) int {
+	switch {
+	case a.missing || b.missing:
+		if a.missing == b.missing {
+			return 0
+		} else if a.missing {
+			return 1
+		}
+		return -1
+	case a.isNumber && b.isNumber:
+		if a.number < b.number {
+			return -1
+		} else if a.number > b.number {
+			return 1
+		}
+		return 0
+	case a.isNumber != b.isNumber:
+		if a.isNumber {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.str, b.str)
+}
+
+func compileSortStep(input string, options map[string]string) (pipelineStep, error) {
+	maxEvents := DefaultSortMaxEvents
+	if s, ok := options["maxEvents"]; ok {
+		i, err := strconv.Atoi(s)
+		if err != nil || i <= 0 {
+			return nil, fmt.Errorf("failed to compile sort: maxEvents must be a positive integer, got '%v'", s)
+		}
+		maxEvents = i
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	ret := sortPipelineStep{maxEvents: maxEvents}
+	for _, w := range words {
+		if w == "asc" || w == "desc" {
+			if len(ret.keys) == 0 {
+				return nil, fmt.Errorf("failed to compile sort: expected a field before '%v'", w)
+			}
+			ret.keys[len(ret.keys)-1].desc = w == "desc"
+			continue
+		}
+		ret.keys = append(ret.keys, sortKey{field: w})
+	}
+	if len(ret.keys) == 0 {
+		return nil, errors.New("failed to compile sort: expected at least one field to sort by")
+	}
+	return &ret, nil
+}
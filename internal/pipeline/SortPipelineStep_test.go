@@ -0,0 +1,258 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestSortPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input             string
+		options           map[string]string
+		expectedIds       []int64
+		expectedTruncated bool
+	}{
+		// 9 < 10 < 100 numerically, but not lexically
+		{"bytes", map[string]string{}, []int64{3, 1, 4, 2, 5, 6}, false},
+		{"bytes desc", map[string]string{}, []int64{5, 2, 1, 4, 3, 6}, false},
+		// Numbers sort before strings, and a missing field sorts last
+		{"status asc", map[string]string{}, []int64{1, 4, 5, 2, 3, 6}, false},
+		// Equal keys keep the order the events were received in
+		{"user", map[string]string{}, []int64{1, 3, 5, 2, 4, 6}, false},
+		{"user desc", map[string]string{}, []int64{2, 4, 6, 1, 3, 5}, false},
+		{"user, bytes desc", map[string]string{}, []int64{5, 1, 3, 2, 4, 6}, false},
+		{"missing", map[string]string{}, []int64{1, 2, 3, 4, 5, 6}, false},
+		{"bytes", map[string]string{"maxEvents": "4"}, []int64{3, 1, 4, 2}, true},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			sps, err := compileSortStep(tt.input, tt.options)
+			if err != nil {
+				t.Fatalf("TestSortPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			// Split over two results to make sure events are sorted across batches
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 1, Fields: map[string]string{"bytes": "10", "status": "200", "user": "alice"}},
+						{Id: 2, Fields: map[string]string{"bytes": "100", "status": "ok", "user": "bob"}},
+						{Id: 3, Fields: map[string]string{"bytes": "9", "status": "timeout", "user": "alice"}},
+					},
+				}
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 4, Fields: map[string]string{"bytes": "10", "status": "404", "user": "bob"}},
+						{Id: 5, Fields: map[string]string{"bytes": "100.5", "status": "404", "user": "alice"}},
+						{Id: 6, Fields: map[string]string{"user": "bob"}},
+					},
+				}
+				close(input)
+			}()
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestSortPipelineStep got unexpected !ok when receiving output")
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestSortPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+			if result.Truncated != tt.expectedTruncated {
+				t.Fatalf("TestSortPipelineStep expected truncated=%v but got %v", tt.expectedTruncated, result.Truncated)
+			}
+			if len(result.Events) != len(tt.expectedIds) {
+				t.Fatalf("TestSortPipelineStep expected %v events but got %v", len(tt.expectedIds), len(result.Events))
+			}
+			for i, evt := range result.Events {
+				if evt.Id != tt.expectedIds[i] {
+					actualIds := make([]int64, len(result.Events))
+					for j, e := range result.Events {
+						actualIds[j] = e.Id
+					}
+					t.Fatalf("TestSortPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSortStep_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		options map[string]string
+	}{
+		{"", map[string]string{}},
+		{"desc", map[string]string{}},
+		{"bytes", map[string]string{"maxEvents": "0"}},
+		{"bytes", map[string]string{"maxEvents": "many"}},
+	} {
+		_, err := compileSortStep(tt.input, tt.options)
+		if err == nil {
+			t.Fatalf("TestCompileSortStep_Errors expected an error for input=%v, options=%v but got nil", tt.input, tt.options)
+		}
+	}
+}
+
+func TestSortPipelineStep_Time(t *testing.T) {
+	base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		input       string
+		expectedIds []int64
+	}{
+		{"_time", []int64{2, 3, 1}},
+		{"_time desc", []int64{1, 3, 2}},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			sps, err := compileSortStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestSortPipelineStep_Time got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			go sps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+			go func() {
+				// _time is the timestamp of the event even if a field with the same name was extracted
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 1, Timestamp: base.Add(time.Hour), Fields: map[string]string{"_time": "a"}},
+						{Id: 2, Timestamp: base, Fields: map[string]string{"_time": "c"}},
+						{Id: 3, Timestamp: base.Add(time.Minute), Fields: map[string]string{"_time": "b"}},
+					},
+				}
+				close(input)
+			}()
+			actualIds := []int64{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actualIds = append(actualIds, evt.Id)
+				}
+			}
+			if !reflect.DeepEqual(actualIds, tt.expectedIds) {
+				t.Fatalf("TestSortPipelineStep_Time expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+		})
+	}
+}
+
+func TestCompilePipeline_SortTimeAscending(t *testing.T) {
+	repo := newInMemRepo(t)
+	base := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	evts := make([]events.Event, 5)
+	for i := range evts {
+		// Added newest first so that the order of the ids is the opposite of the order of the timestamps
+		evts[i] = events.Event{Raw: fmt.Sprintf("event %v", i), Host: "h", Source: "s", Offset: int64(i), Timestamp: base.Add(-time.Duration(i) * time.Minute)}
+	}
+	_, err := repo.AddBatch(evts)
+	if err != nil {
+		t.Fatalf("TestCompilePipeline_SortTimeAscending got error when adding events: %v", err)
+	}
+	expected := []string{"event 4", "event 3", "event 2", "event 1", "event 0"}
+	for _, tt := range []struct {
+		query         string
+		expectedSteps int
+		oldestFirst   bool
+	}{
+		// Directly after the search the repository is asked for the events oldest first instead of sorting them
+		{"event | sort _time", 1, true},
+		{"event | sort _time asc", 1, true},
+		{"event | sort maxEvents=2 _time asc", 1, true},
+		// Otherwise the events are sorted by the sort step
+		{"event | sort _time, host", 2, false},
+		{"event | eval n=1 | sort _time asc", 3, false},
+		{"event | reverse", 2, false},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			p, err := CompilePipeline(tt.query, nil, nil)
+			if err != nil {
+				t.Fatalf("TestCompilePipeline_SortTimeAscending got unexpected error: %v", err)
+			}
+			if len(p.steps) != tt.expectedSteps || len(p.pipes) != tt.expectedSteps {
+				t.Fatalf("TestCompilePipeline_SortTimeAscending expected %v steps but got %v steps and %v pipes", tt.expectedSteps, len(p.steps), len(p.pipes))
+			}
+			if oldestFirst := p.steps[0].(*searchPipelineStep).srch.OldestFirst; oldestFirst != tt.oldestFirst {
+				t.Fatalf("TestCompilePipeline_SortTimeAscending expected oldestFirst=%v but got %v", tt.oldestFirst, oldestFirst)
+			}
+			actual := []string{}
+			for res := range p.Execute(context.Background(), PipelineParameters{Cfg: &config.Config{}, EventsRepo: repo}) {
+				if res.Err != nil {
+					t.Fatalf("TestCompilePipeline_SortTimeAscending got unexpected error when executing: %v", res.Err)
+				}
+				for _, evt := range res.Events {
+					actual = append(actual, evt.Raw)
+				}
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("TestCompilePipeline_SortTimeAscending expected %v but got %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestCompilePipeline_SortStatsRows(t *testing.T) {
+	repo := newInMemRepo(t)
+	now := time.Now()
+	evts := []events.Event{}
+	for i, status := range []string{"200", "200", "200", "404", "500", "500"} {
+		evts = append(evts, events.Event{Raw: "request status=" + status, Host: "a", Source: "access.log", Timestamp: now.Add(-time.Duration(i) * time.Second), Offset: int64(i)})
+	}
+	if _, err := repo.AddBatch(evts); err != nil {
+		t.Fatalf("TestCompilePipeline_SortStatsRows got unexpected error when adding events: %v", err)
+	}
+	for _, tt := range []struct {
+		query    string
+		expected []string
+	}{
+		{"request | stats count by status | sort count desc", []string{"200", "500", "404"}},
+		{"request | stats count by status | sort count", []string{"404", "500", "200"}},
+		{"request | stats count by status | sort status desc", []string{"500", "404", "200"}},
+		// Columns without a value sort last
+		{"request | stats count, sum(missing) by status | sort sum(missing), status", []string{"200", "404", "500"}},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			p, err := CompilePipeline(tt.query, nil, nil)
+			if err != nil {
+				t.Fatalf("TestCompilePipeline_SortStatsRows got unexpected error: %v", err)
+			}
+			actual := []string{}
+			for res := range p.Execute(context.Background(), PipelineParameters{Cfg: &config.Config{KeyValueExtraction: true}, EventsRepo: repo}) {
+				if res.Err != nil {
+					t.Fatalf("TestCompilePipeline_SortStatsRows got unexpected error when executing: %v", res.Err)
+				}
+				if res.Aggregate != nil {
+					for _, row := range res.Aggregate.Rows {
+						actual = append(actual, row.Group[0])
+					}
+				}
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestCompilePipeline_SortStatsRows expected rows=%v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// AggregateResult is the output of the stats command. It is a table with one row per unique combination of values
+// for the GroupBy fields.
+type AggregateResult struct {
+	GroupBy []string
+	// Columns contains the name of each aggregation, such as "count" or "sum(bytes)".
+	Columns []string
+	Rows    []AggregateRow
+}
+
+type AggregateRow struct {
+	// Group contains the value of each GroupBy field. Events missing a field are grouped under an empty string.
+	Group []string
+	// Values contains the value of each column. A value is nil if the column aggregates over a field which had no
+	// numeric values in the group.
+	Values []*float64
+}
+
+type aggregationType string
+
+const (
+	aggregationCount aggregationType = "count"
+	aggregationSum   aggregationType = "sum"
+	aggregationAvg   aggregationType = "avg"
+	aggregationMin   aggregationType = "min"
+	aggregationMax   aggregationType = "max"
+)
+
+type aggregation struct {
+	typ   aggregationType
+	field string
+}
+
+type aggregationState struct {
+	count int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+type statsPipelineStep struct {
+	aggregations []aggregation
+	groupBy      []string
+}
+
+func (s *statsPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	groups := map[string][]aggregationState{}
+	groupValues := map[string][]string{}
+	truncated := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				select {
+				case pipe.output <- PipelineStepResult{
+					Events:    []events.EventWithExtractedFields{},
+					Aggregate: s.result(groups, groupValues),
+					Truncated: truncated,
+				}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			truncated = truncated || res.Truncated
+			for _, evt := range res.Events {
+				values := make([]string, len(s.groupBy))
+				for i, f := range s.groupBy {
+					values[i] = evt.Fields[f]
+				}
+				key := strings.Join(values, "\x00")
+				states, ok := groups[key]
+				if !ok {
+					states = make([]aggregationState, len(s.aggregations))
+					groupValues[key] = values
+				}
+				for i, a := range s.aggregations {
+					if a.typ == aggregationCount {
+						states[i].count++
+						continue
+					}
+					f, err := strconv.ParseFloat(evt.Fields[a.field], 64)
+					if err != nil {
+						continue
+					}
+					if states[i].count == 0 || f < states[i].min {
+						states[i].min = f
+					}
+					if states[i].count == 0 || f > states[i].max {
+						states[i].max = f
+					}
+					states[i].count++
+					states[i].sum += f
+				}
+				groups[key] = states
+			}
+		}
+	}
+}
+
+func (s *statsPipelineStep) result(groups map[string][]aggregationState, groupValues map[string][]string) *AggregateResult {
+	ret := &AggregateResult{
+		GroupBy: s.groupBy,
+		Columns: make([]string, len(s.aggregations)),
+		Rows:    make([]AggregateRow, 0, len(groups)),
+	}
+	for i, a := range s.aggregations {
+		if a.typ == aggregationCount {
+			ret.Columns[i] = string(a.typ)
+		} else {
+			ret.Columns[i] = string(a.typ) + "(" + a.field + ")"
+		}
+	}
+	if len(groups) == 0 && len(s.groupBy) == 0 {
+		// Without any groups there should still be a single row, so that "| stats count" gives 0 instead of nothing
+		groups = map[string][]aggregationState{"": make([]aggregationState, len(s.aggregations))}
+		groupValues = map[string][]string{"": {}}
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		row := AggregateRow{
+			Group:  groupValues[k],
+			Values: make([]*float64, len(s.aggregations)),
+		}
+		for i, state := range groups[k] {
+			var v float64
+			switch s.aggregations[i].typ {
+			case aggregationCount:
+				v = float64(state.count)
+			case aggregationSum:
+				v = state.sum
+			case aggregationAvg:
+				v = state.sum / float64(state.count)
+			case aggregationMin:
+				v = state.min
+			case aggregationMax:
+				v = state.max
+			}
+			if state.count > 0 || s.aggregations[i].typ == aggregationCount {
+				row.Values[i] = &v
+			}
+		}
+		ret.Rows = append(ret.Rows, row)
+	}
+	return ret
+}
+
+// The field may contain any character the field extractors allow in a name, such as the dots in "req.bytes"
+var aggregationRegexp = regexp.MustCompile(`^(\w+)(?:\(([^()]+)\))?$`)
+var lparenRegexp = regexp.MustCompile(`\s*\(\s*`)
+var rparenRegexp = regexp.MustCompile(`\s*\)`)
+
+func compileStatsStep(input string, options map[string]string) (pipelineStep, error) {
+	// Parentheses are tokens of their own, so "sum(bytes)" may have been passed on as "sum ( bytes )"
+	input = lparenRegexp.ReplaceAllString(input, "(")
+	input = rparenRegexp.ReplaceAllString(input, ")")
+	words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+
+	ret := statsPipelineStep{}
+	i := 0
+	for ; i < len(words) && words[i] != "by"; i++ {
+		match := aggregationRegexp.FindStringSubmatch(words[i])
+		if match == nil {
+			return nil, fmt.Errorf("failed to compile stats: unexpected aggregation '%v'", words[i])
+		}
+		a := aggregation{typ: aggregationType(match[1]), field: match[2]}
+		switch a.typ {
+		case aggregationCount:
+			if a.field != "" {
+				return nil, errors.New("failed to compile stats: count does not take a field")
+			}
+		case aggregationSum, aggregationAvg, aggregationMin, aggregationMax:
+			if a.field == "" {
+				return nil, fmt.Errorf("failed to compile stats: %v requires a field, as in %v(<field>)", a.typ, a.typ)
+			}
+		default:
+			return nil, fmt.Errorf("failed to compile stats: unknown aggregation '%v', expected one of count, sum, avg, min or max", a.typ)
+		}
+		ret.aggregations = append(ret.aggregations, a)
+	}
+	if len(ret.aggregations) == 0 {
+		return nil, errors.New("failed to compile stats: expected at least one aggregation")
+	}
+	if i < len(words) {
+		ret.groupBy = words[i+1:]
+		if len(ret.groupBy) == 0 {
+			return nil, errors.New("failed to compile stats: expected at least one field after 'by'")
+		}
+	}
+	return &ret, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+var statsTestEvents = []events.EventWithExtractedFields{
+	{Id: 1, Source: "access.log", Fields: map[string]string{"source": "access.log", "host": "a", "bytes": "100"}},
+	{Id: 2, Source: "access.log", Fields: map[string]string{"source": "access.log", "host": "b", "bytes": "50.5"}},
+	{Id: 3, Source: "error.log", Fields: map[string]string{"source": "error.log", "host": "a", "bytes": "abc"}},
+	{Id: 4, Source: "access.log", Fields: map[string]string{"source": "access.log", "host": "a", "bytes": "25"}},
+	{Id: 5, Source: "other.log", Fields: map[string]string{"source": "other.log"}},
+}
+
+func TestStatsPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected AggregateResult
+	}{
+		{
+			"count by source",
+			AggregateResult{
+				GroupBy: []string{"source"},
+				Columns: []string{"count"},
+				Rows: []AggregateRow{
+					{Group: []string{"access.log"}, Values: floats(3)},
+					{Group: []string{"error.log"}, Values: floats(1)},
+					{Group: []string{"other.log"}, Values: floats(1)},
+				},
+			},
+		},
+		{
+			"sum(bytes), avg(bytes) by host",
+			AggregateResult{
+				GroupBy: []string{"host"},
+				Columns: []string{"sum(bytes)", "avg(bytes)"},
+				Rows: []AggregateRow{
+					{Group: []string{""}, Values: []*float64{nil, nil}},
+					{Group: []string{"a"}, Values: floats(125, 62.5)},
+					{Group: []string{"b"}, Values: floats(50.5, 50.5)},
+				},
+			},
+		},
+		{
+			"count min(bytes) max(bytes)",
+			AggregateResult{
+				Columns: []string{"count", "min(bytes)", "max(bytes)"},
+				Rows: []AggregateRow{
+					{Group: []string{}, Values: floats(5, 25, 100)},
+				},
+			},
+		},
+		{
+			"COUNT BY host, Source",
+			AggregateResult{
+				GroupBy: []string{"host", "source"},
+				Columns: []string{"count"},
+				Rows: []AggregateRow{
+					{Group: []string{"", "other.log"}, Values: floats(1)},
+					{Group: []string{"a", "access.log"}, Values: floats(2)},
+					{Group: []string{"a", "error.log"}, Values: floats(1)},
+					{Group: []string{"b", "access.log"}, Values: floats(1)},
+				},
+			},
+		},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			sps, err := compileStatsStep(tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestStatsPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go sps.Execute(context.Background(), pipe, params)
+
+			input <- PipelineStepResult{Events: statsTestEvents[:2]}
+			input <- PipelineStepResult{Events: statsTestEvents[2:]}
+			close(input)
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestStatsPipelineStep got unexpected !ok when receiving output")
+			}
+			if result.Aggregate == nil {
+				t.Fatal("TestStatsPipelineStep expected an aggregate result but got nil")
+			}
+			if fmt.Sprint(aggregateString(*result.Aggregate)) != fmt.Sprint(aggregateString(tt.expected)) {
+				t.Fatalf("TestStatsPipelineStep expected aggregate=%v but got %v", aggregateString(tt.expected), aggregateString(*result.Aggregate))
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestStatsPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+		})
+	}
+}
+
+func TestStatsPipelineStep_CountWithoutEvents(t *testing.T) {
+	sps, err := compileStatsStep("count", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestStatsPipelineStep_CountWithoutEvents got unexpected error: %v", err)
+	}
+	pipe, input, output := newPipe()
+	close(input)
+
+	go sps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+
+	result := <-output
+	if result.Aggregate == nil || len(result.Aggregate.Rows) != 1 || *result.Aggregate.Rows[0].Values[0] != 0 {
+		t.Fatalf("TestStatsPipelineStep_CountWithoutEvents expected a single row with count 0 but got %v", result.Aggregate)
+	}
+}
+
+func TestCompileStatsStep_Errors(t *testing.T) {
+	for _, input := range []string{"", "by host", "count by", "sum", "count(bytes)", "median(bytes)", "sum(bytes"} {
+		_, err := compileStatsStep(input, map[string]string{})
+		if err == nil {
+			t.Errorf("TestCompileStatsStep_Errors expected error when compiling '%v' but got nil", input)
+		}
+	}
+}
+
+func TestCompileStatsStep_SpacesInsideParentheses(t *testing.T) {
+	sps, err := compileStatsStep("sum ( bytes ) by host", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestCompileStatsStep_SpacesInsideParentheses got unexpected error: %v", err)
+	}
+	expected := &statsPipelineStep{
+		aggregations: []aggregation{{typ: aggregationSum, field: "bytes"}},
+		groupBy:      []string{"host"},
+	}
+	if !reflect.DeepEqual(sps, expected) {
+		t.Fatalf("TestCompileStatsStep_SpacesInsideParentheses expected %v but got %v", expected, sps)
+	}
+}
+
+func TestCompileStatsStep_DottedFieldNames(t *testing.T) {
+	sps, err := compileStatsStep("avg(req.bytes), max(resp-time) by req.host", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestCompileStatsStep_DottedFieldNames got unexpected error: %v", err)
+	}
+	expected := &statsPipelineStep{
+		aggregations: []aggregation{{typ: aggregationAvg, field: "req.bytes"}, {typ: aggregationMax, field: "resp-time"}},
+		groupBy:      []string{"req.host"},
+	}
+	if !reflect.DeepEqual(sps, expected) {
+		t.Fatalf("TestCompileStatsStep_DottedFieldNames expected %v but got %v", expected, sps)
+	}
+}
+
+func floats(fs ...float64) []*float64 {
+	ret := make([]*float64, len(fs))
+	for i := range fs {
+		ret[i] = &fs[i]
+	}
+	return ret
+}
+
+func aggregateString(a AggregateResult) string {
+	s := fmt.Sprintf("groupBy=%v columns=%v rows=[", a.GroupBy, a.Columns)
+	for _, row := range a.Rows {
+		s += fmt.Sprintf("%v:", row.Group)
+		for _, v := range row.Values {
+			if v == nil {
+				s += " nil"
+			} else {
+				s += fmt.Sprintf(" %v", *v)
+			}
+		}
+		s += ";"
+	}
+	return s + "]"
+}
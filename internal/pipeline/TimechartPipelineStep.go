@@ -0,0 +1,241 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+	"github.com/jackbister/logsuck/internal/search"
+)
+
+const (
+	DefaultTimechartSpan = 1 * time.Minute
+	// MaxTimechartBuckets limits the number of rows a timechart can return, since a short span over a long time range
+	// would otherwise fill memory with empty buckets.
+	MaxTimechartBuckets = 10000
+)
+
+type timechartPipelineStep struct {
+	span time.Duration
+	by   string
+
+	startTime, endTime *time.Time
+}
+
+// timeRangeStep is implemented by steps which need the time range of the search at the start of the pipeline.
+type timeRangeStep interface {
+	setTimeRange(startTime, endTime *time.Time)
+}
+
+func (s *timechartPipelineStep) setTimeRange(startTime, endTime *time.Time) {
+	s.startTime = startTime
+	s.endTime = endTime
+}
+
+func (s *timechartPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	loc := time.UTC
+	if params.Cfg != nil && params.Cfg.TimeZone != nil {
+		loc = params.Cfg.TimeZone
+	}
+	var b *timechartBuckets
+	if s.startTime != nil {
+		b = newTimechartBuckets(s.span, loc, *s.startTime)
+	}
+	truncated := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				var agg *AggregateResult
+				var t bool
+				if b == nil && s.endTime != nil {
+					b = newTimechartBuckets(s.span, loc, *s.endTime)
+				}
+				if b == nil {
+					agg = s.emptyResult()
+				} else {
+					agg, t = b.result(s.by, s.startTime, s.endTime)
+				}
+				select {
+				case pipe.output <- PipelineStepResult{
+					Events:    []events.EventWithExtractedFields{},
+					Aggregate: agg,
+					Truncated: truncated || t,
+				}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			truncated = truncated || res.Truncated
+			for _, evt := range res.Events {
+				if b == nil {
+					b = newTimechartBuckets(s.span, loc, evt.Timestamp)
+				}
+				column := "count"
+				if s.by != "" {
+					// Events missing the field are counted under an empty column, like stats groups them
+					column = evt.Fields[s.by]
+				}
+				b.add(evt.Timestamp, column)
+			}
+		}
+	}
+}
+
+func (s *timechartPipelineStep) emptyResult() *AggregateResult {
+	ret := &AggregateResult{GroupBy: []string{"_time"}, Columns: []string{}, Rows: []AggregateRow{}}
+	if s.by == "" {
+		ret.Columns = []string{"count"}
+	}
+	return ret
+}
+
+// timechartBuckets counts events in buckets of span. The buckets are aligned to whole multiples of span in loc, so
+// that span=1h starts every bucket on the hour and span=1d starts them at midnight. The UTC offset of loc at the first
+// time seen is used for every bucket, so around a daylight saving time change the buckets are off by the change.
+type timechartBuckets struct {
+	span   time.Duration
+	loc    *time.Location
+	offset time.Duration
+
+	counts   map[int64]map[string]int
+	columns  map[string]struct{}
+	min, max int64
+}
+
+func newTimechartBuckets(span time.Duration, loc *time.Location, reference time.Time) *timechartBuckets {
+	_, offset := reference.In(loc).Zone()
+	return &timechartBuckets{
+		span:    span,
+		loc:     loc,
+		offset:  time.Duration(offset) * time.Second,
+		counts:  map[int64]map[string]int{},
+		columns: map[string]struct{}{},
+	}
+}
+
+// bucket returns the index of the bucket t is in, counted in spans from the Unix epoch in loc.
+func (b *timechartBuckets) bucket(t time.Time) int64 {
+	n := t.UnixNano() + int64(b.offset)
+	i := n / int64(b.span)
+	if n%int64(b.span) < 0 {
+		i--
+	}
+	return i
+}
+
+func (b *timechartBuckets) bucketTime(i int64) time.Time {
+	return time.Unix(0, i*int64(b.span)-int64(b.offset)).In(b.loc)
+}
+
+func (b *timechartBuckets) add(t time.Time, column string) {
+	i := b.bucket(t)
+	if len(b.counts) == 0 || i < b.min {
+		b.min = i
+	}
+	if len(b.counts) == 0 || i > b.max {
+		b.max = i
+	}
+	counts, ok := b.counts[i]
+	if !ok {
+		counts = map[string]int{}
+		b.counts[i] = counts
+	}
+	counts[column]++
+	b.columns[column] = struct{}{}
+}
+
+// result returns one row per bucket from the bucket of startTime to the bucket of endTime, with zeroes for buckets
+// without events. The first or last bucket with events is used if startTime or endTime is nil. If there would be more
+// than MaxTimechartBuckets rows only the latest ones are returned, and the returned bool is true.
+func (b *timechartBuckets) result(by string, startTime, endTime *time.Time) (*AggregateResult, bool) {
+	columns := make([]string, 0, len(b.columns))
+	for c := range b.columns {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	if by == "" {
+		columns = []string{"count"}
+	}
+	ret := &AggregateResult{GroupBy: []string{"_time"}, Columns: columns, Rows: []AggregateRow{}}
+
+	first, last := b.min, b.max
+	if startTime != nil {
+		first = b.bucket(*startTime)
+	}
+	if endTime != nil {
+		last = b.bucket(*endTime)
+	}
+	if len(b.counts) == 0 && (startTime == nil || endTime == nil) {
+		return ret, false
+	}
+	truncated := false
+	if last-first+1 > MaxTimechartBuckets {
+		first = last - MaxTimechartBuckets + 1
+		truncated = true
+	}
+	for i := first; i <= last; i++ {
+		row := AggregateRow{
+			Group:  []string{b.bucketTime(i).Format(time.RFC3339)},
+			Values: make([]*float64, len(columns)),
+		}
+		for j, c := range columns {
+			v := float64(b.counts[i][c])
+			row.Values[j] = &v
+		}
+		ret.Rows = append(ret.Rows, row)
+	}
+	return ret, truncated
+}
+
+func compileTimechartStep(input string, options map[string]string) (pipelineStep, error) {
+	ret := timechartPipelineStep{span: DefaultTimechartSpan}
+	if s, ok := options["span"]; ok {
+		span, err := search.ParseSpan(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile timechart: %w", err)
+		}
+		ret.span = span
+	}
+	words := strings.Fields(strings.ToLower(input))
+	if len(words) > 0 && words[0] == "count" {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return &ret, nil
+	}
+	if words[0] != "by" {
+		return nil, fmt.Errorf("failed to compile timechart: unexpected '%v', expected count or 'by <field>'", words[0])
+	}
+	if len(words) != 2 {
+		return nil, errors.New("failed to compile timechart: expected a single field after 'by'")
+	}
+	ret.by = words[1]
+	return &ret, nil
+}
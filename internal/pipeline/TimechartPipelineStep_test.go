@@ -0,0 +1,220 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func runTimechart(t *testing.T, step pipelineStep, cfg *config.Config, evts []events.EventWithExtractedFields) PipelineStepResult {
+	params := PipelineParameters{
+		Cfg:        cfg,
+		EventsRepo: newInMemRepo(t),
+	}
+	pipe, input, output := newPipe()
+
+	go step.Execute(context.Background(), pipe, params)
+
+	input <- PipelineStepResult{Events: evts}
+	close(input)
+
+	result, ok := <-output
+	if !ok {
+		t.Fatal("runTimechart got unexpected !ok when receiving output")
+	}
+	if result.Aggregate == nil {
+		t.Fatal("runTimechart expected an aggregate result but got nil")
+	}
+	_, ok = <-output
+	if ok {
+		t.Fatal("runTimechart got unexpected ok when receiving output, expected the channel to be closed by now")
+	}
+	return result
+}
+
+func compileTimechart(t *testing.T, input string, options map[string]string) *timechartPipelineStep {
+	step, err := compileTimechartStep(input, options)
+	if err != nil {
+		t.Fatalf("compileTimechart got unexpected error: %v", err)
+	}
+	return step.(*timechartPipelineStep)
+}
+
+func TestTimechartPipelineStep_SpanAlignment(t *testing.T) {
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	evts := []events.EventWithExtractedFields{
+		{Id: 1, Timestamp: base.Add(7 * time.Minute)},
+		{Id: 2, Timestamp: base.Add(3 * time.Minute)},
+		{Id: 3, Timestamp: base.Add(4*time.Minute + 59*time.Second)},
+		{Id: 4, Timestamp: base.Add(5 * time.Minute)},
+	}
+	step := compileTimechart(t, "count", map[string]string{"span": "5m"})
+
+	result := runTimechart(t, step, &config.Config{}, evts)
+
+	expected := AggregateResult{
+		GroupBy: []string{"_time"},
+		Columns: []string{"count"},
+		Rows: []AggregateRow{
+			{Group: []string{"2021-03-01T12:00:00Z"}, Values: floats(2)},
+			{Group: []string{"2021-03-01T12:05:00Z"}, Values: floats(2)},
+		},
+	}
+	if aggregateString(*result.Aggregate) != aggregateString(expected) {
+		t.Fatalf("TestTimechartPipelineStep_SpanAlignment expected aggregate=%v but got %v", aggregateString(expected), aggregateString(*result.Aggregate))
+	}
+}
+
+func TestTimechartPipelineStep_TimeZoneAlignment(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	evts := []events.EventWithExtractedFields{
+		// 23:30 in UTC+2 on March 1st, but already March 2nd in UTC
+		{Id: 1, Timestamp: time.Date(2021, 3, 1, 21, 30, 0, 0, time.UTC)},
+		// 00:30 in UTC+2 on March 2nd, but still March 1st in UTC
+		{Id: 2, Timestamp: time.Date(2021, 3, 1, 22, 30, 0, 0, time.UTC)},
+	}
+	step := compileTimechart(t, "", map[string]string{"span": "1d"})
+
+	result := runTimechart(t, step, &config.Config{TimeZone: loc}, evts)
+
+	expected := AggregateResult{
+		GroupBy: []string{"_time"},
+		Columns: []string{"count"},
+		Rows: []AggregateRow{
+			{Group: []string{"2021-03-01T00:00:00+02:00"}, Values: floats(1)},
+			{Group: []string{"2021-03-02T00:00:00+02:00"}, Values: floats(1)},
+		},
+	}
+	if aggregateString(*result.Aggregate) != aggregateString(expected) {
+		t.Fatalf("TestTimechartPipelineStep_TimeZoneAlignment expected aggregate=%v but got %v", aggregateString(expected), aggregateString(*result.Aggregate))
+	}
+}
+
+func TestTimechartPipelineStep_ZeroFill(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 30, 0, time.UTC)
+	end := time.Date(2021, 3, 1, 12, 4, 10, 0, time.UTC)
+	evts := []events.EventWithExtractedFields{
+		{Id: 1, Timestamp: time.Date(2021, 3, 1, 12, 2, 15, 0, time.UTC)},
+	}
+	step := compileTimechart(t, "count", map[string]string{})
+	step.setTimeRange(&start, &end)
+
+	result := runTimechart(t, step, &config.Config{}, evts)
+
+	expected := AggregateResult{
+		GroupBy: []string{"_time"},
+		Columns: []string{"count"},
+		Rows: []AggregateRow{
+			{Group: []string{"2021-03-01T12:00:00Z"}, Values: floats(0)},
+			{Group: []string{"2021-03-01T12:01:00Z"}, Values: floats(0)},
+			{Group: []string{"2021-03-01T12:02:00Z"}, Values: floats(1)},
+			{Group: []string{"2021-03-01T12:03:00Z"}, Values: floats(0)},
+			{Group: []string{"2021-03-01T12:04:00Z"}, Values: floats(0)},
+		},
+	}
+	if aggregateString(*result.Aggregate) != aggregateString(expected) {
+		t.Fatalf("TestTimechartPipelineStep_ZeroFill expected aggregate=%v but got %v", aggregateString(expected), aggregateString(*result.Aggregate))
+	}
+
+	result = runTimechart(t, step, &config.Config{}, []events.EventWithExtractedFields{})
+	if len(result.Aggregate.Rows) != 5 {
+		t.Fatalf("TestTimechartPipelineStep_ZeroFill expected 5 rows without events but got %v", aggregateString(*result.Aggregate))
+	}
+}
+
+func TestTimechartPipelineStep_By(t *testing.T) {
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	evts := []events.EventWithExtractedFields{
+		{Id: 1, Timestamp: base, Fields: map[string]string{"status": "200"}},
+		{Id: 2, Timestamp: base.Add(10 * time.Second), Fields: map[string]string{"status": "500"}},
+		{Id: 3, Timestamp: base.Add(20 * time.Second), Fields: map[string]string{"status": "200"}},
+		{Id: 4, Timestamp: base.Add(2 * time.Minute), Fields: map[string]string{"status": "500"}},
+		{Id: 5, Timestamp: base.Add(2 * time.Minute), Fields: map[string]string{}},
+	}
+	step := compileTimechart(t, "count by Status", map[string]string{"span": "1m"})
+
+	result := runTimechart(t, step, &config.Config{}, evts)
+
+	expected := AggregateResult{
+		GroupBy: []string{"_time"},
+		Columns: []string{"", "200", "500"},
+		Rows: []AggregateRow{
+			{Group: []string{"2021-03-01T12:00:00Z"}, Values: floats(0, 2, 1)},
+			{Group: []string{"2021-03-01T12:01:00Z"}, Values: floats(0, 0, 0)},
+			{Group: []string{"2021-03-01T12:02:00Z"}, Values: floats(1, 0, 1)},
+		},
+	}
+	if aggregateString(*result.Aggregate) != aggregateString(expected) {
+		t.Fatalf("TestTimechartPipelineStep_By expected aggregate=%v but got %v", aggregateString(expected), aggregateString(*result.Aggregate))
+	}
+}
+
+func TestTimechartPipelineStep_Truncated(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add((MaxTimechartBuckets + 5) * time.Second)
+	step := compileTimechart(t, "", map[string]string{"span": "1s"})
+	step.setTimeRange(&start, &end)
+
+	result := runTimechart(t, step, &config.Config{}, []events.EventWithExtractedFields{})
+
+	if !result.Truncated {
+		t.Fatal("TestTimechartPipelineStep_Truncated expected Truncated=true but got false")
+	}
+	if len(result.Aggregate.Rows) != MaxTimechartBuckets {
+		t.Fatalf("TestTimechartPipelineStep_Truncated expected %v rows but got %v", MaxTimechartBuckets, len(result.Aggregate.Rows))
+	}
+	if last := result.Aggregate.Rows[len(result.Aggregate.Rows)-1].Group[0]; last != end.Format(time.RFC3339) {
+		t.Fatalf("TestTimechartPipelineStep_Truncated expected the last bucket to be %v but got %v", end.Format(time.RFC3339), last)
+	}
+}
+
+func TestCompilePipeline_TimechartTimeRange(t *testing.T) {
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 3, 1, 12, 10, 0, 0, time.UTC)
+	p, err := CompilePipeline("error | timechart span=5m", &start, &end)
+	if err != nil {
+		t.Fatalf("TestCompilePipeline_TimechartTimeRange got unexpected error: %v", err)
+	}
+	step := p.steps[1].(*timechartPipelineStep)
+	if step.span != 5*time.Minute {
+		t.Fatalf("TestCompilePipeline_TimechartTimeRange expected span=5m but got %v", step.span)
+	}
+	if step.startTime == nil || !step.startTime.Equal(start) || step.endTime == nil || !step.endTime.Equal(end) {
+		t.Fatalf("TestCompilePipeline_TimechartTimeRange expected time range %v-%v but got %v-%v", start, end, step.startTime, step.endTime)
+	}
+}
+
+func TestCompileTimechartStep_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		options map[string]string
+	}{
+		{"avg(x)", map[string]string{}},
+		{"count by", map[string]string{}},
+		{"count by a b", map[string]string{}},
+		{"count", map[string]string{"span": "0m"}},
+		{"count", map[string]string{"span": "1y"}},
+	} {
+		_, err := compileTimechartStep(tt.input, tt.options)
+		if err == nil {
+			t.Fatalf("TestCompileTimechartStep_Errors expected an error for input='%v' options=%v but got nil", tt.input, tt.options)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+const defaultTopCount = 10
+
+// topPipelineStep implements both top and rare, which only differ in which end of the frequency table they keep.
+type topPipelineStep struct {
+	count  int
+	fields []string
+	rare   bool
+}
+
+type topValue struct {
+	values []string
+	count  int
+}
+
+func (s *topPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	tally := map[string]*topValue{}
+	total := 0
+	truncated := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				select {
+				case pipe.output <- PipelineStepResult{
+					Events:    []events.EventWithExtractedFields{},
+					Aggregate: s.result(tally, total),
+					Truncated: truncated,
+				}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			truncated = truncated || res.Truncated
+		evtLoop:
+			for _, evt := range res.Events {
+				values := make([]string, len(s.fields))
+				for i, f := range s.fields {
+					v, ok := evt.Fields[f]
+					if !ok {
+						continue evtLoop
+					}
+					values[i] = v
+				}
+				key := strings.Join(values, "\x00")
+				tv, ok := tally[key]
+				if !ok {
+					tv = &topValue{values: values}
+					tally[key] = tv
+				}
+				tv.count++
+				total++
+			}
+		}
+	}
+}
+
+func (s *topPipelineStep) result(tally map[string]*topValue, total int) *AggregateResult {
+	sorted := make([]*topValue, 0, len(tally))
+	for _, tv := range tally {
+		sorted = append(sorted, tv)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return (sorted[i].count > sorted[j].count) != s.rare
+		}
+		// Ties are broken by the values so that the same events always give the same table
+		return strings.Join(sorted[i].values, "\x00") < strings.Join(sorted[j].values, "\x00")
+	})
+	if len(sorted) > s.count {
+		sorted = sorted[:s.count]
+	}
+
+	ret := &AggregateResult{
+		GroupBy: s.fields,
+		Columns: []string{"count", "percent"},
+		Rows:    make([]AggregateRow, len(sorted)),
+	}
+	for i, tv := range sorted {
+		count := float64(tv.count)
+		percent := 100 * count / float64(total)
+		ret.Rows[i] = AggregateRow{
+			Group:  tv.values,
+			Values: []*float64{&count, &percent},
+		}
+	}
+	return ret
+}
+
+func compileTopStep(input string, options map[string]string) (pipelineStep, error) {
+	return compileTopOrRareStep("top", false, input)
+}
+
+func compileRareStep(input string, options map[string]string) (pipelineStep, error) {
+	return compileTopOrRareStep("rare", true, input)
+}
+
+func compileTopOrRareStep(name string, rare bool, input string) (pipelineStep, error) {
+	words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	ret := topPipelineStep{count: defaultTopCount, rare: rare}
+	if len(words) > 0 {
+		if n, err := strconv.Atoi(words[0]); err == nil {
+			if n <= 0 {
+				return nil, fmt.Errorf("failed to compile %v: expected a positive number of values, got %v", name, n)
+			}
+			ret.count = n
+			words = words[1:]
+		}
+	}
+	if len(words) == 0 {
+		return nil, errors.New("failed to compile " + name + ": expected at least one field")
+	}
+	ret.fields = words
+	return &ret, nil
+}
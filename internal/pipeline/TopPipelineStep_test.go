@@ -0,0 +1,135 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+var topTestEvents = []events.EventWithExtractedFields{
+	{Id: 1, Fields: map[string]string{"status": "200", "host": "a"}},
+	{Id: 2, Fields: map[string]string{"status": "500", "host": "a"}},
+	{Id: 3, Fields: map[string]string{"status": "200", "host": "b"}},
+	{Id: 4, Fields: map[string]string{"status": "404", "host": "a"}},
+	{Id: 5, Fields: map[string]string{"status": "200", "host": "a"}},
+	{Id: 6, Fields: map[string]string{"status": "500", "host": "b"}},
+	{Id: 7, Fields: map[string]string{"host": "c"}},
+	{Id: 8, Fields: map[string]string{"status": "302", "host": "c"}},
+}
+
+func TestTopPipelineStep(t *testing.T) {
+	for _, tt := range []struct {
+		step     string
+		input    string
+		expected AggregateResult
+	}{
+		{
+			"top",
+			"status",
+			AggregateResult{
+				GroupBy: []string{"status"},
+				Columns: []string{"count", "percent"},
+				Rows: []AggregateRow{
+					{Group: []string{"200"}, Values: floats(3, 100*3.0/7)},
+					{Group: []string{"500"}, Values: floats(2, 100*2.0/7)},
+					{Group: []string{"302"}, Values: floats(1, 100*1.0/7)},
+					{Group: []string{"404"}, Values: floats(1, 100*1.0/7)},
+				},
+			},
+		},
+		{
+			"top",
+			"2 Status",
+			AggregateResult{
+				GroupBy: []string{"status"},
+				Columns: []string{"count", "percent"},
+				Rows: []AggregateRow{
+					{Group: []string{"200"}, Values: floats(3, 100*3.0/7)},
+					{Group: []string{"500"}, Values: floats(2, 100*2.0/7)},
+				},
+			},
+		},
+		{
+			"rare",
+			"3 status",
+			AggregateResult{
+				GroupBy: []string{"status"},
+				Columns: []string{"count", "percent"},
+				Rows: []AggregateRow{
+					{Group: []string{"302"}, Values: floats(1, 100*1.0/7)},
+					{Group: []string{"404"}, Values: floats(1, 100*1.0/7)},
+					{Group: []string{"500"}, Values: floats(2, 100*2.0/7)},
+				},
+			},
+		},
+		{
+			"top",
+			"1 host, status",
+			AggregateResult{
+				GroupBy: []string{"host", "status"},
+				Columns: []string{"count", "percent"},
+				Rows: []AggregateRow{
+					{Group: []string{"a", "200"}, Values: floats(2, 100*2.0/7)},
+				},
+			},
+		},
+	} {
+		t.Run(tt.step+" "+tt.input, func(t *testing.T) {
+			step, err := compilers[tt.step](tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestTopPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go step.Execute(context.Background(), pipe, params)
+
+			input <- PipelineStepResult{Events: topTestEvents[:3]}
+			input <- PipelineStepResult{Events: topTestEvents[3:]}
+			close(input)
+
+			result, ok := <-output
+			if !ok {
+				t.Fatal("TestTopPipelineStep got unexpected !ok when receiving output")
+			}
+			if result.Aggregate == nil {
+				t.Fatal("TestTopPipelineStep expected an aggregate result but got nil")
+			}
+			if aggregateString(*result.Aggregate) != aggregateString(tt.expected) {
+				t.Fatalf("TestTopPipelineStep expected aggregate=%v but got %v", aggregateString(tt.expected), aggregateString(*result.Aggregate))
+			}
+			_, ok = <-output
+			if ok {
+				t.Fatal("TestTopPipelineStep got unexpected ok when receiving output, expected the channel to be closed by now")
+			}
+		})
+	}
+}
+
+func TestCompileTopStep_Errors(t *testing.T) {
+	for _, input := range []string{"", "10", "0 status", "-1 status"} {
+		_, err := compileTopStep(input, map[string]string{})
+		if err == nil {
+			t.Fatalf("TestCompileTopStep_Errors expected an error for input='%v' but got nil", input)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+const (
+	// DefaultTransactionMaxPause is the longest time between two events in a transaction unless the maxPause option
+	// is given.
+	DefaultTransactionMaxPause = 30 * time.Minute
+	// DefaultTransactionMaxEvents is the number of events a transaction can hold unless the maxEvents option is given.
+	DefaultTransactionMaxEvents = 1000
+	// DefaultTransactionMaxOpen is the number of transactions which are kept in memory at the same time unless the
+	// maxOpen option is given.
+	DefaultTransactionMaxOpen = 10000
+)
+
+type transactionPipelineStep struct {
+	field     string
+	maxPause  time.Duration
+	maxEvents int
+	maxOpen   int
+}
+
+// transaction is a group of events with the same value for the field, with no more than maxPause between them.
+type transaction struct {
+	evts []events.EventWithExtractedFields
+	// start is the timestamp of the earliest event in the transaction
+	start time.Time
+}
+
+// Execute groups the events into transactions. It assumes that the events arrive latest first, as they do from the
+// search step. This means that once an event more than maxPause earlier than the start of a transaction has been
+// seen, no more events can be added to that transaction and it is sent on.
+// Only the transactions which can still get more events are kept in memory, but since all of their events are kept
+// there is a limit on both the number of events in a transaction and the number of open transactions. A transaction
+// which reaches maxEvents is sent on and a new one is started. If there are more than maxOpen transactions, the one
+// which has gone the longest without another event is sent on early and the result is marked as truncated.
+func (s *transactionPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	open := map[string]*transaction{}
+	truncated := false
+	send := func(closed []*transaction) bool {
+		if len(closed) == 0 {
+			return true
+		}
+		sort.SliceStable(closed, func(i, j int) bool {
+			return closed[i].start.After(closed[j].start)
+		})
+		ret := make([]events.EventWithExtractedFields, len(closed))
+		for i, t := range closed {
+			ret[i] = s.result(t)
+		}
+		select {
+		case pipe.output <- PipelineStepResult{Events: ret, Truncated: truncated}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				closed := make([]*transaction, 0, len(open))
+				for _, t := range open {
+					closed = append(closed, t)
+				}
+				send(closed)
+				return
+			}
+			if res.Err != nil {
+				forwardErr(ctx, pipe, res)
+				return
+			}
+			truncated = truncated || res.Truncated
+			closed := []*transaction{}
+			for _, evt := range res.Events {
+				key, ok := evt.Fields[s.field]
+				if !ok {
+					continue
+				}
+				t, ok := open[key]
+				if ok && (t.start.Sub(evt.Timestamp) > s.maxPause || len(t.evts) >= s.maxEvents) {
+					closed = append(closed, t)
+					delete(open, key)
+					ok = false
+				}
+				if !ok {
+					if len(open) >= s.maxOpen {
+						closed = append(closed, s.closeOldest(open))
+						truncated = true
+					}
+					t = &transaction{start: evt.Timestamp}
+					open[key] = t
+				}
+				t.evts = append(t.evts, evt)
+				if evt.Timestamp.Before(t.start) {
+					t.start = evt.Timestamp
+				}
+			}
+			if len(res.Events) > 0 {
+				// The transactions of other values can not get any more events either once the events are more than
+				// maxPause earlier than their start
+				earliest := res.Events[len(res.Events)-1].Timestamp
+				for key, t := range open {
+					if t.start.Sub(earliest) > s.maxPause {
+						closed = append(closed, t)
+						delete(open, key)
+					}
+				}
+			}
+			if !send(closed) {
+				return
+			}
+		}
+	}
+}
+
+// closeOldest removes the transaction with the latest start from open and returns it. Since the events arrive latest
+// first, this is the transaction which has gone the longest without getting another event.
+func (s *transactionPipelineStep) closeOldest(open map[string]*transaction) *transaction {
+	var oldestKey string
+	var oldest *transaction
+	for key, t := range open {
+		if oldest == nil || t.start.After(oldest.start) {
+			oldestKey, oldest = key, t
+		}
+	}
+	delete(open, oldestKey)
+	return oldest
+}
+
+// result merges the events of t into a single event. The raws are joined by newlines in the order the events happened,
+// and the event gets the timestamp, id, host and source of the earliest event.
+// The fields of all events are kept, using the value from the earliest event if several events have the same field.
+// The eventcount and duration fields are added, where duration is the number of seconds between the earliest and the
+// latest event.
+func (s *transactionPipelineStep) result(t *transaction) events.EventWithExtractedFields {
+	evts := t.evts
+	sort.SliceStable(evts, func(i, j int) bool {
+		return evts[i].Timestamp.Before(evts[j].Timestamp)
+	})
+	raws := make([]string, len(evts))
+	fields := map[string]string{}
+	for i, evt := range evts {
+		raws[i] = evt.Raw
+		for k, v := range evt.Fields {
+			if _, ok := fields[k]; !ok {
+				fields[k] = v
+			}
+		}
+	}
+	first, last := evts[0], evts[len(evts)-1]
+	fields["eventcount"] = strconv.Itoa(len(evts))
+	fields["duration"] = strconv.FormatFloat(last.Timestamp.Sub(first.Timestamp).Seconds(), 'f', -1, 64)
+	return events.EventWithExtractedFields{
+		Id:        first.Id,
+		Raw:       strings.Join(raws, "\n"),
+		Timestamp: first.Timestamp,
+		Host:      first.Host,
+		Source:    first.Source,
+		Fields:    fields,
+	}
+}
+
+func compileTransactionStep(input string, options map[string]string) (pipelineStep, error) {
+	ret := transactionPipelineStep{
+		maxPause:  DefaultTransactionMaxPause,
+		maxEvents: DefaultTransactionMaxEvents,
+		maxOpen:   DefaultTransactionMaxOpen,
+	}
+	if s, ok := options["maxPause"]; ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("failed to compile transaction: maxPause must be a duration such as 30s or 5m, got '%v'", s)
+		}
+		ret.maxPause = d
+	}
+	for _, o := range []struct {
+		name string
+		dest *int
+	}{
+		{"maxEvents", &ret.maxEvents},
+		{"maxOpen", &ret.maxOpen},
+	} {
+		if s, ok := options[o.name]; ok {
+			i, err := strconv.Atoi(s)
+			if err != nil || i <= 0 {
+				return nil, fmt.Errorf("failed to compile transaction: %v must be a positive integer, got '%v'", o.name, s)
+			}
+			*o.dest = i
+		}
+	}
+
+	fields := strings.Fields(strings.ToLower(input))
+	if len(fields) != 1 {
+		return nil, errors.New("failed to compile transaction: expected exactly one field to group the events by")
+	}
+	ret.field = fields[0]
+	return &ret, nil
+}
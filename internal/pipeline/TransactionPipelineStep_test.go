@@ -0,0 +1,203 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestTransactionPipelineStep(t *testing.T) {
+	t0 := time.Date(2021, 1, 20, 20, 0, 0, 0, time.UTC)
+	evt := func(id int64, minutes int, session string) events.EventWithExtractedFields {
+		fields := map[string]string{}
+		if session != "" {
+			fields["session"] = session
+		}
+		return events.EventWithExtractedFields{
+			Id:        id,
+			Raw:       strconv.FormatInt(id, 10),
+			Timestamp: t0.Add(time.Duration(minutes) * time.Minute),
+			Fields:    fields,
+		}
+	}
+	// The sessions a and b are interleaved, and both have a pause of 6 minutes in the middle
+	batches := [][]events.EventWithExtractedFields{
+		{evt(8, 10, "a"), evt(7, 9, "b"), evt(6, 8, "a"), evt(5, 7, "b")},
+		{evt(4, 2, "a"), evt(3, 1, ""), evt(2, 1, "b"), evt(1, 0, "a")},
+	}
+
+	for _, tt := range []struct {
+		name              string
+		options           map[string]string
+		expectedIds       []int64
+		expectedCounts    []string
+		expectedTruncated bool
+	}{
+		{"default max pause", map[string]string{}, []int64{2, 1}, []string{"3", "4"}, false},
+		{"max pause", map[string]string{"maxPause": "5m"}, []int64{6, 5, 2, 1}, []string{"2", "2", "1", "2"}, false},
+		{"max events", map[string]string{"maxEvents": "2"}, []int64{6, 5, 2, 1}, []string{"2", "2", "1", "2"}, false},
+		{"max open", map[string]string{"maxOpen": "1"}, []int64{8, 7, 6, 5, 4, 2, 1}, []string{"1", "1", "1", "1", "1", "1", "1"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tps, err := compileTransactionStep("session", tt.options)
+			if err != nil {
+				t.Fatalf("TestTransactionPipelineStep got unexpected error: %v", err)
+			}
+			params := PipelineParameters{
+				Cfg:        &config.Config{},
+				EventsRepo: newInMemRepo(t),
+			}
+			pipe, input, output := newPipe()
+
+			go tps.Execute(context.Background(), pipe, params)
+
+			go func() {
+				for _, b := range batches {
+					input <- PipelineStepResult{Events: b}
+				}
+				close(input)
+			}()
+
+			actualIds := []int64{}
+			actualCounts := []string{}
+			truncated := false
+			for res := range output {
+				truncated = truncated || res.Truncated
+				for _, e := range res.Events {
+					actualIds = append(actualIds, e.Id)
+					actualCounts = append(actualCounts, e.Fields["eventcount"])
+				}
+			}
+			if !reflect.DeepEqual(actualIds, tt.expectedIds) {
+				t.Fatalf("TestTransactionPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+			if !reflect.DeepEqual(actualCounts, tt.expectedCounts) {
+				t.Fatalf("TestTransactionPipelineStep expected eventcounts=%v but got %v", tt.expectedCounts, actualCounts)
+			}
+			if truncated != tt.expectedTruncated {
+				t.Fatalf("TestTransactionPipelineStep expected truncated=%v but got %v", tt.expectedTruncated, truncated)
+			}
+		})
+	}
+}
+
+func TestTransactionPipelineStep_Result(t *testing.T) {
+	t0 := time.Date(2021, 1, 20, 20, 0, 0, 0, time.UTC)
+	tps, err := compileTransactionStep("session", map[string]string{})
+	if err != nil {
+		t.Fatalf("TestTransactionPipelineStep_Result got unexpected error: %v", err)
+	}
+	pipe, input, output := newPipe()
+
+	go tps.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+
+	go func() {
+		input <- PipelineStepResult{Events: []events.EventWithExtractedFields{
+			{Id: 3, Raw: "logout", Timestamp: t0.Add(90 * time.Second), Host: "web02", Fields: map[string]string{"session": "a", "user": "bob"}},
+			{Id: 2, Raw: "click", Timestamp: t0.Add(30 * time.Second), Host: "web01", Fields: map[string]string{"session": "a", "page": "/"}},
+			{Id: 1, Raw: "login", Timestamp: t0, Host: "web01", Fields: map[string]string{"session": "a", "user": "alice"}},
+		}}
+		close(input)
+	}()
+
+	res := <-output
+	if len(res.Events) != 1 {
+		t.Fatalf("TestTransactionPipelineStep_Result expected 1 transaction but got %v", len(res.Events))
+	}
+	actual := res.Events[0]
+	expected := events.EventWithExtractedFields{
+		Id:        1,
+		Raw:       "login\nclick\nlogout",
+		Timestamp: t0,
+		Host:      "web01",
+		Fields: map[string]string{
+			"session":    "a",
+			"user":       "alice",
+			"page":       "/",
+			"eventcount": "3",
+			"duration":   "90",
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("TestTransactionPipelineStep_Result expected transaction=%v but got %v", expected, actual)
+	}
+}
+
+func TestCompileTransactionStep_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		options map[string]string
+	}{
+		{"", map[string]string{}},
+		{"session user", map[string]string{}},
+		{"session", map[string]string{"maxPause": "five minutes"}},
+		{"session", map[string]string{"maxPause": "-1m"}},
+		{"session", map[string]string{"maxEvents": "0"}},
+		{"session", map[string]string{"maxOpen": "many"}},
+	} {
+		_, err := compileTransactionStep(tt.input, tt.options)
+		if err == nil {
+			t.Fatalf("TestCompileTransactionStep_Errors expected an error for input=%v, options=%v but got nil", tt.input, tt.options)
+		}
+	}
+}
+
+func TestPipeline_Transaction(t *testing.T) {
+	repo := newInMemRepo(t)
+	evts := make([]events.Event, 20)
+	for i := range evts {
+		// Ten requests with two events one second apart each
+		evts[i] = events.Event{
+			Raw:       fmt.Sprintf("request_id=r%v step=%v", i/2, i%2),
+			Host:      "MYHOST",
+			Offset:    int64(i),
+			Source:    "log.txt",
+			Timestamp: time.Date(2021, 1, 20, 20, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Second),
+		}
+	}
+	repo.AddBatch(evts)
+	params := PipelineParameters{
+		Cfg: &config.Config{
+			FieldExtractors: []*regexp.Regexp{regexp.MustCompile("(\\w+)=(\\w+)")},
+		},
+		EventsRepo: repo,
+	}
+
+	p, err := CompilePipeline("request_id=* | transaction maxPause=10s request_id | where eventcount=2", nil, nil)
+	if err != nil {
+		t.Fatalf("TestPipeline_Transaction got unexpected error: %v", err)
+	}
+	count := 0
+	for result := range p.Execute(context.Background(), params) {
+		for _, evt := range result.Events {
+			if evt.Fields["duration"] != "1" {
+				t.Fatalf("TestPipeline_Transaction expected duration=1 but got %v", evt.Fields["duration"])
+			}
+			count++
+		}
+	}
+	if count != 10 {
+		t.Fatalf("TestPipeline_Transaction expected 10 transactions but got %v", count)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+// uniqPipelineStep is like dedup, except that an event is only dropped if it is a duplicate of the event right before
+// it. Unlike dedup it only has to remember the key of the last event it kept.
+type uniqPipelineStep struct {
+	// The key is computed the same way as for dedup
+	dedup dedupPipelineStep
+}
+
+func (s *uniqPipelineStep) Execute(ctx context.Context, pipe pipelinePipe, params PipelineParameters) {
+	defer close(pipe.output)
+
+	var last string
+	hasLast := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res, ok := <-pipe.input:
+			if !ok {
+				return
+			}
+			ret := make([]events.EventWithExtractedFields, 0, len(res.Events))
+			for _, evt := range res.Events {
+				key := s.dedup.key(evt)
+				if hasLast && key == last {
+					continue
+				}
+				last, hasLast = key, true
+				ret = append(ret, evt)
+			}
+			res.Events = ret
+			pipe.output <- res
+		}
+	}
+}
+
+func compileUniqStep(input string, options map[string]string) (pipelineStep, error) {
+	fields := strings.Fields(strings.ToLower(input))
+	return &uniqPipelineStep{
+		dedup: dedupPipelineStep{fields: fields},
+	}, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/config"
+	"github.com/jackbister/logsuck/internal/events"
+)
+
+func TestUniqPipelineStep(t *testing.T) {
+	// The raws are a, a, b, a, a, a with the last two in a separate result
+	for _, tt := range []struct {
+		step        string
+		input       string
+		expectedIds []int64
+	}{
+		// Only adjacent duplicates are dropped, so the a after the b is kept
+		{"uniq", "", []int64{1, 3, 4}},
+		// dedup drops every a after the first one
+		{"dedup", "", []int64{1, 3}},
+		{"uniq", "host", []int64{1, 2, 3, 5}},
+		{"dedup", "host", []int64{1, 2}},
+		{"uniq", "missing", []int64{1}},
+	} {
+		t.Run(tt.step+" "+tt.input, func(t *testing.T) {
+			step, err := compilers[tt.step](tt.input, map[string]string{})
+			if err != nil {
+				t.Fatalf("TestUniqPipelineStep got unexpected error: %v", err)
+			}
+			pipe, input, output := newPipe()
+			go step.Execute(context.Background(), pipe, PipelineParameters{Cfg: &config.Config{}})
+
+			// Split over two results to make sure adjacent duplicates are detected across batches
+			go func() {
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 1, Raw: "a", Fields: map[string]string{"host": "x"}},
+						{Id: 2, Raw: "a", Fields: map[string]string{"host": "y"}},
+						{Id: 3, Raw: "b", Fields: map[string]string{"host": "x"}},
+						{Id: 4, Raw: "a", Fields: map[string]string{"host": "x"}},
+					},
+				}
+				input <- PipelineStepResult{
+					Events: []events.EventWithExtractedFields{
+						{Id: 5, Raw: "a", Fields: map[string]string{"host": "y"}},
+						{Id: 6, Raw: "a", Fields: map[string]string{"host": "y"}},
+					},
+				}
+				close(input)
+			}()
+
+			actualIds := []int64{}
+			for res := range output {
+				for _, evt := range res.Events {
+					actualIds = append(actualIds, evt.Id)
+				}
+			}
+			if !reflect.DeepEqual(actualIds, tt.expectedIds) {
+				t.Fatalf("TestUniqPipelineStep expected ids=%v but got %v", tt.expectedIds, actualIds)
+			}
+		})
+	}
+}
@@ -24,7 +24,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func newInMemRepo(t *testing.T) events.Repository {
+func newInMemRepo(t testing.TB) events.Repository {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		t.Fatalf("TestRexPipelineStep got error when creating in-memory SQLite database: %v", err)
@@ -0,0 +1,131 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// MatchGroupName is the name of the subexpression which Highlight treats as the match, when a regular expression has
+// one. Fragments are compiled with the word boundaries around them as part of the pattern, and those should not be
+// highlighted.
+const MatchGroupName = "match"
+
+// MatchRange is the byte offsets of a match in a raw event, from Start up to but not including End.
+type MatchRange struct {
+	Start, End int
+}
+
+// Highlight returns the ranges of raw which are matched by any of rexes, ordered by their start. Overlapping and
+// adjacent ranges are merged into one. Whether a match is case insensitive is up to the regular expressions, so the
+// same ones a search uses to filter the events can be used to highlight them.
+func Highlight(rexes []*regexp.Regexp, raw string) []MatchRange {
+	ranges := []MatchRange{}
+	for _, rex := range rexes {
+		ranges = append(ranges, findAllMatches(rex, raw)...)
+	}
+	return mergeRanges(ranges)
+}
+
+// findAllMatches returns every range of raw matched by rex. Unlike FindAllStringIndex, a boundary character which ends
+// one match can also start the next one, so both words of "error error" are found by a pattern like (^|\W)error($|\W).
+// To keep ^ from matching in the middle of raw, each search after the first starts one character before the end of
+// the previous match, and matches starting before that end are skipped.
+func findAllMatches(rex *regexp.Regexp, raw string) []MatchRange {
+	group := 0
+	for i, name := range rex.SubexpNames() {
+		if name == MatchGroupName {
+			group = i
+			break
+		}
+	}
+	ranges := []MatchRange{}
+	pos := 0
+	for pos <= len(raw) {
+		from := pos
+		if pos > 0 {
+			_, size := utf8.DecodeLastRuneInString(raw[:pos])
+			from -= size
+		}
+		loc := rex.FindStringSubmatchIndex(raw[from:])
+		if loc == nil {
+			break
+		}
+		start, end := loc[2*group], loc[2*group+1]
+		if start == -1 {
+			// The rest of the pattern matched without the match group, so there is nothing to highlight
+			start, end = loc[0], loc[0]
+		}
+		start += from
+		end += from
+		if start < pos || end == start {
+			// Either the match overlaps the previous one or it is empty, and in both cases the search continues from
+			// the next character so that it always makes progress
+			next := start
+			if next < pos {
+				next = pos
+			}
+			if next >= len(raw) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(raw[next:])
+			pos = next + size
+			continue
+		}
+		ranges = append(ranges, MatchRange{Start: start, End: end})
+		pos = end
+	}
+	return ranges
+}
+
+func mergeRanges(ranges []MatchRange) []MatchRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	ret := []MatchRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &ret[len(ret)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// Annotate returns raw with before and after inserted around each of ranges, such as "<mark>" and "</mark>". The
+// ranges must be ordered and must not overlap, like the ranges returned by Highlight.
+func Annotate(raw string, ranges []MatchRange, before, after string) string {
+	var sb strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		sb.WriteString(raw[pos:r.Start])
+		sb.WriteString(before)
+		sb.WriteString(raw[r.Start:r.End])
+		sb.WriteString(after)
+		pos = r.End
+	}
+	sb.WriteString(raw[pos:])
+	return sb.String()
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// fragRex compiles frag the way fragments are compiled for searching, with the word boundaries outside of the match
+// group.
+func fragRex(frag string) *regexp.Regexp {
+	return regexp.MustCompile("(?i)(^|\\W)(?P<match>" + regexp.QuoteMeta(frag) + ")($|\\W)")
+}
+
+func TestHighlight(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		rexes    []*regexp.Regexp
+		raw      string
+		expected []MatchRange
+	}{
+		{"no match", []*regexp.Regexp{fragRex("error")}, "all good", []MatchRange{}},
+		{"single match", []*regexp.Regexp{fragRex("error")}, "an error occurred", []MatchRange{{3, 8}}},
+		{"multiple matches", []*regexp.Regexp{fragRex("error")}, "error: another error", []MatchRange{{0, 5}, {15, 20}}},
+		{"adjacent words", []*regexp.Regexp{fragRex("error")}, "error error error", []MatchRange{{0, 5}, {6, 11}, {12, 17}}},
+		{"case insensitive", []*regexp.Regexp{fragRex("error")}, "ERROR and Error", []MatchRange{{0, 5}, {10, 15}}},
+		{"not part of a word", []*regexp.Regexp{fragRex("error")}, "errors are not error", []MatchRange{{15, 20}}},
+		{"several fragments", []*regexp.Regexp{fragRex("failed"), fragRex("database")}, "database connection failed", []MatchRange{{0, 8}, {20, 26}}},
+		{"overlapping", []*regexp.Regexp{fragRex("connection failed"), fragRex("failed to")}, "connection failed to open", []MatchRange{{0, 20}}},
+		{"contained", []*regexp.Regexp{fragRex("connection failed"), fragRex("failed")}, "connection failed", []MatchRange{{0, 17}}},
+		{"touching", []*regexp.Regexp{regexp.MustCompile("ab"), regexp.MustCompile("cd")}, "xabcdx", []MatchRange{{1, 5}}},
+		{"without match group", []*regexp.Regexp{regexp.MustCompile("[0-9]+")}, "took 15 ms, 3 retries", []MatchRange{{5, 7}, {12, 13}}},
+		{"multibyte", []*regexp.Regexp{fragRex("café")}, "café café", []MatchRange{{0, 5}, {6, 11}}},
+		{"empty matches", []*regexp.Regexp{regexp.MustCompile("x*")}, "abc", []MatchRange{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := Highlight(tt.rexes, tt.raw)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("TestHighlight expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	raw := "error: connection failed"
+	actual := Annotate(raw, Highlight([]*regexp.Regexp{fragRex("error"), fragRex("failed")}, raw), "<mark>", "</mark>")
+	expected := "<mark>error</mark>: connection <mark>failed</mark>"
+	if actual != expected {
+		t.Fatalf("TestAnnotate expected %v but got %v", expected, actual)
+	}
+	if actual := Annotate(raw, nil, "<mark>", "</mark>"); actual != raw {
+		t.Fatalf("TestAnnotate expected %v without ranges but got %v", raw, actual)
+	}
+}
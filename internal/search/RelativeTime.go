@@ -0,0 +1,72 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var relativeTimeUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// ParseRelativeTime parses a time relative to now. The input is either "now" or a minus sign followed by a number and
+// one of the units s, m, h, d or w, such as "-15m", "-2h" or "-7d".
+func ParseRelativeTime(s string, now time.Time) (time.Time, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "now" {
+		return now, nil
+	}
+	if len(s) < 3 || s[0] != '-' {
+		return time.Time{}, fmt.Errorf("invalid relative time '%v', expected 'now' or something like '-15m'", s)
+	}
+	unit, ok := relativeTimeUnits[s[len(s)-1]]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid unit in relative time '%v', expected one of s, m, h, d or w", s)
+	}
+	n, err := strconv.ParseUint(s[1:len(s)-1], 10, 32)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid number in relative time '%v': %w", s, err)
+	}
+	return now.Add(-time.Duration(n) * unit), nil
+}
+
+// ParseSpan parses a positive length of time written as a number followed by one of the units s, m, h, d or w, such
+// as "30s", "5m" or "1d".
+func ParseSpan(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid span '%v', expected something like '5m'", s)
+	}
+	unit, ok := relativeTimeUnits[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit in span '%v', expected one of s, m, h, d or w", s)
+	}
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number in span '%v': %w", s, err)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("invalid span '%v', must be greater than 0", s)
+	}
+	return time.Duration(n) * unit, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestParseRelativeTime(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected time.Time
+	}{
+		{"now", testNow},
+		{"NOW", testNow},
+		{"-30s", testNow.Add(-30 * time.Second)},
+		{"-15m", testNow.Add(-15 * time.Minute)},
+		{"-2h", testNow.Add(-2 * time.Hour)},
+		{"-24h", testNow.Add(-24 * time.Hour)},
+		{"-7d", testNow.AddDate(0, 0, -7)},
+		{"-1w", testNow.AddDate(0, 0, -7)},
+		{"-0m", testNow},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			actual, err := ParseRelativeTime(tt.input, testNow)
+			if err != nil {
+				t.Fatalf("TestParseRelativeTime got unexpected error: %v", err)
+			}
+			if !actual.Equal(tt.expected) {
+				t.Fatalf("TestParseRelativeTime expected %v but got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseRelativeTime_Malformed(t *testing.T) {
+	for _, input := range []string{"", "-", "-m", "1h", "+1h", "-1y", "-1.5h", "-h1", "--1h", "-1hh", "yesterday"} {
+		_, err := ParseRelativeTime(input, testNow)
+		if err == nil {
+			t.Errorf("TestParseRelativeTime_Malformed expected error when parsing '%v' but got nil", input)
+		}
+	}
+}
+
+func TestParseSpan(t *testing.T) {
+	for _, tt := range []struct {
+		input    string
+		expected time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"1H", time.Hour},
+		{"1d", 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+	} {
+		actual, err := ParseSpan(tt.input)
+		if err != nil {
+			t.Fatalf("TestParseSpan got unexpected error when parsing '%v': %v", tt.input, err)
+		}
+		if actual != tt.expected {
+			t.Fatalf("TestParseSpan expected %v when parsing '%v' but got %v", tt.expected, tt.input, actual)
+		}
+	}
+	for _, input := range []string{"", "m", "0m", "-1m", "1y", "1.5h", "h1"} {
+		_, err := ParseSpan(input)
+		if err == nil {
+			t.Errorf("TestParseSpan expected error when parsing '%v' but got nil", input)
+		}
+	}
+}
+
+func TestParse_EarliestLatest(t *testing.T) {
+	for _, tt := range []struct {
+		input         string
+		expectedStart *time.Time
+		expectedEnd   *time.Time
+	}{
+		{"error", nil, nil},
+		{"error earliest=-1h", timePtr(testNow.Add(-time.Hour)), &testNow},
+		{"earliest=-1d latest=-1h error", timePtr(testNow.AddDate(0, 0, -1)), timePtr(testNow.Add(-time.Hour))},
+		{"latest=-15m", nil, timePtr(testNow.Add(-15 * time.Minute))},
+		{"earliest=-2h latest=now", timePtr(testNow.Add(-2 * time.Hour)), &testNow},
+		{"earliest=-1h earliest=-2h", timePtr(testNow.Add(-2 * time.Hour)), &testNow},
+	} {
+		t.Run(tt.input, func(t *testing.T) {
+			srch, err := parseAt(tt.input, testNow)
+			if err != nil {
+				t.Fatalf("TestParse_EarliestLatest got unexpected error: %v", err)
+			}
+			if !timesEqual(srch.StartTime, tt.expectedStart) || !timesEqual(srch.EndTime, tt.expectedEnd) {
+				t.Fatalf("TestParse_EarliestLatest expected start=%v and end=%v but got start=%v and end=%v", tt.expectedStart, tt.expectedEnd, srch.StartTime, srch.EndTime)
+			}
+			if _, ok := srch.Fields["earliest"]; ok {
+				t.Fatal("TestParse_EarliestLatest expected earliest to be removed from Fields")
+			}
+			if _, ok := srch.Fields["latest"]; ok {
+				t.Fatal("TestParse_EarliestLatest expected latest to be removed from Fields")
+			}
+		})
+	}
+}
+
+func TestParse_EarliestLatestErrors(t *testing.T) {
+	for _, input := range []string{"earliest=-1x", "latest=tomorrow", "earliest=-1h latest=-2h"} {
+		_, err := parseAt(input, testNow)
+		if err == nil {
+			t.Errorf("TestParse_EarliestLatestErrors expected error when parsing '%v' but got nil", input)
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func timesEqual(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
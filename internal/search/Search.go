@@ -15,7 +15,9 @@
 package search
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jackbister/logsuck/internal/parser"
 )
@@ -29,9 +31,47 @@ type Search struct {
 	NotSources   map[string]struct{}
 	Hosts        map[string]struct{}
 	NotHosts     map[string]struct{}
+
+	FieldComparisons []parser.FieldComparison
+	Groups           []*parser.SearchExpression
+
+	// StartTime and EndTime are set if the search contains earliest=<time> or latest=<time>.
+	StartTime, EndTime *time.Time
+
+	// Ids restricts the search to the events with these ids if it is not nil, for searching within the results of an
+	// earlier search. It is not part of the search syntax.
+	Ids []int64
+
+	// OldestFirst makes the repository return the events oldest first instead of newest first. It is not part of the
+	// search syntax, it is set when the pipeline asks for the events in chronological order.
+	OldestFirst bool
+
+	// Snippet makes the SQLite repository return an excerpt of each event around the fragments it matched, with the
+	// matches highlighted, in EventWithId.Snippet. It is not part of the search syntax.
+	Snippet *SnippetOptions
+}
+
+// DefaultSnippetTokens is the number of tokens in a snippet if SnippetOptions.Tokens is 0.
+const DefaultSnippetTokens = 15
+
+// MaxSnippetTokens is the largest number of tokens SQLite can put in a snippet.
+const MaxSnippetTokens = 64
+
+// SnippetOptions decides what the snippets of Search.Snippet look like.
+type SnippetOptions struct {
+	// Start and End are put before and after each match in the snippet.
+	Start, End string
+	// Ellipsis is put at the start or end of the snippet if it does not start or end where the event does.
+	Ellipsis string
+	// Tokens is the largest number of tokens, such as words, in the snippet. 0 means DefaultSnippetTokens.
+	Tokens int
 }
 
 func Parse(searchString string) (*Search, error) {
+	return parseAt(searchString, time.Now())
+}
+
+func parseAt(searchString string, now time.Time) (*Search, error) {
 	res, err := parser.ParseSearch(searchString)
 	if err != nil {
 		return nil, fmt.Errorf("error while parsing: %w", err)
@@ -46,6 +86,36 @@ func Parse(searchString string) (*Search, error) {
 		NotSources:   res.NotSources,
 		Hosts:        res.Hosts,
 		NotHosts:     res.NotHosts,
+
+		FieldComparisons: res.FieldComparisons,
+		Groups:           res.Groups,
+	}
+
+	// earliest and latest are not real fields, so they are taken out of Fields to not filter out every event
+	earliest, hasEarliest := ret.Fields["earliest"]
+	latest, hasLatest := ret.Fields["latest"]
+	delete(ret.Fields, "earliest")
+	delete(ret.Fields, "latest")
+	if hasEarliest {
+		// If earliest is given more than once, the last one wins
+		t, err := ParseRelativeTime(earliest[len(earliest)-1], now)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing earliest: %w", err)
+		}
+		ret.StartTime = &t
+		if !hasLatest {
+			ret.EndTime = &now
+		}
+	}
+	if hasLatest {
+		t, err := ParseRelativeTime(latest[len(latest)-1], now)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing latest: %w", err)
+		}
+		ret.EndTime = &t
+	}
+	if ret.StartTime != nil && ret.EndTime != nil && ret.StartTime.After(*ret.EndTime) {
+		return nil, errors.New("earliest must not be after latest")
 	}
 
 	return &ret, nil
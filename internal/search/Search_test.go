@@ -0,0 +1,33 @@
+// Copyright 2021 The Logsuck Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package search
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackbister/logsuck/internal/parser"
+)
+
+func TestParse_ParseError(t *testing.T) {
+	_, err := Parse("status=500 OR")
+	var parseErr *parser.ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("TestParse_ParseError expected a ParseError but got %v", err)
+	}
+	if parseErr.Offset != 11 {
+		t.Fatalf("TestParse_ParseError expected offset 11 but got %v", parseErr.Offset)
+	}
+}
@@ -15,7 +15,10 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -28,18 +31,27 @@ import (
 	"github.com/jackbister/logsuck/internal/config"
 	"github.com/jackbister/logsuck/internal/events"
 	"github.com/jackbister/logsuck/internal/jobs"
-	"github.com/jackbister/logsuck/internal/parser"
+	"github.com/jackbister/logsuck/internal/logging"
+	"github.com/jackbister/logsuck/internal/pipeline"
+	"github.com/jackbister/logsuck/internal/search"
 )
 
+// healthCheckTimeout is how long the health check waits for the database before reporting it as unavailable, so that
+// a locked database fails the check instead of hanging it.
+const healthCheckTimeout = 5 * time.Second
+
 type Web interface {
 	Serve() error
 }
 
 type webImpl struct {
-	cfg       *config.Config
-	eventRepo events.Repository
-	jobRepo   jobs.Repository
-	jobEngine *jobs.Engine
+	cfg           *config.Config
+	eventRepo     events.Repository
+	jobRepo       jobs.Repository
+	jobEngine     *jobs.Engine
+	liveTail      *events.LiveTail
+	ingestMetrics *events.IngestMetricsPublisher
+	logger        logging.Logger
 }
 
 type webError struct {
@@ -51,12 +63,15 @@ func (w webError) Error() string {
 	return w.err
 }
 
-func NewWeb(cfg *config.Config, eventRepo events.Repository, jobRepo jobs.Repository, jobEngine *jobs.Engine) Web {
+func NewWeb(cfg *config.Config, eventRepo events.Repository, jobRepo jobs.Repository, jobEngine *jobs.Engine, liveTail *events.LiveTail, ingestMetrics *events.IngestMetricsPublisher) Web {
 	return webImpl{
-		cfg:       cfg,
-		eventRepo: eventRepo,
-		jobRepo:   jobRepo,
-		jobEngine: jobEngine,
+		cfg:           cfg,
+		eventRepo:     eventRepo,
+		jobRepo:       jobRepo,
+		jobEngine:     jobEngine,
+		liveTail:      liveTail,
+		ingestMetrics: ingestMetrics,
+		logger:        logging.OrDefault(cfg.Logger),
 	}
 }
 
@@ -105,6 +120,150 @@ func (wi webImpl) Serve() error {
 		c.JSON(200, id)
 	})
 
+	g.GET("/count", func(c *gin.Context) {
+		startTime, endTime, wErr := parseTimeParametersGin(c)
+		if wErr != nil {
+			c.AbortWithError(wErr.code, wErr)
+			return
+		}
+		srch, err := search.Parse(strings.TrimSpace(c.Query("searchString")))
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		count, err := pipeline.Count(c.Request.Context(), wi.eventRepo, wi.cfg, srch, startTime, endTime)
+		if err != nil {
+			c.AbortWithError(searchErrorCode(err), err)
+			return
+		}
+		c.JSON(200, count)
+	})
+
+	g.GET("/facet", func(c *gin.Context) {
+		startTime, endTime, wErr := parseTimeParametersGin(c)
+		if wErr != nil {
+			c.AbortWithError(wErr.code, wErr)
+			return
+		}
+		field, ok := c.GetQuery("field")
+		if !ok || field == "" {
+			c.AbortWithStatus(400)
+			return
+		}
+		limit := 0
+		if l, ok := c.GetQuery("limit"); ok {
+			parsed, err := strconv.Atoi(l)
+			if err != nil {
+				c.AbortWithError(400, err)
+				return
+			}
+			limit = parsed
+		}
+		srch, err := search.Parse(strings.TrimSpace(c.Query("searchString")))
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		values, err := pipeline.Facet(c.Request.Context(), wi.eventRepo, wi.cfg, srch, startTime, endTime, field, limit)
+		if err != nil {
+			c.AbortWithError(searchErrorCode(err), err)
+			return
+		}
+		c.JSON(200, values)
+	})
+
+	// export runs the search and streams the matching events as they are found instead of storing them in a job, so
+	// that exporting a large search does not have to keep all of the events anywhere
+	g.GET("/export", func(c *gin.Context) {
+		startTime, endTime, wErr := parseTimeParametersGin(c)
+		if wErr != nil {
+			c.AbortWithError(wErr.code, wErr)
+			return
+		}
+		format := c.DefaultQuery("format", pipeline.ExportFormatCSV)
+		contentType := "text/csv"
+		if format == pipeline.ExportFormatJSONLines {
+			contentType = "application/x-ndjson"
+		} else if format != pipeline.ExportFormatCSV {
+			c.AbortWithError(400, fmt.Errorf("unknown format=%v", format))
+			return
+		}
+		pl, err := pipeline.CompilePipeline(strings.TrimSpace(c.Query("searchString")), startTime, endTime)
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		results := pl.Execute(ctx, pipeline.PipelineParameters{Cfg: wi.cfg, EventsRepo: wi.eventRepo})
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", "attachment; filename=logsuck-export."+format)
+		c.Status(200)
+		n, err := pipeline.Export(ctx, c.Writer, format, pipeline.ParseFieldList(c.Query("fields")), results)
+		if err != nil {
+			// The status has already been sent, so all that can be done is to stop writing
+			wi.logger.Errorf("error exporting search after numEvents=%v: %v", n, err)
+		}
+	})
+
+	// tail sends the events matching the search as server-sent events as they are published, until the client
+	// disconnects
+	g.GET("/tail", func(c *gin.Context) {
+		srch, err := search.Parse(strings.TrimSpace(c.Query("searchString")))
+		if err != nil {
+			c.AbortWithError(400, err)
+			return
+		}
+		evts := wi.liveTail.Subscribe(c.Request.Context(), pipeline.LiveTailFilter(wi.cfg, srch))
+		c.Stream(func(w io.Writer) bool {
+			evt, ok := <-evts
+			if !ok {
+				return false
+			}
+			c.SSEvent("event", evt)
+			return true
+		})
+	})
+
+	g.GET("/ingestRates", func(c *gin.Context) {
+		c.JSON(200, wi.ingestMetrics.Snapshot())
+	})
+
+	g.GET("/timeRange", func(c *gin.Context) {
+		min, max, err := wi.eventRepo.TimeRange()
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		// Both are null if there are no events
+		if min.IsZero() {
+			c.JSON(200, gin.H{"Min": nil, "Max": nil})
+			return
+		}
+		c.JSON(200, gin.H{"Min": min, "Max": max})
+	})
+
+	g.GET("/health", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+		defer cancel()
+		err := wi.eventRepo.Ping(ctx)
+		if err != nil {
+			wi.logger.Warnf("health check failed: %v", err)
+			c.JSON(503, gin.H{"Status": "unavailable", "Error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"Status": "ok"})
+	})
+
+	g.GET("/sources", func(c *gin.Context) {
+		sources, err := wi.eventRepo.Sources()
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		c.JSON(200, sources)
+	})
+
 	g.POST("/abortJob", func(c *gin.Context) {
 		jobId, err := strconv.ParseInt(c.Query("jobId"), 10, 64)
 		if err != nil {
@@ -147,45 +306,49 @@ func (wi webImpl) Serve() error {
 		})
 	})
 
-	g.GET("/jobResults", func(c *gin.Context) {
+	g.GET("/jobAggregate", func(c *gin.Context) {
 		jobId, err := strconv.ParseInt(c.Query("jobId"), 10, 64)
 		if err != nil {
 			c.AbortWithError(400, err)
 			return
 		}
-		skip, err := strconv.Atoi(c.Query("skip"))
+		aggregate, err := wi.jobRepo.GetAggregate(jobId)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+		c.JSON(200, aggregate)
+	})
+
+	g.GET("/jobResults", func(c *gin.Context) {
+		jobId, err := strconv.ParseInt(c.Query("jobId"), 10, 64)
 		if err != nil {
 			c.AbortWithError(400, err)
 			return
 		}
-		take, err := strconv.Atoi(c.Query("take"))
+		skip, err := strconv.Atoi(c.Query("skip"))
 		if err != nil {
 			c.AbortWithError(400, err)
 			return
 		}
-		eventIds, err := wi.jobRepo.GetResults(jobId, skip, take)
+		take, err := strconv.Atoi(c.Query("take"))
 		if err != nil {
-			c.AbortWithError(500, err)
+			c.AbortWithError(400, err)
 			return
 		}
-		results, err := wi.eventRepo.GetByIds(eventIds, events.SortModeTimestampDesc)
+		// The results are the events as the job's pipeline produced them, in the same order and with the fields the
+		// pipeline gave them, rather than the events stored in the repository
+		results, err := wi.jobRepo.GetResults(jobId, skip, take)
 		if err != nil {
 			c.AbortWithError(500, err)
 			return
 		}
-		retResults := make([]events.EventWithExtractedFields, 0, len(results))
 		for _, r := range results {
-			fields := parser.ExtractFields(r.Raw, wi.cfg.FieldExtractors)
-			retResults = append(retResults, events.EventWithExtractedFields{
-				Id:        r.Id,
-				Raw:       r.Raw,
-				Host:      r.Host,
-				Source:    r.Source,
-				Timestamp: r.Timestamp,
-				Fields:    fields,
-			})
-		}
-		c.JSON(200, retResults)
+			// Host and Source are returned separately
+			delete(r.Fields, "host")
+			delete(r.Fields, "source")
+		}
+		c.JSON(200, results)
 	})
 
 	g.GET("/jobFieldStats", func(c *gin.Context) {
@@ -232,6 +395,15 @@ func parseTemplate(fs http.FileSystem) (*template.Template, error) {
 	return tpl, nil
 }
 
+// searchErrorCode returns the status code for an error from running a search, which is 400 if the search itself was
+// invalid and 500 otherwise.
+func searchErrorCode(err error) int {
+	if errors.Is(err, events.ErrInvalidSearch) {
+		return 400
+	}
+	return 500
+}
+
 func parseTimeParametersGin(c *gin.Context) (*time.Time, *time.Time, *webError) {
 	relativeTime, hasRelativeTime := c.GetQuery("relativeTime")
 	absoluteStart, hasAbsoluteStart := c.GetQuery("startTime")
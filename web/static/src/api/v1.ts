@@ -14,6 +14,7 @@
  * limitations under the License.
  */
 
+import { AggregateResult } from "../models/AggregateResult";
 import { LogEvent } from "../models/Event";
 import { TimeSelection } from "../models/TimeSelection";
 import { validateIsoTimestamp } from "../validateIsoTimestamp";
@@ -103,6 +104,30 @@ export function getResults(
     );
 }
 
+interface RestAggregateResult {
+  GroupBy: string[] | null;
+  Columns: string[] | null;
+  Rows: { Group: string[] | null; Values: (number | null)[] | null }[] | null;
+}
+
+export function getAggregate(jobId: number): Promise<AggregateResult | null> {
+  const queryParams = `?jobId=${jobId}`;
+  return fetch("/api/v1/jobAggregate" + queryParams)
+    .then((r) => r.json())
+    .then((r: RestAggregateResult | null) =>
+      r === null
+        ? null
+        : {
+            groupBy: r.GroupBy || [],
+            columns: r.Columns || [],
+            rows: (r.Rows || []).map((row) => ({
+              group: row.Group || [],
+              values: row.Values || [],
+            })),
+          }
+    );
+}
+
 export function abortJob(jobId: number): Promise<{}> {
   const queryParams = `?jobId=${jobId}`;
   return fetch("/api/v1/abortJob" + queryParams, { method: "POST" });
@@ -0,0 +1,55 @@
+/**
+ * Copyright 2020 The Logsuck Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+import { h } from "preact";
+import { AggregateResult } from "../models/AggregateResult";
+
+export interface AggregateTableProps {
+  aggregate: AggregateResult;
+}
+
+export const AggregateTable = ({ aggregate }: AggregateTableProps) => (
+  <table class="table table-sm table-hover">
+    <thead>
+      <tr>
+        {aggregate.groupBy.map((g) => (
+          <th scope="col" key={"group-" + g}>
+            {g}
+          </th>
+        ))}
+        {aggregate.columns.map((c) => (
+          <th scope="col" key={"column-" + c} style={{ textAlign: "right" }}>
+            {c}
+          </th>
+        ))}
+      </tr>
+    </thead>
+    <tbody>
+      {aggregate.rows.map((r, i) => (
+        <tr key={i}>
+          {r.group.map((g, j) => (
+            <td key={"group-" + j}>{g}</td>
+          ))}
+          {r.values.map((v, j) => (
+            <td key={"column-" + j} style={{ textAlign: "right" }}>
+              {v === null ? "" : v}
+            </td>
+          ))}
+        </tr>
+      ))}
+    </tbody>
+  </table>
+);
@@ -0,0 +1,27 @@
+/**
+ * Copyright 2020 The Logsuck Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+export interface AggregateResult {
+  groupBy: string[];
+  columns: string[];
+  rows: AggregateRow[];
+}
+
+export interface AggregateRow {
+  group: string[];
+  // A value is null if its column aggregates over a field which had no numeric values in the group
+  values: (number | null)[];
+}
@@ -21,6 +21,7 @@ import {
   JobState,
   FieldValueCounts,
 } from "../api/v1";
+import { AggregateResult } from "../models/AggregateResult";
 import { LogEvent } from "../models/Event";
 import { Popover } from "../components/popover";
 import { TopFieldValueInfo } from "../models/TopFieldValueInfo";
@@ -31,6 +32,7 @@ import {
   startJob,
   pollJob,
   getResults,
+  getAggregate,
   abortJob,
   getFieldValueCounts,
 } from "../api/v1";
@@ -39,6 +41,7 @@ import { Navbar } from "../components/Navbar";
 import { SearchInput } from "../components/SearchInput";
 import { FieldValueTable } from "../components/FieldValueTable";
 import { EventTable } from "../components/EventTable";
+import { AggregateTable } from "../components/AggregateTable";
 import { FieldTable } from "../components/FieldTable";
 import { createSearchQueryParams } from "../createSearchUrl";
 import { validateIsoTimestamp } from "../validateIsoTimestamp";
@@ -57,6 +60,7 @@ interface SearchProps {
     skip: number,
     take: number
   ) => Promise<LogEvent[]>;
+  getAggregate: (jobId: number) => Promise<AggregateResult | null>;
   abortJob: (jobId: number) => Promise<{}>;
   getFieldValueCounts: (
     jobId: number,
@@ -113,6 +117,8 @@ interface SearchedPolling extends SearchStateBase {
 
   searchResult: LogEvent[];
   numMatched: number;
+  // The table produced by commands such as stats, which is fetched once the job has finished
+  aggregate: AggregateResult | null;
 
   currentPageIndex: number;
 
@@ -128,6 +134,7 @@ interface SearchedPollingFinished extends SearchStateBase {
 
   searchResult: LogEvent[];
   numMatched: number;
+  aggregate: AggregateResult | null;
 
   currentPageIndex: number;
 
@@ -214,6 +221,7 @@ export class SearchPageComponent extends Component<
           poller: window.setTimeout(async () => this.poll(jobId), 0),
           searchResult: [],
           numMatched: 0,
+          aggregate: null,
           currentPageIndex: currentPageIndex,
         };
         doSearch = false;
@@ -254,11 +262,17 @@ export class SearchPageComponent extends Component<
               this.state.searchResult.length > 0) ||
               this.state.state === SearchState.SEARCHED_POLLING_FINISHED) && (
               <div>
-                {this.state.searchResult.length === 0 && (
-                  <div class="alert alert-info">
-                    No results found. Try a different search?
+                {this.state.aggregate && (
+                  <div class="card">
+                    <AggregateTable aggregate={this.state.aggregate} />
                   </div>
                 )}
+                {!this.state.aggregate &&
+                  this.state.searchResult.length === 0 && (
+                    <div class="alert alert-info">
+                      No results found. Try a different search?
+                    </div>
+                  )}
                 {this.state.searchResult.length !== 0 && (
                   <div class="row">
                     <div class="col-xl-2">
@@ -493,6 +507,7 @@ export class SearchPageComponent extends Component<
         ),
         searchResult: [],
         numMatched: 0,
+        aggregate: null,
         currentPageIndex: 0,
       });
       this.setQueryParams({ jobId: startJobResult.id.toString() });
@@ -560,6 +575,10 @@ export class SearchPageComponent extends Component<
       ) {
         window.clearTimeout(this.state.poller);
         nextState.state = SearchState.SEARCHED_POLLING_FINISHED;
+        nextState.aggregate = await this.props.getAggregate(id);
+        if (id !== this.state.jobId) {
+          return;
+        }
       } else {
         nextState.poller = window.setTimeout(() => this.poll(id), 500);
       }
@@ -20,6 +20,7 @@ import {
   startJob,
   pollJob,
   getResults,
+  getAggregate,
   abortJob,
   getFieldValueCounts,
 } from "../api/v1";
@@ -35,6 +36,7 @@ function main() {
       startJob={startJob}
       pollJob={pollJob}
       getResults={getResults}
+      getAggregate={getAggregate}
       abortJob={abortJob}
       getFieldValueCounts={getFieldValueCounts}
       addRecentSearch={addRecentSearch}